@@ -1,9 +1,13 @@
 package auth
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/mail"
 	"strings"
 	"time"
@@ -15,6 +19,7 @@ type UserId int32
 type NormalizedEmail string // Should always contain a normalized value
 type Email string
 type DeviceId string
+type DeviceName string // Optional, chosen by the user to recognize the device
 type Password string
 type KDFKey string         // KDF output
 type ClientSaltSeed string // part of client-side KDF input along with root password
@@ -22,36 +27,86 @@ type ServerSalt string     // server-side KDF input for accounts
 type AuthTokenString string
 type VerifyTokenString string
 type AuthScope string
+type SigningPublicKey string // hex encoded ed25519 public key
 
+// Can do anything
 const ScopeFull = AuthScope("*")
 
+// Can get the wallet (and its metadata, and listen for updates), but not
+// change it or anything else about the account. For things like backup
+// daemons that only ever need to pull the encrypted wallet.
+const ScopeGetWallet = AuthScope("get-wallet")
+
+// Scopes a client may ask for when logging in
+func (s AuthScope) Valid() bool {
+	return s == ScopeFull || s == ScopeGetWallet
+}
+
 // For test stubs
 type AuthInterface interface {
 	NewAuthToken(UserId, DeviceId, AuthScope) (*AuthToken, error)
 	NewVerifyTokenString() (VerifyTokenString, error)
+	NewTotpSecret() (TotpSecret, error)
 }
 
-type Auth struct{}
+type Auth struct {
+	// Bytes of randomness in each auth and verify token, before encoding. Zero
+	// means DefaultTokenLength.
+	TokenLength int
+
+	// Where tokens and TOTP secrets get their randomness. Nil means
+	// crypto/rand. Only for tests, which can set one that fails.
+	Rand io.Reader
+}
 
 type AuthToken struct {
 	Token      AuthTokenString `json:"token"`
 	DeviceId   DeviceId        `json:"deviceId"`
+	DeviceName DeviceName      `json:"deviceName,omitempty"`
 	Scope      AuthScope       `json:"scope"`
 	UserId     UserId          `json:"userId"`
 	Expiration *time.Time      `json:"expiration"`
 }
 
-const TokenLength = 32
+// 256 bits, well past guessing. Also the least TokenLength can be.
+const DefaultTokenLength = 32
+
+func (a *Auth) tokenLength() int {
+	if a.TokenLength == 0 {
+		return DefaultTokenLength
+	}
+	return a.TokenLength
+}
+
+func (a *Auth) rand() io.Reader {
+	if a.Rand == nil {
+		return rand.Reader
+	}
+	return a.Rand
+}
+
+// A random string for a token, base64url encoded (without padding) so it can
+// go in a URL as it is. If there isn't enough randomness to be had, this
+// fails rather than give a token that's any easier to guess.
+func (a *Auth) newTokenString() (string, error) {
+	if a.tokenLength() < DefaultTokenLength {
+		return "", fmt.Errorf("Error generating token: length %d is below the minimum of %d", a.tokenLength(), DefaultTokenLength)
+	}
+	b := make([]byte, a.tokenLength())
+	if _, err := io.ReadFull(a.rand(), b); err != nil {
+		return "", fmt.Errorf("Error generating token: %+v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
 func (a *Auth) NewAuthToken(userId UserId, deviceId DeviceId, scope AuthScope) (*AuthToken, error) {
-	b := make([]byte, TokenLength)
-	// TODO - Audit: Is this is a secure random function?
-	if _, err := rand.Read(b); err != nil {
-		return nil, fmt.Errorf("Error generating token: %+v", err)
+	token, err := a.newTokenString()
+	if err != nil {
+		return nil, err
 	}
 
 	return &AuthToken{
-		Token:    AuthTokenString(hex.EncodeToString(b)),
+		Token:    AuthTokenString(token),
 		DeviceId: deviceId,
 		Scope:    scope,
 		UserId:   userId,
@@ -60,37 +115,33 @@ func (a *Auth) NewAuthToken(userId UserId, deviceId DeviceId, scope AuthScope) (
 }
 
 func (a *Auth) NewVerifyTokenString() (VerifyTokenString, error) {
-	b := make([]byte, TokenLength)
-	// TODO - Audit: Is this is a secure random function?
-	if _, err := rand.Read(b); err != nil {
-		return "", fmt.Errorf("Error generating token: %+v", err)
-	}
-
-	return VerifyTokenString(hex.EncodeToString(b)), nil
+	token, err := a.newTokenString()
+	return VerifyTokenString(token), err
 }
 
 // NOTE - not stubbing methods of structs like this. more convoluted than it's worth right now
 func (at *AuthToken) ScopeValid(required AuthScope) bool {
-	// So far * is the only scope issued. Used to have more, didn't want to
-	// delete this feature yet in case we add more again. We'll delete it if it's
-	// of no use and ends up complicating anything.
 	return at.Scope == ScopeFull || at.Scope == required
 }
 
 const ServerSaltLength = 16
 const ClientSaltSeedLength = 32
 
-const passwordScryptN = 1 << 15
+// How much work the password KDF does, as log2 of scrypt's N. Each step up
+// doubles the time and memory every hash takes. Keys made with a different
+// cost can only be checked with that cost, so it needs to be stored with them.
+const DefaultPasswordCost = 15
+
 const passwordScryptR = 8
 const passwordScryptP = 1
 const passwordScryptKeyLen = 32
 
 // https://words.filippo.io/the-scrypt-parameters/
-func passwordScrypt(p Password, saltBytes []byte) ([]byte, error) {
+func passwordScrypt(p Password, saltBytes []byte, cost int) ([]byte, error) {
 	return scrypt.Key(
 		[]byte(p),
 		saltBytes,
-		passwordScryptN,
+		1<<cost,
 		passwordScryptR,
 		passwordScryptP,
 		passwordScryptKeyLen,
@@ -101,11 +152,16 @@ func passwordScrypt(p Password, saltBytes []byte) ([]byte, error) {
 // random salt, run the password and salt thorugh the KDF, and return the salt
 // and kdf output. The result generally goes into a database.
 func (p Password) Create() (key KDFKey, salt ServerSalt, err error) {
+	return p.CreateWithCost(DefaultPasswordCost)
+}
+
+// Same as Create, with the given cost instead of DefaultPasswordCost
+func (p Password) CreateWithCost(cost int) (key KDFKey, salt ServerSalt, err error) {
 	saltBytes := make([]byte, ServerSaltLength)
 	if _, err := rand.Read(saltBytes); err != nil {
 		return "", "", fmt.Errorf("Error generating salt: %+v", err)
 	}
-	keyBytes, err := passwordScrypt(p, saltBytes)
+	keyBytes, err := passwordScrypt(p, saltBytes, cost)
 	if err == nil {
 		key = KDFKey(hex.EncodeToString(keyBytes[:]))
 		salt = ServerSalt(hex.EncodeToString(saltBytes[:]))
@@ -119,11 +175,16 @@ func (p Password) Create() (key KDFKey, salt ServerSalt, err error) {
 // The salt and test kdf output generally come out of the database, and is used
 // to check a submitted password.
 func (p Password) Check(checkKey KDFKey, salt ServerSalt) (match bool, err error) {
+	return p.CheckWithCost(checkKey, salt, DefaultPasswordCost)
+}
+
+// Same as Check, for a key made with the given cost
+func (p Password) CheckWithCost(checkKey KDFKey, salt ServerSalt, cost int) (match bool, err error) {
 	saltBytes, err := hex.DecodeString(string(salt))
 	if err != nil {
 		return false, fmt.Errorf("Error decoding salt from hex: %+v", err)
 	}
-	keyBytes, err := passwordScrypt(p, saltBytes)
+	keyBytes, err := passwordScrypt(p, saltBytes, cost)
 	if err == nil {
 		match = KDFKey(hex.EncodeToString(keyBytes[:])) == checkKey
 	}
@@ -155,9 +216,91 @@ func (p Password) Validate() bool {
 	return len(p) >= 8 // Should be much longer but it's a sanity check.
 }
 
+// The shortest email local-part that we'll look for inside of a password. Any
+// shorter and we'd be rejecting passwords for containing things like "jo".
+const weakPasswordMinLocalPartLength = 4
+
+// Catch passwords that are trivially guessable given what's known about the
+// account: the email address itself, the local-part of the email address, or
+// any of the given patterns (the name of the site, etc). Comparisons are case
+// insensitive.
+//
+// NOTE - LBRY clients derive the password they send us from the user's root
+// password, so this would only ever catch anything for a client that sends
+// the root password as-is.
+func (p Password) IsWeak(e Email, patterns []string) bool {
+	password := strings.ToLower(string(p))
+	email := strings.ToLower(string(e))
+
+	if password == email {
+		return true
+	}
+
+	if at := strings.LastIndex(email, "@"); at >= weakPasswordMinLocalPartLength {
+		if strings.Contains(password, email[:at]) {
+			return true
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(password, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
 // TODO consider unicode. Also some providers might be case sensitive, and/or
 // may have other ways of having email addresses be equivalent (which we may
 // not care about though)
 func (e Email) Normalize() NormalizedEmail {
 	return NormalizedEmail(strings.ToLower(string(e)))
 }
+
+// Long enough for a UUID, or whatever else a client might reasonably use
+const maxDeviceIdLength = 128
+
+// Printable ASCII (spaces included, but not at either end), and not too long.
+// Device ids are free-form otherwise, but anything else makes for device rows
+// that differ only in ways the user can't see.
+func (d DeviceId) Validate() bool {
+	if len(d) == 0 || len(d) > maxDeviceIdLength || d != d.Normalize() {
+		return false
+	}
+	for i := 0; i < len(d); i++ {
+		if d[i] < ' ' || d[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Clients aren't always careful about whitespace around the id
+func (d DeviceId) Normalize() DeviceId {
+	return DeviceId(strings.TrimSpace(string(d)))
+}
+
+func (k SigningPublicKey) Validate() bool {
+	b, err := hex.DecodeString(string(k))
+	return err == nil && len(b) == ed25519.PublicKeySize
+}
+
+// What a client signs for a signed request. The body goes in as a hash so
+// that the message stays small no matter how big the wallet is.
+func RequestSigningMessage(method string, path string, body []byte, timestamp string, nonce string) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, path, hex.EncodeToString(bodyHash[:]), timestamp, nonce}, "\n"))
+}
+
+// `signature` is hex encoded
+func (k SigningPublicKey) VerifySignature(message []byte, signature string) bool {
+	publicKey, err := hex.DecodeString(string(k))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(publicKey, message, sig)
+}
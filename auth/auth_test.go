@@ -1,6 +1,13 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -18,10 +25,15 @@ func TestAuthNewAuthToken(t *testing.T) {
 		t.Fatalf("authToken fields don't match expected values")
 	}
 
-	// result.Token is in hex, TokenLength is bytes in the original
-	expectedTokenLength := TokenLength * 2
-	if len(authToken.Token) != expectedTokenLength {
-		t.Fatalf("authToken token string isn't the expected length")
+	// result.Token is in base64url, DefaultTokenLength is bytes in the original
+	decoded, err := base64.RawURLEncoding.DecodeString(string(authToken.Token))
+	if err != nil || len(decoded) != DefaultTokenLength {
+		t.Fatalf("authToken token string isn't the expected length: %s err: %+v", authToken.Token, err)
+	}
+
+	otherAuthToken, err := auth.NewAuthToken(234, "dId", "my-scope")
+	if err != nil || otherAuthToken.Token == authToken.Token {
+		t.Fatalf("Expected a different token each time: %s and %s err: %+v", authToken.Token, otherAuthToken.Token, err)
 	}
 }
 
@@ -33,10 +45,59 @@ func TestAuthNewVerifyTokenString(t *testing.T) {
 		t.Fatalf("Error creating new token")
 	}
 
-	// result.Token is in hex, TokenLength is bytes in the original
-	expectedTokenLength := TokenLength * 2
-	if len(verifyTokenString) != expectedTokenLength {
-		t.Fatalf("verifyTokenString isn't the expected length")
+	// result.Token is in base64url, DefaultTokenLength is bytes in the original
+	decoded, err := base64.RawURLEncoding.DecodeString(string(verifyTokenString))
+	if err != nil || len(decoded) != DefaultTokenLength {
+		t.Fatalf("verifyTokenString isn't the expected length: %s err: %+v", verifyTokenString, err)
+	}
+
+	otherVerifyTokenString, err := auth.NewVerifyTokenString()
+	if err != nil || otherVerifyTokenString == verifyTokenString {
+		t.Fatalf("Expected a different token each time: %s and %s err: %+v", verifyTokenString, otherVerifyTokenString, err)
+	}
+}
+
+func TestAuthTokenLength(t *testing.T) {
+	auth := Auth{TokenLength: 48}
+	authToken, err := auth.NewAuthToken(234, "dId", "my-scope")
+	if err != nil {
+		t.Fatalf("Error creating new token: %+v", err)
+	}
+	if decoded, err := base64.RawURLEncoding.DecodeString(string(authToken.Token)); err != nil || len(decoded) != 48 {
+		t.Errorf("authToken token string isn't the configured length: %s err: %+v", authToken.Token, err)
+	}
+
+	auth = Auth{TokenLength: DefaultTokenLength - 1}
+	if authToken, err := auth.NewAuthToken(234, "dId", "my-scope"); err == nil {
+		t.Errorf("Expected an error for a token length below the minimum, got %+v", authToken)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Some random rand error!")
+}
+
+// Not enough randomness is an error, not a weaker token
+func TestAuthTokenRandError(t *testing.T) {
+	tt := []struct {
+		name string
+		rand io.Reader
+	}{
+		{name: "failing", rand: failingReader{}},
+		{name: "short", rand: bytes.NewReader(make([]byte, DefaultTokenLength-1))},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := Auth{Rand: tc.rand}
+			if authToken, err := auth.NewAuthToken(234, "dId", "my-scope"); err == nil || authToken != nil {
+				t.Errorf("Expected an error and no auth token, got %+v err %+v", authToken, err)
+			}
+			if verifyTokenString, err := auth.NewVerifyTokenString(); err == nil || verifyTokenString != "" {
+				t.Errorf("Expected an error and no verify token, got %s err %+v", verifyTokenString, err)
+			}
+		})
 	}
 }
 
@@ -67,6 +128,15 @@ func TestAuthScopeInvalid(t *testing.T) {
 	}
 }
 
+func TestAuthScopeValidForLogin(t *testing.T) {
+	if !ScopeFull.Valid() || !ScopeGetWallet.Valid() {
+		t.Fatalf("Expected ScopeFull and ScopeGetWallet to be valid scopes to log in with")
+	}
+	if AuthScope("banana").Valid() || AuthScope("").Valid() {
+		t.Fatalf("Expected unknown scopes to be invalid")
+	}
+}
+
 func TestCreatePassword(t *testing.T) {
 	// Since the salt is randomized, there's really not much we can do to test
 	// the create function other than to check the length of the outputs and that
@@ -137,8 +207,150 @@ func TestCheckPassword(t *testing.T) {
 	}
 }
 
+// A key is only good for the cost it was made with
+func TestPasswordWithCost(t *testing.T) {
+	const password = Password("password 1")
+
+	key, salt, err := password.CreateWithCost(10)
+	if err != nil {
+		t.Fatalf("Error creating password: %+v", err)
+	}
+
+	match, err := password.CheckWithCost(key, salt, 10)
+	if err != nil || !match {
+		t.Errorf("Expected password to match with the same cost: match: %v err: %+v", match, err)
+	}
+
+	match, err = password.CheckWithCost(key, salt, 11)
+	if err != nil || match {
+		t.Errorf("Expected password to not match with a different cost: match: %v err: %+v", match, err)
+	}
+}
+
+func TestPasswordIsWeak(t *testing.T) {
+	tt := []struct {
+		name     string
+		password Password
+		email    Email
+		patterns []string
+
+		expectWeak bool
+	}{
+		{
+			name:       "equals email",
+			password:   "Joey@Example.com",
+			email:      "joey@example.com",
+			expectWeak: true,
+		}, {
+			name:       "contains local-part",
+			password:   "JOEY1234",
+			email:      "joey@example.com",
+			expectWeak: true,
+		}, {
+			name:       "contains short local-part",
+			password:   "jo123456",
+			email:      "jo@example.com",
+			expectWeak: false,
+		}, {
+			name:       "contains pattern",
+			password:   "mylbrypassword",
+			email:      "joey@example.com",
+			patterns:   []string{"odysee", "LBRY"},
+			expectWeak: true,
+		}, {
+			name:       "strong",
+			password:   "correct-horse-battery-staple",
+			email:      "joey@example.com",
+			patterns:   []string{"odysee", "lbry"},
+			expectWeak: false,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if weak := tc.password.IsWeak(tc.email, tc.patterns); weak != tc.expectWeak {
+				t.Errorf("Expected IsWeak to be %v, got %v", tc.expectWeak, weak)
+			}
+		})
+	}
+}
+
 func TestEmailNormalize(t *testing.T) {
 	if got, want := Email("aBc@eXaMpLe.CoM").Normalize(), NormalizedEmail("abc@example.com"); got != want {
 		t.Errorf("Email normalization failed. got: %s want: %s", got, want)
 	}
 }
+
+func TestDeviceIdValidate(t *testing.T) {
+	tt := []struct {
+		name        string
+		deviceId    DeviceId
+		expectValid bool
+	}{
+		{"simple", "dev-1", true},
+		{"uuid", "f81d4fae-7dec-11d0-a765-00a0c91e6bf6", true},
+		{"space inside", "Joe's phone", true},
+		{"max length", DeviceId(strings.Repeat("a", maxDeviceIdLength)), true},
+		{"empty", "", false},
+		{"overlong", DeviceId(strings.Repeat("a", maxDeviceIdLength+1)), false},
+		{"control character", "dev\x001", false},
+		{"newline", "dev-1\n", false},
+		{"tab inside", "dev\t1", false},
+		{"delete", "dev\x7f", false},
+		{"non-ascii", "dév-1", false},
+		{"leading space", " dev-1", false},
+		{"trailing space", "dev-1 ", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if valid := tc.deviceId.Validate(); valid != tc.expectValid {
+				t.Errorf("Expected Validate to be %v for %q, got %v", tc.expectValid, tc.deviceId, valid)
+			}
+		})
+	}
+}
+
+func TestDeviceIdNormalize(t *testing.T) {
+	if got, want := DeviceId(" \tdev-1 \n").Normalize(), DeviceId("dev-1"); got != want {
+		t.Errorf("Device id normalization failed. got: %q want: %q", got, want)
+	}
+	// Only the ends
+	if got, want := DeviceId("Joe's phone").Normalize(), DeviceId("Joe's phone"); got != want {
+		t.Errorf("Device id normalization failed. got: %q want: %q", got, want)
+	}
+}
+
+func TestSigningPublicKeyVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %+v", err)
+	}
+	key := SigningPublicKey(hex.EncodeToString(publicKey))
+	if !key.Validate() {
+		t.Fatalf("Expected generated key to validate")
+	}
+
+	message := RequestSigningMessage("POST", "/api/3/password", []byte(`{"a": "b"}`), "1650000000", "nonce-1")
+	signature := hex.EncodeToString(ed25519.Sign(privateKey, message))
+
+	if !key.VerifySignature(message, signature) {
+		t.Errorf("Expected valid signature to verify")
+	}
+
+	tamperedMessage := RequestSigningMessage("POST", "/api/3/password", []byte(`{"a": "c"}`), "1650000000", "nonce-1")
+	if key.VerifySignature(tamperedMessage, signature) {
+		t.Errorf("Expected signature over a different body to not verify")
+	}
+
+	if key.VerifySignature(message, "not-hex") {
+		t.Errorf("Expected malformed signature to not verify")
+	}
+
+	otherPublicKey, _, _ := ed25519.GenerateKey(nil)
+	if SigningPublicKey(hex.EncodeToString(otherPublicKey)).VerifySignature(message, signature) {
+		t.Errorf("Expected signature to not verify against a different key")
+	}
+
+	if SigningPublicKey("abcd").Validate() {
+		t.Errorf("Expected short key to not validate")
+	}
+}
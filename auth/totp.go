@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords (RFC 6238) for two-factor authentication,
+// the kind that authenticator apps show: HMAC-SHA1, 6 digits, a new code
+// every 30 seconds. These are the defaults every app supports, so they go in
+// the otpauth URL but aren't configurable.
+
+const totpDigits = 6
+const totpModulus = 1000000 // 10^totpDigits
+const totpPeriod = 30 * time.Second
+
+// Also accept the codes from one period before and after, for clocks that are
+// a little off and codes typed in just as they change
+const totpSkew = 1
+
+// 160 bits, as RFC 4226 recommends
+const TotpSecretLength = 20
+
+// Base32 without padding, which is how authenticator apps take it
+type TotpSecret string
+
+type TotpCode string
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (a *Auth) NewTotpSecret() (TotpSecret, error) {
+	b := make([]byte, TotpSecretLength)
+	if _, err := io.ReadFull(a.rand(), b); err != nil {
+		return "", fmt.Errorf("Error generating TOTP secret: %+v", err)
+	}
+	return TotpSecret(totpEncoding.EncodeToString(b)), nil
+}
+
+func (c TotpCode) Validate() bool {
+	if len(c) != totpDigits {
+		return false
+	}
+	for _, digit := range c {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// The code for the period that `now` is in
+func (s TotpSecret) Code(now time.Time) (TotpCode, error) {
+	key, err := totpEncoding.DecodeString(string(s))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, totpCounter(now)), nil
+}
+
+// Whether the code is good as of `now`. If so, counter is the period it's
+// for, so that the caller can make sure a code is only ever used once.
+func (s TotpSecret) Check(code TotpCode, now time.Time) (counter int64, ok bool, err error) {
+	key, err := totpEncoding.DecodeString(string(s))
+	if err != nil {
+		return
+	}
+	if !code.Validate() {
+		return
+	}
+	current := totpCounter(now)
+	for counter = current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			return counter, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// For a QR code. The issuer is what the app shows the code under, such as the
+// server's domain.
+func (s TotpSecret) URL(issuer string, email Email) string {
+	params := url.Values{}
+	params.Set("secret", string(s))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(strings.ReplaceAll(issuer, ":", "")) + ":" + url.PathEscape(string(email))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpCounter(now time.Time) int64 {
+	return now.Unix() / int64(totpPeriod.Seconds())
+}
+
+// RFC 4226 section 5.3
+func totpCode(key []byte, counter int64) TotpCode {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return TotpCode(fmt.Sprintf("%0*d", totpDigits, value%totpModulus))
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base32"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B, cut down to 6 digits
+func TestAuthTotpCode(t *testing.T) {
+	secret := TotpSecret(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890")))
+	for _, tc := range []struct {
+		unix int64
+		code TotpCode
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		code, err := secret.Code(time.Unix(tc.unix, 0))
+		if err != nil || code != tc.code {
+			t.Errorf("At %d expected code %s, got %s err %+v", tc.unix, tc.code, code, err)
+		}
+	}
+}
+
+func TestAuthTotpCheck(t *testing.T) {
+	secret, err := (&Auth{}).NewTotpSecret()
+	if err != nil {
+		t.Fatalf("Error creating TOTP secret: %+v", err)
+	}
+	now := time.Now()
+	code, err := secret.Code(now)
+	if err != nil {
+		t.Fatalf("Error getting code: %+v", err)
+	}
+
+	counter, ok, err := secret.Check(code, now)
+	if err != nil || !ok || counter != totpCounter(now) {
+		t.Errorf("Expected the current code to pass: counter %d ok %t err %+v", counter, ok, err)
+	}
+
+	// A period either way is fine
+	if _, ok, _ := secret.Check(code, now.Add(totpPeriod)); !ok {
+		t.Errorf("Expected the code to pass a period later")
+	}
+	if _, ok, _ := secret.Check(code, now.Add(-totpPeriod)); !ok {
+		t.Errorf("Expected the code to pass a period earlier")
+	}
+
+	// Further than that isn't
+	if _, ok, _ := secret.Check(code, now.Add(3*totpPeriod)); ok {
+		t.Errorf("Expected the code to fail three periods later")
+	}
+
+	for _, badCode := range []TotpCode{"", "12345", "1234567", "12345a", " 12345"} {
+		if _, ok, _ := secret.Check(badCode, now); ok {
+			t.Errorf("Expected %q to fail", badCode)
+		}
+	}
+
+	if _, _, err := TotpSecret("not base32!").Check(code, now); err == nil {
+		t.Errorf("Expected an error for a malformed secret")
+	}
+}
+
+// Same as tokens, not enough randomness is an error
+func TestAuthTotpSecretRandError(t *testing.T) {
+	for _, rand := range []io.Reader{failingReader{}, bytes.NewReader(make([]byte, TotpSecretLength-1))} {
+		auth := Auth{Rand: rand}
+		if secret, err := auth.NewTotpSecret(); err == nil || secret != "" {
+			t.Errorf("Expected an error and no secret, got %s err %+v", secret, err)
+		}
+	}
+
+	auth := Auth{Rand: bytes.NewReader([]byte("12345678901234567890"))}
+	secret, err := auth.NewTotpSecret()
+	if err != nil || secret != TotpSecret(totpEncoding.EncodeToString([]byte("12345678901234567890"))) {
+		t.Errorf("Expected the secret to come from Rand, got %s err %+v", secret, err)
+	}
+}
+
+func TestAuthTotpURL(t *testing.T) {
+	url := TotpSecret("JBSWY3DPEHPK3PXP").URL("sync.example.com", "abc@example.com")
+	if !strings.HasPrefix(url, "otpauth://totp/sync.example.com:abc@example.com?") {
+		t.Errorf("Unexpected label in %s", url)
+	}
+	for _, param := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=sync.example.com", "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(url, param) {
+			t.Errorf("Expected %s in %s", param, url)
+		}
+	}
+}
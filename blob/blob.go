@@ -0,0 +1,17 @@
+package blob
+
+import (
+	"fmt"
+)
+
+var ErrNotFound = fmt.Errorf("Blob not found")
+
+// Somewhere to keep big blobs (encrypted wallets) outside of the database. See
+// store.BlobWalletStore.
+//
+// For test stubs
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
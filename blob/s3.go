@@ -0,0 +1,186 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"lbryio/wallet-sync-server/env"
+)
+
+// Talks to S3, or anything else that speaks its API (MinIO, etc). We only
+// need to put, get and delete objects, so rather than pull in a whole SDK we
+// sign the requests ourselves (AWS Signature Version 4). Buckets are
+// addressed path-style, <endpoint>/<bucket>/<key>, since that's what every
+// S3-compatible service supports.
+type S3 struct {
+	Env env.EnvInterface
+}
+
+var s3Client = &http.Client{Timeout: time.Second * 30}
+
+func (s *S3) Put(key string, data []byte) error {
+	res, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3) Get(key string) ([]byte, error) {
+	res, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Deleting something that isn't there isn't an error, same as S3 itself.
+func (s *S3) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("S3 request failed: %s: %s", res.Status, body)
+}
+
+func (s *S3) do(method string, key string, body []byte) (*http.Response, error) {
+	endpoint, bucket, region, accessKeyId, secretAccessKey, err := env.GetS3Configs(s.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(endpoint, "/")+"/"+bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, payloadHash, region, accessKeyId, secretAccessKey, time.Now())
+
+	return s3Client.Do(req)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign the request with AWS Signature Version 4, over the host and every
+// header already set on the request. See:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, payloadHash string, region string, accessKeyId string, secretAccessKey string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	delete(headers, "authorization")
+
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+// Each segment of the path URI encoded, as S3 wants it (unlike other AWS
+// services, not encoded twice)
+func canonicalURI(u *url.URL) string {
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	path := strings.Join(segments, "/")
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// Everything but the unreserved characters, percent encoded. Stricter than
+// url.PathEscape, which leaves things like ':' and '@' alone.
+func uriEncode(s string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
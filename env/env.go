@@ -2,10 +2,14 @@ package env
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 // NOTE for users: If you have weird characters in your email address, please
@@ -24,6 +28,124 @@ const mailgunSendingDomainKey = "MAILGUN_SENDING_DOMAIN"
 // for links in the emails
 const mailgunServerDomainKey = "MAILGUN_SERVER_DOMAIN"
 
+const mailTransportKey = "MAIL_TRANSPORT"
+
+// host:port
+const smtpAddressKey = "SMTP_ADDRESS"
+const smtpUsernameKey = "SMTP_USERNAME"
+const smtpPasswordKey = "SMTP_PASSWORD"
+
+// Same as their Mailgun counterparts
+const smtpSendingDomainKey = "SMTP_SENDING_DOMAIN"
+const smtpServerDomainKey = "SMTP_SERVER_DOMAIN"
+
+const newDeviceEmailKey = "NEW_DEVICE_EMAIL"
+
+const flagSameWalletNewHmacKey = "FLAG_SAME_WALLET_NEW_HMAC"
+
+const weakPasswordCheckKey = "WEAK_PASSWORD_CHECK"
+const weakPasswordPatternsKey = "WEAK_PASSWORD_PATTERNS"
+const passwordMinLengthKey = "PASSWORD_MIN_LENGTH"
+const passwordCostKey = "PASSWORD_COST"
+
+const conflictBackoffKey = "CONFLICT_BACKOFF"
+
+const requireParentHmacKey = "REQUIRE_PARENT_HMAC"
+
+const websocketMaxConnectionsPerIPKey = "WEBSOCKET_MAX_CONNECTIONS_PER_IP"
+const websocketMaxConnectionsPerUserKey = "WEBSOCKET_MAX_CONNECTIONS_PER_USER"
+
+const emailAvailabilityCheckKey = "EMAIL_AVAILABILITY_CHECK"
+
+const storeMetricsKey = "STORE_METRICS"
+const httpMetricsKey = "HTTP_METRICS"
+const requestLogKey = "REQUEST_LOG"
+
+const walletBlobStoreKey = "WALLET_BLOB_STORE"
+const s3EndpointKey = "S3_ENDPOINT"
+const s3BucketKey = "S3_BUCKET"
+const s3RegionKey = "S3_REGION"
+const s3AccessKeyIdKey = "S3_ACCESS_KEY_ID"
+const s3SecretAccessKeyKey = "S3_SECRET_ACCESS_KEY"
+
+const selfTestEmailKey = "SELF_TEST_EMAIL"
+const selfTestPasswordKey = "SELF_TEST_PASSWORD"
+
+const authTokenLifespanKey = "AUTH_TOKEN_LIFESPAN"
+const authTokenLengthKey = "AUTH_TOKEN_LENGTH"
+
+const authRateLimitKey = "AUTH_RATE_LIMIT"
+const authRateLimitWindowKey = "AUTH_RATE_LIMIT_WINDOW"
+const authRateLimitBurstKey = "AUTH_RATE_LIMIT_BURST"
+
+const signupRateLimitKey = "SIGNUP_RATE_LIMIT"
+const signupRateLimitWindowKey = "SIGNUP_RATE_LIMIT_WINDOW"
+const signupRateLimitBurstKey = "SIGNUP_RATE_LIMIT_BURST"
+
+const trustedProxiesKey = "TRUSTED_PROXIES"
+const rateLimitExemptKey = "RATE_LIMIT_EXEMPT"
+
+const loginLockoutThresholdKey = "LOGIN_LOCKOUT_THRESHOLD"
+const loginLockoutDurationKey = "LOGIN_LOCKOUT_DURATION"
+
+const deletedEmailReservationKey = "DELETED_EMAIL_RESERVATION"
+
+const adminApiKey = "ADMIN_API"
+const adminTokenKey = "ADMIN_TOKEN"
+
+const shutdownTimeoutKey = "SHUTDOWN_TIMEOUT"
+
+const corsAllowedOriginsKey = "CORS_ALLOWED_ORIGINS"
+
+const maxWalletSizeKey = "MAX_WALLET_SIZE"
+
+const maxWalletSequenceKey = "MAX_WALLET_SEQUENCE"
+
+const hmacFormatCheckKey = "HMAC_FORMAT_CHECK"
+
+const tokenPurgeKey = "TOKEN_PURGE"
+const tokenPurgeIntervalKey = "TOKEN_PURGE_INTERVAL"
+const defaultTokenPurgeInterval = time.Hour
+
+const sqliteBusyTimeoutKey = "SQLITE_BUSY_TIMEOUT"
+const sqliteWALModeKey = "SQLITE_WAL_MODE"
+const sqliteMaxOpenConnsKey = "SQLITE_MAX_OPEN_CONNS"
+
+const listenHostKey = "LISTEN_HOST"
+const listenPortKey = "LISTEN_PORT"
+const tlsCertFileKey = "TLS_CERT_FILE"
+const tlsKeyFileKey = "TLS_KEY_FILE"
+const httpReadHeaderTimeoutKey = "HTTP_READ_HEADER_TIMEOUT"
+const httpReadTimeoutKey = "HTTP_READ_TIMEOUT"
+const httpWriteTimeoutKey = "HTTP_WRITE_TIMEOUT"
+const httpIdleTimeoutKey = "HTTP_IDLE_TIMEOUT"
+
+const defaultWebsocketMaxConnectionsPerIP = 20
+const defaultWebsocketMaxConnectionsPerUser = 10
+
+const defaultAuthRateLimit = 5
+const defaultAuthRateLimitWindow = time.Minute
+
+const defaultShutdownTimeout = time.Second * 30
+
+// Only reachable from the same machine unless LISTEN_HOST says otherwise,
+// which is what we've always done
+const defaultListenHost = "localhost"
+const defaultListenPort = 8090
+
+// Same as auth.Password.Validate
+const defaultPasswordMinLength = 8
+
+// Each hash takes 1GiB of memory at this cost, which is plenty
+const maxPasswordCost = 20
+
+// Tokens go in URLs and headers, so there's a limit to how long they can
+// sensibly be
+const maxTokenLength = 128
+
+// Long enough that there's no guessing it, if it's random
+const minAdminTokenLength = 32
+
 type AccountVerificationMode string
 
 // Everyone can make an account. Only use for dev purposes.
@@ -36,6 +158,23 @@ const AccountVerificationModeEmailVerify = AccountVerificationMode("EmailVerify"
 // self-hosting users.
 const AccountVerificationModeWhitelist = AccountVerificationMode("Whitelist")
 
+type WalletBlobStore string
+
+// Encrypted wallets go right in the database
+const WalletBlobStoreDatabase = WalletBlobStore("")
+
+// Encrypted wallets go in an S3 compatible object store, with only a reference
+// to them in the database
+const WalletBlobStoreS3 = WalletBlobStore("s3")
+
+type MailTransport string
+
+// Send emails with the Mailgun API
+const MailTransportMailgun = MailTransport("")
+
+// Send emails through an SMTP server
+const MailTransportSMTP = MailTransport("smtp")
+
 // For test stubs
 type EnvInterface interface {
 	Getenv(key string) string
@@ -59,9 +198,373 @@ func GetMailgunConfigs(e EnvInterface, mode AccountVerificationMode) (sendingDom
 	return getMailgunConfigs(e.Getenv(mailgunSendingDomainKey), e.Getenv(mailgunServerDomainKey), e.Getenv(mailgunIsDomainEUKey), e.Getenv(mailgunPrivateAPIKeyKey), mode)
 }
 
+func GetMailTransport(e EnvInterface) (MailTransport, error) {
+	return getMailTransport(e.Getenv(mailTransportKey))
+}
+
+// Username and password may both be blank, for servers that don't need them
+func GetSMTPConfigs(e EnvInterface, mode AccountVerificationMode) (address string, username string, password string, sendingDomain string, serverDomain string, err error) {
+	return getSMTPConfigs(e.Getenv(smtpAddressKey), e.Getenv(smtpUsernameKey), e.Getenv(smtpPasswordKey), e.Getenv(smtpSendingDomainKey), e.Getenv(smtpServerDomainKey), mode)
+}
+
+func GetNewDeviceEmail(e EnvInterface) (bool, error) {
+	return getBoolFlag(newDeviceEmailKey, e.Getenv(newDeviceEmailKey))
+}
+
+func GetFlagSameWalletNewHmac(e EnvInterface) (bool, error) {
+	return getBoolFlag(flagSameWalletNewHmacKey, e.Getenv(flagSameWalletNewHmacKey))
+}
+
+func GetConflictBackoff(e EnvInterface) (bool, error) {
+	return getBoolFlag(conflictBackoffKey, e.Getenv(conflictBackoffKey))
+}
+
+func GetRequireParentHmac(e EnvInterface) (bool, error) {
+	return getBoolFlag(requireParentHmacKey, e.Getenv(requireParentHmacKey))
+}
+
+func GetWebsocketMaxConnections(e EnvInterface) (perIP int, perUser int, err error) {
+	perIP, err = getPositiveInt(websocketMaxConnectionsPerIPKey, e.Getenv(websocketMaxConnectionsPerIPKey), defaultWebsocketMaxConnectionsPerIP)
+	if err != nil {
+		return
+	}
+	perUser, err = getPositiveInt(websocketMaxConnectionsPerUserKey, e.Getenv(websocketMaxConnectionsPerUserKey), defaultWebsocketMaxConnectionsPerUser)
+	return
+}
+
+func GetEmailAvailabilityCheck(e EnvInterface) (bool, error) {
+	return getBoolFlag(emailAvailabilityCheckKey, e.Getenv(emailAvailabilityCheckKey))
+}
+
+func GetStoreMetrics(e EnvInterface) (bool, error) {
+	return getBoolFlag(storeMetricsKey, e.Getenv(storeMetricsKey))
+}
+
+func GetHttpMetrics(e EnvInterface) (bool, error) {
+	return getBoolFlag(httpMetricsKey, e.Getenv(httpMetricsKey))
+}
+
+func GetRequestLog(e EnvInterface) (bool, error) {
+	return getBoolFlag(requestLogKey, e.Getenv(requestLogKey))
+}
+
+func GetWalletBlobStore(e EnvInterface) (WalletBlobStore, error) {
+	return getWalletBlobStore(e.Getenv(walletBlobStoreKey))
+}
+
+func GetS3Configs(e EnvInterface) (endpoint string, bucket string, region string, accessKeyId string, secretAccessKey string, err error) {
+	return getS3Configs(e.Getenv(s3EndpointKey), e.Getenv(s3BucketKey), e.Getenv(s3RegionKey), e.Getenv(s3AccessKeyIdKey), e.Getenv(s3SecretAccessKeyKey))
+}
+
+// The account the self test syncs a wallet with. The self test is off if the
+// email is blank.
+func GetSelfTestAccount(e EnvInterface) (email auth.Email, password auth.Password, err error) {
+	return getSelfTestAccount(e.Getenv(selfTestEmailKey), e.Getenv(selfTestPasswordKey))
+}
+
+func GetPasswordMinLength(e EnvInterface) (int, error) {
+	return getPositiveInt(passwordMinLengthKey, e.Getenv(passwordMinLengthKey), defaultPasswordMinLength)
+}
+
+// Zero if not set, meaning the store's default (auth.DefaultPasswordCost)
+func GetPasswordCost(e EnvInterface) (int, error) {
+	return getPasswordCost(e.Getenv(passwordCostKey))
+}
+
+// Zero if not set, meaning the store's default
+func GetAuthTokenLifespan(e EnvInterface) (time.Duration, error) {
+	return getPositiveDuration(authTokenLifespanKey, e.Getenv(authTokenLifespanKey))
+}
+
+// How many login requests one IP address can make per window, and how many
+// of those it can make at once
+func GetAuthRateLimit(e EnvInterface) (limit int, window time.Duration, burst int, err error) {
+	return getRateLimit(
+		authRateLimitKey, e.Getenv(authRateLimitKey),
+		authRateLimitWindowKey, e.Getenv(authRateLimitWindowKey),
+		authRateLimitBurstKey, e.Getenv(authRateLimitBurstKey),
+		defaultAuthRateLimit, defaultAuthRateLimitWindow,
+	)
+}
+
+// How many sign up requests one IP address can make per window. The limit
+// and window that aren't set are the same as for login, which is what sign up
+// went by before it had its own. The burst, if it isn't set, is the same as
+// the sign up limit.
+func GetSignupRateLimit(e EnvInterface) (limit int, window time.Duration, burst int, err error) {
+	authLimit, authWindow, _, err := GetAuthRateLimit(e)
+	if err != nil {
+		return
+	}
+	return getRateLimit(
+		signupRateLimitKey, e.Getenv(signupRateLimitKey),
+		signupRateLimitWindowKey, e.Getenv(signupRateLimitWindowKey),
+		signupRateLimitBurstKey, e.Getenv(signupRateLimitBurstKey),
+		authLimit, authWindow,
+	)
+}
+
+// Reverse proxies in front of the server, whose X-Forwarded-For we go by to
+// tell clients apart. Empty if not set, meaning none.
+func GetTrustedProxies(e EnvInterface) ([]*net.IPNet, error) {
+	return getIPNets(trustedProxiesKey, e.Getenv(trustedProxiesKey))
+}
+
+// Client addresses that aren't rate limited. Empty if not set, meaning none.
+func GetRateLimitExempt(e EnvInterface) ([]*net.IPNet, error) {
+	return getIPNets(rateLimitExemptKey, e.Getenv(rateLimitExemptKey))
+}
+
+// Zero threshold if not set, meaning no lockout. Zero duration if not set,
+// meaning the store's default.
+func GetLoginLockout(e EnvInterface) (threshold int, duration time.Duration, err error) {
+	threshold, err = getPositiveInt(loginLockoutThresholdKey, e.Getenv(loginLockoutThresholdKey), 0)
+	if err != nil {
+		return
+	}
+	duration, err = getPositiveDuration(loginLockoutDurationKey, e.Getenv(loginLockoutDurationKey))
+	return
+}
+
+// Zero if not set, meaning deleted accounts' emails can sign up again right
+// away
+func GetDeletedEmailReservation(e EnvInterface) (time.Duration, error) {
+	return getPositiveDuration(deletedEmailReservationKey, e.Getenv(deletedEmailReservationKey))
+}
+
+// In bytes. Zero if not set, meaning auth.DefaultTokenLength
+func GetAuthTokenLength(e EnvInterface) (int, error) {
+	return getTokenLength(e.Getenv(authTokenLengthKey))
+}
+
+// Off by default. If it's on, `token` is what every admin request has to give.
+func GetAdminApi(e EnvInterface) (enabled bool, token string, err error) {
+	return getAdminApi(e.Getenv(adminApiKey), e.Getenv(adminTokenKey))
+}
+
+// How long to wait for requests in progress to finish when shutting down
+func GetShutdownTimeout(e EnvInterface) (time.Duration, error) {
+	timeout, err := getPositiveDuration(shutdownTimeoutKey, e.Getenv(shutdownTimeoutKey))
+	if err == nil && timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return timeout, err
+}
+
+// Origins that browser clients can call the API from. Empty means none,
+// other than the server's own.
+func GetCorsAllowedOrigins(e EnvInterface) ([]string, error) {
+	return getCorsAllowedOrigins(e.Getenv(corsAllowedOriginsKey))
+}
+
+// In bytes. Zero if not set, meaning no limit other than the request body size.
+func GetMaxWalletSize(e EnvInterface) (int, error) {
+	return getPositiveInt(maxWalletSizeKey, e.Getenv(maxWalletSizeKey), 0)
+}
+
+// Zero if not set, meaning the store's default (wallet.DefaultMaxSequence)
+func GetMaxWalletSequence(e EnvInterface) (wallet.Sequence, error) {
+	return getMaxWalletSequence(e.Getenv(maxWalletSequenceKey))
+}
+
+func GetHmacFormatCheck(e EnvInterface) (bool, error) {
+	return getBoolFlag(hmacFormatCheckKey, e.Getenv(hmacFormatCheckKey))
+}
+
+// On by default, unlike most flags, since there's no downside other than the
+// occasional query. Turn it off to purge some other way (see
+// -purge-expired-tokens).
+func GetTokenPurge(e EnvInterface) (enabled bool, interval time.Duration, err error) {
+	return getTokenPurge(e.Getenv(tokenPurgeKey), e.Getenv(tokenPurgeIntervalKey))
+}
+
+// Zero busy timeout or max open connections if not set, meaning the defaults
+// (see store.Store)
+func GetSQLiteSettings(e EnvInterface) (busyTimeout time.Duration, walMode bool, maxOpenConns int, err error) {
+	busyTimeout, err = getPositiveDuration(sqliteBusyTimeoutKey, e.Getenv(sqliteBusyTimeoutKey))
+	if err != nil {
+		return
+	}
+	walMode, err = getBoolFlag(sqliteWALModeKey, e.Getenv(sqliteWALModeKey))
+	if err != nil {
+		return
+	}
+	maxOpenConns, err = getPositiveInt(sqliteMaxOpenConnsKey, e.Getenv(sqliteMaxOpenConnsKey), 0)
+	return
+}
+
+func GetWeakPasswordCheck(e EnvInterface) (check bool, patterns []string, err error) {
+	return getWeakPasswordCheck(e.Getenv(weakPasswordCheckKey), e.Getenv(weakPasswordPatternsKey))
+}
+
+// Where the server listens. See server.Config, which checks the rest.
+func GetListenAddress(e EnvInterface) (host string, port int, err error) {
+	return getListenAddress(e.Getenv(listenHostKey), e.Getenv(listenPortKey))
+}
+
+// Empty if not set, meaning plain HTTP
+func GetTLSFiles(e EnvInterface) (certFile string, keyFile string) {
+	return e.Getenv(tlsCertFileKey), e.Getenv(tlsKeyFileKey)
+}
+
+// Zero for any that aren't set, meaning the defaults (see server.Config)
+func GetHttpTimeouts(e EnvInterface) (readHeader time.Duration, read time.Duration, write time.Duration, idle time.Duration, err error) {
+	readHeader, err = getPositiveDuration(httpReadHeaderTimeoutKey, e.Getenv(httpReadHeaderTimeoutKey))
+	if err != nil {
+		return
+	}
+	read, err = getPositiveDuration(httpReadTimeoutKey, e.Getenv(httpReadTimeoutKey))
+	if err != nil {
+		return
+	}
+	write, err = getPositiveDuration(httpWriteTimeoutKey, e.Getenv(httpWriteTimeoutKey))
+	if err != nil {
+		return
+	}
+	idle, err = getPositiveDuration(httpIdleTimeoutKey, e.Getenv(httpIdleTimeoutKey))
+	return
+}
+
 // Factor out the guts of the functions so we can test them by just passing in
 // the env vars
 
+func getTokenPurge(enabledStr string, intervalStr string) (enabled bool, interval time.Duration, err error) {
+	enabled, err = getBoolFlag(tokenPurgeKey, enabledStr)
+	if err != nil {
+		return
+	}
+	if enabledStr == "" {
+		enabled = true
+	}
+	interval, err = getPositiveDuration(tokenPurgeIntervalKey, intervalStr)
+	if err == nil && interval == 0 {
+		interval = defaultTokenPurgeInterval
+	}
+	return
+}
+
+// No lower than the default, since that's what every existing key was made
+// with anyway
+func getPasswordCost(value string) (int, error) {
+	cost, err := getPositiveInt(passwordCostKey, value, 0)
+	if err == nil && value != "" && (cost < auth.DefaultPasswordCost || cost > maxPasswordCost) {
+		err = fmt.Errorf("%s must be between %d and %d", passwordCostKey, auth.DefaultPasswordCost, maxPasswordCost)
+		cost = 0
+	}
+	return cost, err
+}
+
+// No lower than the default, which is the least that's safe
+func getTokenLength(value string) (int, error) {
+	length, err := getPositiveInt(authTokenLengthKey, value, 0)
+	if err == nil && value != "" && (length < auth.DefaultTokenLength || length > maxTokenLength) {
+		err = fmt.Errorf("%s must be between %d and %d", authTokenLengthKey, auth.DefaultTokenLength, maxTokenLength)
+		length = 0
+	}
+	return length, err
+}
+
+// No higher than the default, which is already as high as clients can be
+// expected to handle
+func getMaxWalletSequence(value string) (wallet.Sequence, error) {
+	n, err := getPositiveInt(maxWalletSequenceKey, value, 0)
+	if err == nil && int64(n) > int64(wallet.DefaultMaxSequence) {
+		err = fmt.Errorf("%s must be at most %d", maxWalletSequenceKey, wallet.DefaultMaxSequence)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return wallet.Sequence(n), nil
+}
+
+func getListenAddress(hostStr string, portStr string) (host string, port int, err error) {
+	host = hostStr
+	if host == "" {
+		host = defaultListenHost
+	}
+	port, err = getPositiveInt(listenPortKey, portStr, defaultListenPort)
+	return
+}
+
+// Boolean flags are off unless explicitly set to "true"
+func getBoolFlag(key string, value string) (bool, error) {
+	if value != "true" && value != "false" && value != "" {
+		return false, fmt.Errorf("%s must be 'true' or 'false'", key)
+	}
+	return value == "true", nil
+}
+
+func getPositiveInt(key string, value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// The burst defaults to the limit, which lets the whole limit through at
+// once, same as a fixed window would
+func getRateLimit(limitKey string, limitValue string, windowKey string, windowValue string, burstKey string, burstValue string, defaultLimit int, defaultWindow time.Duration) (limit int, window time.Duration, burst int, err error) {
+	limit, err = getPositiveInt(limitKey, limitValue, defaultLimit)
+	if err != nil {
+		return
+	}
+	window, err = getPositiveDuration(windowKey, windowValue)
+	if err != nil {
+		return
+	}
+	if window == 0 {
+		window = defaultWindow
+	}
+	burst, err = getPositiveInt(burstKey, burstValue, limit)
+	return
+}
+
+// Comma separated IP addresses or CIDR ranges, such as
+// 10.0.0.1,192.168.0.0/16,::1
+func getIPNets(key string, value string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	if value == "" {
+		return nets, nil
+	}
+	for _, s := range strings.Split(value, ",") {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR range in %s: %q", key, s)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address in %s: %q. Addresses should be comma separated with no spaces.", key, s)
+		}
+		// Just the one address
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// In the format of time.ParseDuration, such as "24h" or "90m"
+func getPositiveDuration(key string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, such as 24h", key)
+	}
+	return d, nil
+}
+
 func getAccountVerificationMode(modeStr string) (AccountVerificationMode, error) {
 	mode := AccountVerificationMode(modeStr)
 	switch mode {
@@ -134,3 +637,148 @@ func getMailgunConfigs(sendingDomain string, serverDomain string, isDomainEUStr
 
 	return sendingDomain, serverDomain, isDomainEUStr == "true", privateAPIKey, nil
 }
+
+func getMailTransport(transportStr string) (MailTransport, error) {
+	transport := MailTransport(transportStr)
+	switch transport {
+	case MailTransportMailgun:
+	case MailTransportSMTP:
+	default:
+		return "", fmt.Errorf("Invalid mail transport in %s: %s", mailTransportKey, transport)
+	}
+	return transport, nil
+}
+
+func getSMTPConfigs(address string, username string, password string, sendingDomain string, serverDomain string, mode AccountVerificationMode) (string, string, string, string, string, error) {
+	if mode != AccountVerificationModeEmailVerify && (address != "" || username != "" || password != "" || sendingDomain != "" || serverDomain != "") {
+		return "", "", "", "", "", fmt.Errorf("Do not specify %s, %s, %s, %s or %s in env if %s is not %s",
+			smtpAddressKey,
+			smtpUsernameKey,
+			smtpPasswordKey,
+			smtpSendingDomainKey,
+			smtpServerDomainKey,
+			verificationModeKey,
+			AccountVerificationModeEmailVerify,
+		)
+	}
+	if mode == AccountVerificationModeEmailVerify && (address == "" || sendingDomain == "" || serverDomain == "") {
+		return "", "", "", "", "", fmt.Errorf("Specify %s, %s and %s in env if %s is %s and %s is %s",
+			smtpAddressKey,
+			smtpSendingDomainKey,
+			smtpServerDomainKey,
+			verificationModeKey,
+			AccountVerificationModeEmailVerify,
+			mailTransportKey,
+			MailTransportSMTP,
+		)
+	}
+	if (username == "") != (password == "") {
+		return "", "", "", "", "", fmt.Errorf("Specify both %s and %s in env, or neither", smtpUsernameKey, smtpPasswordKey)
+	}
+	if address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", "", "", "", fmt.Errorf("%s must be host:port", smtpAddressKey)
+		}
+	}
+	return address, username, password, sendingDomain, serverDomain, nil
+}
+
+func getWalletBlobStore(blobStoreStr string) (WalletBlobStore, error) {
+	blobStore := WalletBlobStore(blobStoreStr)
+	switch blobStore {
+	case WalletBlobStoreDatabase:
+	case WalletBlobStoreS3:
+	default:
+		return "", fmt.Errorf("Invalid wallet blob store in %s: %s", walletBlobStoreKey, blobStore)
+	}
+	return blobStore, nil
+}
+
+func getS3Configs(endpoint string, bucket string, region string, accessKeyId string, secretAccessKey string) (string, string, string, string, string, error) {
+	if endpoint == "" || bucket == "" || region == "" || accessKeyId == "" || secretAccessKey == "" {
+		return "", "", "", "", "", fmt.Errorf("Specify %s, %s, %s, %s and %s in env if %s is %s",
+			s3EndpointKey,
+			s3BucketKey,
+			s3RegionKey,
+			s3AccessKeyIdKey,
+			s3SecretAccessKeyKey,
+			walletBlobStoreKey,
+			WalletBlobStoreS3,
+		)
+	}
+	if !strings.HasPrefix(endpoint, "https://") && !strings.HasPrefix(endpoint, "http://") {
+		return "", "", "", "", "", fmt.Errorf("%s must start with https:// or http://", s3EndpointKey)
+	}
+	return endpoint, bucket, region, accessKeyId, secretAccessKey, nil
+}
+
+func getSelfTestAccount(emailStr string, passwordStr string) (auth.Email, auth.Password, error) {
+	if emailStr == "" && passwordStr == "" {
+		return "", "", nil
+	}
+	if emailStr == "" || passwordStr == "" {
+		return "", "", fmt.Errorf("Specify both %s and %s in env, or neither", selfTestEmailKey, selfTestPasswordKey)
+	}
+	email, password := auth.Email(emailStr), auth.Password(passwordStr)
+	if !email.Validate() {
+		return "", "", fmt.Errorf("Invalid email in %s: %s", selfTestEmailKey, email)
+	}
+	if !password.Validate() {
+		return "", "", fmt.Errorf("Invalid password in %s", selfTestPasswordKey)
+	}
+	return email, password, nil
+}
+
+func getAdminApi(enabledStr string, token string) (bool, string, error) {
+	enabled, err := getBoolFlag(adminApiKey, enabledStr)
+	if err != nil || !enabled {
+		return false, "", err
+	}
+	if len(token) < minAdminTokenLength {
+		return false, "", fmt.Errorf("%s must be at least %d characters when %s is on", adminTokenKey, minAdminTokenLength, adminApiKey)
+	}
+	return true, token, nil
+}
+
+func getCorsAllowedOrigins(originsStr string) ([]string, error) {
+	if originsStr == "" {
+		return []string{}, nil
+	}
+
+	origins := strings.Split(originsStr, ",")
+	for _, origin := range origins {
+		if strings.TrimSpace(origin) != origin {
+			return nil, fmt.Errorf("Origins in %s should be comma separated with no spaces.", corsAllowedOriginsKey)
+		}
+		// The browser sends the origin as scheme and host (and port), with no
+		// path, not even a slash. Anything else would never match.
+		scheme, host, _ := strings.Cut(origin, "://")
+		if (scheme != "https" && scheme != "http") || host == "" || strings.Contains(host, "/") {
+			return nil, fmt.Errorf("Invalid origin in %s: %s. It should look like https://example.com", corsAllowedOriginsKey, origin)
+		}
+	}
+	return origins, nil
+}
+
+func getWeakPasswordCheck(checkStr string, patternsStr string) (bool, []string, error) {
+	check, err := getBoolFlag(weakPasswordCheckKey, checkStr)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if patternsStr == "" {
+		return check, []string{}, nil
+	}
+
+	if !check {
+		return false, nil, fmt.Errorf("Do not specify %s in env if %s is not true", weakPasswordPatternsKey, weakPasswordCheckKey)
+	}
+
+	patterns := strings.Split(patternsStr, ",")
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return false, nil, fmt.Errorf("Empty pattern in %s", weakPasswordPatternsKey)
+		}
+	}
+	return check, patterns, nil
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func TestAccountVerificationMode(t *testing.T) {
@@ -212,3 +214,1120 @@ func TestMailgunConfigs(t *testing.T) {
 	}
 
 }
+
+func TestBoolFlag(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue bool
+		expectErr     bool
+	}{
+		{
+			name:          "true",
+			value:         "true",
+			expectedValue: true,
+		},
+		{
+			name:          "false",
+			value:         "false",
+			expectedValue: false,
+		},
+		{
+			name:          "blank",
+			value:         "",
+			expectedValue: false,
+		},
+		{
+			name:      "invalid",
+			value:     "yes",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getBoolFlag("MY_FLAG", tc.value)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestWeakPasswordCheck(t *testing.T) {
+	tt := []struct {
+		name string
+
+		checkStr    string
+		patternsStr string
+
+		expectedCheck    bool
+		expectedPatterns []string
+		expectErr        bool
+	}{
+		{
+			name:             "off",
+			expectedCheck:    false,
+			expectedPatterns: []string{},
+		},
+		{
+			name:             "on, no patterns",
+			checkStr:         "true",
+			expectedCheck:    true,
+			expectedPatterns: []string{},
+		},
+		{
+			name:             "on, with patterns",
+			checkStr:         "true",
+			patternsStr:      "lbry,odysee",
+			expectedCheck:    true,
+			expectedPatterns: []string{"lbry", "odysee"},
+		},
+		{
+			name:        "off, with patterns",
+			checkStr:    "false",
+			patternsStr: "lbry,odysee",
+			expectErr:   true,
+		},
+		{
+			name:        "on, with an empty pattern",
+			checkStr:    "true",
+			patternsStr: "lbry,,odysee",
+			expectErr:   true,
+		},
+		{
+			name:      "invalid check",
+			checkStr:  "yes",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			check, patterns, err := getWeakPasswordCheck(tc.checkStr, tc.patternsStr)
+			if check != tc.expectedCheck {
+				t.Errorf("Expected check %v got %v", tc.expectedCheck, check)
+			}
+			if !reflect.DeepEqual(patterns, tc.expectedPatterns) {
+				t.Errorf("Expected patterns %+v got %+v", tc.expectedPatterns, patterns)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestPositiveInt(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue int
+		expectErr     bool
+	}{
+		{
+			name:          "set",
+			value:         "5",
+			expectedValue: 5,
+		},
+		{
+			name:          "blank gets default",
+			value:         "",
+			expectedValue: 20,
+		},
+		{
+			name:      "zero",
+			value:     "0",
+			expectErr: true,
+		},
+		{
+			name:      "negative",
+			value:     "-1",
+			expectErr: true,
+		},
+		{
+			name:      "not a number",
+			value:     "lots",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getPositiveInt("MY_INT", tc.value, 20)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestPositiveDuration(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue time.Duration
+		expectErr     bool
+	}{
+		{
+			name:          "hours",
+			value:         "24h",
+			expectedValue: time.Hour * 24,
+		},
+		{
+			name:          "minutes",
+			value:         "90m",
+			expectedValue: time.Minute * 90,
+		},
+		{
+			name:          "blank",
+			value:         "",
+			expectedValue: 0,
+		},
+		{
+			name:      "zero",
+			value:     "0s",
+			expectErr: true,
+		},
+		{
+			name:      "negative",
+			value:     "-1h",
+			expectErr: true,
+		},
+		{
+			name:      "no unit",
+			value:     "24",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getPositiveDuration("MY_DURATION", tc.value)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestWalletBlobStore(t *testing.T) {
+	tt := []struct {
+		name string
+
+		blobStoreStr      string
+		expectedBlobStore WalletBlobStore
+		expectErr         bool
+	}{
+		{
+			name: "blank",
+
+			blobStoreStr:      "",
+			expectedBlobStore: WalletBlobStoreDatabase,
+		},
+		{
+			name: "s3",
+
+			blobStoreStr:      "s3",
+			expectedBlobStore: WalletBlobStoreS3,
+		},
+		{
+			name: "invalid",
+
+			blobStoreStr: "floppy",
+			expectErr:    true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			blobStore, err := getWalletBlobStore(tc.blobStoreStr)
+			if blobStore != tc.expectedBlobStore {
+				t.Errorf("Expected blob store %s got %s", tc.expectedBlobStore, blobStore)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestS3Configs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		endpoint        string
+		bucket          string
+		region          string
+		accessKeyId     string
+		secretAccessKey string
+		expectErr       bool
+	}{
+		{
+			name: "all set",
+
+			endpoint:        "https://s3.example.com",
+			bucket:          "wallets",
+			region:          "us-east-1",
+			accessKeyId:     "key-id",
+			secretAccessKey: "secret",
+		},
+		{
+			name: "missing secret",
+
+			endpoint:    "https://s3.example.com",
+			bucket:      "wallets",
+			region:      "us-east-1",
+			accessKeyId: "key-id",
+			expectErr:   true,
+		},
+		{
+			name: "endpoint without scheme",
+
+			endpoint:        "s3.example.com",
+			bucket:          "wallets",
+			region:          "us-east-1",
+			accessKeyId:     "key-id",
+			secretAccessKey: "secret",
+			expectErr:       true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, bucket, region, accessKeyId, secretAccessKey, err := getS3Configs(tc.endpoint, tc.bucket, tc.region, tc.accessKeyId, tc.secretAccessKey)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if endpoint != tc.endpoint || bucket != tc.bucket || region != tc.region || accessKeyId != tc.accessKeyId || secretAccessKey != tc.secretAccessKey {
+				t.Errorf("Unexpected configs: %s %s %s %s %s", endpoint, bucket, region, accessKeyId, secretAccessKey)
+			}
+		})
+	}
+}
+
+func TestMailTransport(t *testing.T) {
+	tt := []struct {
+		name string
+
+		transportStr      string
+		expectedTransport MailTransport
+		expectErr         bool
+	}{
+		{
+			name: "blank",
+
+			transportStr:      "",
+			expectedTransport: MailTransportMailgun,
+		},
+		{
+			name: "smtp",
+
+			transportStr:      "smtp",
+			expectedTransport: MailTransportSMTP,
+		},
+		{
+			name: "invalid",
+
+			transportStr: "pigeon",
+			expectErr:    true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			transport, err := getMailTransport(tc.transportStr)
+			if transport != tc.expectedTransport {
+				t.Errorf("Expected mail transport %s got %s", tc.expectedTransport, transport)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestSMTPConfigs(t *testing.T) {
+	tt := []struct {
+		name string
+
+		address       string
+		username      string
+		password      string
+		sendingDomain string
+		serverDomain  string
+		mode          AccountVerificationMode
+		expectErr     bool
+	}{
+		{
+			name: "all set",
+
+			address:       "smtp.example.com:587",
+			username:      "user",
+			password:      "pass",
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			mode:          AccountVerificationModeEmailVerify,
+		},
+		{
+			name: "no username or password",
+
+			address:       "localhost:25",
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			mode:          AccountVerificationModeEmailVerify,
+		},
+		{
+			name: "none set, not EmailVerify",
+
+			mode: AccountVerificationModeAllowAll,
+		},
+		{
+			name: "set, not EmailVerify",
+
+			address:       "smtp.example.com:587",
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			mode:          AccountVerificationModeWhitelist,
+			expectErr:     true,
+		},
+		{
+			name: "missing server domain",
+
+			address:       "smtp.example.com:587",
+			sendingDomain: "sending.example.com",
+			mode:          AccountVerificationModeEmailVerify,
+			expectErr:     true,
+		},
+		{
+			name: "username without password",
+
+			address:       "smtp.example.com:587",
+			username:      "user",
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			mode:          AccountVerificationModeEmailVerify,
+			expectErr:     true,
+		},
+		{
+			name: "address without port",
+
+			address:       "smtp.example.com",
+			sendingDomain: "sending.example.com",
+			serverDomain:  "server.example.com",
+			mode:          AccountVerificationModeEmailVerify,
+			expectErr:     true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			address, username, password, sendingDomain, serverDomain, err := getSMTPConfigs(tc.address, tc.username, tc.password, tc.sendingDomain, tc.serverDomain, tc.mode)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if address != tc.address || username != tc.username || password != tc.password || sendingDomain != tc.sendingDomain || serverDomain != tc.serverDomain {
+				t.Errorf("Expected the configs back as they were, got %s %s %s %s %s", address, username, password, sendingDomain, serverDomain)
+			}
+		})
+	}
+}
+
+func TestSelfTestAccount(t *testing.T) {
+	tt := []struct {
+		name string
+
+		email            string
+		password         string
+		expectedEmail    auth.Email
+		expectedPassword auth.Password
+		expectErr        bool
+	}{
+		{
+			name: "both blank",
+		},
+		{
+			name: "both set",
+
+			email:            "self-test@example.com",
+			password:         "12345678",
+			expectedEmail:    "self-test@example.com",
+			expectedPassword: "12345678",
+		},
+		{
+			name: "missing password",
+
+			email:     "self-test@example.com",
+			expectErr: true,
+		},
+		{
+			name: "missing email",
+
+			password:  "12345678",
+			expectErr: true,
+		},
+		{
+			name: "invalid email",
+
+			email:     "self-test",
+			password:  "12345678",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			email, password, err := getSelfTestAccount(tc.email, tc.password)
+			if email != tc.expectedEmail || password != tc.expectedPassword {
+				t.Errorf("Expected %s %s got %s %s", tc.expectedEmail, tc.expectedPassword, email, password)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestAdminApi(t *testing.T) {
+	token := "abcdefghijklmnopqrstuvwxyz012345"
+	tt := []struct {
+		name string
+
+		enabled         string
+		token           string
+		expectedEnabled bool
+		expectedToken   string
+		expectErr       bool
+	}{
+		{
+			name: "blank",
+		},
+		{
+			name: "off, with a token",
+
+			enabled: "false",
+			token:   token,
+		},
+		{
+			name: "on",
+
+			enabled:         "true",
+			token:           token,
+			expectedEnabled: true,
+			expectedToken:   token,
+		},
+		{
+			name: "on, missing token",
+
+			enabled:   "true",
+			expectErr: true,
+		},
+		{
+			name: "on, token too short",
+
+			enabled:   "true",
+			token:     token[1:],
+			expectErr: true,
+		},
+		{
+			name: "invalid flag",
+
+			enabled:   "yes",
+			token:     token,
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			enabled, token, err := getAdminApi(tc.enabled, tc.token)
+			if enabled != tc.expectedEnabled || token != tc.expectedToken {
+				t.Errorf("Expected %t %s got %t %s", tc.expectedEnabled, tc.expectedToken, enabled, token)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestTokenPurge(t *testing.T) {
+	tt := []struct {
+		name string
+
+		enabled          string
+		interval         string
+		expectedEnabled  bool
+		expectedInterval time.Duration
+		expectErr        bool
+	}{
+		{
+			name: "defaults",
+
+			expectedEnabled:  true,
+			expectedInterval: time.Hour,
+		},
+		{
+			name: "disabled",
+
+			enabled:          "false",
+			expectedEnabled:  false,
+			expectedInterval: time.Hour,
+		},
+		{
+			name: "custom interval",
+
+			enabled:          "true",
+			interval:         "10m",
+			expectedEnabled:  true,
+			expectedInterval: 10 * time.Minute,
+		},
+		{
+			name: "invalid flag",
+
+			enabled:   "yes",
+			expectErr: true,
+		},
+		{
+			name: "invalid interval",
+
+			interval:  "-10m",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			enabled, interval, err := getTokenPurge(tc.enabled, tc.interval)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if enabled != tc.expectedEnabled || interval != tc.expectedInterval {
+				t.Errorf("Expected %t %s got %t %s", tc.expectedEnabled, tc.expectedInterval, enabled, interval)
+			}
+		})
+	}
+}
+
+type mapEnv map[string]string
+
+func (e mapEnv) Getenv(key string) string {
+	return e[key]
+}
+
+func TestRateLimits(t *testing.T) {
+	tt := []struct {
+		name string
+		env  mapEnv
+
+		expectedAuthLimit    int
+		expectedAuthWindow   time.Duration
+		expectedAuthBurst    int
+		expectedSignupLimit  int
+		expectedSignupWindow time.Duration
+		expectedSignupBurst  int
+		expectErr            bool
+	}{
+		{
+			name: "defaults",
+
+			expectedAuthLimit:    5,
+			expectedAuthWindow:   time.Minute,
+			expectedAuthBurst:    5,
+			expectedSignupLimit:  5,
+			expectedSignupWindow: time.Minute,
+			expectedSignupBurst:  5,
+		},
+		{
+			name: "sign up goes by login if not set",
+			env:  mapEnv{"AUTH_RATE_LIMIT": "20", "AUTH_RATE_LIMIT_WINDOW": "10m"},
+
+			expectedAuthLimit:    20,
+			expectedAuthWindow:   10 * time.Minute,
+			expectedAuthBurst:    20,
+			expectedSignupLimit:  20,
+			expectedSignupWindow: 10 * time.Minute,
+			expectedSignupBurst:  20,
+		},
+		{
+			name: "separate",
+			env:  mapEnv{"AUTH_RATE_LIMIT": "20", "SIGNUP_RATE_LIMIT": "3", "SIGNUP_RATE_LIMIT_WINDOW": "1h"},
+
+			expectedAuthLimit:    20,
+			expectedAuthWindow:   time.Minute,
+			expectedAuthBurst:    20,
+			expectedSignupLimit:  3,
+			expectedSignupWindow: time.Hour,
+			expectedSignupBurst:  3,
+		},
+		{
+			name: "only the sign up window",
+			env:  mapEnv{"AUTH_RATE_LIMIT": "20", "SIGNUP_RATE_LIMIT_WINDOW": "1h"},
+
+			expectedAuthLimit:    20,
+			expectedAuthWindow:   time.Minute,
+			expectedAuthBurst:    20,
+			expectedSignupLimit:  20,
+			expectedSignupWindow: time.Hour,
+			expectedSignupBurst:  20,
+		},
+		{
+			name: "bursts",
+			env:  mapEnv{"AUTH_RATE_LIMIT": "20", "AUTH_RATE_LIMIT_BURST": "5", "SIGNUP_RATE_LIMIT_BURST": "2"},
+
+			expectedAuthLimit:    20,
+			expectedAuthWindow:   time.Minute,
+			expectedAuthBurst:    5,
+			expectedSignupLimit:  20,
+			expectedSignupWindow: time.Minute,
+			expectedSignupBurst:  2,
+		},
+		{
+			name: "sign up burst doesn't go by login",
+			env:  mapEnv{"AUTH_RATE_LIMIT_BURST": "2", "SIGNUP_RATE_LIMIT": "3"},
+
+			expectedAuthLimit:    5,
+			expectedAuthWindow:   time.Minute,
+			expectedAuthBurst:    2,
+			expectedSignupLimit:  3,
+			expectedSignupWindow: time.Minute,
+			expectedSignupBurst:  3,
+		},
+		{
+			name: "invalid sign up limit",
+			env:  mapEnv{"SIGNUP_RATE_LIMIT": "0"},
+
+			expectedAuthLimit:  5,
+			expectedAuthWindow: time.Minute,
+			expectedAuthBurst:  5,
+			expectErr:          true,
+		},
+		{
+			name: "invalid sign up window",
+			env:  mapEnv{"SIGNUP_RATE_LIMIT_WINDOW": "soon"},
+
+			expectedAuthLimit:  5,
+			expectedAuthWindow: time.Minute,
+			expectedAuthBurst:  5,
+			expectErr:          true,
+		},
+		{
+			name: "invalid sign up burst",
+			env:  mapEnv{"SIGNUP_RATE_LIMIT_BURST": "-1"},
+
+			expectedAuthLimit:  5,
+			expectedAuthWindow: time.Minute,
+			expectedAuthBurst:  5,
+			expectErr:          true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			authLimit, authWindow, authBurst, err := GetAuthRateLimit(tc.env)
+			if err != nil {
+				t.Fatalf("Unexpected err: %s", err.Error())
+			}
+			if authLimit != tc.expectedAuthLimit || authWindow != tc.expectedAuthWindow || authBurst != tc.expectedAuthBurst {
+				t.Errorf("Expected login limit %d per %s burst %d got %d per %s burst %d", tc.expectedAuthLimit, tc.expectedAuthWindow, tc.expectedAuthBurst, authLimit, authWindow, authBurst)
+			}
+
+			signupLimit, signupWindow, signupBurst, err := GetSignupRateLimit(tc.env)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if signupLimit != tc.expectedSignupLimit || signupWindow != tc.expectedSignupWindow || signupBurst != tc.expectedSignupBurst {
+				t.Errorf("Expected sign up limit %d per %s burst %d got %d per %s burst %d", tc.expectedSignupLimit, tc.expectedSignupWindow, tc.expectedSignupBurst, signupLimit, signupWindow, signupBurst)
+			}
+		})
+	}
+}
+
+func TestIPNets(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value        string
+		expectedNets []string
+		expectErr    bool
+	}{
+		{
+			name:         "empty",
+			expectedNets: []string{},
+		},
+		{
+			name:         "addresses",
+			value:        "10.0.0.1,::1",
+			expectedNets: []string{"10.0.0.1/32", "::1/128"},
+		},
+		{
+			name:         "ranges",
+			value:        "192.168.0.0/16,fd00::/8",
+			expectedNets: []string{"192.168.0.0/16", "fd00::/8"},
+		},
+		{
+			name:      "spaces",
+			value:     "10.0.0.1, 10.0.0.2",
+			expectErr: true,
+		},
+		{
+			name:      "hostname",
+			value:     "proxy.example.com",
+			expectErr: true,
+		},
+		{
+			name:      "bad range",
+			value:     "10.0.0.0/33",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			nets, err := getIPNets(trustedProxiesKey, tc.value)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected err: %s", err.Error())
+			}
+			netStrs := []string{}
+			for _, n := range nets {
+				netStrs = append(netStrs, n.String())
+			}
+			if !reflect.DeepEqual(netStrs, tc.expectedNets) {
+				t.Errorf("Expected %+v got %+v", tc.expectedNets, netStrs)
+			}
+		})
+	}
+}
+
+func TestPasswordCost(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue int
+		expectErr     bool
+	}{
+		{
+			name:          "blank gets the store's default",
+			value:         "",
+			expectedValue: 0,
+		},
+		{
+			name:          "default",
+			value:         "15",
+			expectedValue: 15,
+		},
+		{
+			name:          "highest",
+			value:         "20",
+			expectedValue: 20,
+		},
+		{
+			name:      "too low",
+			value:     "14",
+			expectErr: true,
+		},
+		{
+			name:      "too high",
+			value:     "21",
+			expectErr: true,
+		},
+		{
+			name:      "not a number",
+			value:     "lots",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getPasswordCost(tc.value)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestTokenLength(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue int
+		expectErr     bool
+	}{
+		{
+			name:          "blank gets the store's default",
+			value:         "",
+			expectedValue: 0,
+		},
+		{
+			name:          "default",
+			value:         "32",
+			expectedValue: 32,
+		},
+		{
+			name:          "highest",
+			value:         "128",
+			expectedValue: 128,
+		},
+		{
+			name:      "too low",
+			value:     "31",
+			expectErr: true,
+		},
+		{
+			name:      "too high",
+			value:     "129",
+			expectErr: true,
+		},
+		{
+			name:      "not a number",
+			value:     "lots",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getTokenLength(tc.value)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestMaxWalletSequence(t *testing.T) {
+	tt := []struct {
+		name string
+
+		value         string
+		expectedValue wallet.Sequence
+		expectErr     bool
+	}{
+		{
+			name:          "blank gets the store's default",
+			value:         "",
+			expectedValue: 0,
+		},
+		{
+			name:          "lower",
+			value:         "1000",
+			expectedValue: 1000,
+		},
+		{
+			name:          "highest",
+			value:         "2147483647",
+			expectedValue: wallet.DefaultMaxSequence,
+		},
+		{
+			name:      "too high",
+			value:     "2147483648",
+			expectErr: true,
+		},
+		{
+			name:      "zero",
+			value:     "0",
+			expectErr: true,
+		},
+		{
+			name:      "negative",
+			value:     "-1",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := getMaxWalletSequence(tc.value)
+			if value != tc.expectedValue {
+				t.Errorf("Expected value %v got %v", tc.expectedValue, value)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tt := []struct {
+		name string
+
+		host         string
+		port         string
+		expectedHost string
+		expectedPort int
+		expectErr    bool
+	}{
+		{
+			name: "defaults",
+
+			expectedHost: "localhost",
+			expectedPort: 8090,
+		},
+		{
+			name: "custom",
+
+			host:         "0.0.0.0",
+			port:         "443",
+			expectedHost: "0.0.0.0",
+			expectedPort: 443,
+		},
+		{
+			name: "invalid port",
+
+			port:      "http",
+			expectErr: true,
+		},
+		{
+			name: "negative port",
+
+			port:      "-1",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port, err := getListenAddress(tc.host, tc.port)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("Expected err")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+			if host != tc.expectedHost || port != tc.expectedPort {
+				t.Errorf("Expected %s %d got %s %d", tc.expectedHost, tc.expectedPort, host, port)
+			}
+		})
+	}
+}
+
+func TestCorsAllowedOrigins(t *testing.T) {
+	tt := []struct {
+		name string
+
+		origins         string
+		expectedOrigins []string
+		expectErr       bool
+	}{
+		{
+			name:            "empty",
+			expectedOrigins: []string{},
+		},
+		{
+			name:            "one",
+			origins:         "https://wallet.example.com",
+			expectedOrigins: []string{"https://wallet.example.com"},
+		},
+		{
+			name:            "several",
+			origins:         "https://wallet.example.com,http://localhost:3000",
+			expectedOrigins: []string{"https://wallet.example.com", "http://localhost:3000"},
+		},
+		{
+			name:      "spaces",
+			origins:   "https://wallet.example.com, http://localhost:3000",
+			expectErr: true,
+		},
+		{
+			name:      "no scheme",
+			origins:   "wallet.example.com",
+			expectErr: true,
+		},
+		{
+			name:      "trailing slash",
+			origins:   "https://wallet.example.com/",
+			expectErr: true,
+		},
+		{
+			name:      "no host",
+			origins:   "https://",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			origins, err := getCorsAllowedOrigins(tc.origins)
+			if !reflect.DeepEqual(origins, tc.expectedOrigins) && !tc.expectErr {
+				t.Errorf("Expected %+v got %+v", tc.expectedOrigins, origins)
+			}
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected err")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("Unexpected err: %s", err.Error())
+			}
+		})
+	}
+}
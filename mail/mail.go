@@ -2,7 +2,6 @@ package mail
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"time"
 
@@ -10,7 +9,6 @@ import (
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/env"
-	"lbryio/wallet-sync-server/server/paths"
 )
 
 const MAILGUN_DEBUG = false
@@ -20,8 +18,24 @@ const MAILGUN_DRY_RUN = false
 
 type MailInterface interface {
 	SendVerificationEmail(auth.Email, auth.VerifyTokenString) error
+	SendNewDeviceEmail(auth.Email, auth.DeviceId, auth.DeviceName) error
 }
 
+// For when email isn't set up (any ACCOUNT_VERIFICATION_MODE other than
+// EmailVerify). Nothing should be asking it to send anything then, but if
+// something does, it's quietly dropped.
+type NoMail struct{}
+
+func (m *NoMail) SendVerificationEmail(auth.Email, auth.VerifyTokenString) error {
+	return nil
+}
+
+func (m *NoMail) SendNewDeviceEmail(auth.Email, auth.DeviceId, auth.DeviceName) error {
+	return nil
+}
+
+// Sends with the Mailgun API (MAIL_TRANSPORT unset). See SMTP for the
+// alternative.
 type Mail struct {
 	Env env.EnvInterface
 }
@@ -37,6 +51,24 @@ func (m *Mail) prepareMessage(token auth.VerifyTokenString) (
 	html string,
 	err error,
 ) {
+	mg, sender, serverDomain, err := m.mailgun()
+	if err != nil {
+		return
+	}
+
+	subject, text, html = verificationMessage(serverDomain, token)
+
+	if MAILGUN_DEBUG {
+		log.Printf(
+			"NewMessage\n\n%s\n\n%s\n\n%s\n\n%s",
+			sender, subject, text, html,
+		)
+	}
+
+	return
+}
+
+func (m *Mail) mailgun() (mg *mailgun.MailgunImpl, sender string, serverDomain string, err error) {
 	verificationMode, err := env.GetAccountVerificationMode(m.Env)
 	if err != nil {
 		return
@@ -55,20 +87,7 @@ func (m *Mail) prepareMessage(token auth.VerifyTokenString) (
 		mg.SetAPIBase("https://api.eu.mailgun.net/v3")
 	}
 
-	sender = fmt.Sprintf("wallet-sync@%s", sendingDomain)
-	subject = fmt.Sprintf("Verify your wallet sync account on %s", serverDomain)
-	url := fmt.Sprintf("https://%s%s?verifyToken=%s", serverDomain, paths.PathVerify, token)
-
-	text = fmt.Sprintf("Click here to verify your account:\n\n%s", url)
-	html = fmt.Sprintf("Click here to verify your account:\n\n<a href=\"%s\">%s</a>", url, url)
-
-	if MAILGUN_DEBUG {
-		log.Printf(
-			"NewMessage\n\n%s\n\n%s\n\n%s\n\n%s",
-			sender, subject, text, html,
-		)
-	}
-
+	sender = senderAddress(sendingDomain)
 	return
 }
 
@@ -79,6 +98,20 @@ func (m *Mail) SendVerificationEmail(recipient auth.Email, token auth.VerifyToke
 		return err
 	}
 
+	return m.send(mg, sender, recipient, subject, text, html)
+}
+
+func (m *Mail) SendNewDeviceEmail(recipient auth.Email, deviceId auth.DeviceId, deviceName auth.DeviceName) (err error) {
+	mg, sender, serverDomain, err := m.mailgun()
+	if err != nil {
+		return
+	}
+
+	subject, text, html := newDeviceMessage(serverDomain, deviceId, deviceName)
+	return m.send(mg, sender, recipient, subject, text, html)
+}
+
+func (m *Mail) send(mg *mailgun.MailgunImpl, sender string, recipient auth.Email, subject string, text string, html string) (err error) {
 	message := mg.NewMessage(sender, subject, text, string(recipient))
 	message.SetHtml(html)
 
@@ -94,7 +127,7 @@ func (m *Mail) SendVerificationEmail(recipient auth.Email, token auth.VerifyToke
 		resp, id, err := mg.Send(ctx, message)
 
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		if MAILGUN_DEBUG {
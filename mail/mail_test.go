@@ -92,3 +92,18 @@ func TestPrepareEmailEU(t *testing.T) {
 		t.Errorf("Unexpected mg.APIBase(). Got: %s Want: %s", want, got)
 	}
 }
+
+// The device name comes from the client, so it gets escaped in the html
+func TestNewDeviceMessage(t *testing.T) {
+	subject, text, html := newDeviceMessage("server.example.com", "dev-1", "<b>My Phone</b>")
+
+	if !strings.Contains(subject, "server.example.com") || strings.Contains(subject, "My Phone") {
+		t.Errorf("Expected subject to contain the server domain and not the device name. Got: %s", subject)
+	}
+	if !strings.Contains(text, "<b>My Phone</b> (dev-1)") {
+		t.Errorf("Expected text to contain the device. Got: %s", text)
+	}
+	if !strings.Contains(html, "&lt;b&gt;My Phone&lt;/b&gt; (dev-1)") || strings.Contains(html, "<b>My Phone</b>") {
+		t.Errorf("Expected html to contain the escaped device. Got: %s", html)
+	}
+}
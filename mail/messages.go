@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"fmt"
+	"html"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+// What the emails say, whichever way they're sent
+
+func senderAddress(sendingDomain string) string {
+	return fmt.Sprintf("wallet-sync@%s", sendingDomain)
+}
+
+func verificationMessage(serverDomain string, token auth.VerifyTokenString) (subject string, text string, htmlText string) {
+	subject = fmt.Sprintf("Verify your wallet sync account on %s", serverDomain)
+	url := fmt.Sprintf("https://%s%s?verifyToken=%s", serverDomain, paths.PathVerify, token)
+
+	text = fmt.Sprintf("Click here to verify your account:\n\n%s", url)
+	htmlText = fmt.Sprintf("Click here to verify your account:\n\n<a href=\"%s\">%s</a>", url, url)
+	return
+}
+
+// The device name (and id) come from the client, so they only go in the body,
+// escaped.
+func newDeviceMessage(serverDomain string, deviceId auth.DeviceId, deviceName auth.DeviceName) (subject string, text string, htmlText string) {
+	subject = fmt.Sprintf("New device logged in to your wallet sync account on %s", serverDomain)
+
+	device := string(deviceId)
+	if deviceName != "" {
+		device = fmt.Sprintf("%s (%s)", deviceName, deviceId)
+	}
+	warning := "If this wasn't you, change your password right away. That logs out every device."
+
+	text = fmt.Sprintf("A new device logged in to your account:\n\n%s\n\n%s", device, warning)
+	htmlText = fmt.Sprintf("A new device logged in to your account:\n\n<b>%s</b>\n\n%s", html.EscapeString(device), warning)
+	return
+}
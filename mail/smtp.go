@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+)
+
+// Sends through an SMTP server (MAIL_TRANSPORT=smtp), for those who'd rather
+// not use Mailgun. Uses STARTTLS if the server offers it, and won't send the
+// username and password without it (unless the server is on localhost).
+type SMTP struct {
+	Env env.EnvInterface
+}
+
+func (m *SMTP) SendVerificationEmail(recipient auth.Email, token auth.VerifyTokenString) error {
+	return m.send(recipient, func(serverDomain string) (string, string, string) {
+		return verificationMessage(serverDomain, token)
+	})
+}
+
+func (m *SMTP) SendNewDeviceEmail(recipient auth.Email, deviceId auth.DeviceId, deviceName auth.DeviceName) error {
+	return m.send(recipient, func(serverDomain string) (string, string, string) {
+		return newDeviceMessage(serverDomain, deviceId, deviceName)
+	})
+}
+
+func (m *SMTP) send(recipient auth.Email, makeMessage func(serverDomain string) (subject string, text string, html string)) (err error) {
+	verificationMode, err := env.GetAccountVerificationMode(m.Env)
+	if err != nil {
+		return
+	}
+
+	address, username, password, sendingDomain, serverDomain, err := env.GetSMTPConfigs(m.Env, verificationMode)
+	if err != nil {
+		return
+	}
+
+	var smtpAuth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(address)
+		smtpAuth = smtp.PlainAuth("", username, password, host)
+	}
+
+	sender := senderAddress(sendingDomain)
+	subject, text, html := makeMessage(serverDomain)
+	message, err := smtpMessage(sender, recipient, subject, text, html, time.Now())
+	if err != nil {
+		return
+	}
+
+	return smtp.SendMail(address, smtpAuth, sender, []string{string(recipient)}, message)
+}
+
+// A multipart/alternative message with both the text and html versions, same
+// as what Mailgun sends. Nothing from the client goes in the headers other
+// than the recipient, which has been validated as an email address by now.
+func smtpMessage(sender string, recipient auth.Email, subject string, text string, html string, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{{"text/plain", text}, {"text/html", html}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType + "; charset=utf-8"}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", sender)
+	fmt.Fprintf(&message, "To: %s\r\n", recipient)
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n", parts.Boundary())
+	fmt.Fprintf(&message, "\r\n")
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
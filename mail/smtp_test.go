@@ -0,0 +1,131 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+type fakeSMTPMessage struct {
+	from string
+	to   string
+	data string
+}
+
+// Just enough of an SMTP server to take one message, without TLS or auth
+func fakeSMTPServer(t *testing.T) (address string, received chan fakeSMTPMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake SMTP server: %+v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received = make(chan fakeSMTPMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+
+		var message fakeSMTPMessage
+		c.PrintfLine("220 localhost")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO", "HELO":
+				c.PrintfLine("250 localhost")
+			case "MAIL":
+				message.from = line
+				c.PrintfLine("250 OK")
+			case "RCPT":
+				message.to = line
+				c.PrintfLine("250 OK")
+			case "DATA":
+				c.PrintfLine("354 Go ahead")
+				data, err := c.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				message.data = string(data)
+				c.PrintfLine("250 OK")
+				received <- message
+			case "QUIT":
+				c.PrintfLine("221 Bye")
+				return
+			default:
+				c.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSendVerificationEmail(t *testing.T) {
+	address, received := fakeSMTPServer(t)
+
+	env := map[string]string{
+		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
+		"MAIL_TRANSPORT":            "smtp",
+		"SMTP_ADDRESS":              address,
+		"SMTP_SENDING_DOMAIN":       "sending.example.com",
+		"SMTP_SERVER_DOMAIN":        "server.example.com",
+	}
+	m := SMTP{&TestEnv{env}}
+
+	if err := m.SendVerificationEmail("recipient@example.com", "abcd1234abcd1234abcd1234abcd1234"); err != nil {
+		t.Fatalf("Unexpected error sending: %+v", err)
+	}
+
+	message := <-received
+	if !strings.Contains(message.from, "<wallet-sync@sending.example.com>") {
+		t.Errorf("Unexpected sender: %s", message.from)
+	}
+	if !strings.Contains(message.to, "<recipient@example.com>") {
+		t.Errorf("Unexpected recipient: %s", message.to)
+	}
+	for _, expected := range []string{
+		"Subject: Verify your wallet sync account on server.example.com",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/plain",
+		"Content-Type: text/html",
+		"https://server.example.com" + paths.PathVerify + "?verifyToken=abcd1234abcd1234abcd1234abcd1234",
+	} {
+		if !strings.Contains(message.data, expected) {
+			t.Errorf("Expected message to contain %q. Got: %s", expected, message.data)
+		}
+	}
+}
+
+// Headers are separate from the body, and the parts are where they should be
+func TestSMTPMessage(t *testing.T) {
+	message, err := smtpMessage("wallet-sync@sending.example.com", auth.Email("recipient@example.com"), "My Subject", "my text", "<p>my html</p>", time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(string(message))))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Error reading headers: %+v", err)
+	}
+	if header.Get("From") != "wallet-sync@sending.example.com" || header.Get("To") != "recipient@example.com" || header.Get("Subject") != "My Subject" {
+		t.Errorf("Unexpected headers: %+v", header)
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "multipart/alternative; boundary=") {
+		t.Errorf("Unexpected Content-Type: %s", header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(message), "my text") || !strings.Contains(string(message), "<p>my html</p>") {
+		t.Errorf("Expected both parts in the message. Got: %s", string(message))
+	}
+}
@@ -1,21 +1,89 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blob"
 	"lbryio/wallet-sync-server/env"
 	"lbryio/wallet-sync-server/mail"
 	"lbryio/wallet-sync-server/server"
 	"lbryio/wallet-sync-server/store"
 )
 
-func storeInit() (s store.Store) {
+func storeInit(e *env.Env) (s store.Store) {
 	s = store.Store{}
 
+	flagSameWalletNewHmac, err := env.GetFlagSameWalletNewHmac(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	s.FlagSameWalletNewHmac = flagSameWalletNewHmac
+
+	s.WeakPasswordCheck, s.WeakPasswordPatterns, err = env.GetWeakPasswordCheck(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.PasswordMinLength, err = env.GetPasswordMinLength(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.PasswordCost, err = env.GetPasswordCost(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.RequireParentHmac, err = env.GetRequireParentHmac(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.TokenExpirationDuration, err = env.GetAuthTokenLifespan(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.LoginLockoutThreshold, s.LoginLockoutDuration, err = env.GetLoginLockout(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.DeletedEmailReservation, err = env.GetDeletedEmailReservation(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.MaxWalletSize, err = env.GetMaxWalletSize(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.MaxWalletSequence, err = env.GetMaxWalletSequence(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.HmacFormatCheck, err = env.GetHmacFormatCheck(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	s.BusyTimeout, s.WALMode, s.MaxOpenConns, err = env.GetSQLiteSettings(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	s.Init("sql.db")
 
-	err := s.Migrate()
+	err = s.Migrate()
 	if err != nil {
 		log.Fatalf("DB setup failure: %+v", err)
 	}
@@ -23,6 +91,39 @@ func storeInit() (s store.Store) {
 	return
 }
 
+// Optionally keep encrypted wallets in an object store rather than the
+// database. See store.BlobWalletStore.
+func blobWalletStore(e *env.Env, s *store.Store) (store.StoreInterface, string) {
+	walletBlobStore, err := env.GetWalletBlobStore(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if walletBlobStore != env.WalletBlobStoreS3 {
+		return s, "sqlite"
+	}
+
+	// just to report config errors to the user on startup
+	endpoint, bucket, _, _, _, err := env.GetS3Configs(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Storing wallets in bucket %s at %s", bucket, endpoint)
+
+	return &store.BlobWalletStore{StoreInterface: s, Blobs: &blob.S3{Env: e}}, "sqlite+s3"
+}
+
+// Optionally time every store operation. See store.InstrumentedStore.
+func instrumentStore(e *env.Env, s store.StoreInterface, backend string) store.StoreInterface {
+	storeMetrics, err := env.GetStoreMetrics(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if !storeMetrics {
+		return s
+	}
+	return &store.InstrumentedStore{Store: s, Backend: backend}
+}
+
 // Output information about the email verification mode so the user can confirm
 // what they set. Also trigger an error on startup if there's a configuration
 // problem.
@@ -37,10 +138,26 @@ func logEmailVerificationConfigs(e *env.Env) (err error) {
 	}
 
 	// just to report config errors to the user on startup
-	sendingDomain, serverDomain, _, _, err := env.GetMailgunConfigs(e, verificationMode)
+	mailTransport, err := env.GetMailTransport(e)
+	if err != nil {
+		return
+	}
+	var sendingDomain, serverDomain string
+	if mailTransport == env.MailTransportSMTP {
+		_, _, _, sendingDomain, serverDomain, err = env.GetSMTPConfigs(e, verificationMode)
+	} else {
+		sendingDomain, serverDomain, _, _, err = env.GetMailgunConfigs(e, verificationMode)
+	}
 	if err != nil {
 		return
 	}
+	newDeviceEmail, err := env.GetNewDeviceEmail(e)
+	if err != nil {
+		return
+	}
+	if newDeviceEmail && verificationMode != env.AccountVerificationModeEmailVerify {
+		return fmt.Errorf("NEW_DEVICE_EMAIL needs ACCOUNT_VERIFICATION_MODE to be EmailVerify, since that's where email gets set up")
+	}
 
 	if verificationMode == env.AccountVerificationModeWhitelist {
 		log.Printf("Account verification mode: %s - Whitelist has %d email(s).\n", verificationMode, len(accountWhitelist))
@@ -48,23 +165,147 @@ func logEmailVerificationConfigs(e *env.Env) (err error) {
 		log.Printf("Account verification mode: %s", verificationMode)
 	}
 	if verificationMode == env.AccountVerificationModeEmailVerify {
-		log.Printf("Mailgun domains: %s for sending addresses, %s for links in the email", sendingDomain, serverDomain)
+		if mailTransport == env.MailTransportSMTP {
+			log.Printf("Sending email over SMTP. Domains: %s for sending addresses, %s for links in the email", sendingDomain, serverDomain)
+		} else {
+			log.Printf("Mailgun domains: %s for sending addresses, %s for links in the email", sendingDomain, serverDomain)
+		}
+	}
+	if newDeviceEmail {
+		log.Printf("Emailing users when a new device logs in")
 	}
 	return
 }
 
+// Token generation settings (AUTH_TOKEN_LENGTH)
+func authInit(e *env.Env) *auth.Auth {
+	tokenLength, err := env.GetAuthTokenLength(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return &auth.Auth{TokenLength: tokenLength}
+}
+
+// Mailgun unless MAIL_TRANSPORT says otherwise, and nothing at all if email
+// isn't set up. Assumes logEmailVerificationConfigs already checked the
+// configs.
+func mailInit(e *env.Env) mail.MailInterface {
+	verificationMode, _ := env.GetAccountVerificationMode(e)
+	if verificationMode != env.AccountVerificationModeEmailVerify {
+		return &mail.NoMail{}
+	}
+	if mailTransport, _ := env.GetMailTransport(e); mailTransport == env.MailTransportSMTP {
+		return &mail.SMTP{Env: e}
+	}
+	return &mail.Mail{Env: e}
+}
+
+// Where and how to listen. Bad settings stop us here, before anything starts.
+func serverConfig(e *env.Env) (config server.Config) {
+	var err error
+	config.Host, config.Port, err = env.GetListenAddress(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	config.TLSCertFile, config.TLSKeyFile = env.GetTLSFiles(e)
+
+	config.ReadHeaderTimeout, config.ReadTimeout, config.WriteTimeout, config.IdleTimeout, err = env.GetHttpTimeouts(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	config.TrustedProxies, err = env.GetTrustedProxies(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	config.RateLimitExempt, err = env.GetRateLimitExempt(e)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	return
+}
+
+// Give space freed up by deleted rows back to the OS, and report how much.
+func reclaim(s *store.Store) {
+	log.Printf("Reclaiming space. The database will be locked until this finishes.")
+	sizeBefore, sizeAfter, err := s.Reclaim()
+	if err != nil {
+		log.Fatalf("Error reclaiming space: %+v", err)
+	}
+	log.Printf("Database size before: %d bytes, after: %d bytes, freed: %d bytes", sizeBefore, sizeAfter, sizeBefore-sizeAfter)
+}
+
+// Report tokens, wallets and highest wallet sequences left without an account,
+// optionally deleting them.
+func findOrphans(s *store.Store, clean bool) {
+	counts, err := s.FindOrphans(clean)
+	if err != nil {
+		log.Fatalf("Error finding orphaned rows: %+v", err)
+	}
+	if clean {
+		log.Printf("Deleted orphaned rows. Tokens: %d, wallets: %d, highest wallet sequences: %d", counts.Tokens, counts.Wallets, counts.HighestSequences)
+	} else {
+		log.Printf("Found orphaned rows (not deleted). Tokens: %d, wallets: %d, highest wallet sequences: %d", counts.Tokens, counts.Wallets, counts.HighestSequences)
+	}
+}
+
+// Delete expired tokens once, for when the server is run with TOKEN_PURGE=false
+func purgeExpiredTokens(s *store.Store) {
+	numDeleted, err := s.PurgeExpiredTokens(context.Background())
+	if err != nil {
+		log.Fatalf("Error purging expired tokens: %+v", err)
+	}
+	log.Printf("Purged %d expired tokens", numDeleted)
+}
+
 func main() {
+	reclaimFlag := flag.Bool("reclaim", false, "Reclaim space freed by deleted rows (VACUUM) and exit. Locks the database while it runs, so preferably stop the server first.")
+	findOrphansFlag := flag.Bool("find-orphans", false, "Report tokens, wallets and highest wallet sequences that have no account, and exit. Read only unless -clean-orphans is also given.")
+	cleanOrphansFlag := flag.Bool("clean-orphans", false, "With -find-orphans, also delete what's found.")
+	purgeExpiredTokensFlag := flag.Bool("purge-expired-tokens", false, "Delete expired tokens and exit. The server does this on its own unless TOKEN_PURGE is false.")
+	flag.Parse()
+
 	e := env.Env{}
 
 	if err := logEmailVerificationConfigs(&e); err != nil {
 		log.Fatal(err.Error())
 	}
 
-	store := storeInit()
+	store := storeInit(&e)
+
+	if *reclaimFlag {
+		reclaim(&store)
+		return
+	}
+
+	if *purgeExpiredTokensFlag {
+		purgeExpiredTokens(&store)
+		return
+	}
+
+	if *cleanOrphansFlag && !*findOrphansFlag {
+		log.Fatal("-clean-orphans only works along with -find-orphans")
+	}
+	if *findOrphansFlag {
+		findOrphans(&store, *cleanOrphansFlag)
+		return
+	}
 
-	// The port that the sync server serves from.
-	internalPort := 8090
+	srvStore, backend := blobWalletStore(&e, &store)
+	srv := server.Init(authInit(&e), instrumentStore(&e, srvStore, backend), &e, mailInit(&e), serverConfig(&e))
 
-	srv := server.Init(&auth.Auth{}, &store, &e, &mail.Mail{&e}, internalPort)
-	srv.Serve()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv.Serve(ctx)
+
+	// The server is done, so nothing is writing anymore
+	if err := store.Close(); err != nil {
+		log.Printf("Error closing the database: %+v", err)
+	}
 }
@@ -22,9 +22,58 @@ var (
 		},
 		[]string{"error_type"},
 	)
+	WebsocketConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_websocket_connections",
+			Help: "Number of currently open websocket connections",
+		},
+	)
+	StoreOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wallet_sync_store_operation_duration_seconds",
+			Help:    "How long store operations take",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation", "backend", "result"},
+	)
+	StoreWalletSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wallet_sync_store_wallet_size_bytes",
+			Help:    "Size of encrypted wallets read from or written to the store",
+			Buckets: prometheus.ExponentialBuckets(1024, 2, 10), // 1KB to 512KB
+		},
+		[]string{"operation", "backend"},
+	)
+	HttpResponsesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "wallet_sync_http_responses_count",
+			Help: "Total number of responses by path and status code",
+		},
+		[]string{"path", "code"},
+	)
+	HttpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "wallet_sync_http_request_duration_seconds",
+			Help:    "How long requests take, by path",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+	SelfTestHealthy = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "wallet_sync_self_test_healthy",
+			Help: "1 if the last self test round trip passed, 0 if it failed",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(RequestsCount)
 	prometheus.MustRegister(ErrorsCount)
+	prometheus.MustRegister(WebsocketConnections)
+	prometheus.MustRegister(StoreOperationDuration)
+	prometheus.MustRegister(StoreWalletSize)
+	prometheus.MustRegister(HttpResponsesCount)
+	prometheus.MustRegister(HttpRequestDuration)
+	prometheus.MustRegister(SelfTestHealthy)
 }
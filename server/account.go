@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/store"
 )
 
@@ -37,7 +41,7 @@ func (r *RegisterRequest) validate() error {
 
 func (s *Server) register(w http.ResponseWriter, req *http.Request) {
 	var registerRequest RegisterRequest
-	if !getPostData(w, req, &registerRequest) {
+	if !getPostData(w, req, &registerRequest, maxSmallBodySize) {
 		return
 	}
 
@@ -88,6 +92,7 @@ modes:
 	}
 
 	err = s.store.CreateAccount(
+		req.Context(),
 		registerRequest.Email,
 		registerRequest.Password,
 		registerRequest.ClientSaltSeed,
@@ -95,11 +100,7 @@ modes:
 	)
 
 	if err != nil {
-		if err == store.ErrDuplicateEmail || err == store.ErrDuplicateAccount {
-			errorJson(w, http.StatusConflict, "Error registering")
-		} else {
-			internalServiceErrorJson(w, err, "Error registering")
-		}
+		s.storeErrorJson(w, err, "Error registering")
 		return
 	}
 
@@ -164,7 +165,7 @@ func (s *Server) resendVerifyEmail(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var resendVerifyEmailRequest ResendVerifyEmailRequest
-	if !getPostData(w, req, &resendVerifyEmailRequest) {
+	if !getPostData(w, req, &resendVerifyEmailRequest, maxSmallBodySize) {
 		return
 	}
 
@@ -175,9 +176,10 @@ func (s *Server) resendVerifyEmail(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = s.store.UpdateVerifyTokenString(resendVerifyEmailRequest.Email, token)
+	err = s.store.UpdateVerifyTokenString(req.Context(), resendVerifyEmailRequest.Email, token)
 	if err == store.ErrWrongCredentials {
-		errorJson(w, http.StatusUnauthorized, "No match for email")
+		// There's no password here to not match
+		errorCodeJson(w, http.StatusUnauthorized, ErrorCodeWrongCredentials, "No match for email")
 		return
 	}
 	if err != nil {
@@ -217,7 +219,7 @@ func (s *Server) verify(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err := s.store.VerifyAccount(token)
+	err := s.store.VerifyAccount(req.Context(), token)
 
 	if err == store.ErrNoTokenForUser {
 		http.Error(w, "The verification token was not found, already used, or expired. If you want to try again, generate a new one from your app.", http.StatusForbidden)
@@ -234,3 +236,134 @@ func (s *Server) verify(w http.ResponseWriter, req *http.Request) {
 	// we can put in the effort then to fetch it
 	log.Printf("User has been verified with token %s", token)
 }
+
+// Checking whether an email is taken inherently tells whoever's asking whether
+// it has an account. So it's opt-in (EMAIL_AVAILABILITY_CHECK), and it's rate
+// limited so that it can't be used to go through a big list of addresses.
+const (
+	emailAvailabilityRateLimit       = 10
+	emailAvailabilityRateLimitWindow = time.Minute
+)
+
+type EmailAvailabilityResponse struct {
+	Available bool `json:"available"`
+}
+
+func (s *Server) getEmailAvailability(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	enabled, err := env.GetEmailAvailabilityCheck(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting email availability check setting")
+		return
+	}
+	if !enabled {
+		errorJson(w, http.StatusNotFound, "Email availability check is not enabled on this server")
+		return
+	}
+
+	if s.rateLimited(w, req, s.emailAvailabilityLimiter, "Too many email availability checks") {
+		return
+	}
+
+	email, paramsErr := getEmailParam(req)
+
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	exists, err := s.store.EmailExists(req.Context(), email)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error checking email availability")
+		return
+	}
+
+	response, err := json.Marshal(EmailAvailabilityResponse{Available: !exists})
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating email availability response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// The password is asked for again, rather than taking a token, so that a
+// leaked token (or an unattended logged in device) isn't enough to delete the
+// account.
+// Totp is required if the account has two-factor authentication enabled
+type DeleteAccountRequest struct {
+	Email    auth.Email    `json:"email"`
+	Password auth.Password `json:"password"`
+	Totp     auth.TotpCode `json:"totp,omitempty"`
+}
+
+func (r *DeleteAccountRequest) validate() error {
+	if !r.Email.Validate() {
+		return fmt.Errorf("Invalid or missing 'email'")
+	}
+	if !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	if r.Totp != "" && !r.Totp.Validate() {
+		return fmt.Errorf("Invalid 'totp'")
+	}
+	return nil
+}
+
+// Delete the account, its wallet, and all of its tokens, logging out every
+// device. Responds with a 204 and no body.
+func (s *Server) deleteAccount(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req, maxSmallBodySize)
+	if !ok {
+		return
+	}
+
+	var deleteAccountRequest DeleteAccountRequest
+	if !getPostData(w, req, &deleteAccountRequest, maxSmallBodySize) {
+		return
+	}
+
+	if !s.checkRequestSignature(w, req, body, deleteAccountRequest.Email) {
+		return
+	}
+
+	userId, err := s.store.GetUserId(req.Context(), deleteAccountRequest.Email, deleteAccountRequest.Password)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error getting User Id")
+		return
+	}
+
+	if !s.checkTotp(w, req, userId, deleteAccountRequest.Totp) {
+		return
+	}
+
+	err = s.store.DeleteAccount(req.Context(), userId)
+	if err != nil {
+		// ErrWrongCredentials if it was deleted (by another request, say) between
+		// GetUserId and here
+		s.storeErrorJson(w, err, "Error deleting account")
+		return
+	}
+
+	// The tokens are gone. Wake up any long polls so they find out, and close
+	// any websockets.
+	s.walletWatchers.notify(userId)
+	timeout := time.NewTimer(100 * time.Millisecond)
+	select {
+	case s.userRemove <- wsClientForUser{userId, nil}:
+	case <-timeout.C:
+		// The account is deleted either way. The sockets can't do anything
+		// without a token.
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-user-remove"}).Inc()
+	}
+	timeout.Stop()
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("User %s has deleted their account", deleteAccountRequest.Email)
+}
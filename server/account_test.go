@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"testing"
 
+	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/server/paths"
 	"lbryio/wallet-sync-server/store"
 )
@@ -22,7 +24,7 @@ func TestServerRegisterSuccess(t *testing.T) {
 	}
 	testMail := TestMail{}
 	testAuth := TestAuth{TestNewVerifyTokenString: "abcd1234abcd1234abcd1234abcd1234"}
-	s := Init(&testAuth, testStore, &TestEnv{env}, &testMail, TestPort)
+	s := Init(&testAuth, testStore, &TestEnv{env}, &testMail, TestConfig)
 
 	requestBody := []byte(`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234" }`)
 
@@ -81,12 +83,62 @@ func TestServerRegisterErrors(t *testing.T) {
 			name:                              "existing account",
 			email:                             "abc@example.com",
 			expectedStatusCode:                http.StatusConflict,
-			expectedErrorString:               http.StatusText(http.StatusConflict) + ": Error registering",
+			expectedErrorString:               http.StatusText(http.StatusConflict) + ": An account with this email address already exists",
 			expectedCallSendVerificationEmail: false,
 			expectedCallCreateAccount:         true,
 
 			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrDuplicateEmail},
 		},
+		{
+			name:                              "existing account, duplicate account error",
+			email:                             "abc@example.com",
+			expectedStatusCode:                http.StatusConflict,
+			expectedErrorString:               http.StatusText(http.StatusConflict) + ": An account with this email address already exists",
+			expectedCallSendVerificationEmail: false,
+			expectedCallCreateAccount:         true,
+
+			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrDuplicateAccount},
+		},
+		{
+			name:                              "recently deleted account",
+			email:                             "abc@example.com",
+			expectedStatusCode:                http.StatusConflict,
+			expectedErrorString:               http.StatusText(http.StatusConflict) + ": The account with this email address was deleted recently. Try again later.",
+			expectedCallSendVerificationEmail: false,
+			expectedCallCreateAccount:         true,
+
+			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrEmailReserved},
+		},
+		{
+			name:                              "invalid email caught by the store",
+			email:                             "abc@example.com",
+			expectedStatusCode:                http.StatusBadRequest,
+			expectedErrorString:               http.StatusText(http.StatusBadRequest) + ": Invalid 'email'",
+			expectedCallSendVerificationEmail: false,
+			expectedCallCreateAccount:         true,
+
+			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrInvalidEmail},
+		},
+		{
+			name:                              "weak password",
+			email:                             "abc@example.com",
+			expectedStatusCode:                http.StatusBadRequest,
+			expectedErrorString:               http.StatusText(http.StatusBadRequest) + ": Password is too easy to guess",
+			expectedCallSendVerificationEmail: false,
+			expectedCallCreateAccount:         true,
+
+			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrWeakPassword},
+		},
+		{
+			name:                              "password too short",
+			email:                             "abc@example.com",
+			expectedStatusCode:                http.StatusBadRequest,
+			expectedErrorString:               http.StatusText(http.StatusBadRequest) + ": Password is too short",
+			expectedCallSendVerificationEmail: false,
+			expectedCallCreateAccount:         true,
+
+			storeErrors: TestStoreFunctionsErrors{CreateAccount: store.ErrPasswordTooShort},
+		},
 		{
 			name:                              "unspecified account creation failure",
 			email:                             "abc@example.com",
@@ -129,7 +181,7 @@ func TestServerRegisterErrors(t *testing.T) {
 			testAuth := TestAuth{TestNewVerifyTokenString: "abcd1234abcd1234abcd1234abcd1234", FailGenToken: tc.failGenToken}
 			testMail := TestMail{SendVerificationEmailError: tc.mailError}
 			testStore := TestStore{Errors: tc.storeErrors}
-			s := Init(&testAuth, &testStore, &TestEnv{env}, &testMail, TestPort)
+			s := Init(&testAuth, &testStore, &TestEnv{env}, &testMail, TestConfig)
 
 			// Make request
 			requestBody := fmt.Sprintf(`{"email": "%s", "password": "12345678", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"}`, tc.email)
@@ -227,7 +279,7 @@ func TestServerRegisterAccountVerification(t *testing.T) {
 			testStore := &TestStore{}
 			testAuth := TestAuth{TestNewVerifyTokenString: "abcd1234abcd1234abcd1234abcd1234"}
 			testMail := TestMail{}
-			s := Init(&testAuth, testStore, &TestEnv{tc.env}, &testMail, TestPort)
+			s := Init(&testAuth, testStore, &TestEnv{tc.env}, &testMail, TestConfig)
 
 			requestBody := []byte(`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234" }`)
 
@@ -332,7 +384,7 @@ func TestServerResendVerifyEmailSuccess(t *testing.T) {
 	env := map[string]string{
 		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
 	}
-	s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestPort)
+	s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestConfig)
 
 	requestBody := []byte(`{"email": "abc@example.com"}`)
 	req := httptest.NewRequest(http.MethodPost, paths.PathVerify, bytes.NewBuffer(requestBody))
@@ -429,7 +481,7 @@ func TestServerResendVerifyEmailErrors(t *testing.T) {
 			// Set this up to fail according to specification
 			testStore := TestStore{Errors: tc.storeErrors}
 			testMail := TestMail{SendVerificationEmailError: tc.mailError}
-			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestPort)
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &testMail, TestConfig)
 
 			// Make request
 			var requestBody []byte
@@ -468,7 +520,7 @@ func TestServerResendVerifyEmailErrors(t *testing.T) {
 
 func TestServerVerifyAccountSuccess(t *testing.T) {
 	testStore := TestStore{}
-	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 
 	req := httptest.NewRequest(http.MethodGet, paths.PathVerify, nil)
 	q := req.URL.Query()
@@ -529,7 +581,7 @@ func TestServerVerifyAccountErrors(t *testing.T) {
 
 			// Set this up to fail according to specification
 			testStore := TestStore{Errors: tc.storeErrors}
-			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 
 			// Make request
 			req := httptest.NewRequest(http.MethodGet, paths.PathVerify, nil)
@@ -555,3 +607,204 @@ func TestServerVerifyAccountErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestServerGetEmailAvailability(t *testing.T) {
+	tt := []struct {
+		name          string
+		enabled       bool
+		emailGetParam string
+		emailExists   bool
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedAvailable   bool
+		expectedEmailCall   auth.Email
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "available",
+			enabled:            true,
+			emailGetParam:      base64.StdEncoding.EncodeToString([]byte("new@example.com")),
+			expectedStatusCode: http.StatusOK,
+			expectedAvailable:  true,
+			expectedEmailCall:  "new@example.com",
+		}, {
+			name:               "taken",
+			enabled:            true,
+			emailGetParam:      base64.StdEncoding.EncodeToString([]byte("taken@example.com")),
+			emailExists:        true,
+			expectedStatusCode: http.StatusOK,
+			expectedAvailable:  false,
+			expectedEmailCall:  "taken@example.com",
+		}, {
+			name:                "disabled",
+			enabled:             false,
+			emailGetParam:       base64.StdEncoding.EncodeToString([]byte("new@example.com")),
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Email availability check is not enabled on this server",
+		}, {
+			name:                "invalid email",
+			enabled:             true,
+			emailGetParam:       base64.StdEncoding.EncodeToString([]byte("bad-example.com")),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid email",
+		}, {
+			name:                "db error",
+			enabled:             true,
+			emailGetParam:       base64.StdEncoding.EncodeToString([]byte("new@example.com")),
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedEmailCall:   "new@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{EmailExists: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestEmailExists: tc.emailExists, Errors: tc.storeErrors}
+			testEnv := TestEnv{env: map[string]string{"EMAIL_AVAILABILITY_CHECK": fmt.Sprintf("%t", tc.enabled)}}
+			s := Init(&TestAuth{}, &testStore, &testEnv, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathEmailAvailable, nil)
+			q := req.URL.Query()
+			q.Add("email", tc.emailGetParam)
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			s.getEmailAvailability(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.EmailExists != tc.expectedEmailCall {
+				t.Errorf("Expected Store.EmailExists to be called with %s got %s", tc.expectedEmailCall, testStore.Called.EmailExists)
+			}
+
+			if tc.expectedErrorString != "" {
+				return // The rest of the test does not apply
+			}
+
+			var result EmailAvailabilityResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Available != tc.expectedAvailable {
+				t.Errorf("Expected available to be %t: result: %+v err: %+v", tc.expectedAvailable, string(body), err)
+			}
+		})
+	}
+}
+
+func TestServerGetEmailAvailabilityRateLimit(t *testing.T) {
+	testStore := TestStore{}
+	testEnv := TestEnv{env: map[string]string{"EMAIL_AVAILABILITY_CHECK": "true"}}
+	s := Init(&TestAuth{}, &testStore, &testEnv, &TestMail{}, TestConfig)
+
+	getEmailAvailability := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, paths.PathEmailAvailable, nil)
+		req.RemoteAddr = remoteAddr
+		q := req.URL.Query()
+		q.Add("email", base64.StdEncoding.EncodeToString([]byte("new@example.com")))
+		req.URL.RawQuery = q.Encode()
+		w := httptest.NewRecorder()
+		s.getEmailAvailability(w, req)
+		return w
+	}
+
+	for i := 0; i < emailAvailabilityRateLimit; i++ {
+		expectStatusCode(t, getEmailAvailability("192.0.2.1:1234"), http.StatusOK)
+	}
+
+	// One too many from the same IP, even from a different port
+	w := getEmailAvailability("192.0.2.1:5678")
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusTooManyRequests)
+	expectErrorString(t, body, http.StatusText(http.StatusTooManyRequests)+": Too many email availability checks")
+	if w.Result().Header.Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	// Other IPs are unaffected
+	expectStatusCode(t, getEmailAvailability("192.0.2.2:1234"), http.StatusOK)
+}
+
+func TestServerDeleteAccount(t *testing.T) {
+	tt := []struct {
+		name         string
+		requestBody  string
+		expectDelete bool
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"email": "abc@example.com", "password": "12345678"}`,
+			expectDelete:       true,
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:                "validation error",
+			requestBody:         `{"email": "abc@example.com"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'password'",
+		},
+		{
+			name:                "wrong password",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for email and/or password",
+
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrWrongCredentials},
+		},
+		{
+			name:                "unverified account",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Account is not verified",
+
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrNotVerified},
+		},
+		{
+			name:                "account went away in the meantime",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			expectDelete:        true,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for email and/or password",
+
+			storeErrors: TestStoreFunctionsErrors{DeleteAccount: store.ErrWrongCredentials},
+		},
+		{
+			name:                "db error deleting",
+			requestBody:         `{"email": "abc@example.com", "password": "12345678"}`,
+			expectDelete:        true,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{DeleteAccount: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestUserId: auth.UserId(37), Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAccountDelete, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.deleteAccount(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectDelete && testStore.Called.DeleteAccount != testStore.TestUserId {
+				t.Errorf("Expected Store.DeleteAccount to be called with %d, got %d", testStore.TestUserId, testStore.Called.DeleteAccount)
+			}
+			if !tc.expectDelete && testStore.Called.DeleteAccount != 0 {
+				t.Errorf("Expected Store.DeleteAccount not to be called")
+			}
+		})
+	}
+}
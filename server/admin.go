@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Endpoints for operators, such as for looking into a support request. Off
+// unless ADMIN_API is on. Even then they take ADMIN_TOKEN, not a user's
+// token; that's the only thing checked, so checkAuth has no part in it.
+
+type AdminAccountResponse struct {
+	UserId    auth.UserId     `json:"userId"`
+	Verified  bool            `json:"verified"`
+	Locked    bool            `json:"locked"`
+	HasWallet bool            `json:"hasWallet"`
+	Sequence  wallet.Sequence `json:"sequence"`
+}
+
+// Whether the request can go ahead. If not, the response has been written.
+func (s *Server) checkAdminAuth(w http.ResponseWriter, req *http.Request) bool {
+	enabled, adminToken, err := env.GetAdminApi(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting admin API setting")
+		return false
+	}
+	if !enabled {
+		errorJson(w, http.StatusNotFound, "Admin API is not enabled on this server")
+		return false
+	}
+
+	token, err := getBearerToken(req)
+	if err != nil {
+		unauthorizedJson(w, ErrorCodeInvalidToken, "invalid_request", err.Error())
+		return false
+	}
+	if token == "" {
+		unauthorizedJson(w, ErrorCodeMissingToken, "", "Missing admin token")
+		return false
+	}
+	// So that how long it takes doesn't say how much of it was right
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("Security: admin request with the wrong token from %s", s.clientIP(req))
+		unauthorizedJson(w, ErrorCodeInvalidToken, "invalid_token", "Invalid admin token")
+		return false
+	}
+	return true
+}
+
+// Takes `email` (base64 encoded, same as everywhere else), and `appId` if
+// it's not the default app's wallet that's wanted. Never gives out anything
+// secret: no password hash, no tokens, no wallet.
+func (s *Server) getAdminAccount(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	if !s.checkAdminAuth(w, req) {
+		return
+	}
+
+	email, paramsErr := getEmailParam(req)
+	var appId wallet.AppId
+	if paramsErr == nil {
+		appId, paramsErr = getAppIdParam(req)
+	}
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	status, err := s.store.GetAccountStatus(req.Context(), email, appId)
+	if err == store.ErrWrongCredentials {
+		errorJson(w, http.StatusNotFound, "No account with this email")
+		return
+	}
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting account status")
+		return
+	}
+
+	log.Printf("Admin looked up the account status of user id %d", status.UserId)
+
+	response, err := json.Marshal(AdminAccountResponse{
+		UserId:    status.UserId,
+		Verified:  status.Verified,
+		Locked:    status.Locked,
+		HasWallet: status.HasWallet,
+		Sequence:  status.Sequence,
+	})
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating admin account response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+const testAdminToken = "abcdefghijklmnopqrstuvwxyz012345"
+
+func TestServerGetAdminAccount(t *testing.T) {
+	tt := []struct {
+		name          string
+		enabled       bool
+		authorization string
+		email         string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedErrorCode   ErrorCode
+		expectedStatusCall  auth.Email
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "present",
+			enabled:            true,
+			authorization:      "Bearer " + testAdminToken,
+			email:              "abc@example.com",
+			expectedStatusCode: http.StatusOK,
+			expectedStatusCall: "abc@example.com",
+		},
+		{
+			name:                "absent",
+			enabled:             true,
+			authorization:       "Bearer " + testAdminToken,
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No account with this email",
+			expectedStatusCall:  "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{GetAccountStatus: store.ErrWrongCredentials},
+		},
+		{
+			name:                "disabled",
+			enabled:             false,
+			authorization:       "Bearer " + testAdminToken,
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Admin API is not enabled on this server",
+		},
+		{
+			name:                "bad admin token",
+			enabled:             true,
+			authorization:       "Bearer " + testAdminToken + "x",
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid admin token",
+			expectedErrorCode:   ErrorCodeInvalidToken,
+		},
+		{
+			name:                "missing admin token",
+			enabled:             true,
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing admin token",
+			expectedErrorCode:   ErrorCodeMissingToken,
+		},
+		{
+			name:                "invalid email",
+			enabled:             true,
+			authorization:       "Bearer " + testAdminToken,
+			email:               "bad-example.com",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid email",
+		},
+		{
+			name:                "db error",
+			enabled:             true,
+			authorization:       "Bearer " + testAdminToken,
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedStatusCall:  "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{GetAccountStatus: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAccountStatus: store.AccountStatus{UserId: 37, Verified: true, HasWallet: true, Sequence: 5},
+				Errors:            tc.storeErrors,
+			}
+			testEnv := TestEnv{env: map[string]string{
+				"ADMIN_API":   fmt.Sprintf("%t", tc.enabled),
+				"ADMIN_TOKEN": testAdminToken,
+			}}
+			s := Init(&TestAuth{}, &testStore, &testEnv, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathAdminAccount, nil)
+			q := req.URL.Query()
+			q.Add("email", base64.StdEncoding.EncodeToString([]byte(tc.email)))
+			req.URL.RawQuery = q.Encode()
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			s.getAdminAccount(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+			if tc.expectedErrorCode != "" {
+				expectErrorCode(t, body, tc.expectedErrorCode)
+			}
+
+			if testStore.Called.GetAccountStatus != tc.expectedStatusCall {
+				t.Errorf("Expected Store.GetAccountStatus to be called with %s got %s", tc.expectedStatusCall, testStore.Called.GetAccountStatus)
+			}
+
+			if tc.expectedErrorString != "" {
+				return // The rest of the test does not apply
+			}
+
+			var result AdminAccountResponse
+			expected := AdminAccountResponse{UserId: 37, Verified: true, HasWallet: true, Sequence: 5}
+			if err := json.Unmarshal(body, &result); err != nil || result != expected {
+				t.Errorf("Expected the account status %+v: result: %+v err: %+v", expected, string(body), err)
+			}
+		})
+	}
+}
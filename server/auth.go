@@ -1,22 +1,34 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 // DeviceId is decided by the device. UserId is decided by the server, and is
-// gatekept by Email/Password
+// gatekept by Email/Password. Scope is optional, defaulting to a full token.
+// DeviceName is optional, for the user to tell their devices apart when
+// listing them. Totp is required if the account has two-factor
+// authentication enabled (see PathTotpEnroll).
 type AuthRequest struct {
-	DeviceId auth.DeviceId `json:"deviceId"`
-	Email    auth.Email    `json:"email"`
-	Password auth.Password `json:"password"`
+	DeviceId   auth.DeviceId   `json:"deviceId"`
+	DeviceName auth.DeviceName `json:"deviceName,omitempty"`
+	Email      auth.Email      `json:"email"`
+	Password   auth.Password   `json:"password"`
+	Scope      auth.AuthScope  `json:"scope,omitempty"`
+	Totp       auth.TotpCode   `json:"totp,omitempty"`
 }
 
+// Normalized here (like the other requests with a device id) so that
+// everything after, including the new device check, sees the same id.
 func (r *AuthRequest) validate() error {
 	if !r.Email.Validate() {
 		return fmt.Errorf("Invalid 'email'")
@@ -24,39 +36,103 @@ func (r *AuthRequest) validate() error {
 	if !r.Password.Validate() {
 		return fmt.Errorf("Invalid or missing 'password'")
 	}
+	r.DeviceId = r.DeviceId.Normalize()
 	if r.DeviceId == "" {
 		return fmt.Errorf("Missing 'deviceId'")
 	}
+	if !r.DeviceId.Validate() {
+		return fmt.Errorf("Invalid 'deviceId'")
+	}
+	if r.Scope != "" && !r.Scope.Valid() {
+		return fmt.Errorf("Invalid 'scope'")
+	}
+	if r.Totp != "" && !r.Totp.Validate() {
+		return fmt.Errorf("Invalid 'totp'")
+	}
 	return nil
 }
 
 func (s *Server) getAuthToken(w http.ResponseWriter, req *http.Request) {
 	var authRequest AuthRequest
-	if !getPostData(w, req, &authRequest) {
+	if !getPostData(w, req, &authRequest, maxSmallBodySize) {
 		return
 	}
 
-	userId, err := s.store.GetUserId(authRequest.Email, authRequest.Password)
-	if err == store.ErrWrongCredentials {
-		errorJson(w, http.StatusUnauthorized, "No match for email and/or password")
+	userId, err := s.store.GetUserId(req.Context(), authRequest.Email, authRequest.Password)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error getting User Id")
 		return
 	}
-	if err == store.ErrNotVerified {
-		errorJson(w, http.StatusUnauthorized, "Account is not verified")
+
+	if !s.checkTotp(w, req, userId, authRequest.Totp) {
 		return
 	}
+
+	scope := authRequest.Scope
+	if scope == "" {
+		scope = auth.ScopeFull
+	}
+
+	// A device has one token at a time, so this replaces whatever token the
+	// device had before, whatever its scope.
+	authToken, err := s.auth.NewAuthToken(userId, authRequest.DeviceId, scope)
+
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error getting User Id")
+		internalServiceErrorJson(w, err, "Error generating auth token")
 		return
 	}
+	authToken.DeviceName = authRequest.DeviceName
 
-	authToken, err := s.auth.NewAuthToken(userId, authRequest.DeviceId, auth.ScopeFull)
+	response, err := json.Marshal(&authToken)
 
 	if err != nil {
 		internalServiceErrorJson(w, err, "Error generating auth token")
 		return
 	}
 
+	err = s.store.SaveToken(req.Context(), authToken)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error saving auth token")
+		return
+	}
+
+	s.notifyNewDevice(req.Context(), authRequest.Email, userId, authRequest.DeviceId, authRequest.DeviceName)
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Lets a client keep using its token past the usual expiration without
+// logging in again (and so without having to keep the password around), as
+// long as it refreshes before the token expires. A token of any scope can
+// refresh itself, and keeps its scope.
+type TokenRefreshRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+}
+
+func (r *TokenRefreshRequest) validate() error {
+	return nil
+}
+
+func (s *Server) refreshAuthToken(w http.ResponseWriter, req *http.Request) {
+	var tokenRefreshRequest TokenRefreshRequest
+	if !getPostData(w, req, &tokenRefreshRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, tokenRefreshRequest.Token, auth.ScopeGetWallet)
+	if authToken == nil {
+		return
+	}
+
+	expiration, err := s.store.RefreshToken(req.Context(), authToken.Token)
+	if err != nil {
+		// ErrNoTokenForUserDevice if the token expired or was replaced between
+		// checkAuth and here
+		s.storeErrorJson(w, err, "Error refreshing auth token")
+		return
+	}
+	authToken.Expiration = &expiration
+
 	response, err := json.Marshal(&authToken)
 
 	if err != nil {
@@ -64,10 +140,218 @@ func (s *Server) getAuthToken(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := s.store.SaveToken(authToken); err != nil {
-		internalServiceErrorJson(w, err, "Error saving auth token")
+	fmt.Fprintf(w, string(response))
+}
+
+type LogoutRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+}
+
+func (r *LogoutRequest) validate() error {
+	return nil
+}
+
+// Delete the token making the request, logging out that device. The user's
+// other devices stay logged in. Responds with a 204 and no body, or a 401 if
+// the token was not found (already logged out, say). A read-only token can log
+// itself out too; that doesn't touch any wallet.
+func (s *Server) logout(w http.ResponseWriter, req *http.Request) {
+	var logoutRequest LogoutRequest
+	if !getPostData(w, req, &logoutRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, logoutRequest.Token, auth.ScopeGetWallet)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.DeleteToken(req.Context(), authToken.UserId, authToken.DeviceId)
+	if err != nil {
+		// ErrNoTokenForUserDevice if it was deleted (by another logout, say)
+		// between checkAuth and here
+		s.storeErrorJson(w, err, "Error deleting auth token")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lets a client carry its session over to a new device id (say, after a
+// reinstall) without logging in again. Only the token making the request is
+// moved.
+type DeviceIdRequest struct {
+	Token    auth.AuthTokenString `json:"token"`
+	DeviceId auth.DeviceId        `json:"deviceId"`
+}
+
+func (r *DeviceIdRequest) validate() error {
+	r.DeviceId = r.DeviceId.Normalize()
+	if r.DeviceId == "" {
+		return fmt.Errorf("Missing 'deviceId'")
+	}
+	if !r.DeviceId.Validate() {
+		return fmt.Errorf("Invalid 'deviceId'")
+	}
+	return nil
+}
+
+func (s *Server) updateDeviceId(w http.ResponseWriter, req *http.Request) {
+	var deviceIdRequest DeviceIdRequest
+	if !getPostData(w, req, &deviceIdRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, deviceIdRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.UpdateTokenDeviceId(req.Context(), authToken.UserId, authToken.DeviceId, deviceIdRequest.DeviceId)
+	if err != nil {
+		// ErrNoTokenForUserDevice if the token was replaced or moved between
+		// checkAuth and here
+		s.storeErrorJson(w, err, "Error updating device id")
+		return
+	}
+
+	var deviceIdResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(deviceIdResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating deviceIdResponse")
 		return
 	}
 
 	fmt.Fprintf(w, string(response))
 }
+
+// A device the user is logged in on. The token itself is never included.
+type DeviceResponse struct {
+	DeviceId   auth.DeviceId   `json:"deviceId"`
+	DeviceName auth.DeviceName `json:"deviceName"`
+	Scope      auth.AuthScope  `json:"scope"`
+	Expiration *time.Time      `json:"expiration"`
+
+	// The wallet sequence the device had the last time it saved or got the
+	// wallet, and when that was. Left out if it never has.
+	LastSyncedSequence wallet.Sequence `json:"lastSyncedSequence,omitempty"`
+	LastSynced         *time.Time      `json:"lastSynced,omitempty"`
+}
+
+type DevicesResponse struct {
+	Devices []DeviceResponse `json:"devices"`
+
+	// The offset to ask for to get the next page. Left out on the last page.
+	NextOffset int `json:"nextOffset,omitempty"`
+}
+
+const defaultDevicesPageSize = 50
+const maxDevicesPageSize = 100
+
+// A limit above maxDevicesPageSize gets maxDevicesPageSize. The client can
+// tell from nextOffset that there's more.
+func getPageParams(req *http.Request) (limit int, offset int, err error) {
+	limit = defaultDevicesPageSize
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("Invalid limit parameter")
+		}
+		if limit > maxDevicesPageSize {
+			limit = maxDevicesPageSize
+		}
+	}
+	if offsetStr := req.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset parameter")
+		}
+	}
+	return limit, offset, nil
+}
+
+// Takes `token`, and optionally `limit` and `offset`. Lists the devices the
+// user currently has a token for, including the one making the request, so
+// the user can see where they're logged in. They come a page at a time,
+// ordered by device id, with up to defaultDevicesPageSize devices unless
+// `limit` says otherwise.
+func (s *Server) getDevices(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	token := getTokenParam(req)
+	limit, offset, paramsErr := getPageParams(req)
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(req, w, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	// One more than the page, to find out whether there's another one
+	devices, ok := s.listDevices(req.Context(), w, authToken.UserId, limit+1, offset)
+	if !ok {
+		return
+	}
+
+	devicesResponse := DevicesResponse{Devices: devices}
+	if len(devices) > limit {
+		devicesResponse.Devices = devices[:limit]
+		devicesResponse.NextOffset = offset + limit
+	}
+
+	response, err := json.Marshal(devicesResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating devicesResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// The devices the user currently has a token for, paged the same way as
+// Store.GetTokensForUser (a zero limit means all of them). Responds with an
+// error and returns false if something goes wrong.
+func (s *Server) listDevices(ctx context.Context, w http.ResponseWriter, userId auth.UserId, limit int, offset int) (devices []DeviceResponse, ok bool) {
+	tokens, err := s.store.GetTokensForUser(ctx, userId, limit, offset)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting devices")
+		return nil, false
+	}
+
+	deviceSyncs, err := s.store.GetDeviceSyncs(ctx, userId)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting device syncs")
+		return nil, false
+	}
+	deviceSyncsById := make(map[auth.DeviceId]store.DeviceSync)
+	for _, deviceSync := range deviceSyncs {
+		deviceSyncsById[deviceSync.DeviceId] = deviceSync
+	}
+
+	devices = []DeviceResponse{}
+	for _, deviceToken := range tokens {
+		deviceResponse := DeviceResponse{
+			DeviceId:   deviceToken.DeviceId,
+			DeviceName: deviceToken.DeviceName,
+			Scope:      deviceToken.Scope,
+			Expiration: deviceToken.Expiration,
+		}
+		// Only devices that are still logged in are listed, so any left over
+		// from logged out devices are ignored
+		if deviceSync, ok := deviceSyncsById[deviceToken.DeviceId]; ok {
+			deviceResponse.LastSyncedSequence = deviceSync.Sequence
+			deviceResponse.LastSynced = &deviceSync.Updated
+		}
+		devices = append(devices, deviceResponse)
+	}
+	return devices, true
+}
@@ -2,13 +2,16 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"lbryio/wallet-sync-server/auth"
 	"lbryio/wallet-sync-server/server/paths"
@@ -18,7 +21,7 @@ import (
 func TestServerAuthHandlerSuccess(t *testing.T) {
 	testAuth := TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}
 	testStore := TestStore{}
-	s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+	s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 
 	requestBody := []byte(`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`)
 
@@ -40,6 +43,69 @@ func TestServerAuthHandlerSuccess(t *testing.T) {
 	if testStore.Called.SaveToken != testAuth.TestNewAuthTokenString {
 		t.Errorf("Expected Store.SaveToken to be called with %s", testAuth.TestNewAuthTokenString)
 	}
+
+	if result.Scope != auth.ScopeFull {
+		t.Errorf("Expected a full token by default, got scope %s", result.Scope)
+	}
+}
+
+func TestServerAuthHandlerScope(t *testing.T) {
+	testAuth := TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}
+	testStore := TestStore{}
+	s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	requestBody := []byte(`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678", "scope": "get-wallet"}`)
+
+	req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer(requestBody))
+	w := httptest.NewRecorder()
+
+	s.getAuthToken(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+
+	var result auth.AuthToken
+	if err := json.Unmarshal(body, &result); err != nil || result.Scope != auth.ScopeGetWallet {
+		t.Errorf("Expected a get-wallet token: result: %+v err: %+v", string(body), err)
+	}
+}
+
+// The device name given at login shows up when listing devices
+func TestServerAuthHandlerDeviceName(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", DeviceName: "Pixel 7", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+	if authToken.DeviceName != "Pixel 7" {
+		t.Errorf("Expected device name in the auth response, got %+v", authToken)
+	}
+	// No name for this one
+	statusCode, err = selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-2", Email: email, Password: password}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+
+	var devicesResponse DevicesResponse
+	statusCode, err = selfTestRequest(s.getDevices, http.MethodGet, paths.PathDevices+"?token="+string(authToken.Token), nil, &devicesResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting devices: status %d err %+v", statusCode, err)
+	}
+	if len(devicesResponse.Devices) != 2 ||
+		devicesResponse.Devices[0].DeviceName != "Pixel 7" ||
+		devicesResponse.Devices[1].DeviceName != "" {
+		t.Errorf("Expected device names in the devices response, got %+v", devicesResponse)
+	}
 }
 
 func TestServerAuthHandlerErrors(t *testing.T) {
@@ -78,6 +144,14 @@ func TestServerAuthHandlerErrors(t *testing.T) {
 
 			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrNotVerified},
 		},
+		{
+			name:                "locked account",
+			email:               "abc@example.com",
+			expectedStatusCode:  http.StatusLocked,
+			expectedErrorString: http.StatusText(http.StatusLocked) + ": Account is locked after too many failed logins. Try again later.",
+
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrAccountLocked},
+		},
 		{
 			name:                "generate token fail",
 			email:               "abc@example.com",
@@ -104,7 +178,7 @@ func TestServerAuthHandlerErrors(t *testing.T) {
 			if tc.authFailGenToken { // TODO - TestAuth{Errors:authErrors}
 				testAuth.FailGenToken = true
 			}
-			server := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			server := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 
 			// Make request
 			// So long as the JSON is well-formed, the content doesn't matter here since the password check will be stubbed out
@@ -137,6 +211,14 @@ func TestServerValidateAuthRequest(t *testing.T) {
 			AuthRequest{Email: "joe@example.com", Password: "12345678"},
 			"deviceId",
 			"Expected AuthRequest with missing device to not successfully validate",
+		}, {
+			AuthRequest{DeviceId: "  ", Email: "joe@example.com", Password: "12345678"},
+			"Missing 'deviceId'",
+			"Expected AuthRequest with a blank device to not successfully validate",
+		}, {
+			AuthRequest{DeviceId: "dev\x001", Email: "joe@example.com", Password: "12345678"},
+			"Invalid 'deviceId'",
+			"Expected AuthRequest with a control character in the device to not successfully validate",
 		}, {
 			AuthRequest{DeviceId: "dId", Email: "joe-example.com", Password: "12345678"},
 			"email",
@@ -156,6 +238,10 @@ func TestServerValidateAuthRequest(t *testing.T) {
 			AuthRequest{DeviceId: "dId", Email: "joe@example.com"},
 			"password",
 			"Expected AuthRequest with missing password to not successfully validate",
+		}, {
+			AuthRequest{DeviceId: "dId", Email: "joe@example.com", Password: "12345678", Scope: "banana"},
+			"scope",
+			"Expected AuthRequest with unknown scope to not successfully validate",
 		},
 	}
 	for _, tc := range tt {
@@ -164,4 +250,594 @@ func TestServerValidateAuthRequest(t *testing.T) {
 			t.Errorf(tc.failureDescription)
 		}
 	}
+
+	// Whitespace around the device id is dropped rather than rejected
+	authRequest = AuthRequest{DeviceId: " dev-1\n", Email: "joe@example.com", Password: "12345678"}
+	if err := authRequest.validate(); err != nil || authRequest.DeviceId != "dev-1" {
+		t.Errorf("Expected the device id to be normalized: err: %+v deviceId: %q", err, authRequest.DeviceId)
+	}
+}
+
+func TestServerRefreshAuthToken(t *testing.T) {
+	refreshedExpiration := time.Now().Add(time.Hour * 24 * 14).UTC().Truncate(time.Second)
+
+	tt := []struct {
+		name                string
+		requestBody         string
+		expectedStatusCode  int
+		expectedErrorString string
+		expectStoreCalled   bool
+
+		// The scope of the token making the request. Full if not set.
+		scope auth.AuthScope
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"token": "seekrit"}`,
+			expectedStatusCode: http.StatusOK,
+			expectStoreCalled:  true,
+		}, {
+			name:               "get-wallet token",
+			requestBody:        `{"token": "seekrit"}`,
+			expectedStatusCode: http.StatusOK,
+			expectStoreCalled:  true,
+			scope:              auth.ScopeGetWallet,
+		}, {
+			name:                "missing token",
+			requestBody:         `{}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing token",
+		}, {
+			name:                "auth token not found",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "auth token expired before refresh",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{RefreshToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "db error",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{RefreshToken: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			scope := tc.scope
+			if scope == "" {
+				scope = auth.ScopeFull
+			}
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    scope,
+					UserId:   auth.UserId(37),
+				},
+				TestRefreshedExpiration: refreshedExpiration,
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthTokenRefresh, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.refreshAuthToken(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			expectedCall := auth.AuthTokenString("")
+			if tc.expectStoreCalled {
+				expectedCall = "seekrit"
+			}
+			if want, got := expectedCall, testStore.Called.RefreshToken; want != got {
+				t.Errorf("Expected Store.RefreshToken to be called with %q, got %q", want, got)
+			}
+
+			if tc.expectedErrorString != "" {
+				return // The rest of the test does not apply
+			}
+
+			// Same token and scope, new expiration
+			var result auth.AuthToken
+			err := json.Unmarshal(body, &result)
+			if err != nil || result.Token != "seekrit" || result.Scope != scope || result.Expiration == nil || !result.Expiration.Equal(refreshedExpiration) {
+				t.Errorf("Expected the same token with the new expiration. result: %s err: %+v", string(body), err)
+			}
+		})
+	}
+}
+
+func TestServerLogout(t *testing.T) {
+	tt := []struct {
+		name                string
+		requestBody         string
+		expectedStatusCode  int
+		expectedErrorString string
+		expectStoreCalled   bool
+
+		// The scope of the token making the request. Full if not set.
+		scope auth.AuthScope
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"token": "seekrit"}`,
+			expectedStatusCode: http.StatusNoContent,
+			expectStoreCalled:  true,
+		}, {
+			name:               "get-wallet token",
+			requestBody:        `{"token": "seekrit"}`,
+			expectedStatusCode: http.StatusNoContent,
+			expectStoreCalled:  true,
+			scope:              auth.ScopeGetWallet,
+		}, {
+			name:                "missing token",
+			requestBody:         `{}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing token",
+		}, {
+			name:                "auth token not found",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "token deleted before logout",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{DeleteToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "db error",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{DeleteToken: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			scope := tc.scope
+			if scope == "" {
+				scope = auth.ScopeFull
+			}
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    scope,
+					UserId:   auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthLogout, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.logout(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if tc.expectedErrorString != "" {
+				expectErrorString(t, body, tc.expectedErrorString)
+			} else if len(body) != 0 {
+				t.Errorf("Expected no body, got %s", body)
+			}
+
+			// Only ever the caller's own device
+			expectedCall := DeleteTokenCall{}
+			if tc.expectStoreCalled {
+				expectedCall = DeleteTokenCall{UserId: 37, DeviceId: "dev-1"}
+			}
+			if want, got := expectedCall, testStore.Called.DeleteToken; want != got {
+				t.Errorf("Expected Store.DeleteToken call %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestServerUpdateDeviceId(t *testing.T) {
+	tt := []struct {
+		name                string
+		requestBody         string
+		expectedStatusCode  int
+		expectedErrorString string
+		expectStoreCalled   bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			requestBody:        `{"token": "seekrit", "deviceId": "dev-2"}`,
+			expectedStatusCode: http.StatusOK,
+			expectStoreCalled:  true,
+		}, {
+			name:                "validation error",
+			requestBody:         `{"token": "seekrit"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'deviceId'",
+		}, {
+			name:                "invalid device id",
+			requestBody:         `{"token": "seekrit", "deviceId": "dev\u00002"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'deviceId'",
+		}, {
+			name:                "device id rejected by the store",
+			requestBody:         `{"token": "seekrit", "deviceId": "dev-2"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid 'deviceId'",
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{UpdateTokenDeviceId: store.ErrInvalidDeviceId},
+		}, {
+			name:                "auth token not found",
+			requestBody:         `{"token": "seekrit", "deviceId": "dev-2"}`,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "device id in use",
+			requestBody:         `{"token": "seekrit", "deviceId": "dev-2"}`,
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Device id is already in use for this account",
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{UpdateTokenDeviceId: store.ErrDuplicateToken},
+		}, {
+			name:                "db error",
+			requestBody:         `{"token": "seekrit", "deviceId": "dev-2"}`,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{UpdateTokenDeviceId: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    auth.ScopeFull,
+					UserId:   auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthDeviceId, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			s.updateDeviceId(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if tc.expectedErrorString != "" {
+				expectErrorString(t, body, tc.expectedErrorString)
+			} else if want, got := "{}", strings.TrimSpace(string(body)); want != got {
+				t.Errorf("Expected body %s, got %s", want, got)
+			}
+
+			// Only ever the caller's own token, moved from its own device id
+			expectedCall := UpdateTokenDeviceIdCall{}
+			if tc.expectStoreCalled {
+				expectedCall = UpdateTokenDeviceIdCall{UserId: 37, OldDeviceId: "dev-1", NewDeviceId: "dev-2"}
+			}
+			if want, got := expectedCall, testStore.Called.UpdateTokenDeviceId; want != got {
+				t.Errorf("Expected Store.UpdateTokenDeviceId call %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestServerGetDevices(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	syncUpdated := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	tt := []struct {
+		name                string
+		tokenParam          string
+		tokenScope          auth.AuthScope
+		expectedStatusCode  int
+		expectedErrorString string
+		expectStoreCalled   bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			tokenParam:         "seekrit",
+			tokenScope:         auth.ScopeFull,
+			expectedStatusCode: http.StatusOK,
+			expectStoreCalled:  true,
+		}, {
+			name:                "missing token",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing token",
+		}, {
+			name:                "auth token not found",
+			tokenParam:          "seekrit",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "get-wallet token",
+			tokenParam:          "seekrit",
+			tokenScope:          auth.ScopeGetWallet,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Scope",
+		}, {
+			name:                "db error",
+			tokenParam:          "seekrit",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{GetTokensForUser: fmt.Errorf("Some random DB Error!")},
+		}, {
+			name:                "db error getting device syncs",
+			tokenParam:          "seekrit",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectStoreCalled:   true,
+
+			storeErrors: TestStoreFunctionsErrors{GetDeviceSyncs: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    tc.tokenScope,
+					UserId:   auth.UserId(37),
+				},
+				TestTokensForUser: []auth.AuthToken{
+					{DeviceId: "dev-1", Scope: auth.ScopeFull, UserId: 37, Expiration: &expiration},
+					{DeviceId: "dev-2", Scope: auth.ScopeGetWallet, UserId: 37, Expiration: &expiration},
+				},
+				// dev-2 hasn't synced, and dev-3 has logged out
+				TestDeviceSyncs: []store.DeviceSync{
+					{DeviceId: "dev-1", Sequence: 42, Updated: syncUpdated},
+					{DeviceId: "dev-3", Sequence: 40, Updated: syncUpdated},
+				},
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathDevices, nil)
+			q := req.URL.Query()
+			if tc.tokenParam != "" {
+				q.Add("token", tc.tokenParam)
+			}
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			s.getDevices(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			expectedCall := GetTokensForUserCall{}
+			if tc.expectStoreCalled {
+				expectedCall = GetTokensForUserCall{UserId: 37, Limit: defaultDevicesPageSize + 1}
+			}
+			if want, got := expectedCall, testStore.Called.GetTokensForUser; want != got {
+				t.Errorf("Expected Store.GetTokensForUser call %+v, got %+v", want, got)
+			}
+
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			if strings.Contains(string(body), `"token"`) {
+				t.Errorf("Expected no token strings in the response, got %s", body)
+			}
+
+			var result DevicesResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding devices response: %+v", err)
+			}
+			if len(result.Devices) != 2 ||
+				result.Devices[0].DeviceId != "dev-1" || result.Devices[0].Scope != auth.ScopeFull ||
+				result.Devices[1].DeviceId != "dev-2" || result.Devices[1].Scope != auth.ScopeGetWallet ||
+				result.Devices[0].Expiration == nil || !result.Devices[0].Expiration.Equal(expiration) {
+				t.Errorf("Unexpected devices in the response: %s", body)
+			}
+			if result.Devices[0].LastSyncedSequence != 42 || result.Devices[0].LastSynced == nil || !result.Devices[0].LastSynced.Equal(syncUpdated) {
+				t.Errorf("Expected dev-1 to be last synced at sequence 42: %s", body)
+			}
+			if result.Devices[1].LastSyncedSequence != 0 || result.Devices[1].LastSynced != nil {
+				t.Errorf("Expected no last sync for dev-2: %s", body)
+			}
+		})
+	}
+}
+
+func TestServerGetDevicesPages(t *testing.T) {
+	tt := []struct {
+		name  string
+		query map[string]string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedDeviceIds   []auth.DeviceId
+		expectedNextOffset  int
+	}{
+		{
+			name:               "first page",
+			query:              map[string]string{"limit": "2"},
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{"dev-1", "dev-2"},
+			expectedNextOffset: 2,
+		}, {
+			name:               "middle page",
+			query:              map[string]string{"limit": "2", "offset": "2"},
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{"dev-3", "dev-4"},
+			expectedNextOffset: 4,
+		}, {
+			name:               "last page",
+			query:              map[string]string{"limit": "2", "offset": "4"},
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{"dev-5"},
+		}, {
+			name:               "beyond the end",
+			query:              map[string]string{"limit": "2", "offset": "10"},
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{},
+		}, {
+			name:               "default page size fits them all",
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{"dev-1", "dev-2", "dev-3", "dev-4", "dev-5"},
+		}, {
+			name:               "above the max page size",
+			query:              map[string]string{"limit": "1000"},
+			expectedStatusCode: http.StatusOK,
+			expectedDeviceIds:  []auth.DeviceId{"dev-1", "dev-2", "dev-3", "dev-4", "dev-5"},
+		}, {
+			name:                "zero limit",
+			query:               map[string]string{"limit": "0"},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid limit parameter",
+		}, {
+			name:                "negative offset",
+			query:               map[string]string{"offset": "-1"},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid offset parameter",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    auth.ScopeFull,
+					UserId:   auth.UserId(37),
+				},
+			}
+			for _, deviceId := range []auth.DeviceId{"dev-1", "dev-2", "dev-3", "dev-4", "dev-5"} {
+				testStore.TestTokensForUser = append(testStore.TestTokensForUser, auth.AuthToken{DeviceId: deviceId, Scope: auth.ScopeFull, UserId: 37})
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathDevices, nil)
+			q := req.URL.Query()
+			q.Add("token", "seekrit")
+			for key, value := range tc.query {
+				q.Add(key, value)
+			}
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			s.getDevices(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var result DevicesResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding devices response: %+v", err)
+			}
+			deviceIds := []auth.DeviceId{}
+			for _, device := range result.Devices {
+				deviceIds = append(deviceIds, device.DeviceId)
+			}
+			if !reflect.DeepEqual(deviceIds, tc.expectedDeviceIds) {
+				t.Errorf("Expected devices %v, got %v", tc.expectedDeviceIds, deviceIds)
+			}
+			if result.NextOffset != tc.expectedNextOffset {
+				t.Errorf("Expected next offset %d, got %d", tc.expectedNextOffset, result.NextOffset)
+			}
+			if tc.expectedNextOffset == 0 && strings.Contains(string(body), "nextOffset") {
+				t.Errorf("Expected no nextOffset on the last page, got %s", body)
+			}
+		})
+	}
+}
+
+// With the token in the Authorization header, neither GET params nor POST
+// bodies need it
+func TestServerAuthorizationHeader(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+
+	request := func(handler http.HandlerFunc, method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+string(authToken.Token))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := request(s.getDevices, http.MethodGet, paths.PathDevices, "")
+	expectStatusCode(t, w, http.StatusOK)
+
+	w = request(s.logout, http.MethodPost, paths.PathAuthLogout, "{}")
+	expectStatusCode(t, w, http.StatusNoContent)
+
+	w = request(s.getDevices, http.MethodGet, paths.PathDevices, "")
+	expectStatusCode(t, w, http.StatusUnauthorized)
+	if got := w.Result().Header.Get("WWW-Authenticate"); got != `Bearer error="invalid_token"` {
+		t.Errorf("Expected WWW-Authenticate for a logged out token, got %q", got)
+	}
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"lbryio/wallet-sync-server/env"
+)
+
+// Limits the server enforces, so that clients can warn the user (or split up
+// a batch) before they run into them rather than after. These are the same
+// values used for enforcement, so they can't drift apart.
+//
+// A wallet has to fit in the request body along with everything else. There
+// may be a separate limit on the size of the encrypted wallet itself, if
+// MAX_WALLET_SIZE is set; otherwise maxWalletSize is left out.
+//
+// maxBodySize is the limit for the requests that carry wallets. Other requests
+// have a smaller one (maxSmallBodySize), but nothing legitimate comes close.
+type CapabilitiesResponse struct {
+	MaxBodySize        int `json:"maxBodySize"`
+	MaxWalletBatchSize int `json:"maxWalletBatchSize"`
+	MaxWalletSize      int `json:"maxWalletSize,omitempty"`
+}
+
+func (s *Server) getCapabilities(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	maxWalletSize, err := env.GetMaxWalletSize(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting max wallet size")
+		return
+	}
+
+	capabilitiesResponse := CapabilitiesResponse{
+		MaxBodySize:        maxBodySize,
+		MaxWalletBatchSize: maxWalletBatchSize,
+		MaxWalletSize:      maxWalletSize,
+	}
+
+	response, err := json.Marshal(capabilitiesResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating capabilitiesResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
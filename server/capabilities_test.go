@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func getTestCapabilities(t *testing.T, s *Server) CapabilitiesResponse {
+	req := httptest.NewRequest(http.MethodGet, paths.PathCapabilities, nil)
+	w := httptest.NewRecorder()
+
+	s.getCapabilities(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusOK)
+
+	var capabilitiesResponse CapabilitiesResponse
+	if err := json.Unmarshal(body, &capabilitiesResponse); err != nil {
+		t.Fatalf("Error decoding capabilities response: %+v", err)
+	}
+	return capabilitiesResponse
+}
+
+func TestServerGetCapabilities(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+	capabilities := getTestCapabilities(t, s)
+
+	if capabilities.MaxBodySize != maxBodySize {
+		t.Errorf("Expected maxBodySize %d, got %d", maxBodySize, capabilities.MaxBodySize)
+	}
+	if capabilities.MaxWalletBatchSize != maxWalletBatchSize {
+		t.Errorf("Expected maxWalletBatchSize %d, got %d", maxWalletBatchSize, capabilities.MaxWalletBatchSize)
+	}
+	if capabilities.MaxWalletSize != 0 {
+		t.Errorf("Expected no maxWalletSize, got %d", capabilities.MaxWalletSize)
+	}
+
+	s = Init(&TestAuth{}, &TestStore{}, &TestEnv{map[string]string{"MAX_WALLET_SIZE": "50000"}}, &TestMail{}, TestConfig)
+	if capabilities := getTestCapabilities(t, s); capabilities.MaxWalletSize != 50000 {
+		t.Errorf("Expected maxWalletSize 50000, got %d", capabilities.MaxWalletSize)
+	}
+}
+
+// A body right at the advertised limit gets through. One byte more is
+// rejected, and the rejection says what the limit is.
+func TestServerCapabilitiesMaxBodySizeEnforced(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+	maxSize := getTestCapabilities(t, s).MaxBodySize
+
+	// Leading whitespace, so the decoder has to read the whole thing
+	atLimit := strings.Repeat(" ", maxSize-2) + "{}"
+	req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer([]byte(atLimit)))
+	w := httptest.NewRecorder()
+	if !getPostData(w, req, &TestReqStruct{key: "hi"}, maxBodySize) {
+		t.Errorf("Expected a body of the advertised max size to be accepted, got %d", w.Code)
+	}
+
+	overLimit := " " + atLimit
+	req = httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer([]byte(overLimit)))
+	w = httptest.NewRecorder()
+	if getPostData(w, req, &TestReqStruct{key: "hi"}, maxBodySize) {
+		t.Fatalf("Expected a body over the advertised max size to be rejected")
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusRequestEntityTooLarge)
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		t.Fatalf("Error decoding error response: %+v", err)
+	}
+	if errorResponse.MaxBodySize != maxSize {
+		t.Errorf("Expected the error to say the max body size is %d, got %d", maxSize, errorResponse.MaxBodySize)
+	}
+}
@@ -23,10 +23,12 @@ type ClientSaltSeedResponse struct {
 	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
 }
 
+// Shared by the GET endpoints that take an email address (base64 encoded)
+//
 // TODO - There's probably a struct-based solution here like with POST/PUT.
 // We could put that struct up top as well.
 // TODO - maybe common code with getWalletParams?
-func getClientSaltSeedParams(req *http.Request) (email auth.Email, err error) {
+func getEmailParam(req *http.Request) (email auth.Email, err error) {
 	emailSlice, hasEmailSlice := req.URL.Query()["email"]
 
 	if !hasEmailSlice || emailSlice[0] == "" {
@@ -53,7 +55,7 @@ func (s *Server) getClientSaltSeed(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	email, paramsErr := getClientSaltSeedParams(req)
+	email, paramsErr := getEmailParam(req)
 
 	if paramsErr != nil {
 		// In this specific case, the error is limited to values that are safe to
@@ -62,11 +64,11 @@ func (s *Server) getClientSaltSeed(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	seed, err := s.store.GetClientSaltSeed(email)
+	seed, err := s.store.GetClientSaltSeed(req.Context(), email)
 	if err == store.ErrWrongCredentials {
 		// Going with 404 instead of 401 because we're not really authenticating
 		// here. It's an open API and anyone can peep someone else's salt seed.
-		errorJson(w, http.StatusNotFound, "No match for email")
+		errorCodeJson(w, http.StatusNotFound, ErrorCodeWrongCredentials, "No match for email")
 		return
 	}
 	if err != nil {
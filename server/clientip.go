@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The address of whoever connected to us, which may be a reverse proxy
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// The client's IP address, for rate limits and such. That's whoever connected
+// to us, unless it's one of TrustedProxies. Then it's who the proxy says it
+// got the request from in X-Forwarded-For. Each proxy adds that to the end, so
+// we go back from the end past our own proxies, and take the first address
+// that isn't one of them. Anything before that is whatever the client sent,
+// which could be made up.
+func (s *Server) clientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !ipInNets(ip, s.config.TrustedProxies) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			// None of our proxies would have put this here
+			break
+		}
+		ip = forwardedIP.String()
+		if !ipInNets(ip, s.config.TrustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tt := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		trustedProxies []*net.IPNet
+
+		expectedIP string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "192.0.2.1:1234",
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:         "forwarded for, but not by a trusted proxy",
+			remoteAddr:   "192.0.2.1:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			expectedIP:   "192.0.2.1",
+		},
+		{
+			name:           "no proxies trusted",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"198.51.100.1"},
+			trustedProxies: []*net.IPNet{},
+			expectedIP:     "10.0.0.1",
+		},
+		{
+			name:           "through a trusted proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"198.51.100.1"},
+			trustedProxies: []*net.IPNet{proxies},
+			expectedIP:     "198.51.100.1",
+		},
+		{
+			name:           "client made up an address",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"203.0.113.7, 198.51.100.1"},
+			trustedProxies: []*net.IPNet{proxies},
+			expectedIP:     "198.51.100.1",
+		},
+		{
+			name:           "through more than one trusted proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"203.0.113.7, 198.51.100.1", "10.0.0.2"},
+			trustedProxies: []*net.IPNet{proxies},
+			expectedIP:     "198.51.100.1",
+		},
+		{
+			name:           "trusted proxy without the header",
+			remoteAddr:     "10.0.0.1:1234",
+			trustedProxies: []*net.IPNet{proxies},
+			expectedIP:     "10.0.0.1",
+		},
+		{
+			name:           "garbage",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"198.51.100.1, not-an-ip"},
+			trustedProxies: []*net.IPNet{proxies},
+			expectedIP:     "10.0.0.1",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config := TestConfig
+			config.TrustedProxies = tc.trustedProxies
+			s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, config)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, forwardedFor := range tc.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+
+			if got := s.clientIP(req); got != tc.expectedIP {
+				t.Errorf("Expected client IP %s, got %s", tc.expectedIP, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// So that a slow (or malicious) client can't hold on to a connection forever.
+// A request body is at most maxBodySize, so reading one shouldn't take long.
+// Writing needs longer, since it covers the whole time a long poll waits (see
+// walletPollWriteMargin).
+const defaultReadHeaderTimeout = 10 * time.Second
+const defaultReadTimeout = 30 * time.Second
+const defaultWriteTimeout = time.Minute
+const defaultIdleTimeout = 2 * time.Minute
+
+// The write timeout starts when the request has been read, so a long poll uses
+// up walletPollTimeout of it just waiting. This is what it needs on top of
+// that to get the wallet and send it.
+const walletPollWriteMargin = 10 * time.Second
+
+// Where and how the server listens. With both TLS files set it serves HTTPS,
+// otherwise plain HTTP (say, behind a reverse proxy that handles TLS). Zero
+// timeouts mean the defaults above.
+type Config struct {
+	Host string
+	Port int
+
+	TLSCertFile string
+	TLSKeyFile  string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Requests from these come through a reverse proxy, which says who the
+	// client is in X-Forwarded-For (see clientIP)
+	TrustedProxies []*net.IPNet
+
+	// Clients that aren't rate limited, such as a health checker that logs in
+	// (see rateLimited)
+	RateLimitExempt []*net.IPNet
+}
+
+func (c *Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("Invalid port %d, must be from 1 to 65535", c.Port)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("Set both the TLS cert file and the TLS key file, or neither")
+	}
+	if c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		return fmt.Errorf("Timeouts can't be negative")
+	}
+	if minWriteTimeout := walletPollTimeout + walletPollWriteMargin; c.writeTimeout() < minWriteTimeout {
+		return fmt.Errorf("Write timeout must be at least %s, to leave time for wallet long polls", minWriteTimeout)
+	}
+	return nil
+}
+
+func (c *Config) useTLS() bool {
+	return c.TLSCertFile != ""
+}
+
+func (c *Config) addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (c *Config) readHeaderTimeout() time.Duration {
+	if c.ReadHeaderTimeout == 0 {
+		return defaultReadHeaderTimeout
+	}
+	return c.ReadHeaderTimeout
+}
+
+func (c *Config) readTimeout() time.Duration {
+	if c.ReadTimeout == 0 {
+		return defaultReadTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c *Config) writeTimeout() time.Duration {
+	if c.WriteTimeout == 0 {
+		return defaultWriteTimeout
+	}
+	return c.WriteTimeout
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	if c.IdleTimeout == 0 {
+		return defaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfigValidate(t *testing.T) {
+	tt := []struct {
+		name   string
+		config Config
+
+		expectedErrorSubstr string
+	}{
+		{
+			name:   "plain http",
+			config: Config{Host: "localhost", Port: 8090},
+		},
+		{
+			name:   "all interfaces",
+			config: Config{Port: 8090},
+		},
+		{
+			name:   "tls",
+			config: Config{Host: "0.0.0.0", Port: 443, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+		},
+		{
+			name:   "timeouts",
+			config: Config{Port: 8090, ReadHeaderTimeout: 10 * time.Second, ReadTimeout: time.Minute, WriteTimeout: time.Minute, IdleTimeout: 2 * time.Minute},
+		},
+		{
+			name:                "zero port",
+			config:              Config{Host: "localhost"},
+			expectedErrorSubstr: "port",
+		},
+		{
+			name:                "port too big",
+			config:              Config{Host: "localhost", Port: 65536},
+			expectedErrorSubstr: "port",
+		},
+		{
+			name:                "tls cert without key",
+			config:              Config{Port: 443, TLSCertFile: "cert.pem"},
+			expectedErrorSubstr: "TLS",
+		},
+		{
+			name:                "tls key without cert",
+			config:              Config{Port: 443, TLSKeyFile: "key.pem"},
+			expectedErrorSubstr: "TLS",
+		},
+		{
+			name:                "negative timeout",
+			config:              Config{Port: 8090, IdleTimeout: -time.Second},
+			expectedErrorSubstr: "negative",
+		},
+		{
+			name:                "write timeout shorter than long polls",
+			config:              Config{Port: 8090, WriteTimeout: 10 * time.Second},
+			expectedErrorSubstr: "long polls",
+		},
+		{
+			name:                "write timeout too close to the long poll timeout",
+			config:              Config{Port: 8090, WriteTimeout: walletPollTimeout + time.Second},
+			expectedErrorSubstr: "long polls",
+		},
+		{
+			name:   "write timeout just long enough",
+			config: Config{Port: 8090, WriteTimeout: walletPollTimeout + walletPollWriteMargin},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.expectedErrorSubstr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %+v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErrorSubstr) {
+				t.Errorf("Expected error containing %q, got %+v", tc.expectedErrorSubstr, err)
+			}
+		})
+	}
+}
+
+func TestServerConfigTimeouts(t *testing.T) {
+	defaults := Config{Port: 8090}
+	if defaults.readHeaderTimeout() != defaultReadHeaderTimeout || defaults.readTimeout() != defaultReadTimeout || defaults.writeTimeout() != defaultWriteTimeout || defaults.idleTimeout() != defaultIdleTimeout {
+		t.Errorf("Expected the default timeouts when none are set")
+	}
+	// Otherwise the defaults wouldn't pass
+	if err := defaults.Validate(); err != nil {
+		t.Errorf("Unexpected error with the default timeouts: %+v", err)
+	}
+
+	custom := Config{Port: 8090, ReadHeaderTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Minute, IdleTimeout: 4 * time.Second}
+	if custom.readHeaderTimeout() != time.Second || custom.readTimeout() != 2*time.Second || custom.writeTimeout() != 3*time.Minute || custom.idleTimeout() != 4*time.Second {
+		t.Errorf("Expected the timeouts that were set")
+	}
+}
+
+func TestServerConfigAddr(t *testing.T) {
+	if addr := (&Config{Host: "localhost", Port: 8090}).addr(); addr != "localhost:8090" {
+		t.Errorf("Expected localhost:8090, got %s", addr)
+	}
+	if addr := (&Config{Host: "::1", Port: 8090}).addr(); addr != "[::1]:8090" {
+		t.Errorf("Expected [::1]:8090, got %s", addr)
+	}
+}
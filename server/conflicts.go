@@ -0,0 +1,154 @@
+package server
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/metrics"
+)
+
+// A client with a bug in how it handles sequence numbers can get stuck
+// retrying a wallet update that will never succeed, getting a conflict every
+// time. We keep track of conflicts per user so that we can see it on the
+// dashboard and, if enabled, make the client back off.
+
+const (
+	// Conflicts this close together count as part of the same streak. A
+	// streak ends (and the record ages out) after this long without one.
+	conflictStreakWindow = time.Minute
+
+	// This many conflicts in a streak and we consider the client stuck.
+	conflictLoopThreshold = 10
+
+	// Backoff for a stuck client starts here and doubles with every further
+	// conflict, up to the max.
+	conflictBackoffMin = time.Second
+	conflictBackoffMax = time.Minute * 5
+)
+
+type conflictRecord struct {
+	count        int
+	lastConflict time.Time
+	backoffUntil time.Time
+}
+
+type conflictTracker struct {
+	mu        sync.Mutex
+	records   map[auth.UserId]*conflictRecord
+	lastSweep time.Time
+
+	// So tests can control time
+	now func() time.Time
+}
+
+func newConflictTracker() *conflictTracker {
+	return &conflictTracker{
+		records: make(map[auth.UserId]*conflictRecord),
+		now:     time.Now,
+	}
+}
+
+func (r *conflictRecord) expired(now time.Time) bool {
+	return now.Sub(r.lastConflict) > conflictStreakWindow && !now.Before(r.backoffUntil)
+}
+
+// Drop records that have aged out so the map doesn't grow forever. There's no
+// need to do it more often than once per window.
+func (c *conflictTracker) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < conflictStreakWindow {
+		return
+	}
+	for userId, record := range c.records {
+		if record.expired(now) {
+			delete(c.records, userId)
+		}
+	}
+	c.lastSweep = now
+}
+
+// Record a wallet update conflict for the user. Once they're past
+// conflictLoopThreshold, set (or extend) their backoff.
+func (c *conflictTracker) recordConflict(userId auth.UserId) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+
+	record, ok := c.records[userId]
+	if !ok || record.expired(now) {
+		record = &conflictRecord{}
+		c.records[userId] = record
+	}
+	record.count++
+	record.lastConflict = now
+
+	if record.count < conflictLoopThreshold {
+		return
+	}
+
+	if record.count == conflictLoopThreshold {
+		// Only flag it once per streak; it'll be in the logs and on the dashboard
+		// already.
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "wallet-conflict-loop"}).Inc()
+		log.Printf("User id %d got %d wallet update conflicts in a row. Client may be stuck in a conflict loop.", userId, record.count)
+	}
+
+	backoff := conflictBackoffMax
+	if shift := record.count - conflictLoopThreshold; shift < 32 {
+		if b := conflictBackoffMin << shift; b < conflictBackoffMax {
+			backoff = b
+		}
+	}
+	record.backoffUntil = now.Add(backoff)
+}
+
+// The client got past the conflict, so the streak is over.
+func (c *conflictTracker) clearConflicts(userId auth.UserId) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.records, userId)
+}
+
+// How much longer the user should back off for. Zero if they don't need to.
+func (c *conflictTracker) backoff(userId auth.UserId) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record, ok := c.records[userId]
+	if !ok {
+		return 0
+	}
+	if remaining := record.backoffUntil.Sub(c.now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// If backoff is enabled and the user is in it, respond with a 429 and return
+// false. Otherwise, return true and let the request go ahead.
+func (s *Server) checkConflictBackoff(w http.ResponseWriter, userId auth.UserId) bool {
+	conflictBackoff, err := env.GetConflictBackoff(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting conflict backoff setting")
+		return false
+	}
+	if !conflictBackoff {
+		return true
+	}
+	if backoff := s.conflicts.backoff(userId); backoff > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(backoff.Seconds()))))
+		errorJson(w, http.StatusTooManyRequests, "Too many conflicting wallet updates")
+		return false
+	}
+	return true
+}
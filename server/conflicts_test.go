@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func conflictLoopCount() float64 {
+	return testutil.ToFloat64(metrics.ErrorsCount.With(prometheus.Labels{"error_type": "wallet-conflict-loop"}))
+}
+
+func TestServerConflictTracker(t *testing.T) {
+	now := time.Now()
+	c := newConflictTracker()
+	c.now = func() time.Time { return now }
+
+	userId := auth.UserId(37)
+	otherUserId := auth.UserId(38)
+	loopCountBefore := conflictLoopCount()
+
+	// Under the threshold: no backoff, nothing flagged
+	for i := 0; i < conflictLoopThreshold-1; i++ {
+		c.recordConflict(userId)
+		now = now.Add(time.Second)
+	}
+	if backoff := c.backoff(userId); backoff != 0 {
+		t.Fatalf("Expected no backoff under the threshold, got %s", backoff)
+	}
+	if want, got := loopCountBefore, conflictLoopCount(); want != got {
+		t.Fatalf("Expected conflict loop count %f, got %f", want, got)
+	}
+
+	// Hit the threshold: flagged once, and backoff engages
+	c.recordConflict(userId)
+	if want, got := loopCountBefore+1, conflictLoopCount(); want != got {
+		t.Fatalf("Expected conflict loop count %f, got %f", want, got)
+	}
+	if want, got := conflictBackoffMin, c.backoff(userId); want != got {
+		t.Fatalf("Expected backoff %s, got %s", want, got)
+	}
+
+	// Other users are unaffected
+	if backoff := c.backoff(otherUserId); backoff != 0 {
+		t.Fatalf("Expected no backoff for other user, got %s", backoff)
+	}
+
+	// Another conflict after the backoff: backoff escalates, but it's not
+	// flagged again for the same streak
+	now = now.Add(conflictBackoffMin)
+	c.recordConflict(userId)
+	if want, got := conflictBackoffMin*2, c.backoff(userId); want != got {
+		t.Fatalf("Expected backoff %s, got %s", want, got)
+	}
+	if want, got := loopCountBefore+1, conflictLoopCount(); want != got {
+		t.Fatalf("Expected conflict loop count %f, got %f", want, got)
+	}
+
+	// Backoff is capped
+	for i := 0; i < 40; i++ {
+		c.recordConflict(userId)
+	}
+	if want, got := conflictBackoffMax, c.backoff(userId); want != got {
+		t.Fatalf("Expected backoff %s, got %s", want, got)
+	}
+
+	// Ages out: after the backoff and the streak window are both over, the
+	// record is gone and a new conflict starts a new streak.
+	now = now.Add(conflictBackoffMax + conflictStreakWindow + time.Second)
+	if backoff := c.backoff(userId); backoff != 0 {
+		t.Fatalf("Expected no backoff after aging out, got %s", backoff)
+	}
+	c.recordConflict(otherUserId) // triggers a sweep
+	if _, ok := c.records[userId]; ok {
+		t.Fatalf("Expected record to be swept after aging out")
+	}
+	c.recordConflict(userId)
+	if want, got := 1, c.records[userId].count; want != got {
+		t.Fatalf("Expected a new streak with count %d, got %d", want, got)
+	}
+
+	// A successful update ends the streak
+	c.clearConflicts(userId)
+	if _, ok := c.records[userId]; ok {
+		t.Fatalf("Expected record to be cleared")
+	}
+}
+
+// Simulate a client stuck on a bad sequence number, and make sure the handler
+// starts turning it away with 429s.
+func TestServerPostWalletConflictBackoff(t *testing.T) {
+	tt := []struct {
+		name              string
+		backoffEnabled    bool
+		expectBackoff     bool
+		expectLoopFlagged bool
+	}{
+		{
+			name:              "backoff enabled",
+			backoffEnabled:    true,
+			expectBackoff:     true,
+			expectLoopFlagged: true,
+		}, {
+			name:              "backoff disabled",
+			backoffEnabled:    false,
+			expectBackoff:     false,
+			expectLoopFlagged: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence},
+			}
+			testEnv := TestEnv{env: map[string]string{"CONFLICT_BACKOFF": fmt.Sprintf("%t", tc.backoffEnabled)}}
+
+			s := Init(&TestAuth{}, &testStore, &testEnv, &TestMail{}, TestConfig)
+
+			loopCountBefore := conflictLoopCount()
+
+			postWallet := func() *httptest.ResponseRecorder {
+				testStore.Called.SetWallet = SetWalletCall{}
+				requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`)
+				req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+				w := httptest.NewRecorder()
+				s.postWallet(w, req)
+				return w
+			}
+
+			for i := 0; i < conflictLoopThreshold; i++ {
+				w := postWallet()
+				expectStatusCode(t, w, http.StatusConflict)
+			}
+
+			if want, got := tc.expectLoopFlagged, conflictLoopCount() == loopCountBefore+1; want != got {
+				t.Errorf("Expected conflict loop flagged: %t", want)
+			}
+
+			w := postWallet()
+			body, _ := ioutil.ReadAll(w.Body)
+
+			if tc.expectBackoff {
+				expectStatusCode(t, w, http.StatusTooManyRequests)
+				expectErrorString(t, body, http.StatusText(http.StatusTooManyRequests)+": Too many conflicting wallet updates")
+				if want, got := "1", w.Result().Header.Get("Retry-After"); want != got {
+					t.Errorf("Expected Retry-After %s, got %s", want, got)
+				}
+				if testStore.Called.SetWallet != (SetWalletCall{}) {
+					t.Errorf("Expected SetWallet not to be called during backoff")
+				}
+			} else {
+				expectStatusCode(t, w, http.StatusConflict)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Lets browser clients on other origins (such as a web wallet) call the API.
+// Only origins on the allowlist (CORS_ALLOWED_ORIGINS) get the headers that
+// let the browser go through with it. With an empty allowlist this does
+// nothing, and browsers only allow the server's own origin.
+//
+// The API doesn't use cookies; clients send their token in the request. So
+// there's no Access-Control-Allow-Credentials. We still give back the
+// matching origin rather than a wildcard, which is what browsers expect if a
+// client sends credentials anyway.
+
+var corsAllowedMethods = strings.Join([]string{http.MethodGet, http.MethodHead, http.MethodPost}, ", ")
+
+var corsAllowedHeaders = strings.Join([]string{
+	"Authorization",
+	"Content-Type",
+	"If-Match",
+	SignatureHeader,
+	SignatureTimestampHeader,
+	SignatureNonceHeader,
+}, ", ")
+
+// Headers a browser client can read from the response besides the basic
+// ones. Retry-After goes with 429s, WWW-Authenticate with 401s, and ETag and
+// WalletSequenceHeader with wallets.
+const corsExposedHeaders = "Retry-After, WWW-Authenticate, ETag, " + WalletSequenceHeader
+
+// How long the browser can remember the answer to a preflight request
+const corsMaxAge = "600"
+
+func cors(allowedOrigins []string, handler http.Handler) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return handler
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+
+		// Caches need to know the response depends on it
+		w.Header().Add("Vary", "Origin")
+
+		if allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		// The browser asking whether it can make the actual request. None of our
+		// endpoints take OPTIONS, so answer here. If the origin isn't allowed,
+		// there are no CORS headers and the browser won't go through with it.
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
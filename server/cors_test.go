@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func TestServerCors(t *testing.T) {
+	tt := []struct {
+		name           string
+		allowedOrigins []string
+		method         string
+		origin         string
+		preflight      bool
+
+		expectedStatusCode  int
+		expectedAllowOrigin string
+		expectHandlerCalled bool
+	}{
+		{
+			name:                "allowed origin",
+			allowedOrigins:      []string{"https://wallet.example.com", "http://localhost:3000"},
+			method:              http.MethodPost,
+			origin:              "http://localhost:3000",
+			expectedStatusCode:  http.StatusOK,
+			expectedAllowOrigin: "http://localhost:3000",
+			expectHandlerCalled: true,
+		},
+		{
+			name:                "other origin",
+			allowedOrigins:      []string{"https://wallet.example.com"},
+			method:              http.MethodPost,
+			origin:              "https://evil.example.com",
+			expectedStatusCode:  http.StatusOK,
+			expectHandlerCalled: true,
+		},
+		{
+			name:                "no origin",
+			allowedOrigins:      []string{"https://wallet.example.com"},
+			method:              http.MethodGet,
+			expectedStatusCode:  http.StatusOK,
+			expectHandlerCalled: true,
+		},
+		{
+			name:                "preflight from allowed origin",
+			allowedOrigins:      []string{"https://wallet.example.com"},
+			method:              http.MethodOptions,
+			origin:              "https://wallet.example.com",
+			preflight:           true,
+			expectedStatusCode:  http.StatusNoContent,
+			expectedAllowOrigin: "https://wallet.example.com",
+		},
+		{
+			name:               "preflight from other origin",
+			allowedOrigins:     []string{"https://wallet.example.com"},
+			method:             http.MethodOptions,
+			origin:             "https://evil.example.com",
+			preflight:          true,
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:                "disabled",
+			method:              http.MethodOptions,
+			origin:              "https://wallet.example.com",
+			preflight:           true,
+			expectedStatusCode:  http.StatusOK,
+			expectHandlerCalled: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			handlerCalled := false
+			handler := cors(tc.allowedOrigins, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handlerCalled = true
+			}))
+
+			req := httptest.NewRequest(tc.method, paths.PathWallet, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				req.Header.Set("Access-Control-Request-Headers", "content-type")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if handlerCalled != tc.expectHandlerCalled {
+				t.Errorf("Expected handler called to be %v", tc.expectHandlerCalled)
+			}
+
+			header := w.Result().Header
+			if allowOrigin := header.Get("Access-Control-Allow-Origin"); allowOrigin != tc.expectedAllowOrigin {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tc.expectedAllowOrigin, allowOrigin)
+			}
+
+			expectPreflightHeaders := tc.preflight && tc.expectedAllowOrigin != ""
+			if got := header.Get("Access-Control-Allow-Methods") != ""; got != expectPreflightHeaders {
+				t.Errorf("Expected Access-Control-Allow-Methods to be set: %v, got %q", expectPreflightHeaders, header.Get("Access-Control-Allow-Methods"))
+			}
+			if got := header.Get("Access-Control-Allow-Headers") != ""; got != expectPreflightHeaders {
+				t.Errorf("Expected Access-Control-Allow-Headers to be set: %v, got %q", expectPreflightHeaders, header.Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+
+	"lbryio/wallet-sync-server/store"
+)
+
+// For clients to tell errors apart without going by the English in the
+// `error` string, which may change. The codes themselves won't, so clients
+// can branch on them. Every error response has one. Errors that don't get a
+// more specific code below get the one for their status.
+type ErrorCode string
+
+const (
+	// By status
+	ErrorCodeBadRequest         ErrorCode = "BAD_REQUEST"
+	ErrorCodeUnauthorized       ErrorCode = "UNAUTHORIZED"
+	ErrorCodeForbidden          ErrorCode = "FORBIDDEN"
+	ErrorCodeNotFound           ErrorCode = "NOT_FOUND"
+	ErrorCodeMethodNotAllowed   ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrorCodeConflict           ErrorCode = "CONFLICT"
+	ErrorCodePreconditionFailed ErrorCode = "PRECONDITION_FAILED"
+	ErrorCodeTooLarge           ErrorCode = "TOO_LARGE"
+	ErrorCodeUnsupportedMedia   ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	ErrorCodeLocked             ErrorCode = "LOCKED"
+	ErrorCodeRateLimited        ErrorCode = "RATE_LIMITED"
+	ErrorCodeInternal           ErrorCode = "INTERNAL_ERROR"
+	ErrorCodeUnavailable        ErrorCode = "UNAVAILABLE"
+	ErrorCodeUnknown            ErrorCode = "ERROR"
+
+	// Requests
+	ErrorCodeInvalidJson      ErrorCode = "INVALID_JSON"
+	ErrorCodeValidationFailed ErrorCode = "VALIDATION_FAILED"
+	ErrorCodeBodyTooLarge     ErrorCode = "BODY_TOO_LARGE"
+
+	// Tokens. A token that expired is the same as one that never existed, as
+	// far as the store is concerned, so they share INVALID_TOKEN.
+	ErrorCodeMissingToken      ErrorCode = "MISSING_TOKEN"
+	ErrorCodeInvalidToken      ErrorCode = "INVALID_TOKEN"
+	ErrorCodeInsufficientScope ErrorCode = "INSUFFICIENT_SCOPE"
+
+	// Wallets
+	ErrorCodeNoWallet          ErrorCode = "NO_WALLET"
+	ErrorCodeWrongSequence     ErrorCode = "WRONG_SEQUENCE"
+	ErrorCodeWrongParentHmac   ErrorCode = "WRONG_PARENT_HMAC"
+	ErrorCodeMissingParentHmac ErrorCode = "MISSING_PARENT_HMAC"
+	ErrorCodeInvalidHmac       ErrorCode = "INVALID_HMAC"
+	ErrorCodeWalletTooLarge    ErrorCode = "WALLET_TOO_LARGE"
+	ErrorCodeWalletExists      ErrorCode = "WALLET_EXISTS"
+	ErrorCodeSequenceExhausted ErrorCode = "SEQUENCE_EXHAUSTED"
+
+	// Accounts
+	ErrorCodeWrongCredentials   ErrorCode = "WRONG_CREDENTIALS"
+	ErrorCodeNotVerified        ErrorCode = "NOT_VERIFIED"
+	ErrorCodeAccountLocked      ErrorCode = "ACCOUNT_LOCKED"
+	ErrorCodeEmailExists        ErrorCode = "EMAIL_EXISTS"
+	ErrorCodeEmailReserved      ErrorCode = "EMAIL_RESERVED"
+	ErrorCodeInvalidEmail       ErrorCode = "INVALID_EMAIL"
+	ErrorCodeWeakPassword       ErrorCode = "WEAK_PASSWORD"
+	ErrorCodePasswordTooShort   ErrorCode = "PASSWORD_TOO_SHORT"
+	ErrorCodeDeviceIdInUse      ErrorCode = "DEVICE_ID_IN_USE"
+	ErrorCodeInvalidDeviceId    ErrorCode = "INVALID_DEVICE_ID"
+	ErrorCodeTotpRequired       ErrorCode = "TOTP_REQUIRED"
+	ErrorCodeTotpInvalid        ErrorCode = "TOTP_INVALID"
+	ErrorCodeTotpAlreadyEnabled ErrorCode = "TOTP_ALREADY_ENABLED"
+	ErrorCodeTotpNotEnrolled    ErrorCode = "TOTP_NOT_ENROLLED"
+)
+
+var statusErrorCodes = map[int]ErrorCode{
+	http.StatusBadRequest:            ErrorCodeBadRequest,
+	http.StatusUnauthorized:          ErrorCodeUnauthorized,
+	http.StatusForbidden:             ErrorCodeForbidden,
+	http.StatusNotFound:              ErrorCodeNotFound,
+	http.StatusMethodNotAllowed:      ErrorCodeMethodNotAllowed,
+	http.StatusConflict:              ErrorCodeConflict,
+	http.StatusPreconditionFailed:    ErrorCodePreconditionFailed,
+	http.StatusRequestEntityTooLarge: ErrorCodeTooLarge,
+	http.StatusUnsupportedMediaType:  ErrorCodeUnsupportedMedia,
+	http.StatusLocked:                ErrorCodeLocked,
+	http.StatusTooManyRequests:       ErrorCodeRateLimited,
+	http.StatusInternalServerError:   ErrorCodeInternal,
+	http.StatusServiceUnavailable:    ErrorCodeUnavailable,
+}
+
+// What the client hears about each store error. Handlers hand their store
+// errors to storeErrorJson, so a given error gets the same status and code
+// from every endpoint, and a new one only needs a line here. Anything not
+// listed is our problem rather than the client's, and comes out as a 500.
+type storeErrorDetails struct {
+	status  int
+	code    ErrorCode
+	message string
+}
+
+var storeErrors = map[error]storeErrorDetails{
+	store.ErrNoTokenForUserDevice: {http.StatusUnauthorized, ErrorCodeInvalidToken, "Token Not Found"},
+	store.ErrDuplicateToken:       {http.StatusConflict, ErrorCodeDeviceIdInUse, "Device id is already in use for this account"},
+	store.ErrInvalidDeviceId:      {http.StatusBadRequest, ErrorCodeInvalidDeviceId, "Invalid 'deviceId'"},
+
+	store.ErrNoWallet:         {http.StatusNotFound, ErrorCodeNoWallet, "No wallet"},
+	store.ErrWrongSequence:    {http.StatusConflict, ErrorCodeWrongSequence, "Bad sequence number"},
+	store.ErrWrongParentHmac:  {http.StatusConflict, ErrorCodeWrongParentHmac, "Parent hmac does not match"},
+	store.ErrNoParentHmac:     {http.StatusBadRequest, ErrorCodeMissingParentHmac, "Missing 'parentHmac'"},
+	store.ErrInvalidHmac:      {http.StatusBadRequest, ErrorCodeInvalidHmac, "Request failed validation: Invalid 'hmac'"},
+	store.ErrWalletTooLarge:   {http.StatusRequestEntityTooLarge, ErrorCodeWalletTooLarge, "Wallet is too large"},
+	store.ErrUnexpectedWallet: {http.StatusConflict, ErrorCodeWalletExists, "Wallet exists; need an updated wallet when changing password"},
+	store.ErrDuplicateWallet:  {http.StatusConflict, ErrorCodeWalletExists, "Wallet already exists"},
+	// Not a conflict; trying again won't help
+	store.ErrSequenceExhausted: {http.StatusBadRequest, ErrorCodeSequenceExhausted, "Sequence is past the highest this server allows"},
+
+	store.ErrWrongCredentials:   {http.StatusUnauthorized, ErrorCodeWrongCredentials, "No match for email and/or password"},
+	store.ErrNotVerified:        {http.StatusUnauthorized, ErrorCodeNotVerified, "Account is not verified"},
+	store.ErrAccountLocked:      {http.StatusLocked, ErrorCodeAccountLocked, "Account is locked after too many failed logins. Try again later."},
+	store.ErrDuplicateEmail:     {http.StatusConflict, ErrorCodeEmailExists, "An account with this email address already exists"},
+	store.ErrDuplicateAccount:   {http.StatusConflict, ErrorCodeEmailExists, "An account with this email address already exists"},
+	store.ErrEmailReserved:      {http.StatusConflict, ErrorCodeEmailReserved, "The account with this email address was deleted recently. Try again later."},
+	store.ErrInvalidEmail:       {http.StatusBadRequest, ErrorCodeInvalidEmail, "Invalid 'email'"},
+	store.ErrWeakPassword:       {http.StatusBadRequest, ErrorCodeWeakPassword, "Password is too easy to guess"},
+	store.ErrPasswordTooShort:   {http.StatusBadRequest, ErrorCodePasswordTooShort, "Password is too short"},
+	store.ErrTotpRequired:       {http.StatusUnauthorized, ErrorCodeTotpRequired, "Two-factor code required"},
+	store.ErrTotpInvalid:        {http.StatusUnauthorized, ErrorCodeTotpInvalid, "Invalid two-factor code"},
+	store.ErrTotpAlreadyEnabled: {http.StatusConflict, ErrorCodeTotpAlreadyEnabled, "Two-factor authentication is already enabled"},
+	store.ErrTotpNotEnrolled:    {http.StatusConflict, ErrorCodeTotpNotEnrolled, "Enroll in two-factor authentication first"},
+}
+
+// The status and response for an error from the store
+func errorToResponse(err error) (int, ErrorResponse) {
+	details, ok := storeErrors[err]
+	if !ok {
+		// Don't report any details to the user
+		status := http.StatusInternalServerError
+		return status, ErrorResponse{Error: http.StatusText(status), Code: ErrorCodeInternal, Retryable: true}
+	}
+	return details.status, ErrorResponse{
+		Error:     http.StatusText(details.status) + ": " + details.message,
+		Code:      details.code,
+		Retryable: retryableStatus(details.status),
+	}
+}
+
+func statusErrorCode(status int) ErrorCode {
+	if errorCode, ok := statusErrorCodes[status]; ok {
+		return errorCode
+	}
+	return ErrorCodeUnknown
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+// Store errors come through to the client with their codes, along with the
+// message
+func TestServerErrorCodes(t *testing.T) {
+	getWallet := func(s *Server) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+		w := httptest.NewRecorder()
+		s.getWallet(w, req)
+		return w
+	}
+	postWallet := func(s *Server) *httptest.ResponseRecorder {
+		requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`)
+		req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+		w := httptest.NewRecorder()
+		s.postWallet(w, req)
+		return w
+	}
+	login := func(s *Server) *httptest.ResponseRecorder {
+		requestBody := []byte(`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`)
+		req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer(requestBody))
+		w := httptest.NewRecorder()
+		s.getAuthToken(w, req)
+		return w
+	}
+
+	tt := []struct {
+		name    string
+		request func(s *Server) *httptest.ResponseRecorder
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedErrorCode   ErrorCode
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:                "no wallet",
+			request:             getWallet,
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+			expectedErrorCode:   ErrorCodeNoWallet,
+
+			storeErrors: TestStoreFunctionsErrors{GetWallet: store.ErrNoWallet},
+		},
+		{
+			name:                "wrong sequence",
+			request:             postWallet,
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectedErrorCode:   ErrorCodeWrongSequence,
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence},
+		},
+		{
+			name:                "wrong parent hmac",
+			request:             postWallet,
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Parent hmac does not match",
+			expectedErrorCode:   ErrorCodeWrongParentHmac,
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrWrongParentHmac},
+		},
+		{
+			name:                "invalid token",
+			request:             getWallet,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectedErrorCode:   ErrorCodeInvalidToken,
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:                "wrong credentials",
+			request:             login,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": No match for email and/or password",
+			expectedErrorCode:   ErrorCodeWrongCredentials,
+
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrWrongCredentials},
+		},
+		{
+			name:                "account locked",
+			request:             login,
+			expectedStatusCode:  http.StatusLocked,
+			expectedErrorString: http.StatusText(http.StatusLocked) + ": Account is locked after too many failed logins. Try again later.",
+			expectedErrorCode:   ErrorCodeAccountLocked,
+
+			storeErrors: TestStoreFunctionsErrors{GetUserId: store.ErrAccountLocked},
+		},
+		{
+			name:                "db error",
+			request:             getWallet,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetWallet: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: auth.AuthTokenString("seekrit"), Scope: auth.ScopeFull},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			w := tc.request(s)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+			expectErrorCode(t, body, tc.expectedErrorCode)
+		})
+	}
+}
+
+// Statuses without a code of their own still get one
+func TestServerErrorCodeUnknownStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	errorJson(w, http.StatusTeapot, "")
+	body, _ := ioutil.ReadAll(w.Body)
+	expectErrorCode(t, body, ErrorCodeUnknown)
+}
+
+// Every store error gets the same response wherever it comes from
+func TestServerErrorToResponse(t *testing.T) {
+	tt := []struct {
+		err error
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedErrorCode   ErrorCode
+	}{
+		{store.ErrDuplicateToken, http.StatusConflict, "Device id is already in use for this account", ErrorCodeDeviceIdInUse},
+		{store.ErrNoTokenForUserDevice, http.StatusUnauthorized, "Token Not Found", ErrorCodeInvalidToken},
+		{store.ErrInvalidDeviceId, http.StatusBadRequest, "Invalid 'deviceId'", ErrorCodeInvalidDeviceId},
+
+		{store.ErrDuplicateWallet, http.StatusConflict, "Wallet already exists", ErrorCodeWalletExists},
+		{store.ErrNoWallet, http.StatusNotFound, "No wallet", ErrorCodeNoWallet},
+		{store.ErrUnexpectedWallet, http.StatusConflict, "Wallet exists; need an updated wallet when changing password", ErrorCodeWalletExists},
+		{store.ErrWrongSequence, http.StatusConflict, "Bad sequence number", ErrorCodeWrongSequence},
+		{store.ErrWrongParentHmac, http.StatusConflict, "Parent hmac does not match", ErrorCodeWrongParentHmac},
+		{store.ErrNoParentHmac, http.StatusBadRequest, "Missing 'parentHmac'", ErrorCodeMissingParentHmac},
+		{store.ErrWalletTooLarge, http.StatusRequestEntityTooLarge, "Wallet is too large", ErrorCodeWalletTooLarge},
+		{store.ErrInvalidHmac, http.StatusBadRequest, "Request failed validation: Invalid 'hmac'", ErrorCodeInvalidHmac},
+		{store.ErrSequenceExhausted, http.StatusBadRequest, "Sequence is past the highest this server allows", ErrorCodeSequenceExhausted},
+
+		{store.ErrDuplicateEmail, http.StatusConflict, "An account with this email address already exists", ErrorCodeEmailExists},
+		{store.ErrDuplicateAccount, http.StatusConflict, "An account with this email address already exists", ErrorCodeEmailExists},
+		{store.ErrEmailReserved, http.StatusConflict, "The account with this email address was deleted recently. Try again later.", ErrorCodeEmailReserved},
+		{store.ErrInvalidEmail, http.StatusBadRequest, "Invalid 'email'", ErrorCodeInvalidEmail},
+
+		{store.ErrWrongCredentials, http.StatusUnauthorized, "No match for email and/or password", ErrorCodeWrongCredentials},
+		{store.ErrNotVerified, http.StatusUnauthorized, "Account is not verified", ErrorCodeNotVerified},
+		{store.ErrAccountLocked, http.StatusLocked, "Account is locked after too many failed logins. Try again later.", ErrorCodeAccountLocked},
+
+		{store.ErrTotpRequired, http.StatusUnauthorized, "Two-factor code required", ErrorCodeTotpRequired},
+		{store.ErrTotpInvalid, http.StatusUnauthorized, "Invalid two-factor code", ErrorCodeTotpInvalid},
+		{store.ErrTotpAlreadyEnabled, http.StatusConflict, "Two-factor authentication is already enabled", ErrorCodeTotpAlreadyEnabled},
+		{store.ErrTotpNotEnrolled, http.StatusConflict, "Enroll in two-factor authentication first", ErrorCodeTotpNotEnrolled},
+
+		{store.ErrWeakPassword, http.StatusBadRequest, "Password is too easy to guess", ErrorCodeWeakPassword},
+		{store.ErrPasswordTooShort, http.StatusBadRequest, "Password is too short", ErrorCodePasswordTooShort},
+
+		// Not for the client to hear about. The email verify page deals with
+		// ErrNoTokenForUser itself, and an unsanitary token is a bug on our end.
+		{store.ErrNoTokenForUser, http.StatusInternalServerError, "", ErrorCodeInternal},
+		{store.ErrUnsanitaryToken, http.StatusInternalServerError, "", ErrorCodeInternal},
+		{fmt.Errorf("Some random DB Error!"), http.StatusInternalServerError, "", ErrorCodeInternal},
+	}
+	for _, tc := range tt {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			statusCode, errorResponse := errorToResponse(tc.err)
+
+			if statusCode != tc.expectedStatusCode {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatusCode, statusCode)
+			}
+			expectedErrorString := http.StatusText(tc.expectedStatusCode)
+			if tc.expectedErrorString != "" {
+				expectedErrorString += ": " + tc.expectedErrorString
+			}
+			if errorResponse.Error != expectedErrorString {
+				t.Errorf("Expected error string %q, got %q", expectedErrorString, errorResponse.Error)
+			}
+			if errorResponse.Code != tc.expectedErrorCode {
+				t.Errorf("Expected code %s, got %s", tc.expectedErrorCode, errorResponse.Code)
+			}
+			if errorResponse.Retryable != retryableStatus(tc.expectedStatusCode) {
+				t.Errorf("Expected retryable to be %v", retryableStatus(tc.expectedStatusCode))
+			}
+		})
+	}
+
+	// Anything the handlers are meant to tell the client about should be above
+	for err := range storeErrors {
+		found := false
+		for _, tc := range tt {
+			found = found || tc.err == err
+		}
+		if !found {
+			t.Errorf("Expected a test case for %q", err.Error())
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Conditional requests for the wallet. GET /wallet gives the version it
+// returned as an ETag, and POST /wallet takes it back in If-Match to say
+// which version the update was built on, instead of (or as well as) the
+// sequence in the body.
+//
+// The ETag is made from the sequence and the hmac, so two different wallets
+// that happen to be at the same sequence (say, two devices that each saved
+// one) get different ETags. The hmac goes in hashed since it comes from the
+// client and could have anything in it, including quotes.
+func walletETag(sequence wallet.Sequence, hmac wallet.WalletHmac) string {
+	hmacHash := sha256.Sum256([]byte(hmac))
+	return fmt.Sprintf(`"%d-%s"`, sequence, hex.EncodeToString(hmacHash[:16]))
+}
+
+// Whether any of the ETags in an If-Match header is the given one, or the
+// header is "*". Weak ETags (W/"...") never match, since If-Match uses strong
+// comparison, and we never give out weak ones anyway.
+func ifMatchMatches(ifMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func preconditionFailedJson(w http.ResponseWriter) {
+	errorJson(w, http.StatusPreconditionFailed, "Wallet has changed since the version in If-Match")
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerIfMatchMatches(t *testing.T) {
+	etag := walletETag(wallet.Sequence(3), wallet.WalletHmac("my-hmac"))
+
+	tt := []struct {
+		name    string
+		ifMatch string
+		matches bool
+	}{
+		{"same", etag, true},
+		{"any", "*", true},
+		{"in a list", `"1-abcd", ` + etag, true},
+		{"different", walletETag(wallet.Sequence(3), wallet.WalletHmac("my-other-hmac")), false},
+		{"weak", "W/" + etag, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ifMatchMatches(tc.ifMatch, etag); got != tc.matches {
+				t.Errorf("Expected ifMatchMatches(%q) to be %v", tc.ifMatch, tc.matches)
+			}
+		})
+	}
+}
+
+// Get the wallet's ETag, then update the wallet with it in If-Match rather
+// than a sequence. An update built on an old ETag fails with a 412.
+func TestServerWalletIfMatch(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+
+	postWallet := func(walletRequest interface{}, ifMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(walletRequest)
+		req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		s.postWallet(w, req)
+		return w
+	}
+	getWalletETag := func() string {
+		req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token="+string(authToken.Token), nil)
+		w := httptest.NewRecorder()
+		s.getWallet(w, req)
+		expectStatusCode(t, w, http.StatusOK)
+		return w.Result().Header.Get("ETag")
+	}
+
+	// The usual way, with a sequence, still works, and gives an ETag
+	w := postWallet(WalletRequest{Token: authToken.Token, EncryptedWallet: "my-encrypted-wallet-1", Sequence: 1, Hmac: "my-hmac-1"}, "")
+	expectStatusCode(t, w, http.StatusOK)
+	etag1 := getWalletETag()
+	if etag1 == "" || w.Result().Header.Get("ETag") != etag1 {
+		t.Fatalf("Expected the same ETag from POST and GET: %q %q", w.Result().Header.Get("ETag"), etag1)
+	}
+
+	// No sequence; it's the one after the ETag's
+	w = postWallet(map[string]string{"token": string(authToken.Token), "encryptedWallet": "my-encrypted-wallet-2", "hmac": "my-hmac-2"}, etag1)
+	expectStatusCode(t, w, http.StatusOK)
+	_, sequence, hmac, _, err := st.GetWallet(context.Background(), authToken.UserId, wallet.DefaultAppId)
+	if err != nil || sequence != 2 || hmac != "my-hmac-2" {
+		t.Fatalf("Expected the wallet at sequence 2: sequence %d hmac %s err %+v", sequence, hmac, err)
+	}
+	etag2 := getWalletETag()
+	if etag2 == etag1 || w.Result().Header.Get("ETag") != etag2 {
+		t.Fatalf("Expected a new ETag: %q %q %q", etag1, w.Result().Header.Get("ETag"), etag2)
+	}
+
+	// Built on the old version
+	w = postWallet(map[string]string{"token": string(authToken.Token), "encryptedWallet": "my-encrypted-wallet-3", "hmac": "my-hmac-3"}, etag1)
+	expectStatusCode(t, w, http.StatusPreconditionFailed)
+	expectErrorString(t, w.Body.Bytes(), http.StatusText(http.StatusPreconditionFailed)+": Wallet has changed since the version in If-Match")
+
+	// Right ETag, but a sequence in the body that doesn't follow from it
+	w = postWallet(WalletRequest{Token: authToken.Token, EncryptedWallet: "my-encrypted-wallet-3", Sequence: 4, Hmac: "my-hmac-3"}, etag2)
+	expectStatusCode(t, w, http.StatusPreconditionFailed)
+
+	if got := getWalletETag(); got != etag2 {
+		t.Errorf("Expected the wallet to be unchanged, got ETag %q", got)
+	}
+}
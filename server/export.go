@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Everything a client needs to move the account to another server: the
+// wallet, and what's needed to log in and decrypt it there (given the
+// password, which we never have). Devices are included so the user can see
+// where they were logged in, but not their tokens, which are no good anywhere
+// else. Nothing derived from the password is included either. See
+// ImportRequest for the other end.
+type ExportResponse struct {
+	Email          auth.Email          `json:"email"`
+	ClientSaltSeed auth.ClientSaltSeed `json:"clientSaltSeed"`
+	Wallet         WalletResponse      `json:"wallet"`
+	AppWallets     []ExportAppWallet   `json:"appWallets"`
+	Devices        []DeviceResponse    `json:"devices"`
+}
+
+// Another app's wallet (see wallet.AppId), in an export and the import that
+// follows it. Same fields as WalletResponse.
+type ExportAppWallet struct {
+	AppId             wallet.AppId             `json:"appId"`
+	EncryptedWallet   wallet.EncryptedWallet   `json:"encryptedWallet"`
+	Sequence          wallet.Sequence          `json:"sequence"`
+	Hmac              wallet.WalletHmac        `json:"hmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
+}
+
+// Takes `token`. Responds with ExportResponse, or a 404 if there's no wallet to
+// export yet.
+func (s *Server) getExport(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "GET", "endpoint": "export"}).Inc()
+
+	if !getGetData(w, req) {
+		return
+	}
+
+	token := getTokenParam(req)
+
+	authToken := s.checkAuth(req, w, token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	encryptedWallet, sequence, hmac, encryptionVersion, err := s.store.GetWallet(req.Context(), authToken.UserId, wallet.DefaultAppId)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error retrieving wallet")
+		return
+	}
+
+	appIds, err := s.store.GetWalletAppIds(req.Context(), authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting wallet app ids")
+		return
+	}
+	appWallets := []ExportAppWallet{}
+	for _, appId := range appIds {
+		// Already have that one
+		if appId == wallet.DefaultAppId {
+			continue
+		}
+		appWallet := ExportAppWallet{AppId: appId}
+		appWallet.EncryptedWallet, appWallet.Sequence, appWallet.Hmac, appWallet.EncryptionVersion, err = s.store.GetWallet(req.Context(), authToken.UserId, appId)
+		if err != nil {
+			// It was there a moment ago, so even ErrNoWallet is unexpected here
+			internalServiceErrorJson(w, err, "Error retrieving app wallet")
+			return
+		}
+		appWallets = append(appWallets, appWallet)
+	}
+
+	email, err := s.store.GetEmail(req.Context(), authToken.UserId)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting email")
+		return
+	}
+
+	clientSaltSeed, err := s.store.GetClientSaltSeed(req.Context(), email)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting client salt seed")
+		return
+	}
+
+	// All of them, unlike GET /devices
+	devices, ok := s.listDevices(req.Context(), w, authToken.UserId, 0, 0)
+	if !ok {
+		return
+	}
+
+	response, err := json.Marshal(ExportResponse{
+		Email:          email,
+		ClientSaltSeed: clientSaltSeed,
+		Wallet: WalletResponse{
+			EncryptedWallet:   encryptedWallet,
+			Sequence:          sequence,
+			Hmac:              hmac,
+			EncryptionVersion: encryptionVersion,
+		},
+		AppWallets: appWallets,
+		Devices:    devices,
+	})
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating exportResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
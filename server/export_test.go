@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerExport(t *testing.T) {
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+
+	tt := []struct {
+		name       string
+		tokenScope auth.AuthScope
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedErrorCode   ErrorCode
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			tokenScope:         auth.ScopeFull,
+			expectedStatusCode: http.StatusOK,
+		}, {
+			name:                "get-wallet token",
+			tokenScope:          auth.ScopeGetWallet,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Scope",
+			expectedErrorCode:   ErrorCodeInsufficientScope,
+		}, {
+			name:                "no wallet",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+			expectedErrorCode:   ErrorCodeNoWallet,
+
+			storeErrors: TestStoreFunctionsErrors{GetWallet: store.ErrNoWallet},
+		}, {
+			name:                "db error getting wallet",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetWallet: fmt.Errorf("Some random DB Error!")},
+		}, {
+			name:                "db error getting wallet app ids",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletAppIds: fmt.Errorf("Some random DB Error!")},
+		}, {
+			name:                "db error getting email",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetEmail: fmt.Errorf("Some random DB Error!")},
+		}, {
+			name:                "db error getting client salt seed",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetClientSaltSeed: fmt.Errorf("Some random DB Error!")},
+		}, {
+			name:                "db error getting devices",
+			tokenScope:          auth.ScopeFull,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+
+			storeErrors: TestStoreFunctionsErrors{GetTokensForUser: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    tc.tokenScope,
+					UserId:   auth.UserId(37),
+				},
+				TestTokensForUser: []auth.AuthToken{
+					{Token: "seekrit", DeviceId: "dev-1", Scope: auth.ScopeFull, UserId: 37, Expiration: &expiration},
+					{Token: "other-seekrit", DeviceId: "dev-2", Scope: auth.ScopeGetWallet, UserId: 37, Expiration: &expiration},
+				},
+				TestEmail:          auth.Email("abc@example.com"),
+				TestClientSaltSeed: auth.ClientSaltSeed("abcd1234abcd1234"),
+
+				// The test store has the same wallet for every app
+				TestWalletAppIds: []wallet.AppId{wallet.DefaultAppId, "my-app"},
+
+				TestEncryptedWallet:   wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:          wallet.Sequence(5),
+				TestHmac:              wallet.WalletHmac("my-hmac"),
+				TestEncryptionVersion: wallet.EncryptionVersion("my-encryption-version"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathExport, nil)
+			req.Header.Set("Authorization", "Bearer seekrit")
+			w := httptest.NewRecorder()
+
+			s.getExport(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+			expectErrorCode(t, body, tc.expectedErrorCode)
+
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			if strings.Contains(string(body), "seekrit") {
+				t.Errorf("Expected no token strings in the response, got %s", body)
+			}
+
+			var exportResponse ExportResponse
+			if err := json.Unmarshal(body, &exportResponse); err != nil {
+				t.Fatalf("Error decoding export response: %+v", err)
+			}
+
+			expected := ExportResponse{
+				Email:          testStore.TestEmail,
+				ClientSaltSeed: testStore.TestClientSaltSeed,
+				Wallet: WalletResponse{
+					EncryptedWallet:   testStore.TestEncryptedWallet,
+					Sequence:          testStore.TestSequence,
+					Hmac:              testStore.TestHmac,
+					EncryptionVersion: testStore.TestEncryptionVersion,
+				},
+				AppWallets: []ExportAppWallet{{
+					AppId:             "my-app",
+					EncryptedWallet:   testStore.TestEncryptedWallet,
+					Sequence:          testStore.TestSequence,
+					Hmac:              testStore.TestHmac,
+					EncryptionVersion: testStore.TestEncryptionVersion,
+				}},
+				Devices: []DeviceResponse{
+					{DeviceId: "dev-1", Scope: auth.ScopeFull, Expiration: &expiration},
+					{DeviceId: "dev-2", Scope: auth.ScopeGetWallet, Expiration: &expiration},
+				},
+			}
+			if !reflect.DeepEqual(exportResponse, expected) {
+				t.Errorf("Unexpected export response: expected %+v got %+v", expected, exportResponse)
+			}
+
+			if want, got := testStore.TestEmail, testStore.Called.GetClientSaltSeed; want != got {
+				t.Errorf("Expected Store.GetClientSaltSeed to be called with %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+// Against the real store, so that we know what actually comes out of the
+// database. Nothing that isn't in ExportResponse (password hashes and such)
+// can sneak in.
+func TestServerExportRealStore(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("Abc@Example.com"), auth.Password("12345678")
+	seed := auth.ClientSaltSeed("abcd1234abcd1234")
+	if err := st.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+
+	exportPath := paths.PathExport + "?token=" + string(authToken.Token)
+
+	// No wallet yet
+	statusCode, _ = selfTestRequest(s.getExport, http.MethodGet, exportPath, nil, nil)
+	if statusCode != http.StatusNotFound {
+		t.Fatalf("Expected a 404 before there's a wallet, got %d", statusCode)
+	}
+
+	statusCode, err = selfTestRequest(s.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+		Token:           authToken.Token,
+		EncryptedWallet: "my-encrypted-wallet",
+		Sequence:        1,
+		Hmac:            "my-hmac",
+	}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error saving a wallet: status %d err %+v", statusCode, err)
+	}
+
+	var body json.RawMessage
+	statusCode, err = selfTestRequest(s.getExport, http.MethodGet, exportPath, nil, &body)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error exporting: status %d err %+v", statusCode, err)
+	}
+
+	if strings.Contains(string(body), string(authToken.Token)) {
+		t.Errorf("Expected no token strings in the export, got %s", body)
+	}
+
+	var exportFields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &exportFields); err != nil {
+		t.Fatalf("Error decoding export: %+v", err)
+	}
+	var fieldNames []string
+	for fieldName := range exportFields {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	if want, got := []string{"appWallets", "clientSaltSeed", "devices", "email", "wallet"}, fieldNames; !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected export fields %v, got %v", want, got)
+	}
+
+	var exportResponse ExportResponse
+	if err := json.Unmarshal(body, &exportResponse); err != nil {
+		t.Fatalf("Error decoding export: %+v", err)
+	}
+
+	// The email as it was signed up with, not normalized
+	if exportResponse.Email != email || exportResponse.ClientSaltSeed != seed {
+		t.Errorf("Unexpected account in export: %+v", exportResponse)
+	}
+	if exportResponse.Wallet.EncryptedWallet != "my-encrypted-wallet" || exportResponse.Wallet.Sequence != 1 || exportResponse.Wallet.Hmac != "my-hmac" {
+		t.Errorf("Unexpected wallet in export: %+v", exportResponse.Wallet)
+	}
+	// None but the default app's
+	if exportResponse.AppWallets == nil || len(exportResponse.AppWallets) != 0 {
+		t.Errorf("Expected an empty list of app wallets in export, got %+v", exportResponse.AppWallets)
+	}
+	if len(exportResponse.Devices) != 1 || exportResponse.Devices[0].DeviceId != "dev-1" || exportResponse.Devices[0].LastSyncedSequence != 1 {
+		t.Errorf("Unexpected devices in export: %+v", exportResponse.Devices)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Wallets can get big, so the endpoints that return them compress the
+// response for clients that take gzip. Anything smaller than this isn't worth
+// it, which includes all error responses.
+const gzipMinSize = 1024
+
+// Holds on to the response so we can decide whether to compress it once we
+// know how big it is. The responses this is used for are at most about the
+// size of a wallet, so this is fine.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// Whether gzip is in Accept-Encoding, and not with q=0
+func acceptsGzip(req *http.Request) bool {
+	for _, header := range req.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(encoding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			if q == "q=0" || strings.HasPrefix(q, "q=0.") && strings.Trim(q[len("q=0."):], "0") == "" {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func gzipResponse(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// Caches need to know the response depends on it, whether or not we end
+		// up compressing this one
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(req) {
+			handler(w, req)
+			return
+		}
+
+		b := bufferedResponseWriter{ResponseWriter: w}
+		handler(&b, req)
+
+		body := b.body.Bytes()
+
+		// Leave it alone if the handler already encoded it somehow
+		if len(body) >= gzipMinSize && w.Header().Get("Content-Encoding") == "" {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			_, err := gz.Write(body)
+			if err == nil {
+				err = gz.Close()
+			}
+			// If compressing somehow fails, just send it as it is
+			if err == nil {
+				body = compressed.Bytes()
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Del("Content-Length")
+			}
+		}
+
+		if b.code != 0 {
+			w.WriteHeader(b.code)
+		}
+		w.Write(body)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerGzipWallet(t *testing.T) {
+	tt := []struct {
+		name            string
+		acceptEncoding  string
+		encryptedWallet wallet.EncryptedWallet
+
+		expectGzip bool
+	}{
+		{
+			name:            "gzip requested",
+			acceptEncoding:  "gzip, deflate, br",
+			encryptedWallet: wallet.EncryptedWallet(strings.Repeat("my-encrypted-wallet", 1000)),
+			expectGzip:      true,
+		},
+		{
+			name:            "gzip not requested",
+			encryptedWallet: wallet.EncryptedWallet(strings.Repeat("my-encrypted-wallet", 1000)),
+		},
+		{
+			name:            "gzip refused",
+			acceptEncoding:  "gzip;q=0, deflate",
+			encryptedWallet: wallet.EncryptedWallet(strings.Repeat("my-encrypted-wallet", 1000)),
+		},
+		{
+			name:            "too small to bother",
+			acceptEncoding:  "gzip",
+			encryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestEncryptedWallet: tc.encryptedWallet,
+				TestSequence:        wallet.Sequence(5),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			gzipResponse(s.handleWallet)(w, req)
+
+			expectStatusCode(t, w, http.StatusOK)
+			if vary := w.Result().Header.Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Expected Vary: Accept-Encoding, got %q", vary)
+			}
+
+			body := w.Body.Bytes()
+			if tc.expectGzip {
+				if encoding := w.Result().Header.Get("Content-Encoding"); encoding != "gzip" {
+					t.Fatalf("Expected Content-Encoding gzip, got %q", encoding)
+				}
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("Error reading gzip response: %+v", err)
+				}
+				if body, err = ioutil.ReadAll(gz); err != nil {
+					t.Fatalf("Error reading gzip response: %+v", err)
+				}
+			} else if encoding := w.Result().Header.Get("Content-Encoding"); encoding != "" {
+				t.Fatalf("Expected no Content-Encoding, got %q", encoding)
+			}
+
+			var result WalletResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.EncryptedWallet != tc.encryptedWallet {
+				t.Errorf("Expected the wallet in the response: err: %+v", err)
+			}
+		})
+	}
+}
+
+// Errors still come through, with their status code, whether or not the client
+// takes gzip
+func TestServerGzipError(t *testing.T) {
+	testStore := TestStore{}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gzipResponse(s.handleWallet)(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusUnauthorized)
+	expectErrorString(t, body, http.StatusText(http.StatusUnauthorized)+": Missing token")
+	if encoding := w.Result().Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", encoding)
+	}
+}
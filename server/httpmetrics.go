@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/metrics"
+)
+
+// Counts responses by status code and times requests, for every path it
+// wraps, so the handlers don't each have to. Only used if HTTP_METRICS is on.
+//
+// The path label is the path the handler is registered under rather than the
+// one requested, so that requests for made up paths don't each get their own
+// series.
+
+// Keeps track of the status code the handler gives
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// So the websocket can still take over the connection. The upgrade response
+// is written to the connection directly, so note it here.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter does not support Hijack")
+	}
+	if r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Nothing written at all is sent as a 200
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+func instrumentRequests(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := statusRecorder{ResponseWriter: w}
+		handler(&recorder, req)
+
+		metrics.HttpRequestDuration.With(prometheus.Labels{"path": path}).Observe(time.Since(start).Seconds())
+		metrics.HttpResponsesCount.With(prometheus.Labels{"path": path, "code": strconv.Itoa(recorder.status())}).Inc()
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"lbryio/wallet-sync-server/metrics"
+)
+
+func httpResponsesCount(path string, code string) float64 {
+	return testutil.ToFloat64(metrics.HttpResponsesCount.With(prometheus.Labels{"path": path, "code": code}))
+}
+
+func httpRequestDurationCount(t *testing.T, path string) uint64 {
+	var m dto.Metric
+	if err := metrics.HttpRequestDuration.With(prometheus.Labels{"path": path}).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Error reading request duration: %+v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestServerInstrumentRequests(t *testing.T) {
+	const path = "/test/instrumented"
+
+	handler := instrumentRequests(path, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("do") {
+		case "conflict":
+			errorJson(w, http.StatusConflict, "")
+		case "write":
+			w.Write([]byte("{}"))
+		}
+		// otherwise write nothing, which is still a 200
+	})
+
+	okBefore := httpResponsesCount(path, "200")
+	conflictBefore := httpResponsesCount(path, "409")
+	durationBefore := httpRequestDurationCount(t, path)
+
+	for _, do := range []string{"conflict", "write", "", "conflict"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path+"?do="+do, nil))
+	}
+
+	if want, got := okBefore+2, httpResponsesCount(path, "200"); want != got {
+		t.Errorf("Expected %v 200 responses, got %v", want, got)
+	}
+	if want, got := conflictBefore+2, httpResponsesCount(path, "409"); want != got {
+		t.Errorf("Expected %v 409 responses, got %v", want, got)
+	}
+	if want, got := durationBefore+4, httpRequestDurationCount(t, path); want != got {
+		t.Errorf("Expected %d request durations, got %d", want, got)
+	}
+}
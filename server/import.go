@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// The wallets from an ExportResponse on another server, to start this account
+// off with. The user signs up here (with the email and client salt seed from
+// the export) and logs in as usual first.
+type ImportRequest struct {
+	Token             auth.AuthTokenString     `json:"token"`
+	EncryptedWallet   wallet.EncryptedWallet   `json:"encryptedWallet"`
+	Sequence          wallet.Sequence          `json:"sequence"`
+	Hmac              wallet.WalletHmac        `json:"hmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
+
+	// Every other app's wallet, as it was in the export's appWallets
+	AppWallets []ExportAppWallet `json:"appWallets"`
+}
+
+func (r *ImportRequest) validate() error {
+	if r.EncryptedWallet == "" {
+		return fmt.Errorf("Missing 'encryptedWallet'")
+	}
+	if r.Hmac == "" {
+		return fmt.Errorf("Missing 'hmac'")
+	}
+	if r.Sequence < store.InitialWalletSequence {
+		return fmt.Errorf("Missing or zero-value 'sequence'")
+	}
+	appIds := make(map[wallet.AppId]bool)
+	for _, appWallet := range r.AppWallets {
+		// The default app's wallet goes in the fields above
+		if appWallet.AppId == wallet.DefaultAppId || !appWallet.AppId.Validate() {
+			return fmt.Errorf("Invalid or missing 'appId' in 'appWallets'")
+		}
+		if appIds[appWallet.AppId] {
+			return fmt.Errorf("Duplicate 'appId' in 'appWallets'")
+		}
+		appIds[appWallet.AppId] = true
+		if appWallet.EncryptedWallet == "" || appWallet.Hmac == "" || appWallet.Sequence < store.InitialWalletSequence {
+			return fmt.Errorf("Fields 'encryptedWallet', 'sequence', and 'hmac' in 'appWallets' should be all non-empty and non-zero")
+		}
+	}
+	return nil
+}
+
+// Like the first POST /wallet, except the wallet keeps the sequence it had on
+// the old server, so the copies the user's clients already have stay in step
+// with it. The other apps' wallets come over the same way, all of them or
+// none.
+//
+// The hmacs have to be ones the LBRY clients could have made, whether or not
+// HMAC_FORMAT_CHECK is on. An import is a one-off, and an hmac that's off is
+// more likely a mangled export than some other client.
+//
+// Responds with a 409 if there's already a wallet for any of the apps, or if
+// a sequence is below one this account has had here before (see
+// store.ImportWallet).
+func (s *Server) postImport(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "import"}).Inc()
+
+	var importRequest ImportRequest
+	if !getPostData(w, req, &importRequest, maxBodySize) {
+		return
+	}
+
+	if !s.checkWalletSize(w, importRequest.EncryptedWallet) {
+		return
+	}
+
+	if !importRequest.Hmac.Validate() {
+		invalidHmacJson(w)
+		return
+	}
+
+	if !s.checkSequenceLimit(w, importRequest.Sequence) {
+		return
+	}
+
+	appWallets := make([]store.AppWalletUpdate, len(importRequest.AppWallets))
+	for i, appWallet := range importRequest.AppWallets {
+		if !s.checkWalletSize(w, appWallet.EncryptedWallet) || !s.checkSequenceLimit(w, appWallet.Sequence) {
+			return
+		}
+		if !appWallet.Hmac.Validate() {
+			invalidHmacJson(w)
+			return
+		}
+		appWallets[i] = store.AppWalletUpdate{
+			AppId:             appWallet.AppId,
+			EncryptedWallet:   appWallet.EncryptedWallet,
+			Sequence:          appWallet.Sequence,
+			Hmac:              appWallet.Hmac,
+			EncryptionVersion: appWallet.EncryptionVersion,
+		}
+	}
+
+	authToken := s.checkAuth(req, w, importRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.ImportWallet(req.Context(), authToken.UserId, wallet.DefaultAppId, importRequest.EncryptedWallet, importRequest.Sequence, importRequest.Hmac, importRequest.EncryptionVersion, appWallets)
+	if err == store.ErrWrongSequence {
+		// Not a race with another device, as it would be for POST /wallet
+		errorCodeJson(w, http.StatusConflict, ErrorCodeWrongSequence, "Sequence is below one this account has had")
+		return
+	} else if err != nil {
+		s.storeErrorJson(w, err, "Error importing wallet")
+		return
+	}
+	s.recordDeviceSync(req.Context(), authToken, wallet.DefaultAppId, importRequest.Sequence)
+	w.Header().Set("ETag", walletETag(importRequest.Sequence, importRequest.Hmac))
+
+	var importResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(importResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating importResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	log.Printf("Wallet imported at sequence %d, along with %d other app wallet(s), for user id %d", importRequest.Sequence, len(appWallets), authToken.UserId)
+
+	// This wakes the long polls for the other apps as well
+	s.notifyWalletUpdate(authToken.UserId, wallet.DefaultAppId, importRequest.Sequence)
+}
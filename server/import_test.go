@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestServerImport(t *testing.T) {
+	validHmac := wallet.WalletHmac(strings.Repeat("ab", wallet.HmacHexLength/2))
+
+	tt := []struct {
+		name            string
+		tokenScope      auth.AuthScope
+		encryptedWallet wallet.EncryptedWallet
+		sequence        wallet.Sequence
+		hmac            wallet.WalletHmac
+		appWallets      []ExportAppWallet
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedErrorCode   ErrorCode
+		expectImportCall    bool
+		expectedAppWallets  []store.AppWalletUpdate
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			tokenScope:         auth.ScopeFull,
+			encryptedWallet:    "my-enc-wallet",
+			sequence:           5,
+			hmac:               validHmac,
+			expectedStatusCode: http.StatusOK,
+			expectImportCall:   true,
+		}, {
+			name:            "success with another app's wallet",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: validHmac, EncryptionVersion: "my-app-version"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectImportCall:   true,
+			expectedAppWallets: []store.AppWalletUpdate{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: validHmac, EncryptionVersion: "my-app-version"},
+			},
+		}, {
+			name:            "app wallet for the default app",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: wallet.DefaultAppId, EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: validHmac},
+			},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'appId' in 'appWallets'",
+			expectedErrorCode:   ErrorCodeValidationFailed,
+		}, {
+			name:            "duplicate app wallet",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: validHmac},
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 4, Hmac: validHmac},
+			},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Duplicate 'appId' in 'appWallets'",
+			expectedErrorCode:   ErrorCodeValidationFailed,
+		}, {
+			name:            "app wallet missing sequence",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Hmac: validHmac},
+			},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Fields 'encryptedWallet', 'sequence', and 'hmac' in 'appWallets' should be all non-empty and non-zero",
+			expectedErrorCode:   ErrorCodeValidationFailed,
+		}, {
+			name:            "app wallet with malformed hmac",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: "my-hmac"},
+			},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'hmac'",
+			expectedErrorCode:   ErrorCodeInvalidHmac,
+		}, {
+			name:            "app wallet too large",
+			tokenScope:      auth.ScopeFull,
+			encryptedWallet: "my-enc-wallet",
+			sequence:        5,
+			hmac:            validHmac,
+			appWallets: []ExportAppWallet{
+				{AppId: "my-app", EncryptedWallet: "my-app-wallet-that-is-too-large", Sequence: 3, Hmac: validHmac},
+			},
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge) + ": Max wallet size is 20 bytes",
+			expectedErrorCode:   ErrorCodeWalletTooLarge,
+		}, {
+			name:                "missing sequence",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet",
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing or zero-value 'sequence'",
+			expectedErrorCode:   ErrorCodeValidationFailed,
+		}, {
+			name:                "malformed hmac",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet",
+			sequence:            5,
+			hmac:                "my-hmac",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'hmac'",
+			expectedErrorCode:   ErrorCodeInvalidHmac,
+		}, {
+			name:                "wallet too large",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet-that-is-too-large",
+			sequence:            5,
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge) + ": Max wallet size is 20 bytes",
+			expectedErrorCode:   ErrorCodeWalletTooLarge,
+		}, {
+			name:                "get-wallet token",
+			tokenScope:          auth.ScopeGetWallet,
+			encryptedWallet:     "my-enc-wallet",
+			sequence:            5,
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Scope",
+			expectedErrorCode:   ErrorCodeInsufficientScope,
+		}, {
+			name:                "wallet already exists",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet",
+			sequence:            5,
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Wallet already exists",
+			expectedErrorCode:   ErrorCodeWalletExists,
+			expectImportCall:    true,
+
+			storeErrors: TestStoreFunctionsErrors{ImportWallet: store.ErrDuplicateWallet},
+		}, {
+			name:                "sequence below one the account has had",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet",
+			sequence:            5,
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Sequence is below one this account has had",
+			expectedErrorCode:   ErrorCodeWrongSequence,
+			expectImportCall:    true,
+
+			storeErrors: TestStoreFunctionsErrors{ImportWallet: store.ErrWrongSequence},
+		}, {
+			name:                "db error",
+			tokenScope:          auth.ScopeFull,
+			encryptedWallet:     "my-enc-wallet",
+			sequence:            5,
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
+			expectImportCall:    true,
+
+			storeErrors: TestStoreFunctionsErrors{ImportWallet: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  tc.tokenScope,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			env := map[string]string{
+				"MAX_WALLET_SIZE": "20",
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			appWalletsJson, err := json.Marshal(tc.appWallets)
+			if err != nil {
+				t.Fatalf("Error encoding app wallets: %+v", err)
+			}
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "encryptedWallet": "%s", "sequence": %d, "hmac": "%s", "appWallets": %s}`, tc.encryptedWallet, tc.sequence, tc.hmac, appWalletsJson))
+			req := httptest.NewRequest(http.MethodPost, paths.PathImport, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postImport(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if called := testStore.Called.ImportWallet.EncryptedWallet != ""; called != tc.expectImportCall {
+				t.Errorf("Expected Store.ImportWallet called to be %v", tc.expectImportCall)
+			}
+
+			if tc.expectedStatusCode != http.StatusOK {
+				expectErrorCode(t, body, tc.expectedErrorCode)
+				if !wsmm.noMessage {
+					t.Errorf("Expected no wallet update to be sent out")
+				}
+				return
+			}
+
+			expectedCall := SetWalletCall{EncryptedWallet: tc.encryptedWallet, Sequence: tc.sequence, Hmac: tc.hmac}
+			if testStore.Called.ImportWallet != expectedCall {
+				t.Errorf("Expected Store.ImportWallet call %+v, got %+v", expectedCall, testStore.Called.ImportWallet)
+			}
+			if want, got := tc.expectedAppWallets, testStore.Called.ImportAppWallets; len(want) != len(got) || (len(want) > 0 && !reflect.DeepEqual(want, got)) {
+				t.Errorf("Expected Store.ImportWallet app wallets %+v, got %+v", want, got)
+			}
+			if want, got := walletETag(tc.sequence, tc.hmac), w.Header().Get("ETag"); want != got {
+				t.Errorf("Expected ETag %s, got %s", want, got)
+			}
+			if wsmm.walletUpdateUserId != testStore.TestAuthToken.UserId || wsmm.walletUpdateSeq != tc.sequence {
+				t.Errorf("Expected a wallet update for user %d at sequence %d, got %+v", testStore.TestAuthToken.UserId, tc.sequence, wsmm)
+			}
+		})
+	}
+}
+
+// Move an account from one server to another with export and import, and
+// carry on from the same sequence
+func TestServerExportImport(t *testing.T) {
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	hmac := wallet.WalletHmac(strings.Repeat("ab", wallet.HmacHexLength/2))
+
+	login := func(s *Server) auth.AuthToken {
+		t.Helper()
+		var authToken auth.AuthToken
+		statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+		}
+		return authToken
+	}
+
+	oldStore, oldTmpFile := storeTestInit(t)
+	defer storeTestCleanup(oldTmpFile)
+	oldServer := Init(&auth.Auth{}, &oldStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	if err := oldStore.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	oldToken := login(oldServer)
+	for sequence := wallet.Sequence(1); sequence <= 3; sequence++ {
+		statusCode, err := selfTestRequest(oldServer.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+			Token:           oldToken.Token,
+			EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d", sequence)),
+			Sequence:        sequence,
+			Hmac:            hmac,
+		}, nil)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error saving a wallet: status %d err %+v", statusCode, err)
+		}
+	}
+	// And another app, further behind
+	for sequence := wallet.Sequence(1); sequence <= 2; sequence++ {
+		statusCode, err := selfTestRequest(oldServer.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+			Token:           oldToken.Token,
+			AppId:           "my-app",
+			EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-app-wallet-%d", sequence)),
+			Sequence:        sequence,
+			Hmac:            hmac,
+		}, nil)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error saving an app wallet: status %d err %+v", statusCode, err)
+		}
+	}
+
+	var exportResponse ExportResponse
+	statusCode, err := selfTestRequest(oldServer.getExport, http.MethodGet, paths.PathExport+"?token="+string(oldToken.Token), nil, &exportResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error exporting: status %d err %+v", statusCode, err)
+	}
+	expectedAppWallets := []ExportAppWallet{{AppId: "my-app", EncryptedWallet: "my-app-wallet-2", Sequence: 2, Hmac: hmac}}
+	if !reflect.DeepEqual(exportResponse.AppWallets, expectedAppWallets) {
+		t.Fatalf("Expected the export to have app wallets %+v, got %+v", expectedAppWallets, exportResponse.AppWallets)
+	}
+
+	newStore, newTmpFile := storeTestInit(t)
+	defer storeTestCleanup(newTmpFile)
+	newServer := Init(&auth.Auth{}, &newStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	if err := newStore.CreateAccount(context.Background(), exportResponse.Email, password, exportResponse.ClientSaltSeed, nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	newToken := login(newServer)
+
+	importRequest := ImportRequest{
+		Token:             newToken.Token,
+		EncryptedWallet:   exportResponse.Wallet.EncryptedWallet,
+		Sequence:          exportResponse.Wallet.Sequence,
+		Hmac:              exportResponse.Wallet.Hmac,
+		EncryptionVersion: exportResponse.Wallet.EncryptionVersion,
+		AppWallets:        exportResponse.AppWallets,
+	}
+	statusCode, err = selfTestRequest(newServer.postImport, http.MethodPost, paths.PathImport, importRequest, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error importing: status %d err %+v", statusCode, err)
+	}
+
+	// Only once
+	statusCode, _ = selfTestRequest(newServer.postImport, http.MethodPost, paths.PathImport, importRequest, nil)
+	if statusCode != http.StatusConflict {
+		t.Fatalf("Expected a 409 importing a second time, got %d", statusCode)
+	}
+
+	var walletResponse WalletResponse
+	statusCode, err = selfTestRequest(newServer.getWallet, http.MethodGet, paths.PathWallet+"?token="+string(newToken.Token), nil, &walletResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting the wallet: status %d err %+v", statusCode, err)
+	}
+	if walletResponse != exportResponse.Wallet {
+		t.Errorf("Expected the imported wallet %+v, got %+v", exportResponse.Wallet, walletResponse)
+	}
+
+	var appWalletResponse WalletResponse
+	statusCode, err = selfTestRequest(newServer.getWallet, http.MethodGet, paths.PathWallet+"?appId=my-app&token="+string(newToken.Token), nil, &appWalletResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting the app wallet: status %d err %+v", statusCode, err)
+	}
+	expectedAppWallet := WalletResponse{
+		EncryptedWallet:   exportResponse.AppWallets[0].EncryptedWallet,
+		Sequence:          exportResponse.AppWallets[0].Sequence,
+		Hmac:              exportResponse.AppWallets[0].Hmac,
+		EncryptionVersion: exportResponse.AppWallets[0].EncryptionVersion,
+	}
+	if appWalletResponse != expectedAppWallet {
+		t.Errorf("Expected the imported app wallet %+v, got %+v", expectedAppWallet, appWalletResponse)
+	}
+
+	// A client that was syncing with the old server carries on where it was
+	statusCode, err = selfTestRequest(newServer.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+		Token:           newToken.Token,
+		EncryptedWallet: "my-enc-wallet-4",
+		Sequence:        4,
+		Hmac:            hmac,
+	}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error saving a wallet after importing: status %d err %+v", statusCode, err)
+	}
+	statusCode, err = selfTestRequest(newServer.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+		Token:           newToken.Token,
+		AppId:           "my-app",
+		EncryptedWallet: "my-app-wallet-3",
+		Sequence:        3,
+		Hmac:            hmac,
+	}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error saving an app wallet after importing: status %d err %+v", statusCode, err)
+	}
+}
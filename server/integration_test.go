@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -100,7 +102,7 @@ func TestIntegrationWalletUpdates(t *testing.T) {
 	env := map[string]string{
 		"ACCOUNT_WHITELIST": "abc@example.com",
 	}
-	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &TestMail{}, TestPort)
+	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &TestMail{}, TestConfig)
 
 	////////////////////
 	t.Log("Request: Register email address - any device")
@@ -134,10 +136,10 @@ func TestIntegrationWalletUpdates(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength := auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength := base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(authToken1.Token) != expectedTokenLength {
-		t.Fatalf("Expected auth response to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected auth response to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 	if authToken1.DeviceId != "dev-1" {
 		t.Fatalf("Unexpected response DeviceId. want: %+v got: %+v", "dev-1", authToken1.DeviceId)
@@ -262,6 +264,113 @@ func TestIntegrationWalletUpdates(t *testing.T) {
 
 // Test one device that registers and changes password. Check that wallet
 // updates and that tokens get deleted.
+// Two devices of a brand new user both try to create the first wallet at the
+// same time (and before that, both log in at the same time with the same
+// device id). Whoever loses the race should get a clean 409, not a 500 from
+// whatever the database had to say about it.
+func TestIntegrationConcurrentFirstWallet(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	env := map[string]string{
+		"ACCOUNT_WHITELIST": "abc@example.com",
+	}
+	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &TestMail{}, TestConfig)
+
+	var registerResponse struct{}
+	responseBody, statusCode := request(
+		t,
+		http.MethodPost,
+		s.register,
+		paths.PathRegister,
+		&registerResponse,
+		`{"email": "abc@example.com", "password": "12345678", "clientSaltSeed": "1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd"}`,
+	)
+	checkStatusCode(t, statusCode, responseBody, http.StatusCreated)
+
+	// Same device id at the same time. Both should get a token; the last one
+	// saved is the one that counts.
+	var wg sync.WaitGroup
+	authTokenStatusCodes := make([]int, 2)
+	for i := range authTokenStatusCodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, authTokenStatusCodes[i] = request(
+				t,
+				http.MethodPost,
+				s.getAuthToken,
+				paths.PathAuthToken,
+				nil,
+				`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678"}`,
+			)
+		}(i)
+	}
+	wg.Wait()
+	for i, statusCode := range authTokenStatusCodes {
+		if statusCode != http.StatusOK {
+			t.Errorf("Expected auth token request %d to succeed, got %d", i, statusCode)
+		}
+	}
+
+	authTokens := make([]auth.AuthToken, 2)
+	for i := range authTokens {
+		responseBody, statusCode := request(
+			t,
+			http.MethodPost,
+			s.getAuthToken,
+			paths.PathAuthToken,
+			&authTokens[i],
+			fmt.Sprintf(`{"deviceId": "dev-%d", "email": "abc@example.com", "password": "12345678"}`, i+1),
+		)
+		checkStatusCode(t, statusCode, responseBody)
+	}
+
+	walletStatusCodes := make([]int, 2)
+	walletResponseBodies := make([][]byte, 2)
+	for i := range walletStatusCodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			walletResponseBodies[i], walletStatusCodes[i] = request(
+				t,
+				http.MethodPost,
+				s.postWallet,
+				paths.PathWallet,
+				nil,
+				fmt.Sprintf(`{
+          "token": "%s",
+          "encryptedWallet": "my-encrypted-wallet-dev-%d",
+          "sequence": 1,
+          "hmac": "my-hmac-dev-%d"
+        }`, authTokens[i].Token, i+1, i+1),
+			)
+		}(i)
+	}
+	wg.Wait()
+
+	var loser int
+	switch {
+	case walletStatusCodes[0] == http.StatusOK && walletStatusCodes[1] == http.StatusConflict:
+		loser = 1
+	case walletStatusCodes[0] == http.StatusConflict && walletStatusCodes[1] == http.StatusOK:
+		loser = 0
+	default:
+		t.Fatalf("Expected one 200 and one 409, got %+v (bodies: %s, %s)", walletStatusCodes, walletResponseBodies[0], walletResponseBodies[1])
+	}
+
+	var errorResponse ErrorResponse
+	if err := json.Unmarshal(walletResponseBodies[loser], &errorResponse); err != nil {
+		t.Fatalf("Expected a JSON error response for the loser: %+v `%s`", err, walletResponseBodies[loser])
+	}
+	if want, got := http.StatusText(http.StatusConflict)+": Bad sequence number", errorResponse.Error; want != got {
+		t.Errorf("Error String: expected %s, got %s", want, got)
+	}
+	if errorResponse.Retryable {
+		t.Errorf("Expected the loser's error to not be retryable; it needs to get the winner's wallet first")
+	}
+}
+
 func TestIntegrationChangePassword(t *testing.T) {
 	st, tmpFile := storeTestInit(t)
 	defer storeTestCleanup(tmpFile)
@@ -270,7 +379,7 @@ func TestIntegrationChangePassword(t *testing.T) {
 	env := map[string]string{
 		"ACCOUNT_WHITELIST": "abc@example.com",
 	}
-	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &TestMail{}, TestPort)
+	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &TestMail{}, TestConfig)
 
 	// Still need to mock this until we're doing a real integration test
 	// where we call Serve(), which brings up the real websocket manager.
@@ -332,10 +441,10 @@ func TestIntegrationChangePassword(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength := auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength := base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(authToken.Token) != expectedTokenLength {
-		t.Fatalf("Expected auth response to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected auth response to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 	if authToken.DeviceId != "dev-1" {
 		t.Fatalf("Unexpected response DeviceId. want: %+v got: %+v", "dev-1", authToken.DeviceId)
@@ -419,10 +528,10 @@ func TestIntegrationChangePassword(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength = auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength = base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(authToken.Token) != expectedTokenLength {
-		t.Fatalf("Expected auth response to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected auth response to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 	if authToken.DeviceId != "dev-1" {
 		t.Fatalf("Unexpected response DeviceId. want: %+v got: %+v", "dev-1", authToken.DeviceId)
@@ -528,10 +637,10 @@ func TestIntegrationChangePassword(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength = auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength = base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(authToken.Token) != expectedTokenLength {
-		t.Fatalf("Expected auth response to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected auth response to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 	if authToken.DeviceId != "dev-1" {
 		t.Fatalf("Unexpected response DeviceId. want: %+v got: %+v", "dev-1", authToken.DeviceId)
@@ -575,7 +684,7 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 		"ACCOUNT_VERIFICATION_MODE": "EmailVerify",
 	}
 	testMail := TestMail{}
-	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &testMail, TestPort)
+	s := Init(&auth.Auth{}, &st, &TestEnv{env}, &testMail, TestConfig)
 
 	////////////////////
 	t.Log("Request: Register email address")
@@ -593,10 +702,10 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody, http.StatusCreated)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength := auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength := base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(testMail.SendVerificationEmailCall.Token) != expectedTokenLength {
-		t.Fatalf("Expected account verify email to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected account verify email to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 
 	////////////////////
@@ -615,10 +724,10 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength = auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength = base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(testMail.SendVerificationEmailCall.Token) != expectedTokenLength {
-		t.Fatalf("Expected account verify email to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected account verify email to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 
 	////////////////////
@@ -670,10 +779,10 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 
 	checkStatusCode(t, statusCode, responseBody)
 
-	// result.Token is in hex, auth.TokenLength is bytes in the original
-	expectedTokenLength = auth.TokenLength * 2
+	// result.Token is in base64url, auth.DefaultTokenLength is bytes in the original
+	expectedTokenLength = base64.RawURLEncoding.EncodedLen(auth.DefaultTokenLength)
 	if len(authToken.Token) != expectedTokenLength {
-		t.Fatalf("Expected auth response to contain token length %d: result: %+v", auth.TokenLength, string(responseBody))
+		t.Fatalf("Expected auth response to contain token length %d: result: %+v", expectedTokenLength, string(responseBody))
 	}
 	if authToken.DeviceId != "dev-1" {
 		t.Fatalf("Unexpected response DeviceId. want: %+v got: %+v", "dev-1", authToken.DeviceId)
@@ -682,3 +791,90 @@ func TestIntegrationVerifyAccount(t *testing.T) {
 		t.Fatalf("Unexpected response Scope. want: %+v got: %+v", auth.ScopeFull, authToken.Scope)
 	}
 }
+
+// Lots of users saving wallets and changing passwords at once. SQLite only
+// allows one writer at a time, but the others should wait their turn rather
+// than fail with "database is locked" (and a 500).
+func TestIntegrationConcurrentWrites(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	const numUsers = 8
+	const numUpdates = 3
+
+	type testUser struct {
+		email auth.Email
+		token auth.AuthTokenString
+	}
+	var users []testUser
+	password, otherPassword := auth.Password("12345678"), auth.Password("87654321")
+	clientSaltSeed := auth.ClientSaltSeed("abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234")
+	for i := 0; i < numUsers; i++ {
+		email := auth.Email(fmt.Sprintf("user-%d@example.com", i))
+		if err := st.CreateAccount(context.Background(), email, password, clientSaltSeed, nil); err != nil {
+			t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+		}
+		var authToken auth.AuthToken
+		statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+		}
+		if err := st.SetWallet(context.Background(), authToken.UserId, wallet.DefaultAppId, "my-encrypted-wallet-1", 1, "my-hmac-1", nil, ""); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+		users = append(users, testUser{email, authToken.Token})
+	}
+
+	var wg sync.WaitGroup
+	failures := make(chan string, numUsers*numUpdates)
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user testUser) {
+			defer wg.Done()
+			for sequence := wallet.Sequence(2); sequence < 2+numUpdates; sequence++ {
+				encryptedWallet := wallet.EncryptedWallet(fmt.Sprintf("my-encrypted-wallet-%d", sequence))
+				hmac := wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence))
+
+				// Password changes read before they write, which is what used to get
+				// "database is locked" when something else was writing
+				var statusCode int
+				var err error
+				if i%2 == 0 {
+					statusCode, err = selfTestRequest(s.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+						Token:           user.token,
+						EncryptedWallet: encryptedWallet,
+						Sequence:        sequence,
+						Hmac:            hmac,
+					}, nil)
+				} else {
+					// Back and forth between the two
+					oldPassword, newPassword := password, otherPassword
+					if sequence%2 == 1 {
+						oldPassword, newPassword = otherPassword, password
+					}
+					statusCode, err = selfTestRequest(s.changePassword, http.MethodPost, paths.PathPassword, ChangePasswordRequest{
+						Email:           user.email,
+						OldPassword:     oldPassword,
+						NewPassword:     newPassword,
+						ClientSaltSeed:  clientSaltSeed,
+						EncryptedWallet: encryptedWallet,
+						Sequence:        sequence,
+						Hmac:            hmac,
+					}, nil)
+				}
+				if err != nil || statusCode != http.StatusOK {
+					failures <- fmt.Sprintf("status %d err %+v", statusCode, err)
+					return
+				}
+			}
+		}(i, user)
+	}
+	wg.Wait()
+	close(failures)
+
+	for failure := range failures {
+		t.Errorf("Write failed: %s", failure)
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/metrics"
+)
+
+// Emails that the response doesn't depend on (such as new device notices)
+// go out in the background, so that a slow mail server doesn't hold up the
+// request. At most this many at a time. Past that they're dropped (and
+// logged), rather than piling up while the mail server is down.
+const maxBackgroundEmails = 10
+
+func (s *Server) sendMailInBackground(description string, send func() error) {
+	select {
+	case s.backgroundEmails <- struct{}{}:
+	default:
+		log.Printf("Too many emails being sent, dropping %s", description)
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "mail"}).Inc()
+		return
+	}
+	go func() {
+		defer func() { <-s.backgroundEmails }()
+		if err := send(); err != nil {
+			log.Printf("Error sending %s: %+v", description, err)
+			metrics.ErrorsCount.With(prometheus.Labels{"error_type": "mail"}).Inc()
+		}
+	}()
+}
+
+// Called on every login. With NEW_DEVICE_EMAIL, lets the user know if it's
+// from a device we've never seen for them. Devices are recorded whether or
+// not it's on, so that turning it on later doesn't set off an email for every
+// device that was already in use.
+//
+// Nothing here fails the login.
+func (s *Server) notifyNewDevice(ctx context.Context, email auth.Email, userId auth.UserId, deviceId auth.DeviceId, deviceName auth.DeviceName) {
+	isNew, err := s.store.AddKnownDevice(ctx, userId, deviceId)
+	if err != nil {
+		log.Printf("Error recording known device: %+v", err)
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "new-device"}).Inc()
+		return
+	}
+	if !isNew {
+		return
+	}
+
+	newDeviceEmail, err := env.GetNewDeviceEmail(s.env)
+	if err != nil {
+		log.Printf("Error getting new device email setting: %+v", err)
+		return
+	}
+	if !newDeviceEmail {
+		return
+	}
+
+	s.sendMailInBackground("new device email", func() error {
+		return s.mail.SendNewDeviceEmail(email, deviceId, deviceName)
+	})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func TestServerAuthNewDeviceEmail(t *testing.T) {
+	tt := []struct {
+		name string
+
+		newDeviceEmail      string
+		newDevice           bool
+		addKnownDeviceError error
+		expectNewDevice     bool
+	}{
+		{
+			name: "off by default",
+
+			newDevice: true,
+		},
+		{
+			name: "new device",
+
+			newDeviceEmail:  "true",
+			newDevice:       true,
+			expectNewDevice: true,
+		},
+		{
+			name: "device seen before",
+
+			newDeviceEmail: "true",
+		},
+		{
+			name: "db error recording the device",
+
+			newDeviceEmail:      "true",
+			addKnownDeviceError: fmt.Errorf("Some random DB Error!"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testAuth := TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}
+			testStore := TestStore{
+				TestNewDevice: tc.newDevice,
+				Errors:        TestStoreFunctionsErrors{AddKnownDevice: tc.addKnownDeviceError},
+			}
+			testEnv := TestEnv{env: map[string]string{"NEW_DEVICE_EMAIL": tc.newDeviceEmail}}
+			testMail := TestMail{SendNewDeviceEmailCalls: make(chan SendNewDeviceEmailCall, 1)}
+			s := Init(&testAuth, &testStore, &testEnv, &testMail, TestConfig)
+
+			requestBody := []byte(`{"deviceId": "dev-1", "deviceName": "My Phone", "email": "abc@example.com", "password": "12345678"}`)
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.getAuthToken(w, req)
+
+			// Whatever happens with the email, the login goes through
+			expectStatusCode(t, w, http.StatusOK)
+
+			// Recorded either way
+			if want := (AddKnownDeviceCall{testStore.TestAuthToken.UserId, "dev-1"}); testStore.Called.AddKnownDevice != want {
+				t.Errorf("Expected Store.AddKnownDevice to be called with %+v, got %+v", want, testStore.Called.AddKnownDevice)
+			}
+
+			if !tc.expectNewDevice {
+				select {
+				case call := <-testMail.SendNewDeviceEmailCalls:
+					t.Errorf("Expected no new device email, got %+v", call)
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case call := <-testMail.SendNewDeviceEmailCalls:
+				if want := (SendNewDeviceEmailCall{"abc@example.com", "dev-1", "My Phone"}); call != want {
+					t.Errorf("Expected new device email %+v, got %+v", want, call)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Expected a new device email")
+			}
+		})
+	}
+}
+
+// Only the first login from a device sets off an email, even if it logged out
+// in between
+func TestServerAuthNewDeviceEmailFirstSeen(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	testMail := TestMail{SendNewDeviceEmailCalls: make(chan SendNewDeviceEmailCall, 10)}
+	s := Init(&auth.Auth{}, &st, &TestEnv{env: map[string]string{"NEW_DEVICE_EMAIL": "true"}}, &testMail, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+
+	login := func(deviceId auth.DeviceId) auth.AuthToken {
+		var authToken auth.AuthToken
+		statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: deviceId, Email: email, Password: password}, &authToken)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error logging in: status %d err %+v", statusCode, err)
+		}
+		return authToken
+	}
+	expectEmail := func(deviceId auth.DeviceId) {
+		t.Helper()
+		select {
+		case call := <-testMail.SendNewDeviceEmailCalls:
+			if call.DeviceId != deviceId {
+				t.Errorf("Expected a new device email for %s, got %+v", deviceId, call)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a new device email for %s", deviceId)
+		}
+	}
+	expectNoEmail := func() {
+		t.Helper()
+		select {
+		case call := <-testMail.SendNewDeviceEmailCalls:
+			t.Errorf("Expected no new device email, got %+v", call)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	authToken := login("dev-1")
+	expectEmail("dev-1")
+
+	login("dev-1")
+	expectNoEmail()
+
+	if err := st.DeleteToken(context.Background(), authToken.UserId, "dev-1"); err != nil {
+		t.Fatalf("Unexpected error in DeleteToken: %+v", err)
+	}
+	login("dev-1")
+	expectNoEmail()
+
+	login("dev-2")
+	expectEmail("dev-2")
+}
+
+// Emails past the limit are dropped rather than waiting their turn
+func TestServerSendMailInBackgroundLimit(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+
+	release := make(chan bool)
+	sent := make(chan bool, maxBackgroundEmails+1)
+	for i := 0; i < maxBackgroundEmails+1; i++ {
+		s.sendMailInBackground("test email", func() error {
+			<-release
+			sent <- true
+			return nil
+		})
+	}
+	close(release)
+
+	for i := 0; i < maxBackgroundEmails; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d emails sent, got %d", maxBackgroundEmails, i)
+		}
+	}
+	select {
+	case <-sent:
+		t.Errorf("Expected the email past the limit to be dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -23,6 +23,29 @@ type ChangePasswordRequest struct {
 	OldPassword     auth.Password          `json:"oldPassword"`
 	NewPassword     auth.Password          `json:"newPassword"`
 	ClientSaltSeed  auth.ClientSaltSeed    `json:"clientSaltSeed"`
+
+	// Optional, and only meaningful along with the wallet. See WalletRequest
+	// and wallet.EncryptionVersion.
+	ParentHmac        *wallet.WalletHmac       `json:"parentHmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
+
+	// Every other app's wallet (see wallet.AppId), re-encrypted with the new
+	// password. Required if there are any; otherwise they'd be left encrypted
+	// with the old one.
+	AppWallets []AppWalletRequest `json:"appWallets"`
+
+	// Required if the account has two-factor authentication enabled
+	Totp auth.TotpCode `json:"totp,omitempty"`
+}
+
+// Another app's wallet, for a password change. Same fields as WalletRequest.
+type AppWalletRequest struct {
+	AppId             wallet.AppId             `json:"appId"`
+	EncryptedWallet   wallet.EncryptedWallet   `json:"encryptedWallet"`
+	Sequence          wallet.Sequence          `json:"sequence"`
+	Hmac              wallet.WalletHmac        `json:"hmac"`
+	ParentHmac        *wallet.WalletHmac       `json:"parentHmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
 }
 
 func (r *ChangePasswordRequest) validate() error {
@@ -49,15 +72,80 @@ func (r *ChangePasswordRequest) validate() error {
 	if !walletPresent && !walletAbsent {
 		return fmt.Errorf("Fields 'encryptedWallet', 'sequence', and 'hmac' should be all non-empty and non-zero, or all omitted")
 	}
+	if walletAbsent && r.EncryptionVersion != "" {
+		return fmt.Errorf("Field 'encryptionVersion' should be omitted if the wallet is omitted")
+	}
+	if walletAbsent && r.ParentHmac != nil {
+		return fmt.Errorf("Field 'parentHmac' should be omitted if the wallet is omitted")
+	}
+	if r.ParentHmac != nil && *r.ParentHmac == "" {
+		return fmt.Errorf("Empty 'parentHmac'")
+	}
+	if r.Totp != "" && !r.Totp.Validate() {
+		return fmt.Errorf("Invalid 'totp'")
+	}
+	appIds := make(map[wallet.AppId]bool)
+	for _, appWallet := range r.AppWallets {
+		// The default app's wallet goes in the fields above
+		if appWallet.AppId == wallet.DefaultAppId || !appWallet.AppId.Validate() {
+			return fmt.Errorf("Invalid or missing 'appId' in 'appWallets'")
+		}
+		if appIds[appWallet.AppId] {
+			return fmt.Errorf("Duplicate 'appId' in 'appWallets'")
+		}
+		appIds[appWallet.AppId] = true
+		if appWallet.EncryptedWallet == "" || appWallet.Hmac == "" || appWallet.Sequence == 0 {
+			return fmt.Errorf("Fields 'encryptedWallet', 'sequence', and 'hmac' in 'appWallets' should be all non-empty and non-zero")
+		}
+		if appWallet.ParentHmac != nil && *appWallet.ParentHmac == "" {
+			return fmt.Errorf("Empty 'parentHmac' in 'appWallets'")
+		}
+	}
 	return nil
 }
 
 func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req, maxBodySize)
+	if !ok {
+		return
+	}
+
 	var changePasswordRequest ChangePasswordRequest
-	if !getPostData(w, req, &changePasswordRequest) {
+	if !getPostData(w, req, &changePasswordRequest, maxBodySize) {
+		return
+	}
+
+	if !s.checkRequestSignature(w, req, body, changePasswordRequest.Email) {
+		return
+	}
+
+	if !s.checkWalletSize(w, changePasswordRequest.EncryptedWallet) {
 		return
 	}
 
+	if changePasswordRequest.EncryptedWallet != "" && !s.checkHmacFormat(w, changePasswordRequest.Hmac) {
+		return
+	}
+
+	if changePasswordRequest.EncryptedWallet != "" && !s.checkSequenceLimit(w, changePasswordRequest.Sequence) {
+		return
+	}
+
+	appWallets := make([]store.AppWalletUpdate, len(changePasswordRequest.AppWallets))
+	for i, appWallet := range changePasswordRequest.AppWallets {
+		if !s.checkWalletSize(w, appWallet.EncryptedWallet) || !s.checkHmacFormat(w, appWallet.Hmac) || !s.checkSequenceLimit(w, appWallet.Sequence) {
+			return
+		}
+		appWallets[i] = store.AppWalletUpdate{
+			AppId:             appWallet.AppId,
+			EncryptedWallet:   appWallet.EncryptedWallet,
+			Sequence:          appWallet.Sequence,
+			Hmac:              appWallet.Hmac,
+			ParentHmac:        appWallet.ParentHmac,
+			EncryptionVersion: appWallet.EncryptionVersion,
+		}
+	}
+
 	// To be cautious, we will block password changes for unverified accounts.
 	// The only reason I can think of for allowing them is if the user
 	// accidentally put in a bad password that they desperately want to change,
@@ -73,43 +161,49 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 	// Someone might find a loophole I'm not thinking of. So I'm just blocking
 	// unverified accounts here for simplicity.
 
-	var err error
-	var userId auth.UserId
+	// The two-factor code goes by user id, which we don't know until the
+	// password checks out. The password does get checked again with the
+	// change, but this way a wrong code doesn't get as far as writing anything.
+	userId, err := s.store.GetUserId(req.Context(), changePasswordRequest.Email, changePasswordRequest.OldPassword)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error getting User Id")
+		return
+	}
+	if !s.checkTotp(w, req, userId, changePasswordRequest.Totp) {
+		return
+	}
+
+	var numTokensDeleted int64
 	if changePasswordRequest.EncryptedWallet != "" {
-		userId, err = s.store.ChangePasswordWithWallet(
+		userId, numTokensDeleted, err = s.store.ChangePasswordWithWallet(
+			req.Context(),
 			changePasswordRequest.Email,
 			changePasswordRequest.OldPassword,
 			changePasswordRequest.NewPassword,
 			changePasswordRequest.ClientSaltSeed,
 			changePasswordRequest.EncryptedWallet,
 			changePasswordRequest.Sequence,
-			changePasswordRequest.Hmac)
+			changePasswordRequest.Hmac,
+			changePasswordRequest.ParentHmac,
+			changePasswordRequest.EncryptionVersion,
+			appWallets)
 		if err == store.ErrWrongSequence {
-			errorJson(w, http.StatusConflict, "Bad sequence number or wallet does not exist")
+			// Also what it says if there's no wallet to change, so say that
+			errorCodeJson(w, http.StatusConflict, ErrorCodeWrongSequence, "Bad sequence number or wallet does not exist")
 			return
 		}
 	} else {
-		userId, err = s.store.ChangePasswordNoWallet(
+		userId, numTokensDeleted, err = s.store.ChangePasswordNoWallet(
+			req.Context(),
 			changePasswordRequest.Email,
 			changePasswordRequest.OldPassword,
 			changePasswordRequest.NewPassword,
 			changePasswordRequest.ClientSaltSeed,
+			appWallets,
 		)
-		if err == store.ErrUnexpectedWallet {
-			errorJson(w, http.StatusConflict, "Wallet exists; need an updated wallet when changing password")
-			return
-		}
-	}
-	if err == store.ErrWrongCredentials {
-		errorJson(w, http.StatusUnauthorized, "No match for email and/or password")
-		return
-	}
-	if err == store.ErrNotVerified {
-		errorJson(w, http.StatusUnauthorized, "Account is not verified")
-		return
 	}
 	if err != nil {
-		internalServiceErrorJson(w, err, "Error changing password")
+		s.storeErrorJson(w, err, "Error changing password")
 		return
 	}
 
@@ -140,6 +234,9 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 	// writer, and pass it to every wallet update db call, and have it check
 	// the auth token within the same transaction as the wallet update.
 
+	// Wake up any long polls, which will find that their tokens are gone
+	s.walletWatchers.notify(userId)
+
 	timeout := time.NewTicker(100 * time.Millisecond)
 	select {
 	case s.userRemove <- wsClientForUser{userId, nil}:
@@ -160,5 +257,5 @@ func (s *Server) changePassword(w http.ResponseWriter, req *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, string(response))
-	log.Printf("User %s has changed their password", changePasswordRequest.Email)
+	log.Printf("User %s has changed their password, deleting %d auth token(s)", changePasswordRequest.Email, numTokensDeleted)
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -75,6 +76,34 @@ func TestServerChangePassword(t *testing.T) {
 			email: "abc@example.com",
 
 			storeErrors: TestStoreFunctionsErrors{ChangePasswordWithWallet: store.ErrWrongSequence},
+		}, {
+			name:                "parent hmac conflict with wallet",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Parent hmac does not match",
+
+			expectChangePasswordCall: true,
+
+			newEncryptedWallet: "my-enc-wallet",
+			newSequence:        2,
+			newHmac:            "my-hmac",
+
+			email: "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{ChangePasswordWithWallet: store.ErrWrongParentHmac},
+		}, {
+			name:                "missing required parent hmac with wallet",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing 'parentHmac'",
+
+			expectChangePasswordCall: true,
+
+			newEncryptedWallet: "my-enc-wallet",
+			newSequence:        2,
+			newHmac:            "my-hmac",
+
+			email: "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{ChangePasswordWithWallet: store.ErrNoParentHmac},
 		}, {
 			name:                "conflict no wallet",
 			expectedStatusCode:  http.StatusConflict,
@@ -133,6 +162,26 @@ func TestServerChangePassword(t *testing.T) {
 			email: "abc@example.com",
 
 			storeErrors: TestStoreFunctionsErrors{ChangePasswordNoWallet: store.ErrNotVerified},
+		}, {
+			name:                "weak password",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Password is too easy to guess",
+
+			expectChangePasswordCall: true,
+
+			email: "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{ChangePasswordNoWallet: store.ErrWeakPassword},
+		}, {
+			name:                "password too short",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Password is too short",
+
+			expectChangePasswordCall: true,
+
+			email: "abc@example.com",
+
+			storeErrors: TestStoreFunctionsErrors{ChangePasswordNoWallet: store.ErrPasswordTooShort},
 		}, {
 			name:                "validation error",
 			expectedStatusCode:  http.StatusBadRequest,
@@ -174,7 +223,7 @@ func TestServerChangePassword(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			testStore := TestStore{Errors: tc.storeErrors, TestUserId: 37}
-			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 			wsmm := wsMockManager{s: s, done: make(chan bool)}
 
 			// Whether we passed in wallet fields (these test cases should be passing
@@ -438,6 +487,69 @@ func TestServerValidateChangePasswordRequest(t *testing.T) {
 			},
 			"should not be the same",
 			"Expected ChangePasswordRequest with password that does not change to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:             "abc@example.com",
+				OldPassword:       "12345678",
+				NewPassword:       "45678901",
+				ClientSaltSeed:    "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				EncryptionVersion: "my-encryption-version",
+			},
+			"'encryptionVersion'",
+			"Expected ChangePasswordRequest with encryption version but no wallet to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				ParentHmac:     new(wallet.WalletHmac),
+			},
+			"'parentHmac'",
+			"Expected ChangePasswordRequest with parent hmac but no wallet to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				AppWallets:     []AppWalletRequest{{EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"}},
+			},
+			"'appId' in 'appWallets'",
+			"Expected ChangePasswordRequest with the default app in appWallets to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				AppWallets: []AppWalletRequest{
+					{AppId: "my-app", EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"},
+					{AppId: "my-app", EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac"},
+				},
+			},
+			"Duplicate 'appId'",
+			"Expected ChangePasswordRequest with the same app twice in appWallets to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				AppWallets:     []AppWalletRequest{{AppId: "my-app", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"}},
+			},
+			"in 'appWallets' should be all non-empty",
+			"Expected ChangePasswordRequest with a partial wallet in appWallets to return an appropriate error",
+		}, {
+			ChangePasswordRequest{
+				Email:          "abc@example.com",
+				OldPassword:    "12345678",
+				NewPassword:    "45678901",
+				ClientSaltSeed: "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+				AppWallets:     []AppWalletRequest{{AppId: "my-app", EncryptedWallet: "my-encrypted-wallet", Sequence: 2, Hmac: "my-hmac", ParentHmac: new(wallet.WalletHmac)}},
+			},
+			"Empty 'parentHmac' in 'appWallets'",
+			"Expected ChangePasswordRequest with an empty parent hmac in appWallets to return an appropriate error",
 		},
 	}
 	for _, tc := range tt {
@@ -447,3 +559,37 @@ func TestServerValidateChangePasswordRequest(t *testing.T) {
 		}
 	}
 }
+
+// Other apps' wallets get passed through to the store along with the password
+// change
+func TestServerChangePasswordAppWallets(t *testing.T) {
+	testStore := TestStore{TestUserId: 5}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	requestBody := []byte(`{
+    "email":          "abc@example.com",
+    "oldPassword":    "old password",
+    "newPassword":    "new password",
+    "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234",
+    "appWallets": [{
+      "appId":           "my-app",
+      "encryptedWallet": "my-app-enc-wallet",
+      "sequence":        3,
+      "hmac":            "my-app-hmac"
+    }]
+  }`)
+
+	req := httptest.NewRequest(http.MethodPost, paths.PathPassword, bytes.NewBuffer(requestBody))
+	w := httptest.NewRecorder()
+
+	s.changePassword(w, req)
+
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusOK)
+	expectErrorString(t, body, "")
+
+	want := []store.AppWalletUpdate{{AppId: "my-app", EncryptedWallet: "my-app-enc-wallet", Sequence: 3, Hmac: "my-app-hmac"}}
+	if got := testStore.Called.ChangePasswordAppWallets; !reflect.DeepEqual(want, got) {
+		t.Errorf("Store.ChangePasswordNoWallet called with app wallets: expected %+v, got %+v", want, got)
+	}
+}
@@ -4,12 +4,30 @@ const ApiVersion = "3"
 const PathPrefix = "/api/" + ApiVersion
 
 const PathAuthToken = PathPrefix + "/auth/full"
+const PathAuthTokenRefresh = PathPrefix + "/auth/full/refresh"
+const PathAuthLogout = PathPrefix + "/auth/logout"
+const PathAuthDeviceId = PathPrefix + "/auth/device-id"
+const PathAuthSigningKey = PathPrefix + "/auth/signing-key"
+const PathTotpEnroll = PathPrefix + "/auth/totp/enroll"
+const PathTotpConfirm = PathPrefix + "/auth/totp/confirm"
+const PathDevices = PathPrefix + "/auth/devices"
 const PathWallet = PathPrefix + "/wallet"
+const PathWalletBatch = PathPrefix + "/wallet/batch"
+const PathWalletVerify = PathPrefix + "/wallet/verify"
+const PathWalletPoll = PathPrefix + "/wallet/poll"
+const PathWalletStatus = PathPrefix + "/wallet/status"
+const PathWalletSync = PathPrefix + "/wallet/sync"
 const PathRegister = PathPrefix + "/signup"
+const PathEmailAvailable = PathPrefix + "/signup/email-available"
 const PathPassword = PathPrefix + "/password"
+const PathAccountDelete = PathPrefix + "/account/delete"
+const PathExport = PathPrefix + "/account/export"
+const PathImport = PathPrefix + "/account/import"
 const PathVerify = PathPrefix + "/verify"
 const PathResendVerify = PathPrefix + "/verify/resend"
 const PathClientSaltSeed = PathPrefix + "/client-salt-seed"
+const PathCapabilities = PathPrefix + "/capabilities"
+const PathAdminAccount = PathPrefix + "/admin/account"
 
 // Using such a generic name since, as I understand, we can do a bunch of
 // different stuff over this one websocket.
@@ -18,4 +36,9 @@ const PathWebsocket = PathPrefix + "/websocket"
 const PathUnknownEndpoint = PathPrefix + "/"
 const PathWrongApiVersion = "/api/"
 
+// Anything else, including endpoints without the PathPrefix
+const PathUnversioned = "/"
+
 const PathPrometheus = "/metrics"
+const PathReadyz = "/readyz"
+const PathHealth = "/health"
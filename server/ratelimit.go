@@ -0,0 +1,118 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// A token bucket for each key (usually an IP address), from
+// golang.org/x/time/rate: up to `burst` requests at once, then `limit` per
+// `window`, spread out evenly. Good enough for keeping someone from hammering
+// an endpoint; it doesn't need to be exact.
+type rateLimiter struct {
+	every rate.Limit
+	burst int
+
+	// A key that's gone this long without a request has its bucket full again,
+	// same as a new one, so there's no need to keep it.
+	idle time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+
+	// So tests can control time
+	now func() time.Time
+}
+
+type rateLimitBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration, burst int) *rateLimiter {
+	interval := window / time.Duration(limit)
+	return &rateLimiter{
+		every:   rate.Every(interval),
+		burst:   burst,
+		idle:    interval * time.Duration(burst),
+		buckets: make(map[string]*rateLimitBucket),
+		now:     time.Now,
+	}
+}
+
+// Count a request for the key. Returns false if it's over the limit, along
+// with how long until the key can make a request again.
+func (r *rateLimiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	b, exists := r.buckets[key]
+	if !exists {
+		b = &rateLimitBucket{limiter: rate.NewLimiter(r.every, r.burst)}
+		r.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// We're turning it down rather than waiting, so it doesn't count
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Drop buckets that are full again so the map doesn't grow forever. There's
+// no need to do it more often than that takes.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.idle {
+		return
+	}
+	for key, b := range r.buckets {
+		if now.Sub(b.lastSeen) >= r.idle {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+func tooManyRequestsJson(w http.ResponseWriter, retryAfter time.Duration, extra string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	errorJson(w, http.StatusTooManyRequests, extra)
+}
+
+// Whether the request is over the limiter's limit for its client IP (see
+// clientIP). If so, responds with a 429. Addresses in RateLimitExempt (such as
+// a health checker that logs in) are never over.
+func (s *Server) rateLimited(w http.ResponseWriter, req *http.Request, limiter *rateLimiter, extra string) bool {
+	ip := s.clientIP(req)
+	if ipInNets(ip, s.config.RateLimitExempt) {
+		return false
+	}
+	if ok, retryAfter := limiter.allow(ip); !ok {
+		tooManyRequestsJson(w, retryAfter, extra)
+		return true
+	}
+	return false
+}
+
+// Limit a handler by client IP. This only wraps the handler as it's registered
+// with the mux, so anything that calls the handler directly (such as the self
+// test) isn't limited.
+func (s *Server) rateLimit(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.rateLimited(w, req, limiter, "Too many requests from this address") {
+			return
+		}
+		handler(w, req)
+	}
+}
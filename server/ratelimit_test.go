@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func TestServerRateLimiter(t *testing.T) {
+	now := time.Now()
+	// One every 20 seconds, up to 3 at once
+	r := newRateLimiter(3, time.Minute, 3)
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := r.allow("a"); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	now = now.Add(time.Second * 5)
+	ok, retryAfter := r.allow("a")
+	if ok {
+		t.Fatalf("Expected request over the limit to not be allowed")
+	}
+	if want, got := time.Second*15, retryAfter; want != got {
+		t.Fatalf("Expected retry after %s, got %s", want, got)
+	}
+
+	// Other keys have their own limit
+	if ok, _ := r.allow("b"); !ok {
+		t.Fatalf("Expected request for another key to be allowed")
+	}
+
+	// Turning one down doesn't use anything up, so one more is allowed once
+	// it's been 20 seconds, and only one
+	now = now.Add(time.Second * 15)
+	if ok, _ := r.allow("a"); !ok {
+		t.Fatalf("Expected request after waiting to be allowed")
+	}
+	if ok, _ := r.allow("a"); ok {
+		t.Fatalf("Expected a second request after waiting to not be allowed")
+	}
+
+	// Keys that are full again get swept
+	now = now.Add(time.Minute * 2)
+	r.allow("c")
+	if _, ok := r.buckets["a"]; ok {
+		t.Fatalf("Expected old bucket to be swept")
+	}
+}
+
+// A smaller burst than the limit spreads the same limit out
+func TestServerRateLimiterBurst(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(6, time.Minute, 2)
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := r.allow("a"); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := r.allow("a")
+	if ok {
+		t.Fatalf("Expected request over the burst to not be allowed")
+	}
+	if want, got := time.Second*10, retryAfter; want != got {
+		t.Fatalf("Expected retry after %s, got %s", want, got)
+	}
+}
+
+func TestServerRateLimitMiddleware(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+	s.config.RateLimitExempt = []*net.IPNet{{IP: net.ParseIP("192.0.2.9").To4(), Mask: net.CIDRMask(32, 32)}}
+
+	calls := 0
+	handler := s.rateLimit(newRateLimiter(2, time.Minute, 2), func(w http.ResponseWriter, req *http.Request) {
+		calls++
+	})
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// Different ports, same IP
+	expectStatusCode(t, request("192.0.2.1:1234"), http.StatusOK)
+	expectStatusCode(t, request("192.0.2.1:5678"), http.StatusOK)
+
+	w := request("192.0.2.1:1234")
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusTooManyRequests)
+	expectErrorString(t, body, http.StatusText(http.StatusTooManyRequests)+": Too many requests from this address")
+	if w.Result().Header.Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After to be 30, got %q", w.Result().Header.Get("Retry-After"))
+	}
+	if calls != 2 {
+		t.Errorf("Expected the handler to be called 2 times, got %d", calls)
+	}
+
+	// Other IPs are unaffected
+	expectStatusCode(t, request("192.0.2.2:1234"), http.StatusOK)
+
+	// Exempt IPs are never limited
+	for i := 0; i < 5; i++ {
+		expectStatusCode(t, request("192.0.2.9:1234"), http.StatusOK)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Logs a line for every request, if REQUEST_LOG is on, with a request id that
+// also goes back to the client in X-Request-ID. If the client (or a proxy in
+// front of us) gives a request id, we use that one, so the line can be
+// matched up with their logs.
+//
+// Only the method and path are logged. Never the query string or the body,
+// since those are where tokens and passwords go.
+
+const RequestIdHeader = "X-Request-ID"
+
+// Anything else, we'd rather not put in the logs as is
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func requestId(req *http.Request) (string, error) {
+	if id := req.Header.Get(RequestIdHeader); validRequestId.MatchString(id) {
+		return id, nil
+	}
+	return randomHex(16)
+}
+
+func (s *Server) logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id, err := requestId(req)
+		if err != nil {
+			s.requestLog.Printf("Error generating request id: %+v", err)
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		recorder := statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(&recorder, req)
+
+		s.requestLog.Printf(
+			"request_id=%s method=%s path=%q status=%d duration=%s",
+			id, req.Method, req.URL.Path, recorder.status(), time.Since(start),
+		)
+	})
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerLogRequests(t *testing.T) {
+	tt := []struct {
+		name         string
+		incomingId   string
+		expectSameId bool
+	}{
+		{
+			name: "new request id",
+		},
+		{
+			name:         "incoming request id",
+			incomingId:   "my-proxy.request_id-123",
+			expectSameId: true,
+		},
+		{
+			name:       "unsafe incoming request id",
+			incomingId: "bad id\nwith a newline",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: TestStoreFunctionsErrors{GetUserId: store.ErrWrongCredentials}}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+			var logged bytes.Buffer
+			s.requestLog = log.New(&logged, "", 0)
+
+			requestBody := `{"deviceId": "dev-1", "email": "abc@example.com", "password": "seekrit-password"}`
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken+"?token=seekrit-token", bytes.NewBuffer([]byte(requestBody)))
+			if tc.incomingId != "" {
+				req.Header.Set(RequestIdHeader, tc.incomingId)
+			}
+			w := httptest.NewRecorder()
+			s.logRequests(http.HandlerFunc(s.getAuthToken)).ServeHTTP(w, req)
+
+			expectStatusCode(t, w, http.StatusUnauthorized)
+
+			id := w.Result().Header.Get(RequestIdHeader)
+			if !validRequestId.MatchString(id) {
+				t.Fatalf("Expected a request id in the response, got %q", id)
+			}
+			if tc.expectSameId && id != tc.incomingId {
+				t.Errorf("Expected the incoming request id %q, got %q", tc.incomingId, id)
+			}
+			if !tc.expectSameId && id == tc.incomingId {
+				t.Errorf("Expected a new request id, got the incoming one")
+			}
+
+			line := logged.String()
+			for _, expected := range []string{
+				"request_id=" + id + " ",
+				"method=POST",
+				`path="` + paths.PathAuthToken + `"`,
+				"status=401",
+				"duration=",
+			} {
+				if !strings.Contains(line, expected) {
+					t.Errorf("Expected %q in the log line, got %q", expected, line)
+				}
+			}
+			for _, secret := range []string{"seekrit-password", "seekrit-token"} {
+				if strings.Contains(line, secret) {
+					t.Errorf("Secret %q found in the log line: %q", secret, line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// If a self test account is configured (SELF_TEST_EMAIL), we periodically go
+// through what a client does to sync, using that account: get a token, get
+// the wallet, push a new version, and get it back again. It goes through the
+// same request handlers a client would (in-process, not over the network),
+// so it catches a broken store, auth, or anything in between, not just a dead
+// process. /readyz reports the result.
+//
+// The account is created (already verified) the first time if it doesn't
+// exist, and only ever holds junk wallets. Don't point it at a real account.
+
+const selfTestInterval = time.Minute
+
+const selfTestDeviceId = auth.DeviceId("self-test")
+
+type selfTestStatus struct {
+	mu     sync.Mutex
+	passed bool
+}
+
+func (st *selfTestStatus) set(passed bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.passed = passed
+}
+
+// Not ready until the self test has passed at least once
+func (st *selfTestStatus) healthy() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.passed
+}
+
+func (s *Server) runSelfTests(email auth.Email, password auth.Password, finish chan bool) {
+	ticker := time.NewTicker(selfTestInterval)
+	defer ticker.Stop()
+	for {
+		s.runSelfTest(email, password)
+		select {
+		case <-ticker.C:
+		case <-finish:
+			return
+		}
+	}
+}
+
+func (s *Server) runSelfTest(email auth.Email, password auth.Password) {
+	err := s.selfTest(email, password)
+	if err != nil {
+		log.Printf("Self test failed: %+v", err)
+		metrics.SelfTestHealthy.Set(0)
+	} else {
+		metrics.SelfTestHealthy.Set(1)
+	}
+	s.selfTestStatus.set(err == nil)
+}
+
+// Call a handler the way a client request would. The response body is
+// decoded into `response` if the status is 200.
+func selfTestRequest(handler http.HandlerFunc, method string, path string, requestBody interface{}, response interface{}) (statusCode int, err error) {
+	var body []byte
+	if requestBody != nil {
+		if body, err = json.Marshal(requestBody); err != nil {
+			return
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	if response != nil {
+		err = json.Unmarshal(w.Body.Bytes(), response)
+	}
+	return w.Code, err
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) ensureSelfTestAccount(email auth.Email, password auth.Password) error {
+	exists, err := s.store.EmailExists(context.Background(), email)
+	if err != nil || exists {
+		return err
+	}
+	seed, err := randomHex(auth.ClientSaltSeedLength)
+	if err != nil {
+		return err
+	}
+	log.Printf("Creating self test account %s", email)
+	return s.store.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed(seed), nil)
+}
+
+func (s *Server) selfTest(email auth.Email, password auth.Password) error {
+	if err := s.ensureSelfTestAccount(email, password); err != nil {
+		return fmt.Errorf("Error making sure the self test account exists: %w", err)
+	}
+
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{
+		DeviceId: selfTestDeviceId,
+		Email:    email,
+		Password: password,
+	}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		return fmt.Errorf("Getting a token: status %d err %v", statusCode, err)
+	}
+
+	walletPath := paths.PathWallet + "?token=" + url.QueryEscape(string(authToken.Token))
+
+	// Build on whatever the last self test left, if anything
+	var current WalletResponse
+	statusCode, err = selfTestRequest(s.getWallet, http.MethodGet, walletPath, nil, &current)
+	if err != nil || (statusCode != http.StatusOK && statusCode != http.StatusNotFound) {
+		return fmt.Errorf("Getting the current wallet: status %d err %v", statusCode, err)
+	}
+
+	junk, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	walletRequest := WalletRequest{
+		Token:           authToken.Token,
+		EncryptedWallet: wallet.EncryptedWallet("self-test-" + junk),
+		Sequence:        current.Sequence + 1,
+		Hmac:            wallet.WalletHmac("self-test-hmac-" + junk),
+	}
+	if statusCode == http.StatusNotFound {
+		walletRequest.Sequence = store.InitialWalletSequence
+	} else {
+		walletRequest.ParentHmac = &current.Hmac
+	}
+	statusCode, err = selfTestRequest(s.postWallet, http.MethodPost, paths.PathWallet, walletRequest, nil)
+	if err != nil || statusCode != http.StatusOK {
+		return fmt.Errorf("Saving a wallet: status %d err %v", statusCode, err)
+	}
+
+	var saved WalletResponse
+	statusCode, err = selfTestRequest(s.getWallet, http.MethodGet, walletPath, nil, &saved)
+	if err != nil || statusCode != http.StatusOK {
+		return fmt.Errorf("Getting the saved wallet: status %d err %v", statusCode, err)
+	}
+	if saved.EncryptedWallet != walletRequest.EncryptedWallet || saved.Sequence != walletRequest.Sequence || saved.Hmac != walletRequest.Hmac {
+		return fmt.Errorf("Got back a different wallet than was saved: sequence %d, expected %d", saved.Sequence, walletRequest.Sequence)
+	}
+
+	return nil
+}
+
+// For load balancers and such. Ready means the self test last passed, or that
+// there's no self test.
+func (s *Server) readyz(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	email, _, err := env.GetSelfTestAccount(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting self test account")
+		return
+	}
+	if email != "" && !s.selfTestStatus.healthy() {
+		errorJson(w, http.StatusServiceUnavailable, "Self test failing")
+		return
+	}
+
+	var readyResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(readyResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating readyResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
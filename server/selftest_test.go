@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// A real store, except that wallet updates can be made to fail
+type selfTestFailingStore struct {
+	store.StoreInterface
+	failSetWallet bool
+}
+
+func (s *selfTestFailingStore) SetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) error {
+	if s.failSetWallet {
+		return fmt.Errorf("Injected failure")
+	}
+	return s.StoreInterface.SetWallet(ctx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+}
+
+func expectReadyz(t *testing.T, s *Server, expectedStatusCode int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, paths.PathReadyz, nil)
+	w := httptest.NewRecorder()
+	s.readyz(w, req)
+	expectStatusCode(t, w, expectedStatusCode)
+}
+
+func TestServerSelfTest(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	failingStore := selfTestFailingStore{StoreInterface: &st}
+	env := map[string]string{
+		"SELF_TEST_EMAIL":    "self-test@example.com",
+		"SELF_TEST_PASSWORD": "12345678",
+	}
+	s := Init(&auth.Auth{}, &failingStore, &TestEnv{env}, &TestMail{}, TestConfig)
+
+	// Not ready until it's passed once
+	expectReadyz(t, s, http.StatusServiceUnavailable)
+
+	// The first run creates the account and the first wallet, the second one
+	// builds on it
+	for i := 1; i <= 2; i++ {
+		s.runSelfTest("self-test@example.com", "12345678")
+		expectReadyz(t, s, http.StatusOK)
+
+		userId, err := st.GetUserId(context.Background(), "self-test@example.com", "12345678")
+		if err != nil {
+			t.Fatalf("Expected the self test account to exist: %+v", err)
+		}
+		if _, sequence, _, _, err := st.GetWallet(context.Background(), userId, wallet.DefaultAppId); err != nil || sequence != wallet.Sequence(i) {
+			t.Errorf("Expected the self test wallet at sequence %d, got %d err: %+v", i, sequence, err)
+		}
+	}
+
+	failingStore.failSetWallet = true
+	s.runSelfTest("self-test@example.com", "12345678")
+	expectReadyz(t, s, http.StatusServiceUnavailable)
+
+	failingStore.failSetWallet = false
+	s.runSelfTest("self-test@example.com", "12345678")
+	expectReadyz(t, s, http.StatusOK)
+}
+
+// With no self test account configured, there's no self test, so nothing to
+// be unready about
+func TestServerReadyzNoSelfTest(t *testing.T) {
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+	expectReadyz(t, s, http.StatusOK)
+}
@@ -5,10 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
-	"os"
-	"os/signal"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -20,8 +21,15 @@ import (
 	"lbryio/wallet-sync-server/wallet"
 )
 
+// The limit on request bodies that carry a wallet (or several). Make it 100k.
+// Increase from there as needed. I'd rather block some people's large wallets
+// and increase the limit than OOM for everybody and decrease the limit.
 const maxBodySize = 100000
 
+// The limit on every other request body. These are emails, passwords, tokens
+// and the like, which come nowhere near it.
+const maxSmallBodySize = 10000
+
 // Message sent from the wallet POST request handler to the websocket manager,
 // indicating that a user's client should receive a (different) message that
 // their wallet has an update on the server.
@@ -31,16 +39,33 @@ type walletUpdateMsg struct {
 }
 
 type Server struct {
-	auth  auth.AuthInterface
-	store store.StoreInterface
-	env   env.EnvInterface
-	mail  mail.MailInterface
-	port  int
+	auth   auth.AuthInterface
+	store  store.StoreInterface
+	env    env.EnvInterface
+	mail   mail.MailInterface
+	config Config
 
 	clientAdd     chan wsClientForUser
 	clientRemove  chan wsClientForUser
 	userRemove    chan wsClientForUser
 	walletUpdates chan walletUpdateMsg
+
+	walletWatchers    *walletWatchers
+	walletPollTimeout time.Duration
+
+	conflicts *conflictTracker
+
+	wsConnections *wsConnectionCounter
+
+	emailAvailabilityLimiter *rateLimiter
+
+	// See sendMailInBackground
+	backgroundEmails chan struct{}
+
+	selfTestStatus selfTestStatus
+
+	// Where REQUEST_LOG lines go. Tests can swap it out to see what's logged.
+	requestLog *log.Logger
 }
 
 func Init(
@@ -48,14 +73,14 @@ func Init(
 	storeInterface store.StoreInterface,
 	envInterface env.EnvInterface,
 	mailInterface mail.MailInterface,
-	port int,
+	config Config,
 ) *Server {
 	return &Server{
-		auth:  authInterface,
-		store: storeInterface,
-		env:   envInterface,
-		mail:  mailInterface,
-		port:  port,
+		auth:   authInterface,
+		store:  storeInterface,
+		env:    envInterface,
+		mail:   mailInterface,
+		config: config,
 
 		// Anything that could get backed up by a lot of requests, let's just
 		// give it a buffer. Starting small until we start to see dashboard
@@ -65,31 +90,127 @@ func Init(
 		clientRemove:  make(chan wsClientForUser),
 		userRemove:    make(chan wsClientForUser, 5),
 		walletUpdates: make(chan walletUpdateMsg, 5),
+
+		walletWatchers:    newWalletWatchers(),
+		walletPollTimeout: walletPollTimeout,
+
+		conflicts: newConflictTracker(),
+
+		wsConnections: newWsConnectionCounter(),
+
+		emailAvailabilityLimiter: newRateLimiter(emailAvailabilityRateLimit, emailAvailabilityRateLimitWindow, emailAvailabilityRateLimit),
+
+		backgroundEmails: make(chan struct{}, maxBackgroundEmails),
+
+		requestLog: log.Default(),
 	}
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+
+	// See ErrorCode
+	Code ErrorCode `json:"code"`
+
+	// Whether the client should try the same request again later. True for
+	// problems on our end (or too many requests), where the request itself was
+	// fine. False when the request needs to change first: fix validation, merge
+	// a conflicting wallet, log in again, etc. Retrying those as they are
+	// would just fail again.
+	Retryable bool `json:"retryable"`
+
+	// Only for 413 responses, so the client can tell how far over it went
+	MaxBodySize   int `json:"maxBodySize,omitempty"`
+	MaxWalletSize int `json:"maxWalletSize,omitempty"`
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
 }
 
 func errorJson(w http.ResponseWriter, code int, extra string) {
+	errorCodeJson(w, code, statusErrorCode(code), extra)
+}
+
+// For any error from the store. The ones the client should hear about get
+// their status, code and message from storeErrors. Anything else is a 500,
+// logged with errContext, same as internalServiceErrorJson.
+func (s *Server) storeErrorJson(w http.ResponseWriter, storeErr error, errContext string) {
+	if storeErr == store.ErrWalletTooLarge {
+		// The client needs to hear what the limit is, which depends on the env
+		s.walletTooLargeJson(w)
+		return
+	}
+	code, errorResponse := errorToResponse(storeErr)
+	if code == http.StatusInternalServerError {
+		internalServiceErrorJson(w, storeErr, errContext)
+		return
+	}
+	errorResponseJson(w, code, errorResponse)
+}
+
+func errorCodeJson(w http.ResponseWriter, code int, errorCode ErrorCode, extra string) {
 	errorStr := http.StatusText(code)
 	if extra != "" {
 		errorStr = errorStr + ": " + extra
 	}
-	authErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr})
+	errorResponseJson(w, code, ErrorResponse{Error: errorStr, Code: errorCode, Retryable: retryableStatus(code)})
+}
+
+func errorResponseJson(w http.ResponseWriter, code int, errorResponse ErrorResponse) {
+	errorJson, err := json.Marshal(errorResponse)
+	if err != nil {
+		// In case something really stupid happens
+		http.Error(w, `{"error": "error when JSON-encoding error message"}`, code)
+		return
+	}
+	http.Error(w, string(errorJson), code)
+}
+
+// maxBytes is the limit for the endpoint. For the wallet endpoints, it's the
+// same limit we advertise in CapabilitiesResponse.
+func bodyTooLargeJson(w http.ResponseWriter, maxBytes int64) {
+	code := http.StatusRequestEntityTooLarge
+	errorStr := fmt.Sprintf("%s: Max request body size is %d bytes", http.StatusText(code), maxBytes)
+	tooLargeErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr, Code: ErrorCodeBodyTooLarge, MaxBodySize: int(maxBytes)})
 	if err != nil {
 		// In case something really stupid happens
 		http.Error(w, `{"error": "error when JSON-encoding error message"}`, code)
+		return
 	}
-	http.Error(w, string(authErrorJson), code)
-	return
+	http.Error(w, string(tooLargeErrorJson), code)
+}
+
+// Like bodyTooLargeJson, for an encrypted wallet over MAX_WALLET_SIZE
+func (s *Server) walletTooLargeJson(w http.ResponseWriter) {
+	maxWalletSize, err := env.GetMaxWalletSize(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting max wallet size")
+		return
+	}
+	code := http.StatusRequestEntityTooLarge
+	errorStr := fmt.Sprintf("%s: Max wallet size is %d bytes", http.StatusText(code), maxWalletSize)
+	tooLargeErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr, Code: ErrorCodeWalletTooLarge, MaxWalletSize: maxWalletSize})
+	if err != nil {
+		// In case something really stupid happens
+		http.Error(w, `{"error": "error when JSON-encoding error message"}`, code)
+		return
+	}
+	http.Error(w, string(tooLargeErrorJson), code)
 }
 
 // Don't report any details to the user. Log it instead.
 func internalServiceErrorJson(w http.ResponseWriter, serverErr error, errContext string) {
 	errorStr := http.StatusText(http.StatusInternalServerError)
-	authErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr})
+	authErrorJson, err := json.Marshal(ErrorResponse{Error: errorStr, Code: ErrorCodeInternal, Retryable: true})
 	if err != nil {
 		// In case something really stupid happens
 		http.Error(w, `{"error": "error when JSON-encoding error message"}`, http.StatusInternalServerError)
@@ -124,16 +245,32 @@ type PostRequest interface {
 	validate() error
 }
 
-// Confirm it's a Post request, various overhead, decode the json, validate the struct
-func getPostData(w http.ResponseWriter, req *http.Request, reqStruct PostRequest) bool {
+// Whether the body claims to be JSON, or says nothing either way. A
+// form-encoded body (say) would otherwise only get a confusing "Error parsing
+// JSON".
+func jsonContentType(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Confirm it's a Post request, various overhead, decode the json, validate the
+// struct. The body can be at most maxBytes; see maxBodySize and
+// maxSmallBodySize.
+func getPostData(w http.ResponseWriter, req *http.Request, reqStruct PostRequest, maxBytes int64) bool {
 	if !requestOverhead(w, req, http.MethodPost) {
 		return false
 	}
 
-	// Make the limit 100k. Increase from there as needed. I'd rather block some
-	// people's large wallets and increase the limit than OOM for everybody and
-	// decrease the limit.
-	req.Body = http.MaxBytesReader(w, req.Body, maxBodySize)
+	if !jsonContentType(req) {
+		errorJson(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
 	decoder := json.NewDecoder(req.Body)
 	decoder.DisallowUnknownFields()
 	err := decoder.Decode(&reqStruct)
@@ -141,46 +278,163 @@ func getPostData(w http.ResponseWriter, req *http.Request, reqStruct PostRequest
 	case err == nil:
 		break
 	case err.Error() == "http: request body too large":
-		errorJson(w, http.StatusRequestEntityTooLarge, "")
+		bodyTooLargeJson(w, maxBytes)
 		return false
 	case strings.HasPrefix(err.Error(), "json: unknown field"):
 		// The error is coming straight out of the json decoder. I think the prefix
 		// we check for determines what it is pretty reliably. I'd think it's safe
 		// to give back to the requesting client (unlike an arbitrary error
 		// message).
-		errorJson(w, http.StatusBadRequest, err.Error())
+		errorCodeJson(w, http.StatusBadRequest, ErrorCodeInvalidJson, err.Error())
 		return false
 	default:
 		// Maybe we can suss out more specific errors later. Need to study what
 		// errors come from Decode.
-		errorJson(w, http.StatusBadRequest, "Error parsing JSON")
+		errorCodeJson(w, http.StatusBadRequest, ErrorCodeInvalidJson, "Error parsing JSON")
 		return false
 	}
 
 	err = reqStruct.validate()
 	if err != nil {
-		errorJson(w, http.StatusBadRequest, "Request failed validation: "+err.Error())
+		errorCodeJson(w, http.StatusBadRequest, ErrorCodeValidationFailed, "Request failed validation: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+// Check the wallets in a request against MAX_WALLET_SIZE before going any
+// further. The store checks too, but this way we don't get as far as the
+// database with them.
+func (s *Server) checkWalletSize(w http.ResponseWriter, encryptedWallets ...wallet.EncryptedWallet) bool {
+	maxWalletSize, err := env.GetMaxWalletSize(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting max wallet size")
+		return false
+	}
+	if maxWalletSize == 0 {
+		return true
+	}
+	for _, encryptedWallet := range encryptedWallets {
+		if len(encryptedWallet) > maxWalletSize {
+			s.walletTooLargeJson(w)
+			return false
+		}
+	}
+	return true
+}
+
+// Reject sequences over MAX_WALLET_SEQUENCE (or wallet.DefaultMaxSequence)
+// before going any further. The store checks too.
+func (s *Server) checkSequenceLimit(w http.ResponseWriter, sequences ...wallet.Sequence) bool {
+	maxWalletSequence, err := env.GetMaxWalletSequence(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting max wallet sequence")
 		return false
 	}
+	if maxWalletSequence == 0 {
+		maxWalletSequence = wallet.DefaultMaxSequence
+	}
+	for _, sequence := range sequences {
+		if sequence > maxWalletSequence {
+			code, errorResponse := errorToResponse(store.ErrSequenceExhausted)
+			errorResponseJson(w, code, errorResponse)
+			return false
+		}
+	}
+	return true
+}
 
+// With HMAC_FORMAT_CHECK, reject hmacs that can't be right before going any
+// further. The store checks too.
+func (s *Server) checkHmacFormat(w http.ResponseWriter, hmacs ...wallet.WalletHmac) bool {
+	hmacFormatCheck, err := env.GetHmacFormatCheck(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting hmac format check")
+		return false
+	}
+	if !hmacFormatCheck {
+		return true
+	}
+	for _, hmac := range hmacs {
+		if !hmac.Validate() {
+			invalidHmacJson(w)
+			return false
+		}
+	}
 	return true
 }
 
+func invalidHmacJson(w http.ResponseWriter) {
+	code, errorResponse := errorToResponse(store.ErrInvalidHmac)
+	errorResponseJson(w, code, errorResponse)
+}
+
 // Confirm it's a Get request, various overhead
 func getGetData(w http.ResponseWriter, req *http.Request) bool {
 	return requestOverhead(w, req, http.MethodGet)
 }
 
+func getHeadData(w http.ResponseWriter, req *http.Request) bool {
+	return requestOverhead(w, req, http.MethodHead)
+}
+
+// `Authorization: Bearer <token>`. Empty if there's no Authorization header at
+// all, and an error if there's one we can't use.
+func getBearerToken(req *http.Request) (token auth.AuthTokenString, err error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return
+	}
+	scheme, value, _ := strings.Cut(header, " ")
+	value = strings.TrimSpace(value)
+	if !strings.EqualFold(scheme, "Bearer") || value == "" {
+		err = fmt.Errorf("Invalid Authorization header")
+		return
+	}
+	return auth.AuthTokenString(value), nil
+}
+
+// Every 401 from checkAuth comes with WWW-Authenticate, so a client can tell
+// that it needs to log in again rather than retry. A token we don't have and
+// one that expired look the same to the store, and to the client.
+func unauthorizedJson(w http.ResponseWriter, errorCode ErrorCode, bearerError string, extra string) {
+	challenge := "Bearer"
+	if bearerError != "" {
+		challenge = fmt.Sprintf(`Bearer error="%s"`, bearerError)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	errorCodeJson(w, http.StatusUnauthorized, errorCode, extra)
+}
+
+// The token goes in the Authorization header. For now, requests that don't
+// have one can still send it the old way, in the body (POST) or the `token`
+// param (GET), which is fallbackToken. The header wins if there are both.
+//
 // TODO - probably don't return all of authToken since we only need userId and
 // deviceId.
 func (s *Server) checkAuth(
+	req *http.Request,
 	w http.ResponseWriter,
-	token auth.AuthTokenString,
+	fallbackToken auth.AuthTokenString,
 	scope auth.AuthScope,
 ) *auth.AuthToken {
-	authToken, err := s.store.GetToken(token)
+	token, err := getBearerToken(req)
+	if err != nil {
+		unauthorizedJson(w, ErrorCodeInvalidToken, "invalid_request", err.Error())
+		return nil
+	}
+	if token == "" {
+		token = fallbackToken
+	}
+	if token == "" {
+		unauthorizedJson(w, ErrorCodeMissingToken, "", "Missing token")
+		return nil
+	}
+
+	authToken, err := s.store.GetToken(req.Context(), token)
 	if err == store.ErrNoTokenForUserDevice {
-		errorJson(w, http.StatusUnauthorized, "Token Not Found")
+		unauthorizedJson(w, ErrorCodeInvalidToken, "invalid_token", "Token Not Found")
 		return nil
 	}
 	if err != nil {
@@ -189,27 +443,19 @@ func (s *Server) checkAuth(
 	}
 
 	if !authToken.ScopeValid(scope) {
-		errorJson(w, http.StatusForbidden, "Scope")
+		errorCodeJson(w, http.StatusForbidden, ErrorCodeInsufficientScope, "Scope")
 		return nil
 	}
 
 	return authToken
 }
 
-// Useful for any request where token is the only GET param to get
+// The old way for GET requests to send the token, for checkAuth to fall back
+// on. Empty if it's not there; checkAuth will complain if there's no
+// Authorization header either.
 // TODO - There's probably a struct-based solution here like with POST/PUT.
-func getTokenParam(req *http.Request) (token auth.AuthTokenString, err error) {
-	tokenSlice, hasTokenSlice := req.URL.Query()["token"]
-
-	if !hasTokenSlice || tokenSlice[0] == "" {
-		err = fmt.Errorf("Missing token parameter")
-	}
-
-	if err == nil {
-		token = auth.AuthTokenString(tokenSlice[0])
-	}
-
-	return
+func getTokenParam(req *http.Request) auth.AuthTokenString {
+	return auth.AuthTokenString(req.URL.Query().Get("token"))
 }
 
 // TODO - both wallet and token requests should be PUT, not POST.
@@ -225,30 +471,167 @@ func (s *Server) wrongApiVersion(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func serve(server *http.Server, done chan bool) {
+// For paths without the version prefix, such as /wallet instead of
+// /api/3/wallet. If it's an endpoint with the prefix, a GET is sent there
+// with a 301. Other methods get a 404 saying where to go instead, since most
+// clients would follow a redirect with a GET and drop the body.
+func unversioned(endpoints map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		versionedPath := paths.PathPrefix + req.URL.Path
+		if !endpoints[versionedPath] {
+			errorJson(w, http.StatusNotFound, "Missing API version. Current version is "+paths.ApiVersion+".")
+			return
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			errorJson(w, http.StatusNotFound, "Missing API version. Use "+versionedPath)
+			return
+		}
+		versionedUrl := url.URL{Path: versionedPath, RawQuery: req.URL.RawQuery}
+		http.Redirect(w, req, versionedUrl.String(), http.StatusMovedPermanently)
+	}
+}
+
+// Give up on the database after this long, so that a health check gets an
+// answer either way
+const healthCheckTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// For load balancers and such, to check that we're up and can reach the
+// database. No auth, and only a trivial query, so it's fine to hit often. See
+// also readyz, which goes by the self test instead.
+func (s *Server) health(w http.ResponseWriter, req *http.Request) {
+	if !getGetData(w, req) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := s.store.Ping(ctx); err != nil {
+		log.Printf("Health check failed to reach the database: %+v", err)
+		errorJson(w, http.StatusServiceUnavailable, "Database unreachable")
+		return
+	}
+
+	response, err := json.Marshal(HealthResponse{Status: "ok"})
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating health response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+func serve(server *http.Server, config *Config, done chan bool) {
 	log.Print("Server start")
-	server.ListenAndServe()
+	var err error
+	if config.useTLS() {
+		err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	// Such as the port being taken, or a bad TLS cert. Nothing is going to
+	// work, so don't just sit there.
+	if err != http.ErrServerClosed {
+		log.Fatalf("Server error: %+v", err)
+	}
 	log.Print("Server finish")
 
 	done <- true
 }
 
-func (s *Server) Serve() {
-	http.HandleFunc(paths.PathAuthToken, s.getAuthToken)
-	http.HandleFunc(paths.PathWallet, s.handleWallet)
-	http.HandleFunc(paths.PathRegister, s.register)
-	http.HandleFunc(paths.PathPassword, s.changePassword)
-	http.HandleFunc(paths.PathVerify, s.verify)
-	http.HandleFunc(paths.PathResendVerify, s.resendVerifyEmail)
-	http.HandleFunc(paths.PathClientSaltSeed, s.getClientSaltSeed)
+// Serve until ctx is done, then shut down. Requests in progress get up to
+// SHUTDOWN_TIMEOUT to finish.
+func (s *Server) Serve(ctx context.Context) {
+	// Logging in and signing up are where someone would try guessing passwords
+	// or making lots of accounts, so each gets a limit per IP. They're set
+	// separately, since someone making accounts needs far fewer requests to do
+	// damage than someone guessing passwords.
+	authRateLimit, authRateLimitWindow, authRateLimitBurst, err := env.GetAuthRateLimit(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	signupRateLimit, signupRateLimitWindow, signupRateLimitBurst, err := env.GetSignupRateLimit(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	shutdownTimeout, err := env.GetShutdownTimeout(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	corsAllowedOrigins, err := env.GetCorsAllowedOrigins(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	httpMetrics, err := env.GetHttpMetrics(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	requestLog, err := env.GetRequestLog(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// The API endpoints, for sending unversioned paths to the right place
+	endpoints := make(map[string]bool)
+	handle := func(path string, handler http.HandlerFunc) {
+		if strings.HasPrefix(path, paths.PathPrefix+"/") && path != paths.PathUnknownEndpoint {
+			endpoints[path] = true
+		}
+		if httpMetrics {
+			handler = instrumentRequests(path, handler)
+		}
+		http.HandleFunc(path, handler)
+	}
+
+	// The websocket (which is long lived, and needs the original
+	// ResponseWriter to take over the connection) and the endpoints for
+	// monitoring aren't counted in the HTTP metrics.
+	handle(paths.PathAuthToken, s.rateLimit(newRateLimiter(authRateLimit, authRateLimitWindow, authRateLimitBurst), s.getAuthToken))
+	handle(paths.PathAuthTokenRefresh, s.refreshAuthToken)
+	handle(paths.PathAuthLogout, s.logout)
+	handle(paths.PathAuthDeviceId, s.updateDeviceId)
+	handle(paths.PathAuthSigningKey, s.setSigningKey)
+	handle(paths.PathTotpEnroll, s.enrollTotp)
+	handle(paths.PathTotpConfirm, s.confirmTotp)
+	handle(paths.PathDevices, s.getDevices)
+	handle(paths.PathWallet, gzipResponse(s.handleWallet))
+	handle(paths.PathWalletBatch, s.postWalletBatch)
+	handle(paths.PathWalletVerify, s.postWalletVerify)
+	handle(paths.PathWalletPoll, gzipResponse(s.getWalletPoll))
+	handle(paths.PathWalletStatus, s.getWalletStatus)
+	handle(paths.PathWalletSync, gzipResponse(s.postWalletSync))
+	handle(paths.PathRegister, s.rateLimit(newRateLimiter(signupRateLimit, signupRateLimitWindow, signupRateLimitBurst), s.register))
+	handle(paths.PathEmailAvailable, s.getEmailAvailability)
+	handle(paths.PathPassword, s.changePassword)
+	handle(paths.PathAccountDelete, s.deleteAccount)
+	handle(paths.PathExport, gzipResponse(s.getExport))
+	handle(paths.PathImport, s.postImport)
+	handle(paths.PathVerify, s.verify)
+	handle(paths.PathResendVerify, s.resendVerifyEmail)
+	handle(paths.PathClientSaltSeed, s.getClientSaltSeed)
+	handle(paths.PathCapabilities, s.getCapabilities)
+	handle(paths.PathAdminAccount, s.getAdminAccount)
 	http.HandleFunc(paths.PathWebsocket, s.websocket)
 
-	http.HandleFunc(paths.PathUnknownEndpoint, s.unknownEndpoint)
-	http.HandleFunc(paths.PathWrongApiVersion, s.wrongApiVersion)
+	handle(paths.PathUnknownEndpoint, s.unknownEndpoint)
+	handle(paths.PathWrongApiVersion, s.wrongApiVersion)
+	handle(paths.PathUnversioned, unversioned(endpoints))
 
 	http.Handle(paths.PathPrometheus, promhttp.Handler())
+	http.HandleFunc(paths.PathReadyz, s.readyz)
+	http.HandleFunc(paths.PathHealth, s.health)
 
-	log.Printf("Serving at localhost:%d\n", s.port)
+	scheme := "http"
+	if s.config.useTLS() {
+		scheme = "https"
+	}
+	log.Printf("Serving at %s://%s\n", scheme, s.config.addr())
 
 	// Signal *to* socket manager that it should finish (we use server.Shutdown
 	// to tell the server to finish)
@@ -260,20 +643,73 @@ func (s *Server) Serve() {
 
 	go s.manageSockets(socketsDone, socketsFinish)
 
-	server := http.Server{Addr: fmt.Sprintf("localhost:%d", s.port)}
-	go serve(&server, serverDone)
+	selfTestEmail, selfTestPassword, err := env.GetSelfTestAccount(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	selfTestFinish := make(chan bool)
+	if selfTestEmail != "" {
+		log.Printf("Running a self test every %s with %s", selfTestInterval, selfTestEmail)
+		go s.runSelfTests(selfTestEmail, selfTestPassword, selfTestFinish)
+	}
+
+	// Checked on every admin request too, but a bad setting should stop us here
+	adminApi, _, err := env.GetAdminApi(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if adminApi {
+		log.Printf("Admin API is on")
+	}
+
+	tokenPurge, tokenPurgeInterval, err := env.GetTokenPurge(s.env)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	tokenPurgeFinish := make(chan bool)
+	if tokenPurge {
+		log.Printf("Purging expired tokens every %s", tokenPurgeInterval)
+		go s.purgeExpiredTokens(tokenPurgeInterval, tokenPurgeFinish)
+	}
+
+	handler := cors(corsAllowedOrigins, http.DefaultServeMux)
+	if requestLog {
+		// On the outside, so everything gets logged, CORS preflights included
+		handler = s.logRequests(handler)
+	}
+
+	server := http.Server{
+		Addr:    s.config.addr(),
+		Handler: handler,
 
-	// Make sure that both the server and the websocket manager close properly on interrupt
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+		// The websocket takes over the connection and sets its own deadlines,
+		// so these don't cut it off.
+		ReadHeaderTimeout: s.config.readHeaderTimeout(),
+		ReadTimeout:       s.config.readTimeout(),
+		WriteTimeout:      s.config.writeTimeout(),
+		IdleTimeout:       s.config.idleTimeout(),
+	}
+	server.RegisterOnShutdown(s.walletWatchers.finish)
+	go serve(&server, &s.config, serverDone)
 
-	// Wait for the interrupt signal
-	<-interrupt
+	// Make sure that both the server and the websocket manager close properly
+	// when we're told to stop (on interrupt or SIGTERM, see main)
+	<-ctx.Done()
+
+	close(selfTestFinish)
+	close(tokenPurgeFinish)
 
 	// Tell the server to finish and wait for it to do so. We want it to finish
 	// to guarantee no more incoming sockets before we turn off the socket
-	// manager.
-	server.Shutdown(context.Background())
+	// manager. Requests in progress (such as a wallet being saved) get to
+	// finish, up to the timeout. Waiting long polls are let go right away with
+	// a 204 (see RegisterOnShutdown above).
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still in progress after %s, closing them: %+v", shutdownTimeout, err)
+		server.Close()
+	}
 	<-serverDone
 
 	// The socket manager's cleanup procedure assumes that there will be no new
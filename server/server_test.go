@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,7 +18,7 @@ import (
 	"lbryio/wallet-sync-server/wallet"
 )
 
-const TestPort = 8090
+var TestConfig = Config{Host: "localhost", Port: 8090}
 
 // Implementing interfaces for stubbed out packages
 
@@ -26,9 +27,20 @@ type SendVerificationEmailCall struct {
 	Token auth.VerifyTokenString
 }
 
+type SendNewDeviceEmailCall struct {
+	Email      auth.Email
+	DeviceId   auth.DeviceId
+	DeviceName auth.DeviceName
+}
+
 type TestMail struct {
 	SendVerificationEmailError error
 	SendVerificationEmailCall  *SendVerificationEmailCall
+
+	// New device emails are sent in the background, so they're sent here as
+	// they happen, if it's set. Make it buffered or make sure to receive.
+	SendNewDeviceEmailError error
+	SendNewDeviceEmailCalls chan SendNewDeviceEmailCall
 }
 
 func (m *TestMail) SendVerificationEmail(email auth.Email, token auth.VerifyTokenString) error {
@@ -36,6 +48,13 @@ func (m *TestMail) SendVerificationEmail(email auth.Email, token auth.VerifyToke
 	return m.SendVerificationEmailError
 }
 
+func (m *TestMail) SendNewDeviceEmail(email auth.Email, deviceId auth.DeviceId, deviceName auth.DeviceName) error {
+	if m.SendNewDeviceEmailCalls != nil {
+		m.SendNewDeviceEmailCalls <- SendNewDeviceEmailCall{email, deviceId, deviceName}
+	}
+	return m.SendNewDeviceEmailError
+}
+
 type TestEnv struct {
 	env map[string]string
 }
@@ -47,6 +66,7 @@ func (e *TestEnv) Getenv(key string) string {
 type TestAuth struct {
 	TestNewAuthTokenString   auth.AuthTokenString
 	TestNewVerifyTokenString auth.VerifyTokenString
+	TestNewTotpSecret        auth.TotpSecret
 	FailGenToken             bool
 }
 
@@ -64,10 +84,26 @@ func (a *TestAuth) NewVerifyTokenString() (auth.VerifyTokenString, error) {
 	return a.TestNewVerifyTokenString, nil
 }
 
+func (a *TestAuth) NewTotpSecret() (auth.TotpSecret, error) {
+	if a.FailGenToken {
+		return "", fmt.Errorf("Test error: fail to generate token")
+	}
+	return a.TestNewTotpSecret, nil
+}
+
+type GetTokensForUserCall struct {
+	UserId auth.UserId
+	Limit  int
+	Offset int
+}
+
 type SetWalletCall struct {
 	EncryptedWallet wallet.EncryptedWallet
 	Sequence        wallet.Sequence
 	Hmac            wallet.WalletHmac
+	ParentHmac      wallet.WalletHmac // "" if not given
+
+	EncryptionVersion wallet.EncryptionVersion
 }
 
 type ChangePasswordNoWalletCall struct {
@@ -78,13 +114,37 @@ type ChangePasswordNoWalletCall struct {
 }
 
 type ChangePasswordWithWalletCall struct {
-	EncryptedWallet wallet.EncryptedWallet
-	Sequence        wallet.Sequence
-	Hmac            wallet.WalletHmac
-	Email           auth.Email
-	OldPassword     auth.Password
-	NewPassword     auth.Password
-	ClientSaltSeed  auth.ClientSaltSeed
+	EncryptedWallet   wallet.EncryptedWallet
+	Sequence          wallet.Sequence
+	Hmac              wallet.WalletHmac
+	ParentHmac        wallet.WalletHmac // "" if not given
+	EncryptionVersion wallet.EncryptionVersion
+	Email             auth.Email
+	OldPassword       auth.Password
+	NewPassword       auth.Password
+	ClientSaltSeed    auth.ClientSaltSeed
+}
+
+type DeleteTokenCall struct {
+	UserId   auth.UserId
+	DeviceId auth.DeviceId
+}
+
+type UpdateTokenDeviceIdCall struct {
+	UserId      auth.UserId
+	OldDeviceId auth.DeviceId
+	NewDeviceId auth.DeviceId
+}
+
+type AddKnownDeviceCall struct {
+	UserId   auth.UserId
+	DeviceId auth.DeviceId
+}
+
+type UpdateDeviceSyncCall struct {
+	UserId   auth.UserId
+	DeviceId auth.DeviceId
+	Sequence wallet.Sequence
 }
 
 type CreateAccountCall struct {
@@ -98,29 +158,81 @@ type CreateAccountCall struct {
 type TestStoreFunctionsCalled struct {
 	SaveToken                auth.AuthTokenString
 	GetToken                 auth.AuthTokenString
+	RefreshToken             auth.AuthTokenString
+	DeleteToken              DeleteTokenCall
+	GetTokensForUser         GetTokensForUserCall
+	UpdateTokenDeviceId      UpdateTokenDeviceIdCall
 	GetUserId                bool
 	CreateAccount            *CreateAccountCall
 	UpdateVerifyTokenString  bool
 	VerifyAccount            bool
 	SetWallet                SetWalletCall
+	SetWalletBatch           []store.WalletUpdate
+	SyncWallet               SetWalletCall
+	ImportWallet             SetWalletCall
+	ImportAppWallets         []store.AppWalletUpdate
 	GetWallet                bool
+	GetWalletMetadata        bool
+	GetWalletAppIds          auth.UserId
+	CheckSequence            wallet.Sequence
+	AppId                    wallet.AppId // of the last wallet call
 	ChangePasswordWithWallet ChangePasswordWithWalletCall
 	ChangePasswordNoWallet   ChangePasswordNoWalletCall
+	ChangePasswordAppWallets []store.AppWalletUpdate // for either one
 	GetClientSaltSeed        auth.Email
+	GetSigningPublicKey      auth.Email
+	GetAccountStatus         auth.Email
+	SetSigningPublicKey      auth.SigningPublicKey
+	EmailExists              auth.Email
+	GetEmail                 auth.UserId
+	DeleteAccount            auth.UserId
+	Ping                     bool
+	UpdateDeviceSync         UpdateDeviceSyncCall
+	GetDeviceSyncs           auth.UserId
+	PurgeExpiredTokens       bool
+	AddKnownDevice           AddKnownDeviceCall
+	SetTotpSecret            auth.TotpSecret
+	EnableTotp               auth.TotpCode
+	CheckTotp                auth.TotpCode
 }
 
 type TestStoreFunctionsErrors struct {
 	SaveToken                error
 	GetToken                 error
+	RefreshToken             error
+	DeleteToken              error
+	GetTokensForUser         error
+	UpdateTokenDeviceId      error
 	GetUserId                error
 	CreateAccount            error
 	UpdateVerifyTokenString  error
 	VerifyAccount            error
 	SetWallet                error
+	SetWalletBatch           error
+	SyncWallet               error
+	ImportWallet             error
 	GetWallet                error
+	GetWalletMetadata        error
+	GetWalletAppIds          error
+	CheckSequence            error
 	ChangePasswordWithWallet error
 	ChangePasswordNoWallet   error
 	GetClientSaltSeed        error
+	GetSigningPublicKey      error
+	GetAccountStatus         error
+	SetSigningPublicKey      error
+	CheckAndStoreNonce       error
+	EmailExists              error
+	GetEmail                 error
+	DeleteAccount            error
+	Ping                     error
+	UpdateDeviceSync         error
+	GetDeviceSyncs           error
+	PurgeExpiredTokens       error
+	AddKnownDevice           error
+	SetTotpSecret            error
+	EnableTotp               error
+	CheckTotp                error
 }
 
 type TestStore struct {
@@ -133,30 +245,88 @@ type TestStore struct {
 
 	TestAuthToken auth.AuthToken
 	TestUserId    auth.UserId
+	TestEmail     auth.Email
+
+	TestRefreshedExpiration time.Time
+
+	TestTokensForUser []auth.AuthToken
+
+	TestNumTokensDeleted int64
 
-	TestEncryptedWallet wallet.EncryptedWallet
-	TestSequence        wallet.Sequence
-	TestHmac            wallet.WalletHmac
+	TestWalletAppIds []wallet.AppId
+
+	TestDeviceSyncs []store.DeviceSync
+
+	TestNewDevice bool
+
+	TestEncryptedWallet   wallet.EncryptedWallet
+	TestSequence          wallet.Sequence
+	TestHmac              wallet.WalletHmac
+	TestEncryptionVersion wallet.EncryptionVersion
+
+	// Whether SyncWallet saves the wallet it's given. If not, it returns the
+	// Test wallet above as the one it lost to (or none if TestSequence is 0).
+	TestSyncWalletLost bool
 
 	TestClientSaltSeed auth.ClientSaltSeed
+
+	TestSigningPublicKey auth.SigningPublicKey
+
+	TestEmailExists bool
+
+	TestAccountStatus store.AccountStatus
+
+	// Nonces seen by CheckAndStoreNonce, so tests can check for replays
+	seenNonces map[string]bool
 }
 
-func (s *TestStore) SaveToken(authToken *auth.AuthToken) error {
+func (s *TestStore) SaveToken(ctx context.Context, authToken *auth.AuthToken) error {
 	s.Called.SaveToken = authToken.Token
 	return s.Errors.SaveToken
 }
 
-func (s *TestStore) GetToken(token auth.AuthTokenString) (*auth.AuthToken, error) {
+func (s *TestStore) GetToken(ctx context.Context, token auth.AuthTokenString) (*auth.AuthToken, error) {
 	s.Called.GetToken = token
 	return &s.TestAuthToken, s.Errors.GetToken
 }
 
-func (s *TestStore) GetUserId(auth.Email, auth.Password) (auth.UserId, error) {
+func (s *TestStore) RefreshToken(ctx context.Context, token auth.AuthTokenString) (time.Time, error) {
+	s.Called.RefreshToken = token
+	return s.TestRefreshedExpiration, s.Errors.RefreshToken
+}
+
+func (s *TestStore) DeleteToken(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) error {
+	s.Called.DeleteToken = DeleteTokenCall{userId, deviceId}
+	return s.Errors.DeleteToken
+}
+
+func (s *TestStore) GetTokensForUser(ctx context.Context, userId auth.UserId, limit int, offset int) ([]auth.AuthToken, error) {
+	s.Called.GetTokensForUser = GetTokensForUserCall{userId, limit, offset}
+	if s.Errors.GetTokensForUser != nil {
+		return nil, s.Errors.GetTokensForUser
+	}
+	tokens := s.TestTokensForUser
+	if offset > len(tokens) {
+		offset = len(tokens)
+	}
+	tokens = tokens[offset:]
+	if limit > 0 && limit < len(tokens) {
+		tokens = tokens[:limit]
+	}
+	return tokens, nil
+}
+
+func (s *TestStore) UpdateTokenDeviceId(ctx context.Context, userId auth.UserId, oldDeviceId auth.DeviceId, newDeviceId auth.DeviceId) error {
+	s.Called.UpdateTokenDeviceId = UpdateTokenDeviceIdCall{userId, oldDeviceId, newDeviceId}
+	return s.Errors.UpdateTokenDeviceId
+}
+
+func (s *TestStore) GetUserId(context.Context, auth.Email, auth.Password) (auth.UserId, error) {
 	s.Called.GetUserId = true
-	return 0, s.Errors.GetUserId
+	return s.TestUserId, s.Errors.GetUserId
 }
 
-func (s *TestStore) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) error {
+func (s *TestStore) CreateAccount(ctx context.Context, email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) error {
 	s.Called.CreateAccount = &CreateAccountCall{
 		Email:          email,
 		Password:       password,
@@ -166,38 +336,114 @@ func (s *TestStore) CreateAccount(email auth.Email, password auth.Password, seed
 	return s.Errors.CreateAccount
 }
 
-func (s *TestStore) UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) (err error) {
+func (s *TestStore) UpdateVerifyTokenString(context.Context, auth.Email, auth.VerifyTokenString) (err error) {
 	s.Called.UpdateVerifyTokenString = true
 	return s.Errors.UpdateVerifyTokenString
 }
 
-func (s *TestStore) VerifyAccount(auth.VerifyTokenString) (err error) {
+func (s *TestStore) VerifyAccount(context.Context, auth.VerifyTokenString) (err error) {
 	s.Called.VerifyAccount = true
 	return s.Errors.VerifyAccount
 }
 
 func (s *TestStore) SetWallet(
+	ctx context.Context,
 	UserId auth.UserId,
+	appId wallet.AppId,
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
 ) (err error) {
-	s.Called.SetWallet = SetWalletCall{encryptedWallet, sequence, hmac}
+	s.Called.SetWallet = SetWalletCall{encryptedWallet, sequence, hmac, "", encryptionVersion}
+	s.Called.AppId = appId
+	if parentHmac != nil {
+		s.Called.SetWallet.ParentHmac = *parentHmac
+	}
 	return s.Errors.SetWallet
 }
 
-func (s *TestStore) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+func (s *TestStore) SyncWallet(
+	ctx context.Context,
+	UserId auth.UserId,
+	appId wallet.AppId,
+	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
+	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+) (applied bool, latest *store.WalletUpdate, err error) {
+	s.Called.SyncWallet = SetWalletCall{encryptedWallet, sequence, hmac, "", encryptionVersion}
+	s.Called.AppId = appId
+	if parentHmac != nil {
+		s.Called.SyncWallet.ParentHmac = *parentHmac
+	}
+	if s.Errors.SyncWallet != nil {
+		return false, nil, s.Errors.SyncWallet
+	}
+	if !s.TestSyncWalletLost {
+		return true, &store.WalletUpdate{EncryptedWallet: encryptedWallet, Sequence: sequence, Hmac: hmac, EncryptionVersion: encryptionVersion}, nil
+	}
+	if s.TestSequence == 0 {
+		return false, nil, nil
+	}
+	return false, &store.WalletUpdate{EncryptedWallet: s.TestEncryptedWallet, Sequence: s.TestSequence, Hmac: s.TestHmac, EncryptionVersion: s.TestEncryptionVersion}, nil
+}
+
+func (s *TestStore) SetWalletBatch(ctx context.Context, userId auth.UserId, appId wallet.AppId, updates []store.WalletUpdate, parentHmac *wallet.WalletHmac) (err error) {
+	s.Called.SetWalletBatch = updates
+	s.Called.AppId = appId
+	return s.Errors.SetWalletBatch
+}
+
+func (s *TestStore) ImportWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, appWallets []store.AppWalletUpdate) (err error) {
+	s.Called.ImportWallet = SetWalletCall{encryptedWallet, sequence, hmac, "", encryptionVersion}
+	s.Called.ImportAppWallets = appWallets
+	s.Called.AppId = appId
+	return s.Errors.ImportWallet
+}
+
+func (s *TestStore) GetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, err error) {
 	s.Called.GetWallet = true
+	s.Called.AppId = appId
 	err = s.Errors.GetWallet
 	if err == nil {
 		encryptedWallet = s.TestEncryptedWallet
 		sequence = s.TestSequence
 		hmac = s.TestHmac
+		encryptionVersion = s.TestEncryptionVersion
+	}
+	return
+}
+
+func (s *TestStore) GetWalletMetadata(ctx context.Context, userId auth.UserId, appId wallet.AppId) (sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+	s.Called.GetWalletMetadata = true
+	s.Called.AppId = appId
+	err = s.Errors.GetWalletMetadata
+	if err == nil {
+		sequence = s.TestSequence
+		hmac = s.TestHmac
 	}
 	return
 }
 
+func (s *TestStore) GetWalletAppIds(ctx context.Context, userId auth.UserId) ([]wallet.AppId, error) {
+	s.Called.GetWalletAppIds = userId
+	if s.Errors.GetWalletAppIds != nil {
+		return nil, s.Errors.GetWalletAppIds
+	}
+	return s.TestWalletAppIds, nil
+}
+
+func (s *TestStore) CheckSequence(ctx context.Context, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (err error) {
+	s.Called.CheckSequence = sequence
+	s.Called.AppId = appId
+	return s.Errors.CheckSequence
+}
+
 func (s *TestStore) ChangePasswordWithWallet(
+	ctx context.Context,
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
@@ -205,35 +451,46 @@ func (s *TestStore) ChangePasswordWithWallet(
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
-) (auth.UserId, error) {
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+	appWallets []store.AppWalletUpdate,
+) (auth.UserId, int64, error) {
+	s.Called.ChangePasswordAppWallets = appWallets
 	s.Called.ChangePasswordWithWallet = ChangePasswordWithWalletCall{
-		EncryptedWallet: encryptedWallet,
-		Sequence:        sequence,
-		Hmac:            hmac,
-		Email:           email,
-		OldPassword:     oldPassword,
-		NewPassword:     newPassword,
-		ClientSaltSeed:  clientSaltSeed,
+		EncryptedWallet:   encryptedWallet,
+		Sequence:          sequence,
+		Hmac:              hmac,
+		EncryptionVersion: encryptionVersion,
+		Email:             email,
+		OldPassword:       oldPassword,
+		NewPassword:       newPassword,
+		ClientSaltSeed:    clientSaltSeed,
 	}
-	return s.TestUserId, s.Errors.ChangePasswordWithWallet
+	if parentHmac != nil {
+		s.Called.ChangePasswordWithWallet.ParentHmac = *parentHmac
+	}
+	return s.TestUserId, s.TestNumTokensDeleted, s.Errors.ChangePasswordWithWallet
 }
 
 func (s *TestStore) ChangePasswordNoWallet(
+	ctx context.Context,
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
-) (auth.UserId, error) {
+	appWallets []store.AppWalletUpdate,
+) (auth.UserId, int64, error) {
+	s.Called.ChangePasswordAppWallets = appWallets
 	s.Called.ChangePasswordNoWallet = ChangePasswordNoWalletCall{
 		Email:          email,
 		OldPassword:    oldPassword,
 		NewPassword:    newPassword,
 		ClientSaltSeed: clientSaltSeed,
 	}
-	return s.TestUserId, s.Errors.ChangePasswordNoWallet
+	return s.TestUserId, s.TestNumTokensDeleted, s.Errors.ChangePasswordNoWallet
 }
 
-func (s *TestStore) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSeed, err error) {
+func (s *TestStore) GetClientSaltSeed(ctx context.Context, email auth.Email) (seed auth.ClientSaltSeed, err error) {
 	s.Called.GetClientSaltSeed = email
 	err = s.Errors.GetClientSaltSeed
 	if err == nil {
@@ -242,6 +499,106 @@ func (s *TestStore) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSee
 	return
 }
 
+func (s *TestStore) EmailExists(ctx context.Context, email auth.Email) (bool, error) {
+	s.Called.EmailExists = email
+	return s.TestEmailExists, s.Errors.EmailExists
+}
+
+func (s *TestStore) GetEmail(ctx context.Context, userId auth.UserId) (auth.Email, error) {
+	s.Called.GetEmail = userId
+	if s.Errors.GetEmail != nil {
+		return "", s.Errors.GetEmail
+	}
+	return s.TestEmail, nil
+}
+
+func (s *TestStore) GetAccountStatus(ctx context.Context, email auth.Email, appId wallet.AppId) (store.AccountStatus, error) {
+	s.Called.GetAccountStatus = email
+	s.Called.AppId = appId
+	if s.Errors.GetAccountStatus != nil {
+		return store.AccountStatus{}, s.Errors.GetAccountStatus
+	}
+	return s.TestAccountStatus, nil
+}
+
+func (s *TestStore) GetSigningPublicKey(ctx context.Context, email auth.Email) (auth.SigningPublicKey, error) {
+	s.Called.GetSigningPublicKey = email
+	return s.TestSigningPublicKey, s.Errors.GetSigningPublicKey
+}
+
+func (s *TestStore) SetSigningPublicKey(ctx context.Context, userId auth.UserId, publicKey auth.SigningPublicKey) error {
+	s.Called.SetSigningPublicKey = publicKey
+	return s.Errors.SetSigningPublicKey
+}
+
+func (s *TestStore) DeleteAccount(ctx context.Context, userId auth.UserId) error {
+	s.Called.DeleteAccount = userId
+	return s.Errors.DeleteAccount
+}
+
+func (s *TestStore) CheckAndStoreNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	if s.Errors.CheckAndStoreNonce != nil {
+		return false, s.Errors.CheckAndStoreNonce
+	}
+	if s.seenNonces == nil {
+		s.seenNonces = make(map[string]bool)
+	}
+	if s.seenNonces[nonce] {
+		return false, nil
+	}
+	s.seenNonces[nonce] = true
+	return true, nil
+}
+
+func (s *TestStore) Ping(context.Context) error {
+	s.Called.Ping = true
+	return s.Errors.Ping
+}
+
+func (s *TestStore) UpdateDeviceSync(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId, sequence wallet.Sequence) error {
+	s.Called.UpdateDeviceSync = UpdateDeviceSyncCall{userId, deviceId, sequence}
+	return s.Errors.UpdateDeviceSync
+}
+
+func (s *TestStore) GetDeviceSyncs(ctx context.Context, userId auth.UserId) ([]store.DeviceSync, error) {
+	s.Called.GetDeviceSyncs = userId
+	if s.Errors.GetDeviceSyncs != nil {
+		return nil, s.Errors.GetDeviceSyncs
+	}
+	return s.TestDeviceSyncs, nil
+}
+
+func (s *TestStore) AddKnownDevice(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) (bool, error) {
+	s.Called.AddKnownDevice = AddKnownDeviceCall{userId, deviceId}
+	if s.Errors.AddKnownDevice != nil {
+		return false, s.Errors.AddKnownDevice
+	}
+	return s.TestNewDevice, nil
+}
+
+func (s *TestStore) SetTotpSecret(ctx context.Context, userId auth.UserId, secret auth.TotpSecret) (auth.Email, error) {
+	s.Called.SetTotpSecret = secret
+	if s.Errors.SetTotpSecret != nil {
+		return "", s.Errors.SetTotpSecret
+	}
+	return s.TestEmail, nil
+}
+
+func (s *TestStore) EnableTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) error {
+	s.Called.EnableTotp = code
+	return s.Errors.EnableTotp
+}
+
+func (s *TestStore) CheckTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) error {
+	s.Called.CheckTotp = code
+	return s.Errors.CheckTotp
+}
+
+func (s *TestStore) PurgeExpiredTokens(context.Context) (int64, error) {
+	s.Called.PurgeExpiredTokens = true
+	return 0, s.Errors.PurgeExpiredTokens
+}
+
 // expectStatusCode: A helper to call in functions that test that request
 // handlers responded with a certain status code. Cuts down on noise.
 func expectStatusCode(t *testing.T, w *httptest.ResponseRecorder, expectedStatusCode int) {
@@ -271,6 +628,32 @@ func expectErrorString(t *testing.T, body []byte, expectedErrorString string) {
 	}
 }
 
+// expectErrorCode: A helper to check the machine readable code in an error
+// response.
+func expectErrorCode(t *testing.T, body []byte, expectedErrorCode ErrorCode) {
+	var result ErrorResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Error decoding error message: %s: `%s`", err, body)
+	}
+
+	if want, got := expectedErrorCode, result.Code; want != got {
+		t.Errorf("Error Code: expected %s, got %s", want, got)
+	}
+}
+
+// expectRetryable: A helper to check whether an error response tells the
+// client to retry.
+func expectRetryable(t *testing.T, body []byte, expectedRetryable bool) {
+	var result ErrorResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("Error decoding error message: %s: `%s`", err, body)
+	}
+
+	if want, got := expectedRetryable, result.Retryable; want != got {
+		t.Errorf("Retryable: expected %t, got %t", want, got)
+	}
+}
+
 type wsMockManager struct {
 	s    *Server
 	done chan bool
@@ -279,6 +662,7 @@ type wsMockManager struct {
 	removedClientUserId auth.UserId
 	removedUserId       auth.UserId
 	walletUpdateUserId  auth.UserId
+	walletUpdateSeq     wallet.Sequence
 	noMessage           bool
 }
 
@@ -293,6 +677,7 @@ func (m *wsMockManager) getOneMessage(timeout time.Duration) {
 		m.removedUserId = msg.userId
 	case msg := <-m.s.walletUpdates:
 		m.walletUpdateUserId = msg.userId
+		m.walletUpdateSeq = msg.sequence
 	case <-t.C:
 		m.noMessage = true
 	}
@@ -300,53 +685,163 @@ func (m *wsMockManager) getOneMessage(timeout time.Duration) {
 	m.done <- true
 }
 
-func TestServerHelperCheckAuth(t *testing.T) {
+func checkAuthRequest(authorizationHeader string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
+	if authorizationHeader != "" {
+		req.Header.Set("Authorization", authorizationHeader)
+	}
+	return req
+}
+
+func TestServerHelperCheckAuthSuccess(t *testing.T) {
 	tt := []struct {
-		name          string
-		requiredScope auth.AuthScope
-		userScope     auth.AuthScope
+		name                string
+		authorizationHeader string
+		fallbackToken       auth.AuthTokenString
 
-		tokenExpected       bool
-		expectedStatusCode  int
-		expectedErrorString string
+		expectedToken auth.AuthTokenString
+	}{
+		{
+			name:                "header",
+			authorizationHeader: "Bearer seekrit",
+			expectedToken:       "seekrit",
+		}, {
+			name:                "header with lowercase scheme",
+			authorizationHeader: "bearer seekrit",
+			expectedToken:       "seekrit",
+		}, {
+			name:          "no header, token in body or params",
+			fallbackToken: "seekrit",
+			expectedToken: "seekrit",
+		}, {
+			name:                "header wins over body or params",
+			authorizationHeader: "Bearer seekrit",
+			fallbackToken:       "other-seekrit",
+			expectedToken:       "seekrit",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				// Just check that scope checks exist. The more detailed specific tests
+				// go in the auth module
+				TestAuthToken: auth.AuthToken{Token: auth.AuthTokenString("seekrit"), Scope: auth.AuthScope("*")},
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			w := httptest.NewRecorder()
+			authToken := s.checkAuth(checkAuthRequest(tc.authorizationHeader), w, tc.fallbackToken, auth.AuthScope("banana"))
+			if authToken == nil || *authToken != testStore.TestAuthToken {
+				t.Errorf("Expected checkAuth to return a valid AuthToken")
+			}
+			if testStore.Called.GetToken != tc.expectedToken {
+				t.Errorf("Expected Store.GetToken to be called with %s, got %s", tc.expectedToken, testStore.Called.GetToken)
+			}
+			body, _ := ioutil.ReadAll(w.Body)
+
+			// not that it's a full request but as of now no error yet means 200 by default
+			expectStatusCode(t, w, http.StatusOK)
+			if len(body) != 0 {
+				t.Errorf("Expected checkAuth not to write anything, got %s", string(body))
+			}
+			if got := w.Result().Header.Get("WWW-Authenticate"); got != "" {
+				t.Errorf("Expected no WWW-Authenticate header, got %q", got)
+			}
+		})
+	}
+}
+
+func TestServerHelperCheckAuthErrors(t *testing.T) {
+	tt := []struct {
+		name                string
+		authorizationHeader string
+		fallbackToken       auth.AuthTokenString
+		requiredScope       auth.AuthScope
+		userScope           auth.AuthScope
+
+		expectedStatusCode      int
+		expectedErrorString     string
+		expectedWWWAuthenticate string
+		expectedErrorCode       ErrorCode
 
 		storeErrors TestStoreFunctionsErrors
 	}{
 		{
-			name: "success",
-			// Just check that scope checks exist. The more detailed specific tests
-			// go in the auth module
+			name:          "missing auth token",
 			requiredScope: auth.AuthScope("banana"),
 			userScope:     auth.AuthScope("*"),
 
-			// not that it's a full request but as of now no error yet means 200 by default
-			expectedStatusCode: 200,
-			tokenExpected:      true,
+			expectedStatusCode:      http.StatusUnauthorized,
+			expectedErrorString:     http.StatusText(http.StatusUnauthorized) + ": Missing token",
+			expectedErrorCode:       ErrorCodeMissingToken,
+			expectedWWWAuthenticate: "Bearer",
 		}, {
-			name:          "auth token not found",
-			requiredScope: auth.AuthScope("banana"),
-			userScope:     auth.AuthScope("*"),
+			name:                "wrong scheme in header",
+			authorizationHeader: "Basic c2Vla3JpdA==",
+			fallbackToken:       "seekrit",
+			requiredScope:       auth.AuthScope("banana"),
+			userScope:           auth.AuthScope("*"),
 
-			expectedStatusCode:  http.StatusUnauthorized,
-			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectedStatusCode:      http.StatusUnauthorized,
+			expectedErrorString:     http.StatusText(http.StatusUnauthorized) + ": Invalid Authorization header",
+			expectedErrorCode:       ErrorCodeInvalidToken,
+			expectedWWWAuthenticate: `Bearer error="invalid_request"`,
+		}, {
+			name:                "no token in header",
+			authorizationHeader: "Bearer ",
+			fallbackToken:       "seekrit",
+			requiredScope:       auth.AuthScope("banana"),
+			userScope:           auth.AuthScope("*"),
+
+			expectedStatusCode:      http.StatusUnauthorized,
+			expectedErrorString:     http.StatusText(http.StatusUnauthorized) + ": Invalid Authorization header",
+			expectedErrorCode:       ErrorCodeInvalidToken,
+			expectedWWWAuthenticate: `Bearer error="invalid_request"`,
+		}, {
+			// The store doesn't return expired tokens either, so this covers those
+			name:                "auth token not found",
+			authorizationHeader: "Bearer seekrit",
+			requiredScope:       auth.AuthScope("banana"),
+			userScope:           auth.AuthScope("*"),
+
+			expectedStatusCode:      http.StatusUnauthorized,
+			expectedErrorString:     http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectedErrorCode:       ErrorCodeInvalidToken,
+			expectedWWWAuthenticate: `Bearer error="invalid_token"`,
 
 			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
 		}, {
-			name:          "unknown auth token db error",
+			name:          "auth token in body or params not found",
+			fallbackToken: "seekrit",
 			requiredScope: auth.AuthScope("banana"),
 			userScope:     auth.AuthScope("*"),
 
+			expectedStatusCode:      http.StatusUnauthorized,
+			expectedErrorString:     http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+			expectedErrorCode:       ErrorCodeInvalidToken,
+			expectedWWWAuthenticate: `Bearer error="invalid_token"`,
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "unknown auth token db error",
+			authorizationHeader: "Bearer seekrit",
+			requiredScope:       auth.AuthScope("banana"),
+			userScope:           auth.AuthScope("*"),
+
 			expectedStatusCode:  http.StatusInternalServerError,
 			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectedErrorCode:   ErrorCodeInternal,
 
 			storeErrors: TestStoreFunctionsErrors{GetToken: fmt.Errorf("Some random DB Error!")},
 		}, {
-			name:          "auth scope failure",
-			requiredScope: auth.AuthScope("banana"),
-			userScope:     auth.AuthScope("carrot"),
+			name:                "auth scope failure",
+			authorizationHeader: "Bearer seekrit",
+			requiredScope:       auth.AuthScope("banana"),
+			userScope:           auth.AuthScope("carrot"),
 
 			expectedStatusCode:  http.StatusForbidden,
 			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Scope",
+			expectedErrorCode:   ErrorCodeInsufficientScope,
 		},
 	}
 	for _, tc := range tt {
@@ -355,20 +850,139 @@ func TestServerHelperCheckAuth(t *testing.T) {
 				Errors:        tc.storeErrors,
 				TestAuthToken: auth.AuthToken{Token: auth.AuthTokenString("seekrit"), Scope: tc.userScope},
 			}
-			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 
 			w := httptest.NewRecorder()
-			authToken := s.checkAuth(w, testStore.TestAuthToken.Token, tc.requiredScope)
-			if tc.tokenExpected && (*authToken != testStore.TestAuthToken) {
-				t.Errorf("Expected checkAuth to return a valid AuthToken")
-			}
-			if !tc.tokenExpected && (authToken != nil) {
+			authToken := s.checkAuth(checkAuthRequest(tc.authorizationHeader), w, tc.fallbackToken, tc.requiredScope)
+			if authToken != nil {
 				t.Errorf("Expected checkAuth not to return a valid AuthToken")
 			}
 			body, _ := ioutil.ReadAll(w.Body)
 
 			expectStatusCode(t, w, tc.expectedStatusCode)
 			expectErrorString(t, body, tc.expectedErrorString)
+			expectErrorCode(t, body, tc.expectedErrorCode)
+			if got := w.Result().Header.Get("WWW-Authenticate"); got != tc.expectedWWWAuthenticate {
+				t.Errorf("Expected WWW-Authenticate %q, got %q", tc.expectedWWWAuthenticate, got)
+			}
+		})
+	}
+}
+
+func TestServerUnversioned(t *testing.T) {
+	endpoints := map[string]bool{paths.PathWallet: true}
+
+	tt := []struct {
+		name   string
+		method string
+		target string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedLocation    string
+	}{
+		{
+			name:               "get moves to the versioned endpoint",
+			method:             http.MethodGet,
+			target:             "/wallet?token=seekrit",
+			expectedStatusCode: http.StatusMovedPermanently,
+			expectedLocation:   paths.PathWallet + "?token=seekrit",
+		},
+		{
+			name:                "post is told where to go",
+			method:              http.MethodPost,
+			target:              "/wallet",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Missing API version. Use " + paths.PathWallet,
+		},
+		{
+			name:                "not an endpoint",
+			method:              http.MethodGet,
+			target:              "/banana",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Missing API version. Current version is " + paths.ApiVersion + ".",
+		},
+		{
+			name:                "root",
+			method:              http.MethodGet,
+			target:              "/",
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": Missing API version. Current version is " + paths.ApiVersion + ".",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			w := httptest.NewRecorder()
+			unversioned(endpoints)(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if tc.expectedStatusCode == http.StatusMovedPermanently {
+				if location := w.Result().Header.Get("Location"); location != tc.expectedLocation {
+					t.Errorf("Expected Location %s, got %s", tc.expectedLocation, location)
+				}
+				return
+			}
+			expectErrorString(t, body, tc.expectedErrorString)
+		})
+	}
+}
+
+func TestServerHelperErrorJsonRetryable(t *testing.T) {
+	tt := []struct {
+		code              int
+		expectedRetryable bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusConflict, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tc := range tt {
+		t.Run(http.StatusText(tc.code), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			errorJson(w, tc.code, "")
+			body, _ := ioutil.ReadAll(w.Body)
+			expectRetryable(t, body, tc.expectedRetryable)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	internalServiceErrorJson(w, fmt.Errorf("Some random DB Error!"), "Error doing something")
+	body, _ := ioutil.ReadAll(w.Body)
+	expectStatusCode(t, w, http.StatusInternalServerError)
+	expectRetryable(t, body, true)
+}
+
+func TestServerHelperGetTokenParam(t *testing.T) {
+	tt := []struct {
+		name     string
+		rawQuery string
+
+		expectedToken auth.AuthTokenString
+	}{
+		{
+			name:          "success",
+			rawQuery:      "token=seekrit",
+			expectedToken: auth.AuthTokenString("seekrit"),
+		}, {
+			// Fine here; it's up to checkAuth whether there's a token somewhere else
+			name:     "missing token",
+			rawQuery: "",
+		}, {
+			name:     "empty token",
+			rawQuery: "token=",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test?"+tc.rawQuery, nil)
+			token := getTokenParam(req)
+			if token != tc.expectedToken {
+				t.Errorf("Expected token %s, got %s", tc.expectedToken, token)
+			}
 		})
 	}
 }
@@ -402,12 +1016,20 @@ func (t *TestReqStruct) validate() error {
 }
 
 func TestServerHelperGetPostDataSuccess(t *testing.T) {
-	requestBody := []byte(`{}`)
-	req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(requestBody))
-	w := httptest.NewRecorder()
-	success := getPostData(w, req, &TestReqStruct{key: "hi"})
-	if !success {
-		t.Errorf("getPostData failed unexpectedly")
+	// No Content-Type at all is fine too
+	for _, contentType := range []string{"", "application/json", "application/json; charset=utf-8"} {
+		t.Run(contentType, func(t *testing.T) {
+			requestBody := []byte(`{}`)
+			req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(requestBody))
+			if contentType != "" {
+				req.Header.Set("Content-Type", contentType)
+			}
+			w := httptest.NewRecorder()
+			success := getPostData(w, req, &TestReqStruct{key: "hi"}, maxSmallBodySize)
+			if !success {
+				t.Errorf("getPostData failed unexpectedly")
+			}
+		})
 	}
 }
 
@@ -416,9 +1038,11 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 	tt := []struct {
 		name                string
 		method              string
+		contentType         string
 		requestBody         string
 		expectedStatusCode  int
 		expectedErrorString string
+		expectedErrorCode   ErrorCode
 	}{
 		{
 			name:                "bad method",
@@ -426,13 +1050,33 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 			requestBody:         "",
 			expectedStatusCode:  http.StatusMethodNotAllowed,
 			expectedErrorString: http.StatusText(http.StatusMethodNotAllowed),
+			expectedErrorCode:   ErrorCodeMethodNotAllowed,
+		},
+		{
+			name:                "form encoded body",
+			method:              http.MethodPost,
+			contentType:         "application/x-www-form-urlencoded",
+			requestBody:         "key=hi",
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedErrorString: http.StatusText(http.StatusUnsupportedMediaType) + ": Content-Type must be application/json",
+			expectedErrorCode:   ErrorCodeUnsupportedMedia,
+		},
+		{
+			name:                "malformed content type",
+			method:              http.MethodPost,
+			contentType:         "application/json; charset",
+			requestBody:         "{}",
+			expectedStatusCode:  http.StatusUnsupportedMediaType,
+			expectedErrorString: http.StatusText(http.StatusUnsupportedMediaType) + ": Content-Type must be application/json",
+			expectedErrorCode:   ErrorCodeUnsupportedMedia,
 		},
 		{
 			name:                "request body too large",
 			method:              http.MethodPost,
-			requestBody:         fmt.Sprintf(`{"key": "%s"}`, strings.Repeat("a", 100000)),
+			requestBody:         fmt.Sprintf(`{"key": "%s"}`, strings.Repeat("a", 1000)),
 			expectedStatusCode:  http.StatusRequestEntityTooLarge,
-			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge),
+			expectedErrorString: http.StatusText(http.StatusRequestEntityTooLarge) + ": Max request body size is 1000 bytes",
+			expectedErrorCode:   ErrorCodeBodyTooLarge,
 		},
 		{
 			name:                "malformed request body JSON",
@@ -440,6 +1084,7 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 			requestBody:         "{",
 			expectedStatusCode:  http.StatusBadRequest,
 			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Error parsing JSON",
+			expectedErrorCode:   ErrorCodeInvalidJson,
 		},
 		{
 			name:                "body JSON failed validation",
@@ -447,6 +1092,7 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 			requestBody:         "{}",
 			expectedStatusCode:  http.StatusBadRequest,
 			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: TestReq Error",
+			expectedErrorCode:   ErrorCodeValidationFailed,
 		},
 		{
 			name:                "body JSON has unknown field",
@@ -454,15 +1100,19 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 			requestBody:         `{"lol": "wut"}`,
 			expectedStatusCode:  http.StatusBadRequest,
 			expectedErrorString: http.StatusText(http.StatusBadRequest) + `: json: unknown field "lol"`,
+			expectedErrorCode:   ErrorCodeInvalidJson,
 		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			// Make request
 			req := httptest.NewRequest(tc.method, paths.PathAuthToken, bytes.NewBuffer([]byte(tc.requestBody)))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
 			w := httptest.NewRecorder()
 
-			success := getPostData(w, req, &TestReqStruct{})
+			success := getPostData(w, req, &TestReqStruct{}, 1000)
 			if success {
 				t.Errorf("getPostData succeeded unexpectedly")
 			}
@@ -470,6 +1120,97 @@ func TestServerHelperGetPostDataErrors(t *testing.T) {
 
 			expectStatusCode(t, w, tc.expectedStatusCode)
 			expectErrorString(t, body, tc.expectedErrorString)
+			expectErrorCode(t, body, tc.expectedErrorCode)
+		})
+	}
+}
+
+// Requests that carry a wallet get the bigger limit; the rest get the small one
+func TestServerBodySizeLimits(t *testing.T) {
+	// Too big for one, fine for the other. Padded with whitespace so that it
+	// doesn't matter what's in it.
+	body := strings.Repeat(" ", maxSmallBodySize) + "{}"
+
+	tt := []struct {
+		name     string
+		handler  func(*Server) http.HandlerFunc
+		path     string
+		tooLarge bool
+	}{
+		{
+			name:     "auth token",
+			handler:  func(s *Server) http.HandlerFunc { return s.getAuthToken },
+			path:     paths.PathAuthToken,
+			tooLarge: true,
+		},
+		{
+			name:     "wallet",
+			handler:  func(s *Server) http.HandlerFunc { return s.postWallet },
+			path:     paths.PathWallet,
+			tooLarge: false,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
+			req := httptest.NewRequest(http.MethodPost, tc.path, bytes.NewBuffer([]byte(body)))
+			w := httptest.NewRecorder()
+			tc.handler(s)(w, req)
+
+			if tc.tooLarge {
+				expectStatusCode(t, w, http.StatusRequestEntityTooLarge)
+				expectErrorString(t, w.Body.Bytes(), fmt.Sprintf("%s: Max request body size is %d bytes", http.StatusText(http.StatusRequestEntityTooLarge), maxSmallBodySize))
+			} else if w.Code == http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected a body of %d bytes to be within the limit", len(body))
+			}
+		})
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	tt := []struct {
+		name string
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "database unreachable",
+			expectedStatusCode:  http.StatusServiceUnavailable,
+			expectedErrorString: http.StatusText(http.StatusServiceUnavailable) + ": Database unreachable",
+
+			storeErrors: TestStoreFunctionsErrors{Ping: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{Errors: tc.storeErrors}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathHealth, nil)
+			w := httptest.NewRecorder()
+			s.health(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if !testStore.Called.Ping {
+				t.Errorf("Expected Store.Ping to be called")
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+			var result HealthResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Status != "ok" {
+				t.Errorf("Expected status ok in the response: result: %+v err: %+v", string(body), err)
+			}
 		})
 	}
 }
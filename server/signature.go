@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+// Accounts can opt in to signed requests by registering a signing public key.
+// Once they have, sensitive operations (changing the password, replacing the
+// key, deleting the account) need a signature from the matching private key
+// on top of the usual credentials, so a leaked password or token alone is not
+// enough.
+//
+// The signature goes in a header, over auth.RequestSigningMessage. The
+// timestamp (unix seconds) has to be recent, and the nonce can't be reused
+// while the timestamp would still be accepted, so a captured request can't be
+// replayed.
+
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+
+	signatureMaxClockSkew = time.Minute * 5
+)
+
+// Read the body up front so that we can check the signature over the exact
+// bytes that were sent. Puts it back so getPostData can decode it as usual.
+// maxBytes is the same as what's passed to getPostData.
+func readBody(w http.ResponseWriter, req *http.Request, maxBytes int64) (body []byte, ok bool) {
+	req.Body = http.MaxBytesReader(w, req.Body, maxBytes)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			bodyTooLargeJson(w, maxBytes)
+		} else {
+			errorJson(w, http.StatusBadRequest, "Error reading request body")
+		}
+		return nil, false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// If the account has a signing key, make sure the request is signed with it.
+// Responds with an error and returns false if not.
+func (s *Server) checkRequestSignature(w http.ResponseWriter, req *http.Request, body []byte, email auth.Email) bool {
+	publicKey, err := s.store.GetSigningPublicKey(req.Context(), email)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting signing public key")
+		return false
+	}
+	if publicKey == "" {
+		// Not opted in
+		return true
+	}
+
+	signature := req.Header.Get(SignatureHeader)
+	timestamp := req.Header.Get(SignatureTimestampHeader)
+	nonce := req.Header.Get(SignatureNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		errorJson(w, http.StatusUnauthorized, "Request signature required")
+		return false
+	}
+
+	timestampSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		errorJson(w, http.StatusUnauthorized, "Invalid request signature timestamp")
+		return false
+	}
+	skew := time.Since(time.Unix(timestampSeconds, 0))
+	if skew > signatureMaxClockSkew || skew < -signatureMaxClockSkew {
+		errorJson(w, http.StatusUnauthorized, "Request signature timestamp out of range")
+		return false
+	}
+
+	message := auth.RequestSigningMessage(req.Method, req.URL.Path, body, timestamp, nonce)
+	if !publicKey.VerifySignature(message, signature) {
+		errorJson(w, http.StatusUnauthorized, "Invalid request signature")
+		return false
+	}
+
+	// Only store nonces for requests that are otherwise valid, so nobody can
+	// fill the table with garbage. Scope them to the key so that different
+	// accounts can't collide. The nonce has to outlive any timestamp that would
+	// still be accepted along with it.
+	fresh, err := s.store.CheckAndStoreNonce(req.Context(), string(publicKey)+":"+nonce, signatureMaxClockSkew*2)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error checking request signature nonce")
+		return false
+	}
+	if !fresh {
+		errorJson(w, http.StatusUnauthorized, "Request signature nonce already used")
+		return false
+	}
+
+	return true
+}
+
+// Totp is required if the account has two-factor authentication enabled
+type SigningKeyRequest struct {
+	Email     auth.Email            `json:"email"`
+	Password  auth.Password         `json:"password"`
+	PublicKey auth.SigningPublicKey `json:"publicKey"`
+	Totp      auth.TotpCode         `json:"totp,omitempty"`
+}
+
+func (r *SigningKeyRequest) validate() error {
+	if !r.Email.Validate() {
+		return fmt.Errorf("Invalid 'email'")
+	}
+	if !r.Password.Validate() {
+		return fmt.Errorf("Invalid or missing 'password'")
+	}
+	if !r.PublicKey.Validate() {
+		return fmt.Errorf("Invalid or missing 'publicKey'")
+	}
+	if r.Totp != "" && !r.Totp.Validate() {
+		return fmt.Errorf("Invalid 'totp'")
+	}
+	return nil
+}
+
+// Register a signing public key for the account, opting it in to signed
+// requests. Replacing a key that's already registered is itself a sensitive
+// operation, so it needs to be signed with the old key.
+func (s *Server) setSigningKey(w http.ResponseWriter, req *http.Request) {
+	body, ok := readBody(w, req, maxSmallBodySize)
+	if !ok {
+		return
+	}
+
+	var signingKeyRequest SigningKeyRequest
+	if !getPostData(w, req, &signingKeyRequest, maxSmallBodySize) {
+		return
+	}
+
+	if !s.checkRequestSignature(w, req, body, signingKeyRequest.Email) {
+		return
+	}
+
+	userId, err := s.store.GetUserId(req.Context(), signingKeyRequest.Email, signingKeyRequest.Password)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error getting User Id")
+		return
+	}
+
+	if !s.checkTotp(w, req, userId, signingKeyRequest.Totp) {
+		return
+	}
+
+	if err := s.store.SetSigningPublicKey(req.Context(), userId, signingKeyRequest.PublicKey); err != nil {
+		internalServiceErrorJson(w, err, "Error saving signing public key")
+		return
+	}
+
+	var signingKeyResponse struct{} // no data to respond with, but keep it JSON
+	response, err := json.Marshal(signingKeyResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating signingKeyResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
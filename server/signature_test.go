@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+)
+
+func newTestSigningKey(t *testing.T) (auth.SigningPublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating signing key: %+v", err)
+	}
+	return auth.SigningPublicKey(hex.EncodeToString(publicKey)), privateKey
+}
+
+func signRequest(req *http.Request, privateKey ed25519.PrivateKey, body []byte, timestamp time.Time, nonce string) {
+	timestampString := strconv.FormatInt(timestamp.Unix(), 10)
+	message := auth.RequestSigningMessage(req.Method, req.URL.Path, body, timestampString, nonce)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(ed25519.Sign(privateKey, message)))
+	req.Header.Set(SignatureTimestampHeader, timestampString)
+	req.Header.Set(SignatureNonceHeader, nonce)
+}
+
+func TestServerSetSigningKey(t *testing.T) {
+	registeredKey, registeredPrivateKey := newTestSigningKey(t)
+	_, otherPrivateKey := newTestSigningKey(t)
+	newKey, _ := newTestSigningKey(t)
+
+	requestBody := []byte(fmt.Sprintf(`{"email": "abc@example.com", "password": "12345678", "publicKey": "%s"}`, newKey))
+	tamperedBody := []byte(fmt.Sprintf(`{"email": "abc@example.com", "password": "87654321", "publicKey": "%s"}`, newKey))
+
+	tt := []struct {
+		name string
+
+		// registered before the request, if any
+		registeredKey auth.SigningPublicKey
+
+		// How to sign the request, if at all
+		signingKey      ed25519.PrivateKey
+		signedBody      []byte
+		signedTimestamp time.Time
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectSetKey        bool
+	}{
+		{
+			name:               "first key, no signature needed",
+			expectedStatusCode: http.StatusOK,
+			expectSetKey:       true,
+		}, {
+			name:               "replace key, signed with the registered key",
+			registeredKey:      registeredKey,
+			signingKey:         registeredPrivateKey,
+			signedBody:         requestBody,
+			signedTimestamp:    time.Now(),
+			expectedStatusCode: http.StatusOK,
+			expectSetKey:       true,
+		}, {
+			name:                "replace key, unsigned",
+			registeredKey:       registeredKey,
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Request signature required",
+		}, {
+			name:                "replace key, signed with a different key",
+			registeredKey:       registeredKey,
+			signingKey:          otherPrivateKey,
+			signedBody:          requestBody,
+			signedTimestamp:     time.Now(),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid request signature",
+		}, {
+			name:                "replace key, body tampered with after signing",
+			registeredKey:       registeredKey,
+			signingKey:          registeredPrivateKey,
+			signedBody:          tamperedBody,
+			signedTimestamp:     time.Now(),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid request signature",
+		}, {
+			name:                "replace key, stale timestamp",
+			registeredKey:       registeredKey,
+			signingKey:          registeredPrivateKey,
+			signedBody:          requestBody,
+			signedTimestamp:     time.Now().Add(-signatureMaxClockSkew * 2),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Request signature timestamp out of range",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{TestSigningPublicKey: tc.registeredKey}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthSigningKey, bytes.NewBuffer(requestBody))
+			if tc.signingKey != nil {
+				signRequest(req, tc.signingKey, tc.signedBody, tc.signedTimestamp, "nonce-1")
+			}
+			w := httptest.NewRecorder()
+
+			s.setSigningKey(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectSetKey && testStore.Called.SetSigningPublicKey != newKey {
+				t.Errorf("Expected Store.SetSigningPublicKey to be called with %s", newKey)
+			}
+			if !tc.expectSetKey && testStore.Called.SetSigningPublicKey != "" {
+				t.Errorf("Expected Store.SetSigningPublicKey not to be called")
+			}
+		})
+	}
+}
+
+// The same signed request, sent twice. The second one is a replay.
+func TestServerSignedRequestReplay(t *testing.T) {
+	registeredKey, registeredPrivateKey := newTestSigningKey(t)
+	newKey, _ := newTestSigningKey(t)
+
+	testStore := TestStore{TestSigningPublicKey: registeredKey}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+	requestBody := []byte(fmt.Sprintf(`{"email": "abc@example.com", "password": "12345678", "publicKey": "%s"}`, newKey))
+	timestamp := time.Now()
+
+	for i, expectedStatusCode := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodPost, paths.PathAuthSigningKey, bytes.NewBuffer(requestBody))
+		signRequest(req, registeredPrivateKey, requestBody, timestamp, "nonce-1")
+		w := httptest.NewRecorder()
+
+		s.setSigningKey(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+
+		expectStatusCode(t, w, expectedStatusCode)
+		if i == 1 {
+			expectErrorString(t, body, http.StatusText(http.StatusUnauthorized)+": Request signature nonce already used")
+		}
+	}
+}
+
+// Password changes are one of the operations that need a signature once the
+// account is opted in.
+func TestServerChangePasswordSigned(t *testing.T) {
+	registeredKey, registeredPrivateKey := newTestSigningKey(t)
+
+	for _, signed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("signed %t", signed), func(t *testing.T) {
+			testStore := TestStore{TestSigningPublicKey: registeredKey, TestUserId: 37}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			requestBody := []byte(`{"email": "abc@example.com", "oldPassword": "old password", "newPassword": "new password", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"}`)
+			req := httptest.NewRequest(http.MethodPost, paths.PathPassword, bytes.NewBuffer(requestBody))
+			if signed {
+				signRequest(req, registeredPrivateKey, requestBody, time.Now(), "nonce-1")
+			}
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.changePassword(w, req)
+			<-wsmm.done
+
+			body, _ := ioutil.ReadAll(w.Body)
+
+			if signed {
+				expectStatusCode(t, w, http.StatusOK)
+				if testStore.Called.ChangePasswordNoWallet.Email != "abc@example.com" {
+					t.Errorf("Expected Store.ChangePasswordNoWallet to be called")
+				}
+			} else {
+				expectStatusCode(t, w, http.StatusUnauthorized)
+				expectErrorString(t, body, http.StatusText(http.StatusUnauthorized)+": Request signature required")
+				if testStore.Called.ChangePasswordNoWallet != (ChangePasswordNoWalletCall{}) {
+					t.Errorf("Expected Store.ChangePasswordNoWallet not to be called")
+				}
+			}
+		})
+	}
+}
+
+func TestServerValidateSigningKeyRequest(t *testing.T) {
+	publicKey, _ := newTestSigningKey(t)
+	signingKeyRequest := SigningKeyRequest{Email: "joe@example.com", Password: "12345678", PublicKey: publicKey}
+	if signingKeyRequest.validate() != nil {
+		t.Errorf("Expected valid SigningKeyRequest to successfully validate")
+	}
+
+	signingKeyRequest.PublicKey = "abcd"
+	if err := signingKeyRequest.validate(); err == nil || !strings.Contains(err.Error(), "publicKey") {
+		t.Errorf("Expected SigningKeyRequest with invalid public key to not successfully validate")
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/metrics"
+)
+
+// Delete expired tokens every so often (TOKEN_PURGE_INTERVAL), until told to
+// finish. The first purge is one interval after startup, so a restart doesn't
+// come with a big delete right away.
+func (s *Server) purgeExpiredTokens(interval time.Duration, finish chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.purgeExpiredTokensOnce()
+		case <-finish:
+			return
+		}
+	}
+}
+
+func (s *Server) purgeExpiredTokensOnce() {
+	numDeleted, err := s.store.PurgeExpiredTokens(context.Background())
+	if err != nil {
+		log.Printf("Error purging expired tokens: %+v", err)
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "token-purge"}).Inc()
+		return
+	}
+	if numDeleted > 0 {
+		log.Printf("Purged %d expired tokens", numDeleted)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// The purge runs on every tick until it's told to finish, and keeps going
+// after an error
+func TestServerPurgeExpiredTokens(t *testing.T) {
+	for _, purgeErr := range []error{nil, fmt.Errorf("Some random DB Error!")} {
+		testStore := TestStore{Errors: TestStoreFunctionsErrors{PurgeExpiredTokens: purgeErr}}
+		s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+		finish := make(chan bool)
+		done := make(chan bool)
+		go func() {
+			s.purgeExpiredTokens(time.Millisecond, finish)
+			done <- true
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+
+		// Unbuffered, so by the time this goes through the loop is done touching
+		// testStore
+		finish <- true
+		<-done
+
+		if !testStore.Called.PurgeExpiredTokens {
+			t.Errorf("Expected Store.PurgeExpiredTokens to be called (error: %+v)", purgeErr)
+		}
+	}
+}
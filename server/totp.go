@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+// Two-factor authentication with an authenticator app (TOTP). The user
+// enrolls with PathTotpEnroll, which gives them a secret to put in the app,
+// and turns it on with PathTotpConfirm by sending the first code from the app.
+// From then on PathAuthToken needs a code along with the password, and so do
+// the other requests that go by the password alone: PathPassword,
+// PathAccountDelete and PathSigningKey.
+
+type TotpEnrollRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+}
+
+func (r *TotpEnrollRequest) validate() error {
+	return nil
+}
+
+// Url is an otpauth:// URL with everything in it, for showing as a QR code.
+// Secret is the same secret on its own, for typing in.
+type TotpEnrollResponse struct {
+	Secret auth.TotpSecret `json:"secret"`
+	Url    string          `json:"url"`
+}
+
+// Enrolling again before confirming replaces the secret. Once confirmed, it's
+// a 409.
+func (s *Server) enrollTotp(w http.ResponseWriter, req *http.Request) {
+	var totpEnrollRequest TotpEnrollRequest
+	if !getPostData(w, req, &totpEnrollRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, totpEnrollRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	secret, err := s.auth.NewTotpSecret()
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating TOTP secret")
+		return
+	}
+
+	email, err := s.store.SetTotpSecret(req.Context(), authToken.UserId, secret)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error saving TOTP secret")
+		return
+	}
+
+	response, err := json.Marshal(TotpEnrollResponse{
+		Secret: secret,
+		Url:    secret.URL(req.Host, email),
+	})
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating TOTP enroll response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+type TotpConfirmRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+	Totp  auth.TotpCode        `json:"totp"`
+}
+
+func (r *TotpConfirmRequest) validate() error {
+	if !r.Totp.Validate() {
+		return fmt.Errorf("Invalid or missing 'totp'")
+	}
+	return nil
+}
+
+// Responds with a 204 and no body once two-factor authentication is on
+func (s *Server) confirmTotp(w http.ResponseWriter, req *http.Request) {
+	var totpConfirmRequest TotpConfirmRequest
+	if !getPostData(w, req, &totpConfirmRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, totpConfirmRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	err := s.store.EnableTotp(req.Context(), authToken.UserId, totpConfirmRequest.Totp)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error enabling two-factor authentication")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// For logging in (and the like), once the password checks out. Responds with
+// an error and returns false if the account needs a code and didn't get a
+// good one.
+func (s *Server) checkTotp(w http.ResponseWriter, req *http.Request, userId auth.UserId, code auth.TotpCode) bool {
+	err := s.store.CheckTotp(req.Context(), userId, code)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error checking two-factor code")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+)
+
+func TestServerEnrollTotp(t *testing.T) {
+	tt := []struct {
+		name string
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "already enabled",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Two-factor authentication is already enabled",
+
+			storeErrors: TestStoreFunctionsErrors{SetTotpSecret: store.ErrTotpAlreadyEnabled},
+		},
+		{
+			name:                "auth error",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:                "db error",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{SetTotpSecret: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testAuth := TestAuth{TestNewTotpSecret: auth.TotpSecret("JBSWY3DPEHPK3PXP")}
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				TestEmail:     "abc@example.com",
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			requestBody := []byte(`{"token": "seekrit"}`)
+			req := httptest.NewRequest(http.MethodPost, paths.PathTotpEnroll, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.enrollTotp(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var result TotpEnrollResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Secret != testAuth.TestNewTotpSecret || !strings.HasPrefix(result.Url, "otpauth://totp/") || !strings.Contains(result.Url, "abc@example.com") {
+				t.Errorf("Expected the secret and url in the response: result: %+v err: %+v", string(body), err)
+			}
+			if testStore.Called.SetTotpSecret != testAuth.TestNewTotpSecret {
+				t.Errorf("Expected Store.SetTotpSecret to be called with %s", testAuth.TestNewTotpSecret)
+			}
+		})
+	}
+}
+
+func TestServerConfirmTotp(t *testing.T) {
+	tt := []struct {
+		name string
+		totp string
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			totp:               "123456",
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:                "invalid code",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid two-factor code",
+
+			storeErrors: TestStoreFunctionsErrors{EnableTotp: store.ErrTotpInvalid},
+		},
+		{
+			name:                "not enrolled",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Enroll in two-factor authentication first",
+
+			storeErrors: TestStoreFunctionsErrors{EnableTotp: store.ErrTotpNotEnrolled},
+		},
+		{
+			name:                "already enabled",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Two-factor authentication is already enabled",
+
+			storeErrors: TestStoreFunctionsErrors{EnableTotp: store.ErrTotpAlreadyEnabled},
+		},
+		{
+			name:                "malformed code",
+			totp:                "12345",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid or missing 'totp'",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{Token: "seekrit", Scope: auth.ScopeFull},
+				Errors:        tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "totp": "%s"}`, tc.totp))
+			req := httptest.NewRequest(http.MethodPost, paths.PathTotpConfirm, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.confirmTotp(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedStatusCode == http.StatusNoContent && testStore.Called.EnableTotp != auth.TotpCode(tc.totp) {
+				t.Errorf("Expected Store.EnableTotp to be called with %s", tc.totp)
+			}
+		})
+	}
+}
+
+func TestServerAuthHandlerTotp(t *testing.T) {
+	tt := []struct {
+		name string
+		totp string
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "good code",
+			totp:               "123456",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "code required",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Two-factor code required",
+
+			storeErrors: TestStoreFunctionsErrors{CheckTotp: store.ErrTotpRequired},
+		},
+		{
+			name:                "wrong code",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid two-factor code",
+
+			storeErrors: TestStoreFunctionsErrors{CheckTotp: store.ErrTotpInvalid},
+		},
+		{
+			name:                "malformed code",
+			totp:                "abcdef",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'totp'",
+		},
+		{
+			name:                "db error",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{CheckTotp: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testAuth := TestAuth{TestNewAuthTokenString: auth.AuthTokenString("seekrit")}
+			testStore := TestStore{Errors: tc.storeErrors}
+			s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			requestBody := []byte(fmt.Sprintf(`{"deviceId": "dev-1", "email": "abc@example.com", "password": "12345678", "totp": "%s"}`, tc.totp))
+			req := httptest.NewRequest(http.MethodPost, paths.PathAuthToken, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.getAuthToken(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedStatusCode == http.StatusOK {
+				if testStore.Called.CheckTotp != auth.TotpCode(tc.totp) {
+					t.Errorf("Expected Store.CheckTotp to be called with %s", tc.totp)
+				}
+				return
+			}
+			if testStore.Called.SaveToken != "" {
+				t.Errorf("Expected no token to be saved")
+			}
+		})
+	}
+}
+
+// The other requests that go by the password alone need a code too, checked
+// before they change anything
+func TestServerTotpSensitiveRequests(t *testing.T) {
+	publicKey, _ := newTestSigningKey(t)
+
+	requests := []struct {
+		name        string
+		path        string
+		requestBody string
+		handler     func(*Server) http.HandlerFunc
+
+		expectedStatusCode int
+		changed            func(*TestStore) bool
+	}{
+		{
+			name:               "delete account",
+			path:               paths.PathAccountDelete,
+			requestBody:        `{"email": "abc@example.com", "password": "12345678", "totp": "%s"}`,
+			handler:            func(s *Server) http.HandlerFunc { return s.deleteAccount },
+			expectedStatusCode: http.StatusNoContent,
+			changed:            func(s *TestStore) bool { return s.Called.DeleteAccount != 0 },
+		}, {
+			name:               "change password",
+			path:               paths.PathPassword,
+			requestBody:        `{"email": "abc@example.com", "oldPassword": "12345678", "newPassword": "45678901", "clientSaltSeed": "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234", "totp": "%s"}`,
+			handler:            func(s *Server) http.HandlerFunc { return s.changePassword },
+			expectedStatusCode: http.StatusOK,
+			changed:            func(s *TestStore) bool { return s.Called.ChangePasswordNoWallet != ChangePasswordNoWalletCall{} },
+		}, {
+			name:               "set signing key",
+			path:               paths.PathAuthSigningKey,
+			requestBody:        `{"email": "abc@example.com", "password": "12345678", "publicKey": "` + string(publicKey) + `", "totp": "%s"}`,
+			handler:            func(s *Server) http.HandlerFunc { return s.setSigningKey },
+			expectedStatusCode: http.StatusOK,
+			changed:            func(s *TestStore) bool { return s.Called.SetSigningPublicKey != "" },
+		},
+	}
+
+	tt := []struct {
+		name string
+		totp string
+
+		// if not the request's usual success
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name: "good code",
+			totp: "123456",
+		},
+		{
+			name:                "code required",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Two-factor code required",
+
+			storeErrors: TestStoreFunctionsErrors{CheckTotp: store.ErrTotpRequired},
+		},
+		{
+			name:                "wrong code",
+			totp:                "123456",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Invalid two-factor code",
+
+			storeErrors: TestStoreFunctionsErrors{CheckTotp: store.ErrTotpInvalid},
+		},
+		{
+			name:                "malformed code",
+			totp:                "abcdef",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Invalid 'totp'",
+		},
+	}
+	for _, r := range requests {
+		for _, tc := range tt {
+			t.Run(r.name+" "+tc.name, func(t *testing.T) {
+				testStore := TestStore{TestUserId: auth.UserId(37), Errors: tc.storeErrors}
+				s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+				req := httptest.NewRequest(http.MethodPost, r.path, bytes.NewBuffer([]byte(fmt.Sprintf(r.requestBody, tc.totp))))
+				w := httptest.NewRecorder()
+
+				r.handler(s)(w, req)
+				body, _ := ioutil.ReadAll(w.Body)
+
+				expectedStatusCode := tc.expectedStatusCode
+				if expectedStatusCode == 0 {
+					expectedStatusCode = r.expectedStatusCode
+				}
+				expectStatusCode(t, w, expectedStatusCode)
+				expectErrorString(t, body, tc.expectedErrorString)
+
+				if tc.expectedStatusCode == 0 {
+					if testStore.Called.CheckTotp != auth.TotpCode(tc.totp) {
+						t.Errorf("Expected Store.CheckTotp to be called with %s", tc.totp)
+					}
+					if !r.changed(&testStore) {
+						t.Errorf("Expected the request to go through")
+					}
+					return
+				}
+				if r.changed(&testStore) {
+					t.Errorf("Expected the request to change nothing")
+				}
+			})
+		}
+	}
+}
+
+// Enroll, confirm, and from then on logging in needs a code
+func TestServerTotpLogin(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error logging in: status %d err %+v", statusCode, err)
+	}
+
+	var enrollResponse TotpEnrollResponse
+	statusCode, err = selfTestRequest(s.enrollTotp, http.MethodPost, paths.PathTotpEnroll, TotpEnrollRequest{Token: authToken.Token}, &enrollResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error enrolling: status %d err %+v", statusCode, err)
+	}
+
+	// Not on until it's confirmed
+	statusCode, err = selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-2", Email: email, Password: password}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Expected to log in without a code before confirming: status %d err %+v", statusCode, err)
+	}
+
+	code, err := enrollResponse.Secret.Code(time.Now())
+	if err != nil {
+		t.Fatalf("Error getting TOTP code: %+v", err)
+	}
+	statusCode, err = selfTestRequest(s.confirmTotp, http.MethodPost, paths.PathTotpConfirm, TotpConfirmRequest{Token: authToken.Token, Totp: code}, nil)
+	if err != nil || statusCode != http.StatusNoContent {
+		t.Fatalf("Error confirming: status %d err %+v", statusCode, err)
+	}
+
+	statusCode, err = selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-3", Email: email, Password: password}, nil)
+	if err != nil || statusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 logging in without a code: status %d err %+v", statusCode, err)
+	}
+
+	// The code from confirming has been used up, so take the next one
+	code, err = enrollResponse.Secret.Code(time.Now().Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("Error getting TOTP code: %+v", err)
+	}
+	statusCode, err = selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-3", Email: email, Password: password, Totp: code}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Expected to log in with a code: status %d err %+v", statusCode, err)
+	}
+}
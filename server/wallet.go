@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,33 +22,68 @@ type WalletRequest struct {
 	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
 	Sequence        wallet.Sequence        `json:"sequence"`
 	Hmac            wallet.WalletHmac      `json:"hmac"`
+
+	// Optional. The hmac of the wallet (at `sequence - 1`) that this one was
+	// built on. If given, the update will be rejected if it doesn't match the
+	// hmac of the wallet we have at `sequence - 1`.
+	ParentHmac *wallet.WalletHmac `json:"parentHmac"`
+
+	// Optional. Opaque to the server, see wallet.EncryptionVersion.
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
+
+	// Optional. Which app's wallet this is, see wallet.AppId. Left out for the
+	// default one.
+	AppId wallet.AppId `json:"appId"`
+
+	// The If-Match header, if any. It says which wallet this one was built on,
+	// so `sequence` and `parentHmac` can be left out. Set before decoding the
+	// body, so that validate knows about it.
+	ifMatch string
+
+	// Whether the client only wants to know if the sequence would be accepted
+	// (see postWallet). Then there's no need for it to send the wallet itself.
+	// Set before decoding the body, like ifMatch.
+	validateOnly bool
 }
 
 func (r *WalletRequest) validate() error {
-	if r.Token == "" {
-		return fmt.Errorf("Missing 'token'")
-	}
-	if r.EncryptedWallet == "" {
+	if r.EncryptedWallet == "" && !r.validateOnly {
 		return fmt.Errorf("Missing 'encryptedWallet'")
 	}
-	if r.Hmac == "" {
+	if r.Hmac == "" && !r.validateOnly {
 		return fmt.Errorf("Missing 'hmac'")
 	}
-	if r.Sequence < store.InitialWalletSequence {
+	if r.Sequence < store.InitialWalletSequence && r.ifMatch == "" {
 		return fmt.Errorf("Missing or zero-value 'sequence'")
 	}
+	if r.ParentHmac != nil && *r.ParentHmac == "" {
+		return fmt.Errorf("Empty 'parentHmac'")
+	}
+	if r.ParentHmac != nil && r.ifMatch != "" {
+		return fmt.Errorf("Field 'parentHmac' should be omitted when using If-Match")
+	}
+	if !r.AppId.Validate() {
+		return fmt.Errorf("Invalid 'appId'")
+	}
 	return nil
 }
 
 type WalletResponse struct {
-	EncryptedWallet wallet.EncryptedWallet `json:"encryptedWallet"`
-	Sequence        wallet.Sequence        `json:"sequence"`
-	Hmac            wallet.WalletHmac      `json:"hmac"`
+	EncryptedWallet   wallet.EncryptedWallet   `json:"encryptedWallet"`
+	Sequence          wallet.Sequence          `json:"sequence"`
+	Hmac              wallet.WalletHmac        `json:"hmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
 }
 
+// The sequence of the wallet we have, on HEAD /wallet, so the client doesn't
+// have to pick it out of the ETag
+const WalletSequenceHeader = "X-Wallet-Sequence"
+
 func (s *Server) handleWallet(w http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodGet {
 		s.getWallet(w, req)
+	} else if req.Method == http.MethodHead {
+		s.headWallet(w, req)
 	} else if req.Method == http.MethodPost {
 		s.postWallet(w, req)
 	} else {
@@ -61,8 +98,8 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token, paramsErr := getTokenParam(req)
-
+	token := getTokenParam(req)
+	appId, paramsErr := getAppIdParam(req)
 	if paramsErr != nil {
 		// In this specific case, the error is limited to values that are safe to
 		// give to the user.
@@ -70,26 +107,26 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	authToken := s.checkAuth(w, token, auth.ScopeFull)
+	authToken := s.checkAuth(req, w, token, auth.ScopeGetWallet)
 
 	if authToken == nil {
 		return
 	}
 
-	latestEncryptedWallet, latestSequence, latestHmac, err := s.store.GetWallet(authToken.UserId)
+	latestEncryptedWallet, latestSequence, latestHmac, latestEncryptionVersion, err := s.store.GetWallet(req.Context(), authToken.UserId, appId)
 
-	if err == store.ErrNoWallet {
-		errorJson(w, http.StatusNotFound, "No wallet")
-		return
-	} else if err != nil {
-		internalServiceErrorJson(w, err, "Error retrieving wallet")
+	if err != nil {
+		s.storeErrorJson(w, err, "Error retrieving wallet")
 		return
 	}
+	s.recordDeviceSync(req.Context(), authToken, appId, latestSequence)
+	w.Header().Set("ETag", walletETag(latestSequence, latestHmac))
 
 	walletResponse := WalletResponse{
-		EncryptedWallet: latestEncryptedWallet,
-		Sequence:        latestSequence,
-		Hmac:            latestHmac,
+		EncryptedWallet:   latestEncryptedWallet,
+		Sequence:          latestSequence,
+		Hmac:              latestHmac,
+		EncryptionVersion: latestEncryptionVersion,
 	}
 
 	var response []byte
@@ -103,34 +140,157 @@ func (s *Server) getWallet(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, string(response))
 }
 
+// Takes the same parameters as GET /wallet, and gives the same status and
+// ETag, plus WalletSequenceHeader, but no body. For clients that only want to
+// know whether there's a wallet and which one it is. We don't even get the
+// wallet itself for this.
+//
+// The error responses are the usual ones; net/http leaves out the body for a
+// HEAD request. The device doesn't count as synced, since it didn't get the
+// wallet.
+func (s *Server) headWallet(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "HEAD", "endpoint": "wallet"}).Inc()
+
+	if !getHeadData(w, req) {
+		return
+	}
+
+	token := getTokenParam(req)
+	appId, paramsErr := getAppIdParam(req)
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(req, w, token, auth.ScopeGetWallet)
+	if authToken == nil {
+		return
+	}
+
+	sequence, hmac, err := s.store.GetWalletMetadata(req.Context(), authToken.UserId, appId)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error retrieving wallet metadata")
+		return
+	}
+
+	w.Header().Set("ETag", walletETag(sequence, hmac))
+	w.Header().Set(WalletSequenceHeader, strconv.FormatUint(uint64(sequence), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Instead of giving the sequence (and parentHmac) in the body, a client can
+// give the ETag it got from GET /wallet in If-Match. The update is then built
+// on that version: the sequence, if left out, is the next one after it, and
+// the update fails with a 412 rather than a 409 if it's not the current
+// version. The response has the new version's ETag either way.
+//
+// With `validate=1` (or `true`) in the query string, nothing is saved. The client just
+// finds out whether the sequence would be accepted right now, with the same
+// response it would get for the real thing (other than the ETag) but without
+// having to upload the wallet first. `encryptedWallet` and `hmac` can be left
+// out. Only the sequence is checked, not parentHmac, and the real update can
+// still conflict if another one lands in the meantime.
+//
 // Response Code:
 //   200: Update successful
+//   400: Invalid request, missing parentHmac when it's required, an hmac
+//     that can't be right (only if HMAC_FORMAT_CHECK is enabled), or a
+//     sequence past MAX_WALLET_SEQUENCE
 //   409: Update unsuccessful due to new wallet's sequence not being 1 +
-//     current wallet's sequence
+//     current wallet's sequence, or (if given) parentHmac not matching the
+//     current wallet's hmac. Includes the current wallet. See
+//     WalletConflictResponse.
+//   412: Update unsuccessful because If-Match is not the current wallet
+//   413: Encrypted wallet is over MAX_WALLET_SIZE
+//   429: Update not attempted because this user has had too many conflicts
+//     in a row (only if CONFLICT_BACKOFF is enabled). See Retry-After.
 //   500: Update unsuccessful for unanticipated reasons
 func (s *Server) postWallet(w http.ResponseWriter, req *http.Request) {
 	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "wallet"}).Inc()
 
-	var walletRequest WalletRequest
-	if !getPostData(w, req, &walletRequest) {
+	validateOnly, err := getValidateParam(req)
+	if err != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	walletRequest := WalletRequest{ifMatch: req.Header.Get("If-Match"), validateOnly: validateOnly}
+	if !getPostData(w, req, &walletRequest, maxBodySize) {
+		return
+	}
+
+	if !s.checkWalletSize(w, walletRequest.EncryptedWallet) {
+		return
+	}
+
+	// Only missing if validateOnly, in which case there's nothing to check
+	if walletRequest.Hmac != "" && !s.checkHmacFormat(w, walletRequest.Hmac) {
 		return
 	}
 
-	authToken := s.checkAuth(w, walletRequest.Token, auth.ScopeFull)
+	// The sequence from If-Match (if it's left out) is up to the store
+	if !s.checkSequenceLimit(w, walletRequest.Sequence) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, walletRequest.Token, auth.ScopeFull)
 	if authToken == nil {
 		return
 	}
 
-	err := s.store.SetWallet(authToken.UserId, walletRequest.EncryptedWallet, walletRequest.Sequence, walletRequest.Hmac)
+	if !s.checkConflictBackoff(w, authToken.UserId) {
+		return
+	}
+
+	if walletRequest.ifMatch != "" {
+		currentSequence, currentHmac, err := s.store.GetWalletMetadata(req.Context(), authToken.UserId, walletRequest.AppId)
+		if err == store.ErrNoWallet {
+			preconditionFailedJson(w)
+			return
+		} else if err != nil {
+			internalServiceErrorJson(w, err, "Error retrieving wallet metadata")
+			return
+		}
+		if !ifMatchMatches(walletRequest.ifMatch, walletETag(currentSequence, currentHmac)) {
+			s.conflicts.recordConflict(authToken.UserId)
+			preconditionFailedJson(w)
+			return
+		}
+		if walletRequest.Sequence == 0 {
+			walletRequest.Sequence = currentSequence + 1
+		}
+		// Going through the parent hmac means the store makes sure it's still
+		// the current version when it goes to save it, in case another update
+		// lands in the meantime.
+		walletRequest.ParentHmac = &currentHmac
+	}
 
-	if err == store.ErrWrongSequence {
-		errorJson(w, http.StatusConflict, "Bad sequence number")
+	if walletRequest.validateOnly {
+		s.checkWalletSequence(req.Context(), w, authToken.UserId, walletRequest)
+		return
+	}
+
+	err = s.store.SetWallet(req.Context(), authToken.UserId, walletRequest.AppId, walletRequest.EncryptedWallet, walletRequest.Sequence, walletRequest.Hmac, walletRequest.ParentHmac, walletRequest.EncryptionVersion)
+
+	if (err == store.ErrWrongSequence || err == store.ErrWrongParentHmac) && walletRequest.ifMatch != "" {
+		s.conflicts.recordConflict(authToken.UserId)
+		preconditionFailedJson(w)
+		return
+	} else if err == store.ErrWrongSequence || err == store.ErrWrongParentHmac {
+		s.conflicts.recordConflict(authToken.UserId)
+		s.walletConflictJson(req.Context(), w, authToken.UserId, walletRequest.AppId, err)
 		return
 	} else if err != nil {
-		// Something other than sequence error
-		internalServiceErrorJson(w, err, "Error saving or getting wallet")
+		s.storeErrorJson(w, err, "Error saving or getting wallet")
 		return
 	}
+	s.conflicts.clearConflicts(authToken.UserId)
+	s.recordDeviceSync(req.Context(), authToken, walletRequest.AppId, walletRequest.Sequence)
+	w.Header().Set("ETag", walletETag(walletRequest.Sequence, walletRequest.Hmac))
 
 	var response []byte
 	var walletResponse struct{} // no data to respond with, but keep it JSON
@@ -146,16 +306,480 @@ func (s *Server) postWallet(w http.ResponseWriter, req *http.Request) {
 		log.Printf("Initial wallet created for user id %d", authToken.UserId)
 	}
 
-	// Inform the other clients over websockets. If we can't do it within 100
-	// milliseconds, don't bother. It's a nice-to-have, not mission critical.
-	// But, count the misses on the dashboard. If it happens a lot we should
-	// probably increase the buffer on the notify chans for the clients. Those
-	// will be a bottleneck within the socket manager.
+	s.notifyWalletUpdate(authToken.UserId, walletRequest.AppId, walletRequest.Sequence)
+}
+
+func getValidateParam(req *http.Request) (bool, error) {
+	validateStr := req.URL.Query().Get("validate")
+	if validateStr == "" {
+		return false, nil
+	}
+	validate, err := strconv.ParseBool(validateStr)
+	if err != nil {
+		return false, fmt.Errorf("Invalid validate parameter")
+	}
+	return validate, nil
+}
+
+// Left out for the default app
+func getAppIdParam(req *http.Request) (wallet.AppId, error) {
+	appId := wallet.AppId(req.URL.Query().Get("appId"))
+	if !appId.Validate() {
+		return "", fmt.Errorf("Invalid appId parameter")
+	}
+	return appId, nil
+}
+
+// The dry run version of postWallet. Conflicts don't count towards the
+// backoff, since the client is doing what we'd want it to do about them.
+func (s *Server) checkWalletSequence(ctx context.Context, w http.ResponseWriter, userId auth.UserId, walletRequest WalletRequest) {
+	err := s.store.CheckSequence(ctx, userId, walletRequest.AppId, walletRequest.Sequence)
+	if err == store.ErrWrongSequence && walletRequest.ifMatch != "" {
+		preconditionFailedJson(w)
+		return
+	} else if err == store.ErrWrongSequence {
+		s.walletConflictJson(ctx, w, userId, walletRequest.AppId, err)
+		return
+	} else if err != nil {
+		s.storeErrorJson(w, err, "Error checking sequence")
+		return
+	}
+
+	var walletResponse struct{} // same as a successful update
+	response, err := json.Marshal(walletResponse)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating walletResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// What a client that lost a sequence race needs to merge and try again,
+// without a separate request to get the wallet it lost to.
+type WalletConflictResponse struct {
+	ErrorResponse
+
+	// The wallet we have now. Left out if there isn't one (the client tried to
+	// update a wallet that doesn't exist yet) or if we couldn't get it, in which
+	// case the client can still get it the usual way.
+	Latest *WalletResponse `json:"latest,omitempty"`
+}
+
+// Like storeErrorJson for a sequence or parent hmac conflict, plus the current
+// wallet. The wallet is gotten after the update failed, so by the time the
+// client sees it there may be a newer one yet, in which case the retry will
+// conflict again.
+func (s *Server) walletConflictJson(ctx context.Context, w http.ResponseWriter, userId auth.UserId, appId wallet.AppId, storeErr error) {
+	code, errorResponse := errorToResponse(storeErr)
+	conflictResponse := WalletConflictResponse{ErrorResponse: errorResponse}
+
+	encryptedWallet, sequence, hmac, encryptionVersion, err := s.store.GetWallet(ctx, userId, appId)
+	if err == nil {
+		conflictResponse.Latest = &WalletResponse{
+			EncryptedWallet:   encryptedWallet,
+			Sequence:          sequence,
+			Hmac:              hmac,
+			EncryptionVersion: encryptionVersion,
+		}
+	} else if err != store.ErrNoWallet {
+		log.Printf("Error getting the latest wallet for a conflict response: %+v", err)
+	}
+
+	conflictJson, err := json.Marshal(conflictResponse)
+	if err != nil {
+		// In case something really stupid happens
+		http.Error(w, `{"error": "error when JSON-encoding error message"}`, code)
+		return
+	}
+	http.Error(w, string(conflictJson), code)
+}
+
+// Note which sequence the device is at, for the device list. Failing doesn't
+// fail the request; the wallet part is done by now. The device list is about
+// the default app's wallet, so the other apps don't count.
+func (s *Server) recordDeviceSync(ctx context.Context, authToken *auth.AuthToken, appId wallet.AppId, sequence wallet.Sequence) {
+	if appId != wallet.DefaultAppId {
+		return
+	}
+	if err := s.store.UpdateDeviceSync(ctx, authToken.UserId, authToken.DeviceId, sequence); err != nil {
+		log.Printf("Error recording device sync for user id %d: %+v", authToken.UserId, err)
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "device-sync"}).Inc()
+	}
+}
+
+// Inform the other clients over websockets. If we can't do it within 100
+// milliseconds, don't bother. It's a nice-to-have, not mission critical.
+// But, count the misses on the dashboard. If it happens a lot we should
+// probably increase the buffer on the notify chans for the clients. Those
+// will be a bottleneck within the socket manager.
+func (s *Server) notifyWalletUpdate(userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) {
+	// Long polls don't go through the socket manager, and never block. They're
+	// woken for any app, and check again for the one they're waiting on.
+	s.walletWatchers.notify(userId)
+
+	// The websocket message doesn't say which app, and the clients listening
+	// for it only know about the default one
+	if appId != wallet.DefaultAppId {
+		return
+	}
+
 	timeout := time.NewTicker(100 * time.Millisecond)
 	select {
-	case s.walletUpdates <- walletUpdateMsg{authToken.UserId, walletRequest.Sequence}:
+	case s.walletUpdates <- walletUpdateMsg{userId, sequence}:
 	case <-timeout.C:
 		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-client-notify"}).Inc()
 	}
 	timeout.Stop()
 }
+
+// Keep it short. It's meant for clients catching up a few versions, and the
+// whole batch has to fit within maxBodySize anyway.
+const maxWalletBatchSize = 10
+
+type WalletBatchUpdate struct {
+	EncryptedWallet   wallet.EncryptedWallet   `json:"encryptedWallet"`
+	Sequence          wallet.Sequence          `json:"sequence"`
+	Hmac              wallet.WalletHmac        `json:"hmac"`
+	EncryptionVersion wallet.EncryptionVersion `json:"encryptionVersion"`
+}
+
+type WalletBatchRequest struct {
+	Token auth.AuthTokenString `json:"token"`
+
+	// Optional. The hmac of the wallet that the first update was built on. See
+	// WalletRequest.
+	ParentHmac *wallet.WalletHmac `json:"parentHmac"`
+
+	// In order. Each must have a sequence 1 higher than the one before it.
+	Updates []WalletBatchUpdate `json:"updates"`
+
+	// Optional. Which app's wallet these are for. See WalletRequest.
+	AppId wallet.AppId `json:"appId"`
+}
+
+func (r *WalletBatchRequest) validate() error {
+	if len(r.Updates) == 0 {
+		return fmt.Errorf("Missing 'updates'")
+	}
+	if len(r.Updates) > maxWalletBatchSize {
+		return fmt.Errorf("Too many 'updates' (max %d)", maxWalletBatchSize)
+	}
+	if r.ParentHmac != nil && *r.ParentHmac == "" {
+		return fmt.Errorf("Empty 'parentHmac'")
+	}
+	if !r.AppId.Validate() {
+		return fmt.Errorf("Invalid 'appId'")
+	}
+	for i, update := range r.Updates {
+		if update.EncryptedWallet == "" {
+			return fmt.Errorf("Missing 'encryptedWallet' in update %d", i)
+		}
+		if update.Hmac == "" {
+			return fmt.Errorf("Missing 'hmac' in update %d", i)
+		}
+		if update.Sequence < store.InitialWalletSequence {
+			return fmt.Errorf("Missing or zero-value 'sequence' in update %d", i)
+		}
+		if i > 0 && update.Sequence != r.Updates[i-1].Sequence+1 {
+			return fmt.Errorf("'sequence' in update %d does not follow the one before it", i)
+		}
+	}
+	return nil
+}
+
+// Apply a chain of wallet updates all at once, or none of them.
+//
+// Response Code:
+//   200: All updates successful
+//   400: Invalid request, including a chain with gaps in the sequence,
+//     missing parentHmac when it's required, an hmac that can't be right
+//     (only if HMAC_FORMAT_CHECK is enabled), or a sequence past
+//     MAX_WALLET_SEQUENCE
+//   409: No updates applied, because the first update's sequence doesn't
+//     follow the current wallet's, or (if given) parentHmac doesn't match the
+//     current wallet's hmac. Includes the current wallet, same as postWallet.
+//   413: No updates applied, because one of them is over MAX_WALLET_SIZE
+//   429: Updates not attempted, see postWallet
+//   500: No updates applied, for unanticipated reasons
+func (s *Server) postWalletBatch(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "wallet-batch"}).Inc()
+
+	var walletBatchRequest WalletBatchRequest
+	if !getPostData(w, req, &walletBatchRequest, maxBodySize) {
+		return
+	}
+
+	var encryptedWallets []wallet.EncryptedWallet
+	var hmacs []wallet.WalletHmac
+	var sequences []wallet.Sequence
+	for _, update := range walletBatchRequest.Updates {
+		encryptedWallets = append(encryptedWallets, update.EncryptedWallet)
+		hmacs = append(hmacs, update.Hmac)
+		sequences = append(sequences, update.Sequence)
+	}
+	if !s.checkWalletSize(w, encryptedWallets...) {
+		return
+	}
+	if !s.checkHmacFormat(w, hmacs...) {
+		return
+	}
+	if !s.checkSequenceLimit(w, sequences...) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, walletBatchRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	if !s.checkConflictBackoff(w, authToken.UserId) {
+		return
+	}
+
+	var updates []store.WalletUpdate
+	for _, update := range walletBatchRequest.Updates {
+		updates = append(updates, store.WalletUpdate{
+			EncryptedWallet:   update.EncryptedWallet,
+			Sequence:          update.Sequence,
+			Hmac:              update.Hmac,
+			EncryptionVersion: update.EncryptionVersion,
+		})
+	}
+
+	err := s.store.SetWalletBatch(req.Context(), authToken.UserId, walletBatchRequest.AppId, updates, walletBatchRequest.ParentHmac)
+
+	if err == store.ErrWrongSequence || err == store.ErrWrongParentHmac {
+		s.conflicts.recordConflict(authToken.UserId)
+		s.walletConflictJson(req.Context(), w, authToken.UserId, walletBatchRequest.AppId, err)
+		return
+	} else if err != nil {
+		s.storeErrorJson(w, err, "Error saving wallet batch")
+		return
+	}
+	s.conflicts.clearConflicts(authToken.UserId)
+	s.recordDeviceSync(req.Context(), authToken, walletBatchRequest.AppId, updates[len(updates)-1].Sequence)
+
+	var response []byte
+	var walletBatchResponse struct{} // no data to respond with, but keep it JSON
+	response, err = json.Marshal(walletBatchResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating walletBatchResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+	if updates[0].Sequence == store.InitialWalletSequence {
+		log.Printf("Initial wallet created for user id %d", authToken.UserId)
+	}
+
+	// Other clients only need to know about the latest one
+	s.notifyWalletUpdate(authToken.UserId, walletBatchRequest.AppId, updates[len(updates)-1].Sequence)
+}
+
+type WalletSyncResponse struct {
+	// Whether the client's wallet was saved. If not, the client should merge
+	// its changes into `wallet` and try again.
+	Applied bool `json:"applied"`
+
+	// The wallet we have now: the client's own if it was applied, otherwise
+	// the one it lost to. Left out if there's no wallet at all.
+	Wallet *WalletResponse `json:"wallet,omitempty"`
+}
+
+// Takes the same request as POST /wallet (other than If-Match). Saves the
+// wallet if it follows from the one we have, and either way responds with the
+// wallet we have after that, checked and saved in one go. A client that loses
+// the race gets the wallet that beat it, without another round trip and
+// without the chance of a newer one landing in between.
+//
+// Losing the race isn't an error here, so it's a 200 either way; see
+// `applied`. The other errors are the same as POST /wallet.
+func (s *Server) postWalletSync(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "wallet-sync"}).Inc()
+
+	var walletRequest WalletRequest
+	if !getPostData(w, req, &walletRequest, maxBodySize) {
+		return
+	}
+
+	if !s.checkWalletSize(w, walletRequest.EncryptedWallet) {
+		return
+	}
+
+	if !s.checkHmacFormat(w, walletRequest.Hmac) {
+		return
+	}
+
+	if !s.checkSequenceLimit(w, walletRequest.Sequence) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, walletRequest.Token, auth.ScopeFull)
+	if authToken == nil {
+		return
+	}
+
+	if !s.checkConflictBackoff(w, authToken.UserId) {
+		return
+	}
+
+	applied, latest, err := s.store.SyncWallet(req.Context(), authToken.UserId, walletRequest.AppId, walletRequest.EncryptedWallet, walletRequest.Sequence, walletRequest.Hmac, walletRequest.ParentHmac, walletRequest.EncryptionVersion)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error syncing wallet")
+		return
+	}
+
+	if applied {
+		s.conflicts.clearConflicts(authToken.UserId)
+	} else {
+		s.conflicts.recordConflict(authToken.UserId)
+	}
+
+	walletSyncResponse := WalletSyncResponse{Applied: applied}
+	if latest != nil {
+		// Either way, the device has this one now
+		s.recordDeviceSync(req.Context(), authToken, walletRequest.AppId, latest.Sequence)
+		w.Header().Set("ETag", walletETag(latest.Sequence, latest.Hmac))
+		walletSyncResponse.Wallet = &WalletResponse{
+			EncryptedWallet:   latest.EncryptedWallet,
+			Sequence:          latest.Sequence,
+			Hmac:              latest.Hmac,
+			EncryptionVersion: latest.EncryptionVersion,
+		}
+	}
+
+	response, err := json.Marshal(walletSyncResponse)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating walletSyncResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+
+	if applied {
+		if walletRequest.Sequence == store.InitialWalletSequence {
+			log.Printf("Initial wallet created for user id %d", authToken.UserId)
+		}
+		s.notifyWalletUpdate(authToken.UserId, walletRequest.AppId, walletRequest.Sequence)
+	}
+}
+
+// Lets a client (or an auditing tool) check that the server still has the
+// version of the wallet it expects, without downloading it.
+type WalletVerifyRequest struct {
+	Token    auth.AuthTokenString `json:"token"`
+	Sequence wallet.Sequence      `json:"sequence"`
+	Hmac     wallet.WalletHmac    `json:"hmac"`
+
+	// Optional. See WalletRequest.
+	AppId wallet.AppId `json:"appId"`
+}
+
+func (r *WalletVerifyRequest) validate() error {
+	if r.Hmac == "" {
+		return fmt.Errorf("Missing 'hmac'")
+	}
+	if r.Sequence < store.InitialWalletSequence {
+		return fmt.Errorf("Missing or zero-value 'sequence'")
+	}
+	if !r.AppId.Validate() {
+		return fmt.Errorf("Invalid 'appId'")
+	}
+	return nil
+}
+
+type WalletVerifyResponse struct {
+	// Whether both the sequence and hmac match the current wallet's
+	Matches bool `json:"matches"`
+}
+
+// Response Code:
+//   200: Compared, see `matches` in the response
+//   404: No wallet to compare with
+func (s *Server) postWalletVerify(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "POST", "endpoint": "wallet-verify"}).Inc()
+
+	var walletVerifyRequest WalletVerifyRequest
+	if !getPostData(w, req, &walletVerifyRequest, maxSmallBodySize) {
+		return
+	}
+
+	authToken := s.checkAuth(req, w, walletVerifyRequest.Token, auth.ScopeGetWallet)
+	if authToken == nil {
+		return
+	}
+
+	sequence, hmac, err := s.store.GetWalletMetadata(req.Context(), authToken.UserId, walletVerifyRequest.AppId)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error retrieving wallet metadata")
+		return
+	}
+
+	walletVerifyResponse := WalletVerifyResponse{
+		Matches: sequence == walletVerifyRequest.Sequence && hmac == walletVerifyRequest.Hmac,
+	}
+
+	response, err := json.Marshal(walletVerifyResponse)
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating walletVerifyResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
+
+// Just enough for a client to tell whether it's up to date, without the
+// wallet itself. Same as WalletResponse otherwise.
+type WalletStatusResponse struct {
+	Sequence wallet.Sequence   `json:"sequence"`
+	Hmac     wallet.WalletHmac `json:"hmac"`
+}
+
+// Takes `token`, and `appId` if it's not the default app. If the sequence is
+// the same as the one the client has, it can skip GET /wallet.
+//
+// Response Code:
+//   200: See WalletStatusResponse
+//   404: No wallet yet
+func (s *Server) getWalletStatus(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "GET", "endpoint": "wallet-status"}).Inc()
+
+	if !getGetData(w, req) {
+		return
+	}
+
+	token := getTokenParam(req)
+	appId, paramsErr := getAppIdParam(req)
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	authToken := s.checkAuth(req, w, token, auth.ScopeGetWallet)
+	if authToken == nil {
+		return
+	}
+
+	sequence, hmac, err := s.store.GetWalletMetadata(req.Context(), authToken.UserId, appId)
+	if err != nil {
+		s.storeErrorJson(w, err, "Error retrieving wallet metadata")
+		return
+	}
+
+	response, err := json.Marshal(WalletStatusResponse{
+		Sequence: sequence,
+		Hmac:     hmac,
+	})
+
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating walletStatusResponse")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
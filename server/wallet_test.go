@@ -2,12 +2,14 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +23,7 @@ func TestServerGetWallet(t *testing.T) {
 	tt := []struct {
 		name        string
 		tokenString auth.AuthTokenString
+		tokenScope  auth.AuthScope // auth.ScopeFull if ""
 
 		expectedStatusCode  int
 		expectedErrorString string
@@ -33,14 +36,16 @@ func TestServerGetWallet(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 		},
 		{
-			name:                "validation error", // missing auth token
+			name:               "success with get-wallet token",
+			tokenString:        auth.AuthTokenString("seekrit"),
+			tokenScope:         auth.ScopeGetWallet,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "missing token",
 			tokenString:         auth.AuthTokenString(""),
-			expectedStatusCode:  http.StatusBadRequest,
-			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing token parameter",
-
-			// Just check one validation error (missing auth token) to make sure the
-			// validate function is called. We'll check the rest of the validation
-			// errors in the other test below.
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing token",
 		},
 		{
 			name:        "auth error",
@@ -51,6 +56,17 @@ func TestServerGetWallet(t *testing.T) {
 
 			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
 		},
+		{
+			name:        "no wallet",
+			tokenString: auth.AuthTokenString("seekrit"),
+
+			// Clients get this before their first sync, so it needs to be a 404
+			// specifically, not an empty 200 or a 500.
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+
+			storeErrors: TestStoreFunctionsErrors{GetWallet: store.ErrNoWallet},
+		},
 		{
 			name:        "db error getting wallet",
 			tokenString: auth.AuthTokenString("seekrit"),
@@ -64,22 +80,29 @@ func TestServerGetWallet(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 
+			tokenScope := tc.tokenScope
+			if tokenScope == "" {
+				tokenScope = auth.ScopeFull
+			}
+
 			testAuth := TestAuth{}
 			testStore := TestStore{
 				TestAuthToken: auth.AuthToken{
 					Token: auth.AuthTokenString(tc.tokenString),
-					Scope: auth.ScopeFull,
+					Scope: tokenScope,
 				},
 
 				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
 				TestSequence:        wallet.Sequence(2),
 				TestHmac:            wallet.WalletHmac("my-hmac"),
 
+				TestEncryptionVersion: wallet.EncryptionVersion("my-encryption-version"),
+
 				Errors: tc.storeErrors,
 			}
 
 			testEnv := TestEnv{}
-			s := Init(&testAuth, &testStore, &testEnv, &TestMail{}, TestPort)
+			s := Init(&testAuth, &testStore, &testEnv, &TestMail{}, TestConfig)
 
 			req := httptest.NewRequest(http.MethodGet, paths.PathWallet, nil)
 			q := req.URL.Query()
@@ -118,7 +141,8 @@ func TestServerGetWallet(t *testing.T) {
 			if err != nil ||
 				result.EncryptedWallet != testStore.TestEncryptedWallet ||
 				result.Hmac != testStore.TestHmac ||
-				result.Sequence != testStore.TestSequence {
+				result.Sequence != testStore.TestSequence ||
+				result.EncryptionVersion != testStore.TestEncryptionVersion {
 				t.Errorf("Expected wallet response to have the test wallet values: result: %+v err: %+v", string(body), err)
 			}
 
@@ -129,6 +153,128 @@ func TestServerGetWallet(t *testing.T) {
 	}
 }
 
+// With a real store: a new account has no wallet until the first one is saved
+// Through a real server, since it's net/http that leaves out the body
+func TestServerHeadWallet(t *testing.T) {
+	tt := []struct {
+		name string
+
+		expectedStatusCode int
+		expectedETag       string
+		expectedSequence   string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			expectedStatusCode: http.StatusOK,
+			expectedETag:       walletETag(wallet.Sequence(5), wallet.WalletHmac("my-hmac")),
+			expectedSequence:   "5",
+		},
+		{
+			name:               "no wallet",
+			expectedStatusCode: http.StatusNotFound,
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: store.ErrNoWallet},
+		},
+		{
+			name:               "auth error",
+			expectedStatusCode: http.StatusUnauthorized,
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:    auth.AuthTokenString("seekrit"),
+					DeviceId: auth.DeviceId("dev-1"),
+					Scope:    auth.ScopeGetWallet,
+					UserId:   auth.UserId(37),
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(5),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			httpServer := httptest.NewServer(http.HandlerFunc(s.handleWallet))
+			defer httpServer.Close()
+
+			resp, err := http.Head(httpServer.URL + paths.PathWallet + "?token=seekrit")
+			if err != nil {
+				t.Fatalf("Error making HEAD request: %+v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected status code %d, got %d", tc.expectedStatusCode, resp.StatusCode)
+			}
+			if len(body) != 0 {
+				t.Errorf("Expected no body, got %s", string(body))
+			}
+			if want, got := tc.expectedETag, resp.Header.Get("ETag"); want != got {
+				t.Errorf("Expected ETag %q, got %q", want, got)
+			}
+			if want, got := tc.expectedSequence, resp.Header.Get(WalletSequenceHeader); want != got {
+				t.Errorf("Expected %s %q, got %q", WalletSequenceHeader, want, got)
+			}
+
+			if testStore.Called.GetWallet {
+				t.Errorf("Expected Store.GetWallet to not be called")
+			}
+			if want, got := (UpdateDeviceSyncCall{}), testStore.Called.UpdateDeviceSync; want != got {
+				t.Errorf("Expected no Store.UpdateDeviceSync call, got %+v", got)
+			}
+		})
+	}
+}
+
+func TestServerGetWalletNewAccount(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+	walletPath := paths.PathWallet + "?token=" + string(authToken.Token)
+
+	req := httptest.NewRequest(http.MethodGet, walletPath, nil)
+	w := httptest.NewRecorder()
+	s.getWallet(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusNotFound)
+	expectErrorString(t, body, http.StatusText(http.StatusNotFound)+": No wallet")
+
+	if err := st.SetWallet(context.Background(), authToken.UserId, wallet.DefaultAppId, "my-encrypted-wallet", store.InitialWalletSequence, "my-hmac", nil, ""); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	var walletResponse WalletResponse
+	statusCode, err = selfTestRequest(s.getWallet, http.MethodGet, walletPath, nil, &walletResponse)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting the wallet: status %d err %+v", statusCode, err)
+	}
+	expected := WalletResponse{EncryptedWallet: "my-encrypted-wallet", Sequence: 1, Hmac: "my-hmac"}
+	if walletResponse != expected {
+		t.Errorf("Expected %+v, got %+v", expected, walletResponse)
+	}
+}
+
 func TestServerPostWallet(t *testing.T) {
 	tt := []struct {
 		name string
@@ -144,12 +290,16 @@ func TestServerPostWallet(t *testing.T) {
 		// check in that case.
 		skipAuthCheck bool
 
+		tokenScope auth.AuthScope // auth.ScopeFull if ""
+
 		// `new...` refers to what is being passed into the via POST request (and
 		//   what we expect to get passed into SetWallet for the *non-error* cases
 		//   below)
-		newEncryptedWallet wallet.EncryptedWallet
-		newSequence        wallet.Sequence
-		newHmac            wallet.WalletHmac
+		newEncryptedWallet   wallet.EncryptedWallet
+		newSequence          wallet.Sequence
+		newHmac              wallet.WalletHmac
+		newParentHmac        wallet.WalletHmac        // left out of the request if ""
+		newEncryptionVersion wallet.EncryptionVersion // left out of the request if ""
 
 		storeErrors TestStoreFunctionsErrors
 	}{
@@ -179,6 +329,53 @@ func TestServerPostWallet(t *testing.T) {
 			newHmac:            wallet.WalletHmac("my-hmac-new"),
 
 			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence},
+		}, {
+			name:                "success with parent hmac",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+			expectWsMsg:         true,
+
+			newEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+			newSequence:        wallet.Sequence(2),
+			newHmac:            wallet.WalletHmac("my-hmac"),
+			newParentHmac:      wallet.WalletHmac("my-parent-hmac"),
+		}, {
+			name:                "success with encryption version",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+			expectWsMsg:         true,
+
+			newEncryptedWallet:   wallet.EncryptedWallet("my-encrypted-wallet"),
+			newSequence:          wallet.Sequence(2),
+			newHmac:              wallet.WalletHmac("my-hmac"),
+			newEncryptionVersion: wallet.EncryptionVersion("my-encryption-version"),
+		}, {
+			name:                "conflict with parent hmac",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Parent hmac does not match",
+			expectSetWalletCall: true,
+
+			// Simulates a situation where the existing sequence is 1, the new
+			// proposed sequence is 2, but the existing wallet's hmac is not the
+			// parent hmac the client built on.
+
+			newEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet-new"),
+			newSequence:        wallet.Sequence(2),
+			newHmac:            wallet.WalletHmac("my-hmac-new"),
+			newParentHmac:      wallet.WalletHmac("my-forked-parent-hmac"),
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrWrongParentHmac},
+		}, {
+			name:                "missing required parent hmac",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing 'parentHmac'",
+			expectSetWalletCall: true,
+
+			newEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet-new"),
+			newSequence:        wallet.Sequence(2),
+			newHmac:            wallet.WalletHmac("my-hmac-new"),
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrNoParentHmac},
 		}, {
 			name:                "validation error",
 			expectedStatusCode:  http.StatusBadRequest,
@@ -205,6 +402,17 @@ func TestServerPostWallet(t *testing.T) {
 
 			// What causes the error
 			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		}, {
+			name:                "get-wallet token",
+			expectedStatusCode:  http.StatusForbidden,
+			expectedErrorString: http.StatusText(http.StatusForbidden) + ": Scope",
+
+			// A token that can only get the wallet can't change it
+			tokenScope: auth.ScopeGetWallet,
+
+			newEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+			newSequence:        wallet.Sequence(2),
+			newHmac:            wallet.WalletHmac("my-hmac"),
 		}, {
 			name:                "db error setting wallet",
 			expectedStatusCode:  http.StatusInternalServerError,
@@ -228,27 +436,40 @@ func TestServerPostWallet(t *testing.T) {
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
+			tokenScope := tc.tokenScope
+			if tokenScope == "" {
+				tokenScope = auth.ScopeFull
+			}
+
 			testAuth := TestAuth{}
 			testStore := TestStore{
 				TestAuthToken: auth.AuthToken{
 					Token:  auth.AuthTokenString("seekrit"),
-					Scope:  auth.ScopeFull,
+					Scope:  tokenScope,
 					UserId: auth.UserId(37),
 				},
 
 				Errors: tc.storeErrors,
 			}
 
-			s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestPort)
+			s := Init(&testAuth, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
 			wsmm := wsMockManager{s: s, done: make(chan bool)}
 
+			optionalFields := ""
+			if tc.newParentHmac != "" {
+				optionalFields += fmt.Sprintf(`, "parentHmac": "%s"`, tc.newParentHmac)
+			}
+			if tc.newEncryptionVersion != "" {
+				optionalFields += fmt.Sprintf(`, "encryptionVersion": "%s"`, tc.newEncryptionVersion)
+			}
+
 			requestBody := []byte(
 				fmt.Sprintf(`{
           "token": "%s",
           "encryptedWallet": "%s",
           "sequence": %d,
-          "hmac": "%s"
-        }`, testStore.TestAuthToken.Token, tc.newEncryptedWallet, tc.newSequence, tc.newHmac),
+          "hmac": "%s"%s
+        }`, testStore.TestAuthToken.Token, tc.newEncryptedWallet, tc.newSequence, tc.newHmac, optionalFields),
 			)
 
 			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
@@ -281,46 +502,1278 @@ func TestServerPostWallet(t *testing.T) {
 				t.Errorf("Expected post wallet response to be \"{}\": result: %+v", string(body))
 			}
 
-			if want, got := (SetWalletCall{tc.newEncryptedWallet, tc.newSequence, tc.newHmac}), testStore.Called.SetWallet; tc.expectSetWalletCall && want != got {
+			if want, got := (SetWalletCall{tc.newEncryptedWallet, tc.newSequence, tc.newHmac, tc.newParentHmac, tc.newEncryptionVersion}), testStore.Called.SetWallet; tc.expectSetWalletCall && want != got {
 				t.Errorf("Store.SetWallet called with: expected %+v, got %+v", want, got)
 			}
 		})
 	}
 }
 
-func TestServerValidateWalletRequest(t *testing.T) {
-	walletRequest := WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 2}
-	if walletRequest.validate() != nil {
-		t.Errorf("Expected valid WalletRequest to successfully validate")
+func TestServerPostWalletMaxWalletSize(t *testing.T) {
+	tt := []struct {
+		name            string
+		encryptedWallet wallet.EncryptedWallet
+
+		expectedStatusCode  int
+		expectSetWalletCall bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:                "right at the limit",
+			encryptedWallet:     "0123456789",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+		},
+		{
+			name:               "one byte over",
+			encryptedWallet:    "0123456789a",
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			// In case the store is set up with a different limit
+			name:                "store says too large",
+			encryptedWallet:     "0123456789",
+			expectedStatusCode:  http.StatusRequestEntityTooLarge,
+			expectSetWalletCall: true,
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrWalletTooLarge},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			env := map[string]string{
+				"MAX_WALLET_SIZE": "10",
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "encryptedWallet": "%s", "sequence": 1, "hmac": "my-hmac"}`, tc.encryptedWallet))
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWallet(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+
+			if tc.expectedStatusCode == http.StatusRequestEntityTooLarge {
+				expectErrorString(t, body, http.StatusText(http.StatusRequestEntityTooLarge)+": Max wallet size is 10 bytes")
+				var errorResponse ErrorResponse
+				if err := json.Unmarshal(body, &errorResponse); err != nil || errorResponse.MaxWalletSize != 10 {
+					t.Errorf("Expected maxWalletSize 10 in the response: result: %+v err: %+v", string(body), err)
+				}
+			}
+
+			if called := testStore.Called.SetWallet.EncryptedWallet != ""; called != tc.expectSetWalletCall {
+				t.Errorf("Expected Store.SetWallet called to be %v", tc.expectSetWalletCall)
+			}
+		})
 	}
+}
 
+// Sequences past the limit, and ones that were never going to be valid, don't
+// get as far as the store
+func TestServerPostWalletMaxSequence(t *testing.T) {
 	tt := []struct {
-		walletRequest       WalletRequest
-		expectedErrorSubstr string
-		failureDescription  string
+		name     string
+		sequence string
+		env      map[string]string
+
+		expectedStatusCode  int
+		expectedErrorCode   ErrorCode
+		expectSetWalletCall bool
+
+		storeErrors TestStoreFunctionsErrors
 	}{
 		{
-			WalletRequest{EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 2},
-			"token",
-			"Expected WalletRequest with missing token to not successfully validate",
-		}, {
-			WalletRequest{Token: "seekrit", Hmac: "my-hmac", Sequence: 2},
-			"encryptedWallet",
-			"Expected WalletRequest with missing encrypted wallet to not successfully validate",
-		}, {
-			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Sequence: 2},
-			"hmac",
-			"Expected WalletRequest with missing hmac to not successfully validate",
-		}, {
-			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 0},
-			"sequence",
-			"Expected WalletRequest with sequence < 1 to not successfully validate",
+			name:                "right at the limit",
+			sequence:            "10",
+			env:                 map[string]string{"MAX_WALLET_SEQUENCE": "10"},
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+		},
+		{
+			name:               "one over",
+			sequence:           "11",
+			env:                map[string]string{"MAX_WALLET_SEQUENCE": "10"},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeSequenceExhausted,
+		},
+		{
+			name:                "right at the default limit",
+			sequence:            "2147483647",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+		},
+		{
+			name:               "one over the default limit",
+			sequence:           "2147483648",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeSequenceExhausted,
+		},
+		{
+			name:               "too big to be a sequence at all",
+			sequence:           "4294967296",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeInvalidJson,
+		},
+		{
+			name:               "negative",
+			sequence:           "-1",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeInvalidJson,
+		},
+		{
+			name:               "zero",
+			sequence:           "0",
+			expectedStatusCode: http.StatusBadRequest,
+			expectedErrorCode:  ErrorCodeValidationFailed,
+		},
+		{
+			// In case the store is set up with a different limit
+			name:                "store says exhausted",
+			sequence:            "10",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorCode:   ErrorCodeSequenceExhausted,
+			expectSetWalletCall: true,
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrSequenceExhausted},
 		},
 	}
 	for _, tc := range tt {
-		err := tc.walletRequest.validate()
-		if err == nil || !strings.Contains(err.Error(), tc.expectedErrorSubstr) {
-			t.Errorf(tc.failureDescription)
-		}
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{tc.env}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": %s, "hmac": "my-hmac"}`, tc.sequence))
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWallet(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if tc.expectedErrorCode != "" {
+				expectErrorCode(t, body, tc.expectedErrorCode)
+			}
+
+			if called := testStore.Called.SetWallet.EncryptedWallet != ""; called != tc.expectSetWalletCall {
+				t.Errorf("Expected Store.SetWallet called to be %v", tc.expectSetWalletCall)
+			}
+		})
+	}
+}
+
+func TestServerPostWalletHmacFormatCheck(t *testing.T) {
+	validHmac := wallet.WalletHmac(strings.Repeat("ab", wallet.HmacHexLength/2))
+
+	tt := []struct {
+		name            string
+		hmac            wallet.WalletHmac
+		hmacFormatCheck string
+
+		expectedStatusCode  int
+		expectSetWalletCall bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:                "valid hmac",
+			hmac:                validHmac,
+			hmacFormatCheck:     "true",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+		},
+		{
+			name:               "wrong length hmac",
+			hmac:               validHmac[2:],
+			hmacFormatCheck:    "true",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:                "wrong length hmac with the check off",
+			hmac:                validHmac[2:],
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+		},
+		{
+			// In case the store is set up differently
+			name:                "store says invalid",
+			hmac:                validHmac,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectSetWalletCall: true,
+
+			storeErrors: TestStoreFunctionsErrors{SetWallet: store.ErrInvalidHmac},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+			env := map[string]string{
+				"HMAC_FORMAT_CHECK": tc.hmacFormatCheck,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 1, "hmac": "%s"}`, tc.hmac))
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWallet(w, req)
+			<-wsmm.done
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			if tc.expectedStatusCode == http.StatusBadRequest {
+				expectErrorString(t, body, http.StatusText(http.StatusBadRequest)+": Request failed validation: Invalid 'hmac'")
+			}
+
+			if called := testStore.Called.SetWallet.Hmac != ""; called != tc.expectSetWalletCall {
+				t.Errorf("Expected Store.SetWallet called to be %v", tc.expectSetWalletCall)
+			}
+		})
+	}
+}
+
+// Saving or getting the wallet records the sequence the device is at, and
+// failing to doesn't fail the request
+func TestServerWalletDeviceSync(t *testing.T) {
+	for _, updateDeviceSyncErr := range []error{nil, fmt.Errorf("Some random DB Error!")} {
+		testStore := TestStore{
+			TestAuthToken: auth.AuthToken{
+				Token:    auth.AuthTokenString("seekrit"),
+				DeviceId: auth.DeviceId("dev-1"),
+				Scope:    auth.ScopeFull,
+				UserId:   auth.UserId(37),
+			},
+
+			TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+			TestSequence:        wallet.Sequence(5),
+			TestHmac:            wallet.WalletHmac("my-hmac"),
+
+			Errors: TestStoreFunctionsErrors{UpdateDeviceSync: updateDeviceSyncErr},
+		}
+		s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+		wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+		requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 6, "hmac": "my-hmac"}`)
+		req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+		w := httptest.NewRecorder()
+
+		go wsmm.getOneMessage(100 * time.Millisecond)
+		s.postWallet(w, req)
+		<-wsmm.done
+
+		expectStatusCode(t, w, http.StatusOK)
+		if want, got := (UpdateDeviceSyncCall{37, "dev-1", 6}), testStore.Called.UpdateDeviceSync; want != got {
+			t.Errorf("Expected Store.UpdateDeviceSync call %+v, got %+v", want, got)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit", nil)
+		w = httptest.NewRecorder()
+		s.getWallet(w, req)
+
+		expectStatusCode(t, w, http.StatusOK)
+		if want, got := (UpdateDeviceSyncCall{37, "dev-1", 5}), testStore.Called.UpdateDeviceSync; want != got {
+			t.Errorf("Expected Store.UpdateDeviceSync call %+v, got %+v", want, got)
+		}
+	}
+}
+
+// A wallet for another app goes to that app's wallet in the store. It doesn't
+// count for the device list or go out over websockets, which are only about
+// the default app.
+func TestServerWalletAppId(t *testing.T) {
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{
+			Token:    auth.AuthTokenString("seekrit"),
+			DeviceId: auth.DeviceId("dev-1"),
+			Scope:    auth.ScopeFull,
+			UserId:   auth.UserId(37),
+		},
+
+		TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+		TestSequence:        wallet.Sequence(5),
+		TestHmac:            wallet.WalletHmac("my-hmac"),
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+	wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+	requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 6, "hmac": "my-hmac", "appId": "my-app"}`)
+	w := httptest.NewRecorder()
+
+	go wsmm.getOneMessage(100 * time.Millisecond)
+	s.postWallet(w, httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody)))
+	<-wsmm.done
+
+	expectStatusCode(t, w, http.StatusOK)
+	if want, got := wallet.AppId("my-app"), testStore.Called.AppId; want != got {
+		t.Errorf("Expected Store.SetWallet to be called with app id %q, got %q", want, got)
+	}
+	if !wsmm.noMessage {
+		t.Errorf("Expected no websocket message for another app's wallet")
+	}
+	if want, got := (UpdateDeviceSyncCall{}), testStore.Called.UpdateDeviceSync; want != got {
+		t.Errorf("Expected no Store.UpdateDeviceSync call, got %+v", got)
+	}
+
+	testStore.Called = TestStoreFunctionsCalled{}
+	w = httptest.NewRecorder()
+	s.getWallet(w, httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit&appId=my-app", nil))
+
+	expectStatusCode(t, w, http.StatusOK)
+	if want, got := wallet.AppId("my-app"), testStore.Called.AppId; want != got {
+		t.Errorf("Expected Store.GetWallet to be called with app id %q, got %q", want, got)
+	}
+
+	testStore.Called = TestStoreFunctionsCalled{}
+	w = httptest.NewRecorder()
+	s.getWallet(w, httptest.NewRequest(http.MethodGet, paths.PathWallet+"?token=seekrit&appId=my%20app", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expectStatusCode(t, w, http.StatusBadRequest)
+	expectErrorString(t, body, http.StatusText(http.StatusBadRequest)+": Invalid appId parameter")
+	if testStore.Called.GetWallet {
+		t.Errorf("Expected Store.GetWallet to not be called")
+	}
+}
+
+func TestServerValidateWalletRequest(t *testing.T) {
+	parentHmac := wallet.WalletHmac("my-parent-hmac")
+
+	walletRequest := WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 2}
+	if walletRequest.validate() != nil {
+		t.Errorf("Expected valid WalletRequest to successfully validate")
+	}
+
+	walletRequest = WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", ifMatch: `"1-abcd"`}
+	if walletRequest.validate() != nil {
+		t.Errorf("Expected WalletRequest with If-Match and no sequence to successfully validate")
+	}
+
+	walletRequest = WalletRequest{Token: "seekrit", Sequence: 2, validateOnly: true}
+	if walletRequest.validate() != nil {
+		t.Errorf("Expected WalletRequest that's only validating, with no wallet, to successfully validate")
+	}
+
+	tt := []struct {
+		walletRequest       WalletRequest
+		expectedErrorSubstr string
+		failureDescription  string
+	}{
+		{
+			WalletRequest{Token: "seekrit", Hmac: "my-hmac", Sequence: 2},
+			"encryptedWallet",
+			"Expected WalletRequest with missing encrypted wallet to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Sequence: 2},
+			"hmac",
+			"Expected WalletRequest with missing hmac to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 0},
+			"sequence",
+			"Expected WalletRequest with sequence < 1 to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", Sequence: 0, validateOnly: true},
+			"sequence",
+			"Expected WalletRequest that's only validating with sequence < 1 to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 2, ParentHmac: new(wallet.WalletHmac)},
+			"parentHmac",
+			"Expected WalletRequest with empty parent hmac to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", ParentHmac: &parentHmac, ifMatch: `"1-abcd"`},
+			"parentHmac",
+			"Expected WalletRequest with both parent hmac and If-Match to not successfully validate",
+		}, {
+			WalletRequest{Token: "seekrit", EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: 2, AppId: "my/app"},
+			"appId",
+			"Expected WalletRequest with invalid app id to not successfully validate",
+		},
+	}
+	for _, tc := range tt {
+		err := tc.walletRequest.validate()
+		if err == nil || !strings.Contains(err.Error(), tc.expectedErrorSubstr) {
+			t.Errorf(tc.failureDescription)
+		}
+	}
+}
+
+// A client that gets a sequence conflict needs to merge before it tries again,
+// whereas a DB problem might just go away.
+func TestServerPostWalletErrorRetryable(t *testing.T) {
+	tt := []struct {
+		name               string
+		storeErrors        TestStoreFunctionsErrors
+		expectedStatusCode int
+		expectedRetryable  bool
+	}{
+		{
+			name:               "sequence conflict",
+			storeErrors:        TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence},
+			expectedStatusCode: http.StatusConflict,
+			expectedRetryable:  false,
+		}, {
+			name:               "db error",
+			storeErrors:        TestStoreFunctionsErrors{SetWallet: fmt.Errorf("Some random db problem")},
+			expectedStatusCode: http.StatusInternalServerError,
+			expectedRetryable:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`)
+			req := httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.postWallet(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectRetryable(t, body, tc.expectedRetryable)
+		})
+	}
+}
+
+// A conflict comes with the wallet the client lost to, if there is one, for
+// both a single update and a batch
+func TestServerPostWalletConflictLatest(t *testing.T) {
+	tt := []struct {
+		name        string
+		batch       bool
+		storeErrors TestStoreFunctionsErrors
+
+		expectedErrorString string
+		expectLatest        bool
+	}{
+		{
+			name:                "sequence conflict",
+			storeErrors:         TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence},
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectLatest:        true,
+		}, {
+			name:                "parent hmac conflict",
+			storeErrors:         TestStoreFunctionsErrors{SetWallet: store.ErrWrongParentHmac},
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Parent hmac does not match",
+			expectLatest:        true,
+		}, {
+			name:                "batch sequence conflict",
+			batch:               true,
+			storeErrors:         TestStoreFunctionsErrors{SetWalletBatch: store.ErrWrongSequence},
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectLatest:        true,
+		}, {
+			name:                "sequence conflict with no wallet yet",
+			storeErrors:         TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence, GetWallet: store.ErrNoWallet},
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+		}, {
+			name:                "sequence conflict with error getting the wallet",
+			storeErrors:         TestStoreFunctionsErrors{SetWallet: store.ErrWrongSequence, GetWallet: fmt.Errorf("Some random db problem")},
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestEncryptedWallet:   wallet.EncryptedWallet("my-latest-encrypted-wallet"),
+				TestSequence:          wallet.Sequence(5),
+				TestHmac:              wallet.WalletHmac("my-latest-hmac"),
+				TestEncryptionVersion: wallet.EncryptionVersion("my-encryption-version"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			w := httptest.NewRecorder()
+			if tc.batch {
+				requestBody := []byte(`{"token": "seekrit", "updates": [{"encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}]}`)
+				s.postWalletBatch(w, httptest.NewRequest(http.MethodPost, paths.PathWalletBatch, bytes.NewBuffer(requestBody)))
+			} else {
+				requestBody := []byte(`{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 2, "hmac": "my-hmac"}`)
+				s.postWallet(w, httptest.NewRequest(http.MethodPost, paths.PathWallet, bytes.NewBuffer(requestBody)))
+			}
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, http.StatusConflict)
+			expectErrorString(t, body, tc.expectedErrorString)
+			expectRetryable(t, body, false)
+
+			var result WalletConflictResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding conflict response: %+v", err)
+			}
+			if !tc.expectLatest {
+				if result.Latest != nil {
+					t.Errorf("Expected no latest wallet, got %+v", result.Latest)
+				}
+				return
+			}
+			expectedLatest := WalletResponse{
+				EncryptedWallet:   testStore.TestEncryptedWallet,
+				Sequence:          testStore.TestSequence,
+				Hmac:              testStore.TestHmac,
+				EncryptionVersion: testStore.TestEncryptionVersion,
+			}
+			if result.Latest == nil || *result.Latest != expectedLatest {
+				t.Errorf("Expected latest wallet %+v, got %+v", expectedLatest, result.Latest)
+			}
+		})
+	}
+}
+
+// With validate=1, the sequence is checked but nothing is saved
+func TestServerPostWalletValidateOnly(t *testing.T) {
+	tt := []struct {
+		name        string
+		query       string
+		requestBody string
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode    int
+		expectedErrorString   string
+		expectCheckSequenceOf wallet.Sequence
+	}{
+		{
+			name:                  "would be accepted",
+			query:                 "?validate=1",
+			requestBody:           `{"token": "seekrit", "sequence": 6}`,
+			expectedStatusCode:    http.StatusOK,
+			expectCheckSequenceOf: wallet.Sequence(6),
+		}, {
+			name:                  "would be accepted, with the wallet anyway",
+			query:                 "?validate=true",
+			requestBody:           `{"token": "seekrit", "encryptedWallet": "my-encrypted-wallet", "sequence": 6, "hmac": "my-hmac"}`,
+			expectedStatusCode:    http.StatusOK,
+			expectCheckSequenceOf: wallet.Sequence(6),
+		}, {
+			name:                  "would conflict",
+			query:                 "?validate=1",
+			requestBody:           `{"token": "seekrit", "sequence": 2}`,
+			storeErrors:           TestStoreFunctionsErrors{CheckSequence: store.ErrWrongSequence},
+			expectedStatusCode:    http.StatusConflict,
+			expectedErrorString:   http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectCheckSequenceOf: wallet.Sequence(2),
+		}, {
+			name:                "invalid validate parameter",
+			query:               "?validate=maybe",
+			requestBody:         `{"token": "seekrit", "sequence": 6}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid validate parameter",
+		}, {
+			name:                "not validating needs the wallet",
+			query:               "?validate=0",
+			requestBody:         `{"token": "seekrit", "sequence": 6}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'encryptedWallet'",
+		}, {
+			name:                  "db error",
+			query:                 "?validate=1",
+			requestBody:           `{"token": "seekrit", "sequence": 6}`,
+			storeErrors:           TestStoreFunctionsErrors{CheckSequence: fmt.Errorf("Some random db problem")},
+			expectedStatusCode:    http.StatusInternalServerError,
+			expectedErrorString:   http.StatusText(http.StatusInternalServerError),
+			expectCheckSequenceOf: wallet.Sequence(6),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-latest-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(5),
+				TestHmac:            wallet.WalletHmac("my-latest-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			w := httptest.NewRecorder()
+			s.postWallet(w, httptest.NewRequest(http.MethodPost, paths.PathWallet+tc.query, bytes.NewBuffer([]byte(tc.requestBody))))
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.CheckSequence != tc.expectCheckSequenceOf {
+				t.Errorf("Expected CheckSequence to be called with %d, got %d", tc.expectCheckSequenceOf, testStore.Called.CheckSequence)
+			}
+			if testStore.Called.SetWallet != (SetWalletCall{}) {
+				t.Errorf("Expected SetWallet not to be called, got %+v", testStore.Called.SetWallet)
+			}
+			if w.Header().Get("ETag") != "" {
+				t.Errorf("Expected no ETag, since nothing was saved")
+			}
+
+			if tc.expectedStatusCode == http.StatusConflict {
+				var result WalletConflictResponse
+				if err := json.Unmarshal(body, &result); err != nil || result.Latest == nil || result.Latest.Sequence != testStore.TestSequence {
+					t.Errorf("Expected the latest wallet in the conflict response: result: %s err: %+v", string(body), err)
+				}
+			}
+		})
+	}
+}
+
+func TestServerPostWalletSync(t *testing.T) {
+	tt := []struct {
+		name        string
+		requestBody string
+		lost        bool
+		noWallet    bool
+		storeErrors TestStoreFunctionsErrors
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectApplied       bool
+		expectLatest        *WalletResponse
+		expectSyncWalletOf  SetWalletCall
+		expectWsMsg         bool
+	}{
+		{
+			name:               "applied",
+			requestBody:        `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 6, "hmac": "my-new-hmac"}`,
+			expectedStatusCode: http.StatusOK,
+			expectApplied:      true,
+			expectLatest:       &WalletResponse{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac"},
+			expectSyncWalletOf: SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac"},
+			expectWsMsg:        true,
+		}, {
+			name:               "applied with parent hmac",
+			requestBody:        `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 6, "hmac": "my-new-hmac", "parentHmac": "my-latest-hmac"}`,
+			expectedStatusCode: http.StatusOK,
+			expectApplied:      true,
+			expectLatest:       &WalletResponse{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac"},
+			expectSyncWalletOf: SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac", ParentHmac: "my-latest-hmac"},
+			expectWsMsg:        true,
+		}, {
+			name:               "lost to another device",
+			requestBody:        `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 5, "hmac": "my-new-hmac"}`,
+			lost:               true,
+			expectedStatusCode: http.StatusOK,
+			expectLatest:       &WalletResponse{EncryptedWallet: "my-latest-encrypted-wallet", Sequence: 5, Hmac: "my-latest-hmac"},
+			expectSyncWalletOf: SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 5, Hmac: "my-new-hmac"},
+		}, {
+			name:               "lost with no wallet to give back",
+			requestBody:        `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 2, "hmac": "my-new-hmac"}`,
+			lost:               true,
+			noWallet:           true,
+			expectedStatusCode: http.StatusOK,
+			expectSyncWalletOf: SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 2, Hmac: "my-new-hmac"},
+		}, {
+			name:                "missing parent hmac",
+			requestBody:         `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 6, "hmac": "my-new-hmac"}`,
+			storeErrors:         TestStoreFunctionsErrors{SyncWallet: store.ErrNoParentHmac},
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing 'parentHmac'",
+			expectSyncWalletOf:  SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac"},
+		}, {
+			name:                "request failed validation",
+			requestBody:         `{"token": "seekrit", "sequence": 6, "hmac": "my-new-hmac"}`,
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'encryptedWallet'",
+		}, {
+			name:                "db error",
+			requestBody:         `{"token": "seekrit", "encryptedWallet": "my-new-encrypted-wallet", "sequence": 6, "hmac": "my-new-hmac"}`,
+			storeErrors:         TestStoreFunctionsErrors{SyncWallet: fmt.Errorf("Some random db problem")},
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectSyncWalletOf:  SetWalletCall{EncryptedWallet: "my-new-encrypted-wallet", Sequence: 6, Hmac: "my-new-hmac"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-latest-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(5),
+				TestHmac:            wallet.WalletHmac("my-latest-hmac"),
+
+				TestSyncWalletLost: tc.lost,
+
+				Errors: tc.storeErrors,
+			}
+			if tc.noWallet {
+				testStore.TestSequence = 0
+			}
+
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletSync, bytes.NewBuffer([]byte(tc.requestBody)))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWalletSync(w, req)
+			<-wsmm.done
+
+			if tc.expectWsMsg && (wsmm.walletUpdateUserId != testStore.TestAuthToken.UserId || wsmm.walletUpdateSeq != tc.expectLatest.Sequence) {
+				t.Errorf("Expected websocket message to update wallet to sequence %d, got user %d sequence %d", tc.expectLatest.Sequence, wsmm.walletUpdateUserId, wsmm.walletUpdateSeq)
+			}
+			if !tc.expectWsMsg && wsmm.walletUpdateUserId == testStore.TestAuthToken.UserId {
+				t.Error("Expected no websocket message to update wallet")
+			}
+
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if testStore.Called.SyncWallet != tc.expectSyncWalletOf {
+				t.Errorf("Store.SyncWallet called with: expected %+v, got %+v", tc.expectSyncWalletOf, testStore.Called.SyncWallet)
+			}
+
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var result WalletSyncResponse
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatalf("Error decoding the sync response: result: %s err: %+v", string(body), err)
+			}
+			if result.Applied != tc.expectApplied {
+				t.Errorf("Expected applied to be %v, got %v", tc.expectApplied, result.Applied)
+			}
+
+			if tc.expectLatest == nil {
+				if result.Wallet != nil {
+					t.Errorf("Expected no wallet in the response, got %+v", result.Wallet)
+				}
+				if w.Header().Get("ETag") != "" {
+					t.Errorf("Expected no ETag without a wallet")
+				}
+				return
+			}
+			if result.Wallet == nil || *result.Wallet != *tc.expectLatest {
+				t.Errorf("Expected wallet %+v in the response, got %+v", tc.expectLatest, result.Wallet)
+			}
+			if expected := walletETag(tc.expectLatest.Sequence, tc.expectLatest.Hmac); w.Header().Get("ETag") != expected {
+				t.Errorf("Expected ETag %s, got %s", expected, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+// Devices racing to sync the same sequence through the real store: one of
+// them wins, and everyone else gets the winner's wallet back in the same
+// request.
+func TestServerPostWalletSyncConcurrent(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+
+	const numDevices = 5
+	tokens := make([]auth.AuthTokenString, numDevices)
+	for i := range tokens {
+		var authToken auth.AuthToken
+		statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: auth.DeviceId(fmt.Sprintf("dev-%d", i)), Email: email, Password: password}, &authToken)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+		}
+		tokens[i] = authToken.Token
+	}
+
+	results := make([]WalletSyncResponse, numDevices)
+	errs := make([]error, numDevices)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statusCode, err := selfTestRequest(s.postWalletSync, http.MethodPost, paths.PathWalletSync, WalletRequest{
+				Token:           tokens[i],
+				EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-encrypted-wallet-%d", i)),
+				Sequence:        1,
+				Hmac:            wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", i)),
+			}, &results[i])
+			if err == nil && statusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", statusCode)
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	var winner *WalletResponse
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatalf("Error syncing from device %d: %+v", i, errs[i])
+		}
+		if results[i].Applied {
+			if winner != nil {
+				t.Fatalf("Expected exactly one device to win, got %+v and %+v", *winner, *results[i].Wallet)
+			}
+			winner = results[i].Wallet
+		}
+	}
+	if winner == nil {
+		t.Fatalf("Expected one device to win")
+	}
+	for i := range results {
+		if results[i].Wallet == nil || *results[i].Wallet != *winner {
+			t.Errorf("Expected device %d to get the winning wallet %+v, got %+v", i, *winner, results[i].Wallet)
+		}
+	}
+}
+
+func TestServerPostWalletBatch(t *testing.T) {
+	tt := []struct {
+		name string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectSetWalletCall bool
+		expectWsMsg         bool
+
+		newSequences []wallet.Sequence
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:                "success",
+			expectedStatusCode:  http.StatusOK,
+			expectSetWalletCall: true,
+			expectWsMsg:         true,
+
+			newSequences: []wallet.Sequence{2, 3, 4},
+		}, {
+			name:                "conflict",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Bad sequence number",
+			expectSetWalletCall: true,
+
+			newSequences: []wallet.Sequence{2, 3, 4},
+
+			storeErrors: TestStoreFunctionsErrors{SetWalletBatch: store.ErrWrongSequence},
+		}, {
+			name:                "conflict with parent hmac",
+			expectedStatusCode:  http.StatusConflict,
+			expectedErrorString: http.StatusText(http.StatusConflict) + ": Parent hmac does not match",
+			expectSetWalletCall: true,
+
+			newSequences: []wallet.Sequence{2, 3, 4},
+
+			storeErrors: TestStoreFunctionsErrors{SetWalletBatch: store.ErrWrongParentHmac},
+		}, {
+			name:                "gap in chain",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: 'sequence' in update 1 does not follow the one before it",
+
+			newSequences: []wallet.Sequence{2, 4},
+		}, {
+			name:                "db error setting wallet batch",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+			expectSetWalletCall: true,
+
+			newSequences: []wallet.Sequence{2, 3, 4},
+
+			storeErrors: TestStoreFunctionsErrors{SetWalletBatch: fmt.Errorf("Some random db problem")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+
+				Errors: tc.storeErrors,
+			}
+
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+			wsmm := wsMockManager{s: s, done: make(chan bool)}
+
+			batchRequest := WalletBatchRequest{Token: testStore.TestAuthToken.Token}
+			var expectedUpdates []store.WalletUpdate
+			for _, sequence := range tc.newSequences {
+				update := WalletBatchUpdate{
+					EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-encrypted-wallet-%d", sequence)),
+					Sequence:        sequence,
+					Hmac:            wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence)),
+				}
+				batchRequest.Updates = append(batchRequest.Updates, update)
+				expectedUpdates = append(expectedUpdates, store.WalletUpdate{
+					EncryptedWallet: update.EncryptedWallet,
+					Sequence:        update.Sequence,
+					Hmac:            update.Hmac,
+				})
+			}
+			requestBody, _ := json.Marshal(batchRequest)
+
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletBatch, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			go wsmm.getOneMessage(100 * time.Millisecond)
+			s.postWalletBatch(w, req)
+			<-wsmm.done
+
+			// Other clients only hear about the end of the chain
+			lastSequence := tc.newSequences[len(tc.newSequences)-1]
+			if tc.expectWsMsg && (wsmm.walletUpdateUserId != testStore.TestAuthToken.UserId || wsmm.walletUpdateSeq != lastSequence) {
+				t.Errorf("Expected websocket message to update wallet to sequence %d, got user %d sequence %d", lastSequence, wsmm.walletUpdateUserId, wsmm.walletUpdateSeq)
+			}
+			if !tc.expectWsMsg && wsmm.walletUpdateUserId == testStore.TestAuthToken.UserId {
+				t.Error("Expected no websocket message to update wallet")
+			}
+
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedErrorString == "" && string(body) != "{}" {
+				t.Errorf("Expected post wallet batch response to be \"{}\": result: %+v", string(body))
+			}
+
+			if tc.expectSetWalletCall {
+				if len(testStore.Called.SetWalletBatch) != len(expectedUpdates) {
+					t.Fatalf("Store.SetWalletBatch called with: expected %+v, got %+v", expectedUpdates, testStore.Called.SetWalletBatch)
+				}
+				for i := range expectedUpdates {
+					if expectedUpdates[i] != testStore.Called.SetWalletBatch[i] {
+						t.Errorf("Store.SetWalletBatch called with: expected %+v, got %+v", expectedUpdates, testStore.Called.SetWalletBatch)
+					}
+				}
+			} else if testStore.Called.SetWalletBatch != nil {
+				t.Errorf("Expected Store.SetWalletBatch not to be called")
+			}
+		})
+	}
+}
+
+func TestServerValidateWalletBatchRequest(t *testing.T) {
+	validUpdates := []WalletBatchUpdate{
+		{EncryptedWallet: "my-encrypted-wallet-2", Hmac: "my-hmac-2", Sequence: 2},
+		{EncryptedWallet: "my-encrypted-wallet-3", Hmac: "my-hmac-3", Sequence: 3},
+	}
+	walletBatchRequest := WalletBatchRequest{Token: "seekrit", Updates: validUpdates}
+	if walletBatchRequest.validate() != nil {
+		t.Errorf("Expected valid WalletBatchRequest to successfully validate")
+	}
+
+	tooManyUpdates := []WalletBatchUpdate{}
+	for i := 1; i <= maxWalletBatchSize+1; i++ {
+		tooManyUpdates = append(tooManyUpdates, WalletBatchUpdate{EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac", Sequence: wallet.Sequence(i)})
+	}
+
+	tt := []struct {
+		walletBatchRequest  WalletBatchRequest
+		expectedErrorSubstr string
+		failureDescription  string
+	}{
+		{
+			WalletBatchRequest{Token: "seekrit"},
+			"updates",
+			"Expected WalletBatchRequest with no updates to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: tooManyUpdates},
+			"Too many",
+			"Expected WalletBatchRequest with too many updates to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: validUpdates, ParentHmac: new(wallet.WalletHmac)},
+			"parentHmac",
+			"Expected WalletBatchRequest with empty parent hmac to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: []WalletBatchUpdate{validUpdates[0], {Hmac: "my-hmac-3", Sequence: 3}}},
+			"encryptedWallet",
+			"Expected WalletBatchRequest with missing encrypted wallet to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: []WalletBatchUpdate{validUpdates[0], {EncryptedWallet: "my-encrypted-wallet-3", Sequence: 3}}},
+			"hmac",
+			"Expected WalletBatchRequest with missing hmac to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: []WalletBatchUpdate{{EncryptedWallet: "my-encrypted-wallet", Hmac: "my-hmac"}}},
+			"sequence",
+			"Expected WalletBatchRequest with sequence < 1 to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: []WalletBatchUpdate{validUpdates[1], validUpdates[0]}},
+			"does not follow",
+			"Expected WalletBatchRequest with out of order sequences to not successfully validate",
+		}, {
+			WalletBatchRequest{Token: "seekrit", Updates: validUpdates, AppId: "my/app"},
+			"appId",
+			"Expected WalletBatchRequest with invalid app id to not successfully validate",
+		},
+	}
+	for _, tc := range tt {
+		err := tc.walletBatchRequest.validate()
+		if err == nil || !strings.Contains(err.Error(), tc.expectedErrorSubstr) {
+			t.Errorf(tc.failureDescription)
+		}
+	}
+}
+
+func TestServerPostWalletVerify(t *testing.T) {
+	tt := []struct {
+		name string
+
+		sequence wallet.Sequence
+		hmac     wallet.WalletHmac
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectedMatches     bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "matches",
+			sequence:           wallet.Sequence(2),
+			hmac:               wallet.WalletHmac("my-hmac"),
+			expectedStatusCode: http.StatusOK,
+			expectedMatches:    true,
+		},
+		{
+			name:               "different hmac",
+			sequence:           wallet.Sequence(2),
+			hmac:               wallet.WalletHmac("my-other-hmac"),
+			expectedStatusCode: http.StatusOK,
+			expectedMatches:    false,
+		},
+		{
+			name:               "different sequence",
+			sequence:           wallet.Sequence(3),
+			hmac:               wallet.WalletHmac("my-hmac"),
+			expectedStatusCode: http.StatusOK,
+			expectedMatches:    false,
+		},
+		{
+			name:                "validation error", // missing hmac
+			sequence:            wallet.Sequence(2),
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Request failed validation: Missing 'hmac'",
+		},
+		{
+			name:     "auth error",
+			sequence: wallet.Sequence(2),
+			hmac:     wallet.WalletHmac("my-hmac"),
+
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:     "no wallet",
+			sequence: wallet.Sequence(2),
+			hmac:     wallet.WalletHmac("my-hmac"),
+
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: store.ErrNoWallet},
+		},
+		{
+			name:     "db error getting wallet metadata",
+			sequence: wallet.Sequence(2),
+			hmac:     wallet.WalletHmac("my-hmac"),
+
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeFull,
+				},
+
+				TestSequence: wallet.Sequence(2),
+				TestHmac:     wallet.WalletHmac("my-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			requestBody := []byte(fmt.Sprintf(`{"token": "seekrit", "sequence": %d, "hmac": "%s"}`, tc.sequence, tc.hmac))
+			req := httptest.NewRequest(http.MethodPost, paths.PathWalletVerify, bytes.NewBuffer(requestBody))
+			w := httptest.NewRecorder()
+
+			s.postWalletVerify(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			// The whole point is not to load the wallet itself
+			if testStore.Called.GetWallet {
+				t.Errorf("Expected Store.GetWallet not to be called")
+			}
+
+			if len(tc.expectedErrorString) > 0 {
+				return // The rest of the test does not apply
+			}
+
+			var result WalletVerifyResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Matches != tc.expectedMatches {
+				t.Errorf("Expected matches to be %t: result: %s err: %+v", tc.expectedMatches, string(body), err)
+			}
+		})
+	}
+}
+
+func TestServerGetWalletStatus(t *testing.T) {
+	tt := []struct {
+		name        string
+		tokenString auth.AuthTokenString
+
+		expectedStatusCode  int
+		expectedErrorString string
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "success",
+			tokenString:        auth.AuthTokenString("seekrit"),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:                "missing token",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Missing token",
+		},
+		{
+			name:                "auth error",
+			tokenString:         auth.AuthTokenString("seekrit"),
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:                "no wallet",
+			tokenString:         auth.AuthTokenString("seekrit"),
+			expectedStatusCode:  http.StatusNotFound,
+			expectedErrorString: http.StatusText(http.StatusNotFound) + ": No wallet",
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: store.ErrNoWallet},
+		},
+		{
+			name:                "db error getting wallet metadata",
+			tokenString:         auth.AuthTokenString("seekrit"),
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeGetWallet,
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(2),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+
+			req := httptest.NewRequest(http.MethodGet, paths.PathWalletStatus, nil)
+			q := req.URL.Query()
+			if tc.tokenString != "" {
+				q.Add("token", string(tc.tokenString))
+			}
+			req.URL.RawQuery = q.Encode()
+			w := httptest.NewRecorder()
+
+			s.getWalletStatus(w, req)
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			// The whole point is not to load the wallet itself
+			if testStore.Called.GetWallet {
+				t.Errorf("Expected Store.GetWallet not to be called")
+			}
+
+			if len(tc.expectedErrorString) > 0 {
+				return // The rest of the test does not apply
+			}
+
+			if strings.Contains(string(body), "encryptedWallet") {
+				t.Errorf("Expected no encrypted wallet in the response, got %s", body)
+			}
+			var result WalletStatusResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Sequence != 2 || result.Hmac != "my-hmac" {
+				t.Errorf("Expected the sequence and hmac in the response: result: %s err: %+v", string(body), err)
+			}
+		})
 	}
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Long polling, for clients that want to hear about wallet updates right away
+// but can't (or would rather not) keep a websocket open, such as mobile apps
+// that would otherwise poll GET /wallet over and over. The client says which
+// sequence it has, and the request doesn't return until there's a newer one,
+// or until walletPollTimeout.
+
+// The HTTP write timeout is what would cut off a poll that waits too long,
+// so Config.Validate makes sure it's comfortably longer than this.
+const walletPollTimeout = 30 * time.Second
+
+// Everyone waiting on a wallet update, by user. Unlike the websocket manager,
+// nothing has to be running for this to work; a waiting request registers
+// itself, and a wallet update wakes up everyone registered for the user.
+type walletWatchers struct {
+	mu     sync.Mutex
+	byUser map[auth.UserId]map[chan struct{}]bool
+
+	// Closed when the server shuts down, so that waiting requests return
+	// right away instead of holding up the shutdown
+	finished     chan struct{}
+	finishedOnce sync.Once
+}
+
+func newWalletWatchers() *walletWatchers {
+	return &walletWatchers{
+		byUser:   make(map[auth.UserId]map[chan struct{}]bool),
+		finished: make(chan struct{}),
+	}
+}
+
+func (ww *walletWatchers) finish() {
+	ww.finishedOnce.Do(func() { close(ww.finished) })
+}
+
+// The returned channel is closed on the next update for the user. Call stop
+// when done waiting, whether or not it was closed.
+func (ww *walletWatchers) watch(userId auth.UserId) (updated chan struct{}, stop func()) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+
+	updated = make(chan struct{})
+	if _, ok := ww.byUser[userId]; !ok {
+		ww.byUser[userId] = make(map[chan struct{}]bool)
+	}
+	ww.byUser[userId][updated] = true
+
+	stop = func() {
+		ww.mu.Lock()
+		defer ww.mu.Unlock()
+		if _, ok := ww.byUser[userId][updated]; !ok {
+			return // already notified
+		}
+		delete(ww.byUser[userId], updated)
+		if len(ww.byUser[userId]) == 0 {
+			delete(ww.byUser, userId)
+		}
+	}
+	return
+}
+
+func (ww *walletWatchers) notify(userId auth.UserId) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	for updated := range ww.byUser[userId] {
+		close(updated)
+	}
+	delete(ww.byUser, userId)
+}
+
+func getLastSequenceParam(req *http.Request) (lastSequence wallet.Sequence, err error) {
+	lastSequenceStr := req.URL.Query().Get("lastSequence")
+	if lastSequenceStr == "" {
+		err = fmt.Errorf("Missing lastSequence parameter")
+		return
+	}
+	lastSequenceInt, err := strconv.ParseUint(lastSequenceStr, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("Invalid lastSequence parameter")
+		return
+	}
+	return wallet.Sequence(lastSequenceInt), nil
+}
+
+// Takes `token` and `lastSequence` (0 if the client has no wallet yet), and
+// `appId` if it's not the default app.
+// Responds with the wallet, same as GET /wallet, as soon as we have one with a
+// sequence above lastSequence, which may be right away. If there's nothing
+// new by the timeout, responds with a 204 and no body, and the client can poll
+// again.
+func (s *Server) getWalletPoll(w http.ResponseWriter, req *http.Request) {
+	metrics.RequestsCount.With(prometheus.Labels{"method": "GET", "endpoint": "wallet-poll"}).Inc()
+
+	if !getGetData(w, req) {
+		return
+	}
+
+	token := getTokenParam(req)
+	lastSequence, paramsErr := getLastSequenceParam(req)
+	var appId wallet.AppId
+	if paramsErr == nil {
+		appId, paramsErr = getAppIdParam(req)
+	}
+	if paramsErr != nil {
+		// In this specific case, the error is limited to values that are safe to
+		// give to the user.
+		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+		return
+	}
+
+	timeout := time.NewTimer(s.walletPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		// Check the token every time around, so that a token that went away
+		// while we were waiting (password change, logout) doesn't get the update.
+		authToken := s.checkAuth(req, w, token, auth.ScopeGetWallet)
+		if authToken == nil {
+			return
+		}
+
+		// Start watching before checking, so an update that lands in between
+		// isn't missed.
+		updated, stop := s.walletWatchers.watch(authToken.UserId)
+
+		sequence, _, err := s.store.GetWalletMetadata(req.Context(), authToken.UserId, appId)
+		if err == store.ErrNoWallet {
+			sequence = 0
+		} else if err != nil {
+			stop()
+			internalServiceErrorJson(w, err, "Error getting wallet metadata")
+			return
+		}
+
+		if sequence > lastSequence {
+			stop()
+			s.writeLatestWallet(req.Context(), w, authToken, appId)
+			return
+		}
+
+		select {
+		case <-updated:
+			stop()
+		case <-timeout.C:
+			stop()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.walletWatchers.finished:
+			// Same as a timeout. The client will poll again, hopefully once we're
+			// back up.
+			stop()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-req.Context().Done():
+			// The client gave up
+			stop()
+			return
+		}
+	}
+}
+
+func (s *Server) writeLatestWallet(ctx context.Context, w http.ResponseWriter, authToken *auth.AuthToken, appId wallet.AppId) {
+	encryptedWallet, sequence, hmac, encryptionVersion, err := s.store.GetWallet(ctx, authToken.UserId, appId)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error retrieving wallet")
+		return
+	}
+	s.recordDeviceSync(ctx, authToken, appId, sequence)
+	w.Header().Set("ETag", walletETag(sequence, hmac))
+
+	response, err := json.Marshal(WalletResponse{
+		EncryptedWallet:   encryptedWallet,
+		Sequence:          sequence,
+		Hmac:              hmac,
+		EncryptionVersion: encryptionVersion,
+	})
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error generating wallet response")
+		return
+	}
+
+	fmt.Fprintf(w, string(response))
+}
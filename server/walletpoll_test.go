@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/server/paths"
+	"lbryio/wallet-sync-server/store"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func walletPollRequest(token auth.AuthTokenString, lastSequence string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, paths.PathWalletPoll, nil)
+	q := req.URL.Query()
+	q.Add("token", string(token))
+	if lastSequence != "" {
+		q.Add("lastSequence", lastSequence)
+	}
+	req.URL.RawQuery = q.Encode()
+	return req
+}
+
+// Wait until a poll for the user is registered, so we know it's waiting
+func waitForWalletWatcher(t *testing.T, s *Server, userId auth.UserId) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.walletWatchers.mu.Lock()
+		n := len(s.walletWatchers.byUser[userId])
+		s.walletWatchers.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected a wallet poll to be waiting")
+}
+
+func TestServerWalletPoll(t *testing.T) {
+	tt := []struct {
+		name         string
+		lastSequence string
+
+		expectedStatusCode  int
+		expectedErrorString string
+		expectWallet        bool
+
+		storeErrors TestStoreFunctionsErrors
+	}{
+		{
+			name:               "newer wallet already",
+			lastSequence:       "4",
+			expectedStatusCode: http.StatusOK,
+			expectWallet:       true,
+		},
+		{
+			name:               "nothing newer before the timeout",
+			lastSequence:       "5",
+			expectedStatusCode: http.StatusNoContent,
+		},
+		{
+			name:               "no wallet yet before the timeout",
+			lastSequence:       "0",
+			expectedStatusCode: http.StatusNoContent,
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: store.ErrNoWallet},
+		},
+		{
+			name:                "missing lastSequence",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Missing lastSequence parameter",
+		},
+		{
+			name:                "invalid lastSequence",
+			lastSequence:        "-1",
+			expectedStatusCode:  http.StatusBadRequest,
+			expectedErrorString: http.StatusText(http.StatusBadRequest) + ": Invalid lastSequence parameter",
+		},
+		{
+			name:                "auth error",
+			lastSequence:        "4",
+			expectedStatusCode:  http.StatusUnauthorized,
+			expectedErrorString: http.StatusText(http.StatusUnauthorized) + ": Token Not Found",
+
+			storeErrors: TestStoreFunctionsErrors{GetToken: store.ErrNoTokenForUserDevice},
+		},
+		{
+			name:                "db error getting wallet metadata",
+			lastSequence:        "4",
+			expectedStatusCode:  http.StatusInternalServerError,
+			expectedErrorString: http.StatusText(http.StatusInternalServerError),
+
+			storeErrors: TestStoreFunctionsErrors{GetWalletMetadata: fmt.Errorf("Some random DB Error!")},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token: auth.AuthTokenString("seekrit"),
+					Scope: auth.ScopeGetWallet,
+				},
+
+				TestEncryptedWallet: wallet.EncryptedWallet("my-encrypted-wallet"),
+				TestSequence:        wallet.Sequence(5),
+				TestHmac:            wallet.WalletHmac("my-hmac"),
+
+				Errors: tc.storeErrors,
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+			s.walletPollTimeout = 50 * time.Millisecond
+
+			w := httptest.NewRecorder()
+			s.getWalletPoll(w, walletPollRequest(testStore.TestAuthToken.Token, tc.lastSequence))
+			body, _ := ioutil.ReadAll(w.Body)
+
+			expectStatusCode(t, w, tc.expectedStatusCode)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			if tc.expectedStatusCode == http.StatusNoContent && len(body) != 0 {
+				t.Errorf("Expected no body with a 204, got %s", string(body))
+			}
+
+			if !tc.expectWallet {
+				return
+			}
+			var result WalletResponse
+			if err := json.Unmarshal(body, &result); err != nil || result.Sequence != testStore.TestSequence || result.EncryptedWallet != testStore.TestEncryptedWallet {
+				t.Errorf("Expected the wallet in the response: result: %+v err: %+v", string(body), err)
+			}
+		})
+	}
+}
+
+// A poll that's waiting returns as soon as a new wallet is saved
+func TestServerWalletPollWakesOnUpdate(t *testing.T) {
+	st, tmpFile := storeTestInit(t)
+	defer storeTestCleanup(tmpFile)
+
+	s := Init(&auth.Auth{}, &st, &TestEnv{}, &TestMail{}, TestConfig)
+	s.walletPollTimeout = 10 * time.Second
+
+	email, password := auth.Email("abc@example.com"), auth.Password("12345678")
+	if err := st.CreateAccount(context.Background(), email, password, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	var authToken auth.AuthToken
+	statusCode, err := selfTestRequest(s.getAuthToken, http.MethodPost, paths.PathAuthToken, AuthRequest{DeviceId: "dev-1", Email: email, Password: password}, &authToken)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error getting a token: status %d err %+v", statusCode, err)
+	}
+
+	type pollResult struct {
+		code int
+		body []byte
+	}
+	done := make(chan pollResult)
+	go func() {
+		w := httptest.NewRecorder()
+		s.getWalletPoll(w, walletPollRequest(authToken.Token, "0"))
+		done <- pollResult{w.Code, w.Body.Bytes()}
+	}()
+
+	waitForWalletWatcher(t, s, authToken.UserId)
+
+	statusCode, err = selfTestRequest(s.postWallet, http.MethodPost, paths.PathWallet, WalletRequest{
+		Token:           authToken.Token,
+		EncryptedWallet: "my-encrypted-wallet",
+		Sequence:        1,
+		Hmac:            "my-hmac",
+	}, nil)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error saving a wallet: status %d err %+v", statusCode, err)
+	}
+
+	select {
+	case result := <-done:
+		if result.code != http.StatusOK {
+			t.Fatalf("Expected the poll to get the new wallet, got status %d", result.code)
+		}
+		var walletResponse WalletResponse
+		if err := json.Unmarshal(result.body, &walletResponse); err != nil || walletResponse.Sequence != 1 || walletResponse.EncryptedWallet != "my-encrypted-wallet" {
+			t.Errorf("Expected the new wallet in the response: result: %+v err: %+v", string(result.body), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the poll to return after the wallet update")
+	}
+}
+
+// Shutting down lets go of waiting polls rather than waiting out the timeout
+func TestServerWalletPollFinish(t *testing.T) {
+	testStore := TestStore{
+		TestAuthToken: auth.AuthToken{
+			Token:  auth.AuthTokenString("seekrit"),
+			Scope:  auth.ScopeFull,
+			UserId: auth.UserId(37),
+		},
+		TestSequence: wallet.Sequence(5),
+	}
+	s := Init(&TestAuth{}, &testStore, &TestEnv{}, &TestMail{}, TestConfig)
+	s.walletPollTimeout = 10 * time.Second
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		s.getWalletPoll(w, walletPollRequest(testStore.TestAuthToken.Token, "5"))
+		done <- w.Code
+	}()
+
+	waitForWalletWatcher(t, s, testStore.TestAuthToken.UserId)
+	s.walletWatchers.finish()
+
+	select {
+	case code := <-done:
+		if code != http.StatusNoContent {
+			t.Errorf("Expected a 204 on shutdown, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the poll to return on shutdown")
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/env"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/wallet"
 
 	"github.com/gorilla/websocket"
@@ -62,6 +67,7 @@ func debugLog(format string, v ...any) {
 type wsClient struct {
 	socket *websocket.Conn
 	notify chan wsClientNotifyMsg
+	ip     string
 }
 
 // Each user with at least one actively connected client will have one of these
@@ -77,9 +83,67 @@ type wsClientForUser struct {
 
 var upgrader = websocket.Upgrader{} // use default options
 
+// Websocket connections are long-lived, so a client can tie up a lot of
+// resources with very few requests. Keep count of open connections per IP and
+// per user so we can turn away new ones past a limit.
+//
+// This is separate from the socket manager because we need to count
+// connections (and reject them) before they're upgraded, and get an answer
+// right away.
+type wsConnectionCounter struct {
+	mu     sync.Mutex
+	byIP   map[string]int
+	byUser map[auth.UserId]int
+}
+
+func newWsConnectionCounter() *wsConnectionCounter {
+	return &wsConnectionCounter{
+		byIP:   make(map[string]int),
+		byUser: make(map[auth.UserId]int),
+	}
+}
+
+// Count a new connection, unless it would put the IP or the user over their
+// limit. Returns a reason (for the error response) if it was rejected. Every
+// accepted connection needs a matching release.
+func (c *wsConnectionCounter) acquire(ip string, userId auth.UserId, maxPerIP int, maxPerUser int) (ok bool, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byIP[ip] >= maxPerIP {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-connection-limit-ip"}).Inc()
+		return false, "Too many connections from this IP address"
+	}
+	if c.byUser[userId] >= maxPerUser {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "ws-connection-limit-user"}).Inc()
+		return false, "Too many connections for this user"
+	}
+	c.byIP[ip]++
+	c.byUser[userId]++
+	metrics.WebsocketConnections.Inc()
+	return true, ""
+}
+
+func (c *wsConnectionCounter) release(ip string, userId auth.UserId) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byIP[ip]--; c.byIP[ip] <= 0 {
+		delete(c.byIP, ip)
+	}
+	if c.byUser[userId]--; c.byUser[userId] <= 0 {
+		delete(c.byUser, userId)
+	}
+	metrics.WebsocketConnections.Dec()
+}
+
 // Just handle ping/pong
 func (s *Server) wsReader(userId auth.UserId, client *wsClient) {
 	defer func() {
+		// The reader is the side that notices the connection is gone, so it's
+		// the one that gives back the connection count.
+		s.wsConnections.release(client.ip, userId)
+
 		// Since wsWriter is waiting on the notify channel, tell the manager to
 		// close it. This will make wsWriter stop (if it hasn't already).
 		s.clientRemove <- wsClientForUser{userId, client}
@@ -134,18 +198,23 @@ func (s *Server) wsWriter(userId auth.UserId, client *wsClient) {
 
 // This is the server endpoint that initiates a new websocket
 func (s *Server) websocket(w http.ResponseWriter, req *http.Request) {
-	token, paramsErr := getTokenParam(req)
+	token := getTokenParam(req)
 
-	if paramsErr != nil {
-		// In this specific case, the error is limited to values that are safe to
-		// give to the user.
-		errorJson(w, http.StatusBadRequest, paramsErr.Error())
+	authToken := s.checkAuth(req, w, token, auth.ScopeGetWallet)
+
+	if authToken == nil {
 		return
 	}
 
-	authToken := s.checkAuth(w, token, auth.ScopeFull)
+	maxPerIP, maxPerUser, err := env.GetWebsocketMaxConnections(s.env)
+	if err != nil {
+		internalServiceErrorJson(w, err, "Error getting websocket connection limits")
+		return
+	}
 
-	if authToken == nil {
+	ip := s.clientIP(req)
+	if ok, reason := s.wsConnections.acquire(ip, authToken.UserId, maxPerIP, maxPerUser); !ok {
+		errorJson(w, http.StatusTooManyRequests, reason)
 		return
 	}
 
@@ -153,11 +222,12 @@ func (s *Server) websocket(w http.ResponseWriter, req *http.Request) {
 
 	ws, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
+		s.wsConnections.release(ip, authToken.UserId)
 		log.Println(err)
 		return
 	}
 
-	client := wsClient{ws, make(chan wsClientNotifyMsg, notifyChanBuffer)}
+	client := wsClient{ws, make(chan wsClientNotifyMsg, notifyChanBuffer), ip}
 	newClient := wsClientForUser{authToken.UserId, &client}
 	s.clientAdd <- newClient
 
@@ -1,12 +1,22 @@
 package server
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
 )
 
 func TestWebsocketManagerQuits(t *testing.T) {
-	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestPort)
+	s := Init(&TestAuth{}, &TestStore{}, &TestEnv{}, &TestMail{}, TestConfig)
 	done := make(chan bool)
 	finish := make(chan bool)
 
@@ -33,3 +43,132 @@ func TestWebsocketManagerQuits(t *testing.T) {
 // with websockets here, is a real pain in the ass, and it's probably not the
 // highest priority right now. If websockets become higher profile we can work
 // on it again.
+
+func TestWebsocketConnectionCounter(t *testing.T) {
+	c := newWsConnectionCounter()
+	gaugeBefore := testutil.ToFloat64(metrics.WebsocketConnections)
+
+	// Per user
+	for i := 0; i < 2; i++ {
+		if ok, reason := c.acquire("1.2.3.4", auth.UserId(1), 3, 2); !ok {
+			t.Fatalf("Expected connection %d to be accepted, got: %s", i, reason)
+		}
+	}
+	if ok, _ := c.acquire("5.6.7.8", auth.UserId(1), 3, 2); ok {
+		t.Fatalf("Expected connection past the per-user limit to be rejected")
+	}
+
+	// Per IP
+	if ok, reason := c.acquire("1.2.3.4", auth.UserId(2), 3, 2); !ok {
+		t.Fatalf("Expected connection to be accepted, got: %s", reason)
+	}
+	if ok, _ := c.acquire("1.2.3.4", auth.UserId(3), 3, 2); ok {
+		t.Fatalf("Expected connection past the per-IP limit to be rejected")
+	}
+
+	if want, got := gaugeBefore+3, testutil.ToFloat64(metrics.WebsocketConnections); want != got {
+		t.Errorf("Expected connections gauge %f, got %f", want, got)
+	}
+
+	// Releasing makes room again
+	c.release("1.2.3.4", auth.UserId(1))
+	if ok, reason := c.acquire("1.2.3.4", auth.UserId(3), 3, 2); !ok {
+		t.Fatalf("Expected connection to be accepted after a release, got: %s", reason)
+	}
+
+	c.release("1.2.3.4", auth.UserId(1))
+	c.release("1.2.3.4", auth.UserId(2))
+	c.release("1.2.3.4", auth.UserId(3))
+	if len(c.byIP) != 0 || len(c.byUser) != 0 {
+		t.Errorf("Expected counts to be cleaned up after everything is released: %+v %+v", c.byIP, c.byUser)
+	}
+	if want, got := gaugeBefore, testutil.ToFloat64(metrics.WebsocketConnections); want != got {
+		t.Errorf("Expected connections gauge %f, got %f", want, got)
+	}
+}
+
+// Open real websocket connections past the limit
+func TestWebsocketConnectionLimit(t *testing.T) {
+	tt := []struct {
+		name                string
+		env                 map[string]string
+		expectedErrorString string
+	}{
+		{
+			name: "per user",
+			env: map[string]string{
+				"WEBSOCKET_MAX_CONNECTIONS_PER_IP":   "10",
+				"WEBSOCKET_MAX_CONNECTIONS_PER_USER": "2",
+			},
+			expectedErrorString: http.StatusText(http.StatusTooManyRequests) + ": Too many connections for this user",
+		}, {
+			name: "per ip",
+			env: map[string]string{
+				"WEBSOCKET_MAX_CONNECTIONS_PER_IP":   "2",
+				"WEBSOCKET_MAX_CONNECTIONS_PER_USER": "10",
+			},
+			expectedErrorString: http.StatusText(http.StatusTooManyRequests) + ": Too many connections from this IP address",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testStore := TestStore{
+				TestAuthToken: auth.AuthToken{
+					Token:  auth.AuthTokenString("seekrit"),
+					Scope:  auth.ScopeFull,
+					UserId: auth.UserId(37),
+				},
+			}
+			s := Init(&TestAuth{}, &testStore, &TestEnv{env: tc.env}, &TestMail{}, TestConfig)
+
+			done := make(chan bool)
+			finish := make(chan bool)
+			go s.manageSockets(done, finish)
+
+			httpServer := httptest.NewServer(http.HandlerFunc(s.websocket))
+			defer httpServer.Close()
+			url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/?token=seekrit"
+
+			var conns []*websocket.Conn
+			for i := 0; i < 2; i++ {
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Fatalf("Expected connection %d to succeed: %+v", i, err)
+				}
+				conns = append(conns, conn)
+			}
+
+			// One too many
+			_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+			if err == nil {
+				t.Fatalf("Expected connection past the limit to fail")
+			}
+			if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("Expected connection past the limit to get %d, got %+v", http.StatusTooManyRequests, resp)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			expectErrorString(t, body, tc.expectedErrorString)
+
+			// Closing one makes room for another, once the server notices
+			conns[0].Close()
+			var conn *websocket.Conn
+			for i := 0; i < 50; i++ {
+				if conn, _, err = websocket.DefaultDialer.Dial(url, nil); err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("Expected a connection to succeed after closing one: %+v", err)
+			}
+			conns[0] = conn
+
+			for _, conn := range conns {
+				conn.Close()
+			}
+			finish <- true
+			<-done
+		})
+	}
+}
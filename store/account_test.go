@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	"github.com/mattn/go-sqlite3"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func expectAccountMatch(
@@ -27,14 +29,14 @@ func expectAccountMatch(
 	var salt auth.ServerSalt
 	var email auth.Email
 	var verifyExpiration *time.Time
-	var verifyTokenString *auth.VerifyTokenString
+	var verifyTokenHash *string
 	var created time.Time
 	var updated time.Time
 
 	err := s.db.QueryRow(
 		`SELECT key, server_salt, email, verify_token, verify_expiration, created, updated from accounts WHERE normalized_email=? AND client_salt_seed=?`,
 		normEmail, seed,
-	).Scan(&key, &salt, &email, &verifyTokenString, &verifyExpiration, &created, &updated)
+	).Scan(&key, &salt, &email, &verifyTokenHash, &verifyExpiration, &created, &updated)
 	if err != nil {
 		t.Fatalf("Error finding account for: %s %s - %+v", normEmail, password, err)
 	}
@@ -51,20 +53,21 @@ func expectAccountMatch(
 		t.Fatalf("Email case not as expected. Want: %s Got: %s", email, expectedEmail)
 	}
 
-	if (verifyTokenString == nil) != (expectedVerifyTokenString == nil) {
+	if (verifyTokenHash == nil) != (expectedVerifyTokenString == nil) {
 		t.Fatalf(
 			"Verify token string nil-ness not as expected. Want: %v Got: %v",
 			expectedVerifyTokenString == nil,
-			verifyTokenString == nil,
+			verifyTokenHash == nil,
 		)
 	}
 
+	// Stored hashed
 	if expectedVerifyTokenString != nil {
-		if *verifyTokenString != *expectedVerifyTokenString {
+		if *verifyTokenHash != hashVerifyToken(*expectedVerifyTokenString) {
 			t.Fatalf(
-				"Verify token string not as expected. Want: %s Got: %s",
+				"Verify token string not as expected. Want: hash of %s Got: %s",
 				*expectedVerifyTokenString,
-				*verifyTokenString,
+				*verifyTokenHash,
 			)
 		}
 	}
@@ -136,7 +139,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Create an account. Make it verified (i.e. no token) for the usual
 	// case. We'll test unverified (with token) separately.
-	if err := s.CreateAccount(email, password, seed, nil); err != nil {
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -147,7 +150,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Try to create a new account with the same email and different password,
 	// fail because email already exists
-	if err := s.CreateAccount(email, newPassword, seed, nil); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(context.Background(), email, newPassword, seed, nil); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -155,7 +158,7 @@ func TestStoreCreateAccount(t *testing.T) {
 
 	// Try to create a new account with the same email different capitalization.
 	// fail because email already exists
-	if err := s.CreateAccount(differentCaseEmail, password, seed, nil); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(context.Background(), differentCaseEmail, password, seed, nil); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err (for case insensitivity check): wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -163,6 +166,57 @@ func TestStoreCreateAccount(t *testing.T) {
 	expectAccountMatch(t, &s, normEmail, email, password, seed, nil, nil, time.Now().UTC(), time.Now().UTC())
 }
 
+func TestStoreCreateAccountInvalidEmail(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	password, seed := auth.Password("123"), auth.ClientSaltSeed("abcd1234abcd1234")
+
+	for _, email := range []auth.Email{"", "   ", "foo", "Joe <joe@example.com>", " joe@example.com"} {
+		if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != ErrInvalidEmail {
+			t.Errorf(`CreateAccount err for email "%s": wanted "%+v", got "%+v"`, email, ErrInvalidEmail, err)
+		}
+		if exists, err := s.EmailExists(context.Background(), email); err != nil || exists {
+			t.Errorf(`Expected no account for email "%s". err: %+v`, email, err)
+		}
+	}
+}
+
+// Passwords are stored as the output of a KDF with a per-account salt (see
+// auth.Password.Create), never as they are
+func TestStoreCreateAccountPasswordNotStored(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	email, normEmail := auth.Email("Abc@Example.Com"), auth.NormalizedEmail("abc@example.com")
+	password, seed := auth.Password("my-plaintext-password"), auth.ClientSaltSeed("abcd1234abcd1234")
+
+	expectPasswordNotStored := func(password auth.Password) {
+		var key, salt string
+		err := s.db.QueryRow("SELECT key, server_salt FROM accounts WHERE normalized_email=?", normEmail).Scan(&key, &salt)
+		if err != nil {
+			t.Fatalf("Error getting account: %+v", err)
+		}
+		if strings.Contains(key, string(password)) || strings.Contains(salt, string(password)) {
+			t.Fatalf("Expected the password not to be stored as is")
+		}
+		if _, err := s.GetUserId(context.Background(), email, password); err != nil {
+			t.Fatalf("Expected the password to still work: %+v", err)
+		}
+	}
+
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	expectPasswordNotStored(password)
+
+	newPassword := auth.Password("my-new-plaintext-password")
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, password, newPassword, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordNoWallet: %+v", err)
+	}
+	expectPasswordNotStored(newPassword)
+}
+
 // Test that I can use CreateAccount twice for different emails with no veriy token
 // This is related to https://github.com/lbryio/wallet-sync-server/issues/13
 func TestStoreCreateAccountTwoVerifiedSucceed(t *testing.T) {
@@ -178,11 +232,11 @@ func TestStoreCreateAccountTwoVerifiedSucceed(t *testing.T) {
 	// Create a couple accounts. Don't care if they have the same password.
 	// Make them verified (i.e. no token) for the usual
 	// case. We'll test unverified (with token) separately.
-	if err := s.CreateAccount(email1, password1, seed1, nil); err != nil {
+	if err := s.CreateAccount(context.Background(), email1, password1, seed1, nil); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
-	if err := s.CreateAccount(email2, password2, seed2, nil); err != nil {
+	if err := s.CreateAccount(context.Background(), email2, password2, seed2, nil); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -207,12 +261,12 @@ func TestStoreCreateAccountTwoSameVerfiyTokenFail(t *testing.T) {
 	verifyToken2 := auth.VerifyTokenString("00001234abcd1234abcd123400000000")
 
 	// Create the first account
-	if err := s.CreateAccount(email1, password1, seed1, &verifyToken1); err != nil {
+	if err := s.CreateAccount(context.Background(), email1, password1, seed1, &verifyToken1); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
 	// Try to create the second account with the same verify token, fail
-	if err := s.CreateAccount(email2, password2, seed2, &verifyToken1); err != ErrDuplicateAccount {
+	if err := s.CreateAccount(context.Background(), email2, password2, seed2, &verifyToken1); err != ErrDuplicateAccount {
 		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrDuplicateAccount, err)
 	}
 
@@ -220,7 +274,7 @@ func TestStoreCreateAccountTwoSameVerfiyTokenFail(t *testing.T) {
 	expectAccountNotExists(t, &s, normEmail2)
 
 	// Create the second account with a different verify token
-	if err := s.CreateAccount(email2, password2, seed2, &verifyToken2); err != nil {
+	if err := s.CreateAccount(context.Background(), email2, password2, seed2, &verifyToken2); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -240,7 +294,7 @@ func TestStoreCreateAccountUnverified(t *testing.T) {
 
 	// Create an account
 	verifyToken := auth.VerifyTokenString("abcd1234abcd1234abcd1234abcd1234")
-	if err := s.CreateAccount(email, password, seed, &verifyToken); err != nil {
+	if err := s.CreateAccount(context.Background(), email, password, seed, &verifyToken); err != nil {
 		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
 	}
 
@@ -256,7 +310,7 @@ func TestStoreGetUserIdAccountNotExists(t *testing.T) {
 
 	email, password := auth.Email("abc@example.com"), auth.Password("123")
 
-	if userId, err := s.GetUserId(email, password); err != ErrWrongCredentials || userId != 0 {
+	if userId, err := s.GetUserId(context.Background(), email, password); err != ErrWrongCredentials || userId != 0 {
 		t.Fatalf(`GetUserId error for nonexistant account: wanted "%+v", got "%+v. userId: %v"`, ErrWrongCredentials, err, userId)
 	}
 }
@@ -274,17 +328,17 @@ func TestStoreGetUserIdAccountExists(t *testing.T) {
 	upperEmail := auth.Email(strings.ToUpper(string(email)))
 
 	// Check that there's now a user id for the email and password
-	if userId, err := s.GetUserId(lowerEmail, password); err != nil || userId != createdUserId {
+	if userId, err := s.GetUserId(context.Background(), lowerEmail, password); err != nil || userId != createdUserId {
 		t.Fatalf("Unexpected error in GetUserId: err: %+v userId: %v", err, userId)
 	}
 
 	// Check that there's now a user id for the email and password
-	if userId, err := s.GetUserId(upperEmail, password); err != nil || userId != createdUserId {
+	if userId, err := s.GetUserId(context.Background(), upperEmail, password); err != nil || userId != createdUserId {
 		t.Fatalf("Unexpected error in GetUserId: err: %+v userId: %v", err, userId)
 	}
 
 	// Check that it won't return if the wrong password is given
-	if userId, err := s.GetUserId(email, password+auth.Password("_wrong")); err != ErrWrongCredentials || userId != 0 {
+	if userId, err := s.GetUserId(context.Background(), email, password+auth.Password("_wrong")); err != ErrWrongCredentials || userId != 0 {
 		t.Fatalf(`GetUserId error for wrong password: wanted "%+v", got "%+v. userId: %v"`, ErrWrongCredentials, err, userId)
 	}
 }
@@ -298,11 +352,165 @@ func TestStoreGetUserIdAccountUnverified(t *testing.T) {
 	_, email, password, _ := makeTestUser(t, &s, &verifyToken, &time.Time{})
 
 	// Check that it won't return if the account is unverified
-	if userId, err := s.GetUserId(email, password); err != ErrNotVerified || userId != 0 {
+	if userId, err := s.GetUserId(context.Background(), email, password); err != ErrNotVerified || userId != 0 {
 		t.Fatalf(`GetUserId error for unverified account: wanted "%+v", got "%+v. userId: %v"`, ErrNotVerified, err, userId)
 	}
 }
 
+// After enough failed logins in a row, even the right password is refused
+// until the lockout is over
+func TestStoreGetUserIdLockout(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.LoginLockoutThreshold = 3
+	clock := newTestClock()
+	s.Clock = clock
+
+	createdUserId, email, password, _ := makeTestUser(t, &s, nil, nil)
+	wrongPassword := password + auth.Password("_wrong")
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetUserId(context.Background(), email, wrongPassword); err != ErrWrongCredentials {
+			t.Fatalf(`GetUserId error for wrong password %d: wanted "%+v", got "%+v"`, i+1, ErrWrongCredentials, err)
+		}
+	}
+
+	if userId, err := s.GetUserId(context.Background(), email, password); err != ErrAccountLocked || userId != 0 {
+		t.Fatalf(`GetUserId error for locked account: wanted "%+v", got "%+v. userId: %v"`, ErrAccountLocked, err, userId)
+	}
+
+	var lockedUntil time.Time
+	if err := s.db.QueryRow("SELECT locked_until FROM accounts WHERE user_id=?", createdUserId).Scan(&lockedUntil); err != nil {
+		t.Fatalf("Error getting locked_until: %+v", err)
+	}
+	if expectedLockedUntil := clock.Now().Add(LoginLockoutDuration); !lockedUntil.Equal(expectedLockedUntil) {
+		t.Errorf("Expected locked_until to be %s, got %s", expectedLockedUntil, lockedUntil)
+	}
+
+	// Still locked until the very end
+	clock.advance(LoginLockoutDuration - time.Second)
+	if _, err := s.GetUserId(context.Background(), email, password); err != ErrAccountLocked {
+		t.Fatalf(`GetUserId error just before the lockout is over: wanted "%+v", got "%+v"`, ErrAccountLocked, err)
+	}
+
+	// The lockout is over
+	clock.advance(time.Second)
+	if userId, err := s.GetUserId(context.Background(), email, password); err != nil || userId != createdUserId {
+		t.Fatalf("Unexpected error in GetUserId after the lockout: err: %+v userId: %v", err, userId)
+	}
+}
+
+// A successful login starts the count of failed logins over
+func TestStoreGetUserIdLockoutResetOnSuccess(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.LoginLockoutThreshold = 3
+
+	createdUserId, email, password, _ := makeTestUser(t, &s, nil, nil)
+	wrongPassword := password + auth.Password("_wrong")
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			if _, err := s.GetUserId(context.Background(), email, wrongPassword); err != ErrWrongCredentials {
+				t.Fatalf(`GetUserId error for wrong password: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+			}
+		}
+		if userId, err := s.GetUserId(context.Background(), email, password); err != nil || userId != createdUserId {
+			t.Fatalf("Unexpected error in GetUserId: err: %+v userId: %v", err, userId)
+		}
+	}
+
+	var failedLoginCount int
+	if err := s.db.QueryRow("SELECT failed_login_count FROM accounts WHERE user_id=?", createdUserId).Scan(&failedLoginCount); err != nil || failedLoginCount != 0 {
+		t.Errorf("Expected failed_login_count to be reset: got %d err %+v", failedLoginCount, err)
+	}
+}
+
+// With no threshold set, there's no lockout however many logins fail
+func TestStoreGetUserIdNoLockout(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	createdUserId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	for i := 0; i < 10; i++ {
+		s.GetUserId(context.Background(), email, password+auth.Password("_wrong"))
+	}
+	if userId, err := s.GetUserId(context.Background(), email, password); err != nil || userId != createdUserId {
+		t.Fatalf("Unexpected error in GetUserId: err: %+v userId: %v", err, userId)
+	}
+}
+
+func expectPasswordCost(t *testing.T, s *Store, userId auth.UserId, expectedCost int) (key auth.KDFKey) {
+	t.Helper()
+	var cost int
+	if err := s.db.QueryRow("SELECT key, password_cost FROM accounts WHERE user_id=?", userId).Scan(&key, &cost); err != nil {
+		t.Fatalf("Error getting password cost: %+v", err)
+	}
+	if cost != expectedCost {
+		t.Fatalf("Expected password cost %d, got %d", expectedCost, cost)
+	}
+	return
+}
+
+// A key made with a lower cost than the configured one gets hashed again on
+// login, and the login still works
+func TestStoreGetUserIdUpgradesPasswordCost(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	createdUserId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	oldKey, oldSalt, err := password.CreateWithCost(10)
+	if err != nil {
+		t.Fatalf("Error creating password: %+v", err)
+	}
+	if _, err := s.db.Exec("UPDATE accounts SET key=?, server_salt=?, password_cost=10 WHERE user_id=?", oldKey, oldSalt, createdUserId); err != nil {
+		t.Fatalf("Error setting an outdated key: %+v", err)
+	}
+
+	if userId, err := s.GetUserId(context.Background(), email, password); err != nil || userId != createdUserId {
+		t.Fatalf("Unexpected error in GetUserId: err: %+v userId: %v", err, userId)
+	}
+
+	newKey := expectPasswordCost(t, &s, createdUserId, auth.DefaultPasswordCost)
+	if newKey == oldKey {
+		t.Errorf("Expected the key to be replaced")
+	}
+
+	// The new key works, and the wrong password still doesn't
+	if userId, err := s.GetUserId(context.Background(), email, password); err != nil || userId != createdUserId {
+		t.Fatalf("Unexpected error in GetUserId after the upgrade: err: %+v userId: %v", err, userId)
+	}
+	if _, err := s.GetUserId(context.Background(), email, password+auth.Password("_wrong")); err != ErrWrongCredentials {
+		t.Fatalf(`GetUserId error for wrong password: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
+// Lowering the configured cost only affects passwords set from then on
+func TestStorePasswordCostNoDowngrade(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.PasswordCost = 10
+
+	createdUserId, email, password, seed := makeTestUser(t, &s, nil, nil)
+
+	if _, err := s.GetUserId(context.Background(), email, password); err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	expectPasswordCost(t, &s, createdUserId, auth.DefaultPasswordCost)
+
+	newPassword := auth.Password("my-new-password")
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, password, newPassword, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordNoWallet: %+v", err)
+	}
+	expectPasswordCost(t, &s, createdUserId, 10)
+
+	if _, err := s.GetUserId(context.Background(), email, newPassword); err != nil {
+		t.Fatalf("Unexpected error in GetUserId with the new password: %+v", err)
+	}
+}
+
 func TestStoreAccountEmptyFields(t *testing.T) {
 	// Make sure expiration doesn't get set if sanitization fails
 	tt := []struct {
@@ -311,12 +519,8 @@ func TestStoreAccountEmptyFields(t *testing.T) {
 		clientSaltSeed auth.ClientSaltSeed
 		password       auth.Password
 	}{
-		{
-			name:           "missing email",
-			email:          "",
-			clientSaltSeed: "abcd1234abcd1234",
-			password:       "xyz",
-		},
+		// Not testing empty email because CreateAccount rejects it before it gets
+		// to the database. See TestStoreCreateAccountInvalidEmail.
 		{
 			name:           "missing client salt seed",
 			email:          "a@example.com",
@@ -334,7 +538,7 @@ func TestStoreAccountEmptyFields(t *testing.T) {
 
 			var sqliteErr sqlite3.Error
 
-			err := s.CreateAccount(tc.email, tc.password, tc.clientSaltSeed, nil)
+			err := s.CreateAccount(context.Background(), tc.email, tc.password, tc.clientSaltSeed, nil)
 			if errors.As(err, &sqliteErr) {
 				if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintCheck) {
 					return // We got the error we expected
@@ -357,10 +561,10 @@ func TestStoreGetClientSaltSeedAccountExists(t *testing.T) {
 	lowerEmail := auth.Email(strings.ToLower(string(email)))
 	upperEmail := auth.Email(strings.ToUpper(string(email)))
 
-	if seed, err := s.GetClientSaltSeed(lowerEmail); err != nil || seed != createdSeed {
+	if seed, err := s.GetClientSaltSeed(context.Background(), lowerEmail); err != nil || seed != createdSeed {
 		t.Fatalf("Unexpected error in GetClientSaltSeed: err: %+v seed: %v", err, seed)
 	}
-	if seed, err := s.GetClientSaltSeed(upperEmail); err != nil || seed != createdSeed {
+	if seed, err := s.GetClientSaltSeed(context.Background(), upperEmail); err != nil || seed != createdSeed {
 		t.Fatalf("Unexpected error in GetClientSaltSeed: err: %+v seed: %v", err, seed)
 	}
 }
@@ -372,11 +576,142 @@ func TestStoreGetClientSaltSeedAccountNotExists(t *testing.T) {
 
 	email := auth.Email("abc@example.com")
 
-	if seed, err := s.GetClientSaltSeed(email); err != ErrWrongCredentials || seed != "" {
+	if seed, err := s.GetClientSaltSeed(context.Background(), email); err != ErrWrongCredentials || seed != "" {
 		t.Fatalf(`GetClientSaltSeed error for nonexistant account: wanted "%+v", got "%+v. seed: %v"`, ErrWrongCredentials, err, seed)
 	}
 }
 
+func TestStoreEmailExists(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if exists, err := s.EmailExists(context.Background(), "abc@example.com"); err != nil || exists {
+		t.Fatalf("Expected email to not exist yet: err: %+v exists: %v", err, exists)
+	}
+
+	// An unverified account takes the email just the same
+	verifyToken := auth.VerifyTokenString("00000000000000000000000000000000")
+	verifyExpiration := time.Now().Add(time.Hour).UTC()
+	_, email, _, _ := makeTestUser(t, &s, &verifyToken, &verifyExpiration)
+
+	// Irrespective of the case of the characters in the email
+	upperEmail := auth.Email(strings.ToUpper(string(email)))
+	if exists, err := s.EmailExists(context.Background(), upperEmail); err != nil || !exists {
+		t.Fatalf("Expected email to exist: err: %+v exists: %v", err, exists)
+	}
+}
+
+func TestStoreGetEmail(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, createdEmail, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// makeTestUser signs up with a mixed case email, and that's what we get
+	// back, not the normalized one
+	if email, err := s.GetEmail(context.Background(), userId); err != nil || email != createdEmail {
+		t.Fatalf("Unexpected result from GetEmail: err: %+v email: %s", err, email)
+	}
+
+	if email, err := s.GetEmail(context.Background(), userId+1); err != ErrWrongCredentials || email != "" {
+		t.Fatalf(`GetEmail error for nonexistant account: wanted "%+v", got "%+v". email: %s`, ErrWrongCredentials, err, email)
+	}
+}
+
+func TestStoreGetAccountStatus(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	clock := newTestClock()
+	s.Clock = clock
+
+	if status, err := s.GetAccountStatus(context.Background(), "abc@example.com", wallet.DefaultAppId); err != ErrWrongCredentials || status != (AccountStatus{}) {
+		t.Fatalf(`GetAccountStatus error for nonexistant account: wanted "%+v", got "%+v". status: %+v`, ErrWrongCredentials, err, status)
+	}
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Irrespective of the case of the characters in the email
+	upperEmail := auth.Email(strings.ToUpper(string(email)))
+	if status, err := s.GetAccountStatus(context.Background(), upperEmail, wallet.DefaultAppId); err != nil || status != (AccountStatus{UserId: userId, Verified: true}) {
+		t.Fatalf("Expected a verified account with no wallet: status: %+v err: %+v", status, err)
+	}
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-1"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-2"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if status, err := s.GetAccountStatus(context.Background(), email, wallet.DefaultAppId); err != nil || status != (AccountStatus{UserId: userId, Verified: true, HasWallet: true, Sequence: 2}) {
+		t.Fatalf("Expected the wallet's sequence: status: %+v err: %+v", status, err)
+	}
+	// Another app's wallet is its own
+	if status, err := s.GetAccountStatus(context.Background(), email, wallet.AppId("other-app")); err != nil || status.HasWallet || status.Sequence != 0 {
+		t.Fatalf("Expected no wallet for the other app: status: %+v err: %+v", status, err)
+	}
+
+	if _, err := s.db.Exec("UPDATE accounts SET verify_token='abcd', locked_until=? WHERE user_id=?", clock.Now().Add(time.Minute).UTC(), userId); err != nil {
+		t.Fatalf("Error setting up unverified, locked account: %+v", err)
+	}
+	// Only locked if lockouts are on
+	if status, err := s.GetAccountStatus(context.Background(), email, wallet.DefaultAppId); err != nil || status.Verified || status.Locked {
+		t.Fatalf("Expected an unverified account, not locked: status: %+v err: %+v", status, err)
+	}
+	s.LoginLockoutThreshold = 3
+	if status, err := s.GetAccountStatus(context.Background(), email, wallet.DefaultAppId); err != nil || !status.Locked {
+		t.Fatalf("Expected a locked account: status: %+v err: %+v", status, err)
+	}
+	clock.advance(time.Minute)
+	if status, err := s.GetAccountStatus(context.Background(), email, wallet.DefaultAppId); err != nil || status.Locked {
+		t.Fatalf("Expected the lockout to be over: status: %+v err: %+v", status, err)
+	}
+}
+
+// Test registering, getting, and replacing a signing public key
+func TestStoreSigningPublicKey(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// None registered to start with
+	if publicKey, err := s.GetSigningPublicKey(context.Background(), email); err != nil || publicKey != "" {
+		t.Fatalf("Expected no signing public key yet: err: %+v publicKey: %v", err, publicKey)
+	}
+
+	publicKey1 := auth.SigningPublicKey("11111111111111111111111111111111")
+	publicKey2 := auth.SigningPublicKey("22222222222222222222222222222222")
+
+	if err := s.SetSigningPublicKey(context.Background(), userId, publicKey1); err != nil {
+		t.Fatalf("Unexpected error in SetSigningPublicKey: %+v", err)
+	}
+	// Irrespective of the case of the characters in the email
+	upperEmail := auth.Email(strings.ToUpper(string(email)))
+	if publicKey, err := s.GetSigningPublicKey(context.Background(), upperEmail); err != nil || publicKey != publicKey1 {
+		t.Fatalf("Unexpected result in GetSigningPublicKey: err: %+v publicKey: %v", err, publicKey)
+	}
+
+	if err := s.SetSigningPublicKey(context.Background(), userId, publicKey2); err != nil {
+		t.Fatalf("Unexpected error in SetSigningPublicKey: %+v", err)
+	}
+	if publicKey, err := s.GetSigningPublicKey(context.Background(), email); err != nil || publicKey != publicKey2 {
+		t.Fatalf("Unexpected result in GetSigningPublicKey: err: %+v publicKey: %v", err, publicKey)
+	}
+}
+
+// Test signing public key functions for a nonexisting account
+func TestStoreSigningPublicKeyAccountNotExists(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if publicKey, err := s.GetSigningPublicKey(context.Background(), "abc@example.com"); err != nil || publicKey != "" {
+		t.Fatalf("Expected no signing public key for nonexistant account: err: %+v publicKey: %v", err, publicKey)
+	}
+	if err := s.SetSigningPublicKey(context.Background(), 1, "11111111111111111111111111111111"); err != ErrWrongCredentials {
+		t.Fatalf(`SetSigningPublicKey error for nonexistant account: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
 // Test UpdateVerifyTokenString for existing account
 func TestUpdateVerifyTokenStringSuccess(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
@@ -399,12 +734,12 @@ func TestUpdateVerifyTokenStringSuccess(t *testing.T) {
 	verifyTokenString3 := auth.VerifyTokenString("ef095678ef095678ef095678ef095678")
 	approxVerifyExpiration := time.Now().Add(time.Hour * 24 * 2).UTC()
 
-	if err := s.UpdateVerifyTokenString(lowerEmail, verifyTokenString2); err != nil {
+	if err := s.UpdateVerifyTokenString(context.Background(), lowerEmail, verifyTokenString2); err != nil {
 		t.Fatalf("Unexpected error in UpdateVerifyTokenString: err: %+v", err)
 	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, &verifyTokenString2, &approxVerifyExpiration, time.Now().UTC(), time.Now().UTC())
 
-	if err := s.UpdateVerifyTokenString(upperEmail, verifyTokenString3); err != nil {
+	if err := s.UpdateVerifyTokenString(context.Background(), upperEmail, verifyTokenString3); err != nil {
 		t.Fatalf("Unexpected error in UpdateVerifyTokenString: err: %+v", err)
 	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, &verifyTokenString3, &approxVerifyExpiration, time.Now().UTC(), time.Now().UTC())
@@ -417,7 +752,7 @@ func TestStoreUpdateVerifyTokenStringAccountNotExists(t *testing.T) {
 
 	email := auth.Email("abc@example.com")
 
-	if err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrWrongCredentials {
+	if err := s.UpdateVerifyTokenString(context.Background(), email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrWrongCredentials {
 		t.Fatalf(`UpdateVerifyTokenString error for nonexistant account: wanted "%+v", got "%+v."`, ErrWrongCredentials, err)
 	}
 }
@@ -429,7 +764,7 @@ func TestStoreUpdateVerifyTokenStringAccountVerified(t *testing.T) {
 
 	_, email, _, _ := makeTestUser(t, &s, nil, nil)
 
-	if err := s.UpdateVerifyTokenString(email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
+	if err := s.UpdateVerifyTokenString(context.Background(), email, "abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
 		t.Fatalf(`UpdateVerifyTokenString error for already verified account: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 }
@@ -447,7 +782,7 @@ func TestUpdateVerifyAccountSuccess(t *testing.T) {
 	// we're not testing normalization features so we'll just use this here
 	normEmail := email.Normalize()
 
-	if err := s.VerifyAccount(verifyTokenString); err != nil {
+	if err := s.VerifyAccount(context.Background(), verifyTokenString); err != nil {
 		t.Fatalf("Unexpected error in VerifyAccount: err: %+v", err)
 	}
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
@@ -458,7 +793,7 @@ func TestStoreVerifyAccountTokenNotExists(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
 
-	if err := s.VerifyAccount("abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
+	if err := s.VerifyAccount(context.Background(), "abcd1234abcd1234abcd1234abcd1234"); err != ErrNoTokenForUser {
 		t.Fatalf(`VerifyAccount error for nonexistant token: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 }
@@ -476,9 +811,204 @@ func TestUpdateVerifyAccountTokenExpired(t *testing.T) {
 	// we're not testing normalization features so we'll just use this here
 	normEmail := email.Normalize()
 
-	if err := s.VerifyAccount(verifyTokenString); err != ErrNoTokenForUser {
+	if err := s.VerifyAccount(context.Background(), verifyTokenString); err != ErrNoTokenForUser {
 		t.Fatalf(`VerifyAccount error for expired token: wanted "%+v", got "%+v."`, ErrNoTokenForUser, err)
 	}
 
 	expectAccountMatch(t, &s, normEmail, email, password, createdSeed, &verifyTokenString, &verifyExpiration, time.Now().UTC(), time.Now().UTC())
 }
+
+// Weak passwords are only rejected when the check is turned on
+func TestStoreCreateAccountWeakPassword(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	email, normEmail := auth.Email("Abc@Example.Com"), auth.NormalizedEmail("abc@example.com")
+	password, seed := auth.Password("abc@example.com"), auth.ClientSaltSeed("abcd1234abcd1234")
+
+	s.WeakPasswordCheck = true
+
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != ErrWeakPassword {
+		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrWeakPassword, err)
+	}
+	expectAccountNotExists(t, &s, normEmail)
+
+	s.WeakPasswordCheck = false
+
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	expectAccountMatch(t, &s, normEmail, email, password, seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+}
+
+func TestStoreCreateAccountPasswordTooShort(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	email, normEmail := auth.Email("Abc@Example.Com"), auth.NormalizedEmail("abc@example.com")
+	seed := auth.ClientSaltSeed("abcd1234abcd1234")
+
+	s.PasswordMinLength = 12
+
+	if err := s.CreateAccount(context.Background(), email, auth.Password("12345678901"), seed, nil); err != ErrPasswordTooShort {
+		t.Fatalf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrPasswordTooShort, err)
+	}
+	expectAccountNotExists(t, &s, normEmail)
+
+	password := auth.Password("123456789012")
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	expectAccountMatch(t, &s, normEmail, email, password, seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+}
+
+func TestStoreDeleteAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, ""); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.UpdateDeviceSync(context.Background(), userId, auth.DeviceId("dId-1"), wallet.Sequence(1)); err != nil {
+		t.Fatalf("Unexpected error in UpdateDeviceSync: %+v", err)
+	}
+	if _, err := s.AddKnownDevice(context.Background(), userId, auth.DeviceId("dId-1")); err != nil {
+		t.Fatalf("Unexpected error in AddKnownDevice: %+v", err)
+	}
+	expiration := time.Now().Add(time.Hour).UTC()
+	for _, authToken := range []auth.AuthToken{
+		{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId},
+		{Token: "seekrit-2", DeviceId: "dId-2", Scope: "*", UserId: userId},
+	} {
+		if err := s.insertToken(context.Background(), &authToken, expiration); err != nil {
+			t.Fatalf("Unexpected error in insertToken: %+v", err)
+		}
+	}
+
+	// Someone else's account, to be left alone
+	otherEmail, otherPassword := auth.Email("other@example.com"), auth.Password("456")
+	if err := s.CreateAccount(context.Background(), otherEmail, otherPassword, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	otherUserId, err := s.GetUserId(context.Background(), otherEmail, otherPassword)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	otherToken := auth.AuthToken{Token: "seekrit-other", DeviceId: "dId-1", Scope: "*", UserId: otherUserId}
+	if err := s.insertToken(context.Background(), &otherToken, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	if err := s.DeleteAccount(context.Background(), userId); err != nil {
+		t.Fatalf("Unexpected error in DeleteAccount: %+v", err)
+	}
+
+	expectAccountNotExists(t, &s, email.Normalize())
+	expectWalletNotExists(t, &s, userId)
+	expectTokenNotExists(t, &s, "seekrit-1")
+	expectTokenNotExists(t, &s, "seekrit-2")
+	if deviceSyncs, err := s.GetDeviceSyncs(context.Background(), userId); err != nil || len(deviceSyncs) != 0 {
+		t.Errorf("Expected the device syncs to be gone: deviceSyncs: %+v err: %+v", deviceSyncs, err)
+	}
+	var numKnownDevices int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM known_devices WHERE user_id=?", userId).Scan(&numKnownDevices); err != nil || numKnownDevices != 0 {
+		t.Errorf("Expected the known devices to be gone: %d err: %+v", numKnownDevices, err)
+	}
+
+	if _, err := s.GetToken(context.Background(), otherToken.Token); err != nil {
+		t.Errorf("Expected the other account's token to stay, got %+v", err)
+	}
+
+	// Nothing left to delete
+	if err := s.DeleteAccount(context.Background(), userId); err != ErrWrongCredentials {
+		t.Errorf(`DeleteAccount err: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+}
+
+// If any part of the delete fails, nothing is deleted
+func TestStoreDeleteAccountRollback(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, seed := makeTestUser(t, &s, nil, nil)
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, ""); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId}
+	if err := s.SaveToken(context.Background(), &authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	// Fail on the last step, after the tokens and the wallet are deleted
+	_, err := s.db.Exec(`
+		CREATE TRIGGER fail_account_delete BEFORE DELETE ON accounts
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END;
+	`)
+	if err != nil {
+		t.Fatalf("Error creating trigger: %+v", err)
+	}
+
+	if err := s.DeleteAccount(context.Background(), userId); err == nil {
+		t.Fatalf("Expected DeleteAccount to fail")
+	}
+
+	expectAccountMatch(t, &s, email.Normalize(), email, password, seed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
+	expectTokenExists(t, &s, authToken)
+}
+
+// With DeletedEmailReservation set, the email can't sign up again until it's
+// over, however it's written
+func TestStoreDeleteAccountReservesEmail(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	clock := newTestClock()
+	s.Clock = clock
+	s.DeletedEmailReservation = time.Hour
+
+	userId, email, password, seed := makeTestUser(t, &s, nil, nil)
+	if err := s.DeleteAccount(context.Background(), userId); err != nil {
+		t.Fatalf("Unexpected error in DeleteAccount: %+v", err)
+	}
+
+	clock.advance(time.Minute * 59)
+
+	sameEmail := auth.Email(strings.ToUpper(string(email)))
+	if err := s.CreateAccount(context.Background(), sameEmail, password, seed, nil); err != ErrEmailReserved {
+		t.Errorf(`CreateAccount err: wanted "%+v", got "%+v"`, ErrEmailReserved, err)
+	}
+	expectAccountNotExists(t, &s, email.Normalize())
+	if exists, err := s.EmailExists(context.Background(), email); err != nil || !exists {
+		t.Errorf("Expected the reserved email to count as taken: exists %t err %+v", exists, err)
+	}
+
+	clock.advance(time.Minute)
+
+	if exists, err := s.EmailExists(context.Background(), email); err != nil || exists {
+		t.Errorf("Expected the email to be available after the reservation: exists %t err %+v", exists, err)
+	}
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Fatalf("Expected to sign up again after the reservation, got %+v", err)
+	}
+	var numReserved int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM reserved_emails").Scan(&numReserved); err != nil || numReserved != 0 {
+		t.Errorf("Expected the reservation to be aged out: %d err: %+v", numReserved, err)
+	}
+}
+
+// Off by default, so the email can sign up again right away
+func TestStoreDeleteAccountNoReservation(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, seed := makeTestUser(t, &s, nil, nil)
+	if err := s.DeleteAccount(context.Background(), userId); err != nil {
+		t.Fatalf("Unexpected error in DeleteAccount: %+v", err)
+	}
+
+	if err := s.CreateAccount(context.Background(), email, password, seed, nil); err != nil {
+		t.Errorf("Expected to sign up again right away, got %+v", err)
+	}
+}
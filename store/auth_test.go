@@ -1,7 +1,9 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
@@ -10,10 +12,11 @@ import (
 	"github.com/mattn/go-sqlite3"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func expectTokenExists(t *testing.T, s *Store, expectedToken auth.AuthToken) {
-	rows, err := s.db.Query("SELECT * FROM auth_tokens WHERE token=?", expectedToken.Token)
+	rows, err := s.db.Query("SELECT token, user_id, device_id, device_name, scope, expiration FROM auth_tokens WHERE token=?", expectedToken.Token)
 	if err != nil {
 		t.Fatalf("Error finding token for: %s - %+v", expectedToken.Token, err)
 	}
@@ -26,6 +29,7 @@ func expectTokenExists(t *testing.T, s *Store, expectedToken auth.AuthToken) {
 			&gotToken.Token,
 			&gotToken.UserId,
 			&gotToken.DeviceId,
+			&gotToken.DeviceName,
 			&gotToken.Scope,
 			&gotToken.Expiration,
 		)
@@ -44,7 +48,7 @@ func expectTokenExists(t *testing.T, s *Store, expectedToken auth.AuthToken) {
 }
 
 func expectTokenNotExists(t *testing.T, s *Store, token auth.AuthTokenString) {
-	rows, err := s.db.Query("SELECT * FROM auth_tokens WHERE token=?", token)
+	rows, err := s.db.Query("SELECT token, user_id, device_id, device_name, scope, expiration FROM auth_tokens WHERE token=?", token)
 	if err != nil {
 		t.Fatalf("Error finding (lack of) token for: %s - %+v", token, err)
 	}
@@ -57,6 +61,7 @@ func expectTokenNotExists(t *testing.T, s *Store, token auth.AuthTokenString) {
 			&gotToken.Token,
 			&gotToken.UserId,
 			&gotToken.DeviceId,
+			&gotToken.DeviceName,
 			&gotToken.Scope,
 			&gotToken.Expiration,
 		)
@@ -92,7 +97,7 @@ func TestStoreInsertToken(t *testing.T) {
 	expectTokenNotExists(t, &s, authToken1.Token)
 
 	// Put in a token
-	if err := s.insertToken(&authToken1, expiration); err != nil {
+	if err := s.insertToken(context.Background(), &authToken1, expiration); err != nil {
 		t.Fatalf("Unexpected error in insertToken: %+v", err)
 	}
 
@@ -107,7 +112,7 @@ func TestStoreInsertToken(t *testing.T) {
 	authToken2 := authToken1
 	authToken2.Token = "seekrit-2"
 
-	if err := s.insertToken(&authToken2, expiration); err != ErrDuplicateToken {
+	if err := s.insertToken(context.Background(), &authToken2, expiration); err != ErrDuplicateToken {
 		t.Fatalf(`insertToken err: wanted "%+v", got "%+v"`, ErrDuplicateToken, err)
 	}
 
@@ -138,7 +143,7 @@ func TestStoreUpdateToken(t *testing.T) {
 	expectTokenNotExists(t, &s, authTokenUpdate.Token)
 
 	// Try to update the token - fail because we don't have an entry there in the first place
-	if err := s.updateToken(&authTokenUpdate, expiration); err != ErrNoTokenForUserDevice {
+	if err := s.updateToken(context.Background(), &authTokenUpdate, expiration); err != ErrNoTokenForUserDevice {
 		t.Fatalf(`updateToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
 	}
 
@@ -150,12 +155,12 @@ func TestStoreUpdateToken(t *testing.T) {
 	authTokenInsert := authTokenUpdate
 	authTokenInsert.Token = "seekrit-insert"
 
-	if err := s.insertToken(&authTokenInsert, expiration); err != nil {
+	if err := s.insertToken(context.Background(), &authTokenInsert, expiration); err != nil {
 		t.Fatalf("Unexpected error in insertToken: %+v", err)
 	}
 
 	// Now successfully update token
-	if err := s.updateToken(&authTokenUpdate, expiration); err != nil {
+	if err := s.updateToken(context.Background(), &authTokenUpdate, expiration); err != nil {
 		t.Fatalf("Unexpected error in updateToken: %+v", err)
 	}
 
@@ -180,6 +185,8 @@ func TestStoreUpdateToken(t *testing.T) {
 func TestStoreSaveToken(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
+	clock := newTestClock()
+	s.Clock = clock
 
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
@@ -195,10 +202,10 @@ func TestStoreSaveToken(t *testing.T) {
 	authToken_d2_1 := authToken_d1_1
 	authToken_d2_1.Token = "seekrit-d2-1"
 
-	// Save, have error for lack of device ID. We don't care what kind of error,
-	// we just want to make sure Expiration doesn't get set.
-	if err := s.SaveToken(&authToken_d1_1); err == nil {
-		t.Fatalf("Expected SaveToken to have err")
+	// Save, have error for lack of device ID. Make sure Expiration doesn't get
+	// set.
+	if err := s.SaveToken(context.Background(), &authToken_d1_1); err != ErrUnsanitaryToken {
+		t.Fatalf(`SaveToken err: wanted "%+v", got "%+v"`, ErrUnsanitaryToken, err)
 	}
 	if authToken_d1_1.Expiration != nil {
 		t.Fatalf("Expected SaveToken to not set expiration on error")
@@ -213,10 +220,10 @@ func TestStoreSaveToken(t *testing.T) {
 	expectTokenNotExists(t, &s, authToken_d2_1.Token)
 
 	// Save Version 1 tokens for both devices
-	if err := s.SaveToken(&authToken_d1_1); err != nil {
+	if err := s.SaveToken(context.Background(), &authToken_d1_1); err != nil {
 		t.Fatalf("Unexpected error in SaveToken: %+v", err)
 	}
-	if err := s.SaveToken(&authToken_d2_1); err != nil {
+	if err := s.SaveToken(context.Background(), &authToken_d2_1); err != nil {
 		t.Fatalf("Unexpected error in SaveToken: %+v", err)
 	}
 
@@ -224,9 +231,8 @@ func TestStoreSaveToken(t *testing.T) {
 	if authToken_d1_1.Expiration == nil {
 		t.Fatalf("Expected SaveToken to set an Expiration")
 	}
-	nowDiff := authToken_d1_1.Expiration.Sub(time.Now().UTC())
-	if time.Hour*24*14+time.Minute < nowDiff || nowDiff < time.Hour*24*14-time.Minute {
-		t.Fatalf("Expected SaveToken to set a token Expiration 2 weeks in the future.")
+	if expectedExpiration := clock.Now().Add(AuthTokenLifespan); !authToken_d1_1.Expiration.Equal(expectedExpiration) {
+		t.Fatalf("Expected SaveToken to set a token Expiration 2 weeks in the future: expected %s got %s", expectedExpiration, authToken_d1_1.Expiration)
 	}
 
 	// Get and confirm the tokens we just put in
@@ -240,21 +246,23 @@ func TestStoreSaveToken(t *testing.T) {
 	authToken_d2_2 := authToken_d2_1
 	authToken_d2_2.Token = "seekrit-d2-2"
 
+	clock.advance(time.Minute)
+
 	// Save Version 2 tokens for both devices
-	if err := s.SaveToken(&authToken_d1_2); err != nil {
+	if err := s.SaveToken(context.Background(), &authToken_d1_2); err != nil {
 		t.Fatalf("Unexpected error in SaveToken: %+v", err)
 	}
-	if err := s.SaveToken(&authToken_d2_2); err != nil {
+	if err := s.SaveToken(context.Background(), &authToken_d2_2); err != nil {
 		t.Fatalf("Unexpected error in SaveToken: %+v", err)
 	}
 
-	// Check that the expiration of this new token is marginally later
+	// Check that the expiration of this new token is as much later as the clock
+	// moved
 	if authToken_d1_2.Expiration == nil {
 		t.Fatalf("Expected SaveToken to set an Expiration")
 	}
-	expDiff := authToken_d1_2.Expiration.Sub(*authToken_d1_1.Expiration)
-	if time.Second < expDiff || expDiff < 0 {
-		t.Fatalf("Expected new expiration to be slightly later than previous expiration. diff: %+v", expDiff)
+	if expDiff := authToken_d1_2.Expiration.Sub(*authToken_d1_1.Expiration); expDiff != time.Minute {
+		t.Fatalf("Expected new expiration to be a minute later than previous expiration. diff: %+v", expDiff)
 	}
 
 	// Get and confirm the tokens we just put in
@@ -266,10 +274,467 @@ func TestStoreSaveToken(t *testing.T) {
 	expectTokenNotExists(t, &s, authToken_d2_1.Token)
 }
 
+// A store with TokenExpirationDuration set issues and refreshes tokens for
+// that long instead of AuthTokenLifespan
+func TestStoreTokenExpirationDuration(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.TokenExpirationDuration = time.Hour * 24
+	clock := newTestClock()
+	s.Clock = clock
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId}
+	if err := s.SaveToken(context.Background(), &authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+	if expectedExpiration := clock.Now().Add(time.Hour * 24); !authToken.Expiration.Equal(expectedExpiration) {
+		t.Errorf("Expected expiration %s, got %s", expectedExpiration, authToken.Expiration)
+	}
+	expectTokenExists(t, &s, authToken)
+
+	clock.advance(time.Hour)
+	expiration, err := s.RefreshToken(context.Background(), authToken.Token)
+	if err != nil {
+		t.Fatalf("Unexpected error in RefreshToken: %+v", err)
+	}
+	if expectedExpiration := clock.Now().Add(time.Hour * 24); !expiration.Equal(expectedExpiration) {
+		t.Errorf("Expected expiration %s, got %s", expectedExpiration, expiration)
+	}
+}
+
+// A token is good right up until its expiration, and not after
+func TestStoreGetTokenExpiration(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	clock := newTestClock()
+	s.Clock = clock
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId}
+	if err := s.SaveToken(context.Background(), &authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	clock.advance(AuthTokenLifespan - time.Second)
+	gotToken, err := s.GetToken(context.Background(), authToken.Token)
+	if err != nil || gotToken.Expiration == nil || !gotToken.Expiration.Equal(*authToken.Expiration) {
+		t.Fatalf("Expected the token a second before it expires: token: %+v err: %+v", gotToken, err)
+	}
+
+	clock.advance(time.Second)
+	if _, err := s.GetToken(context.Background(), authToken.Token); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`GetToken err at expiration: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+}
+
+// Unlike GetToken, an expired token comes back, marked as expired
+func TestStoreGetTokenIncludingExpired(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	clock := newTestClock()
+	s.Clock = clock
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Never there
+	gotToken, expired, err := s.GetTokenIncludingExpired("seekrit-1")
+	if gotToken != nil || expired || err != ErrNoTokenForUserDevice {
+		t.Fatalf("Expected ErrNoTokenForUserDevice. token: %+v expired: %t err: %+v", gotToken, expired, err)
+	}
+
+	authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId}
+	if err := s.SaveToken(context.Background(), &authToken); err != nil {
+		t.Fatalf("Unexpected error in SaveToken: %+v", err)
+	}
+
+	clock.advance(AuthTokenLifespan - time.Second)
+	gotToken, expired, err = s.GetTokenIncludingExpired(authToken.Token)
+	if err != nil || expired || gotToken == nil || !reflect.DeepEqual(*gotToken, authToken) {
+		t.Fatalf("Expected the token, not expired: token: %+v expired: %t err: %+v", gotToken, expired, err)
+	}
+
+	clock.advance(time.Second)
+	gotToken, expired, err = s.GetTokenIncludingExpired(authToken.Token)
+	if err != nil || !expired || gotToken == nil || !reflect.DeepEqual(*gotToken, authToken) {
+		t.Fatalf("Expected the token, expired: token: %+v expired: %t err: %+v", gotToken, expired, err)
+	}
+
+	// GetToken still won't have it
+	if _, err := s.GetToken(context.Background(), authToken.Token); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`GetToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+}
+
+func TestStoreRefreshToken(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	clock := newTestClock()
+	s.Clock = clock
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	almostExpired := clock.Now().Add(time.Minute)
+	expired := clock.Now().Add(-time.Minute)
+	authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId, Expiration: &almostExpired}
+	expiredToken := auth.AuthToken{Token: "seekrit-2", DeviceId: "dId-2", Scope: "*", UserId: userId, Expiration: &expired}
+
+	if err := s.insertToken(context.Background(), &authToken, almostExpired); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+	if err := s.insertToken(context.Background(), &expiredToken, expired); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	// The same token, now good for as long as a new one would be
+	expiration, err := s.RefreshToken(context.Background(), authToken.Token)
+	if err != nil {
+		t.Fatalf("Unexpected error in RefreshToken: %+v", err)
+	}
+	if expectedExpiration := clock.Now().Add(AuthTokenLifespan); !expiration.Equal(expectedExpiration) {
+		t.Errorf("Expected expiration %s, got %s", expectedExpiration, expiration)
+	}
+	authToken.Expiration = &expiration
+	expectTokenExists(t, &s, authToken)
+
+	// Too late for this one
+	if _, err := s.RefreshToken(context.Background(), expiredToken.Token); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`RefreshToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+	expectTokenExists(t, &s, expiredToken)
+
+	if _, err := s.RefreshToken(context.Background(), "seekrit-nonexistent"); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`RefreshToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+}
+
+// Logging out one device leaves the user's other devices logged in
+// The device name is saved with the token, replaced along with it, and may be
+// empty
+func TestStoreSaveTokenDeviceName(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	tokens := []auth.AuthToken{
+		// insertToken
+		{Token: "seekrit-1", DeviceId: "dId", DeviceName: "work laptop", Scope: "*", UserId: userId},
+		// updateToken, new name
+		{Token: "seekrit-2", DeviceId: "dId", DeviceName: "Pixel 7", Scope: "*", UserId: userId},
+		// updateToken, no name
+		{Token: "seekrit-3", DeviceId: "dId", DeviceName: "", Scope: "*", UserId: userId},
+	}
+	for _, authToken := range tokens {
+		if err := s.SaveToken(context.Background(), &authToken); err != nil {
+			t.Fatalf("Unexpected error in SaveToken: %+v", err)
+		}
+		gotToken, err := s.GetToken(context.Background(), authToken.Token)
+		if err != nil {
+			t.Fatalf("Unexpected error in GetToken: %+v", err)
+		}
+		if gotToken.DeviceName != authToken.DeviceName {
+			t.Errorf("Expected device name %q, got %q", authToken.DeviceName, gotToken.DeviceName)
+		}
+	}
+}
+
+func TestStoreGetTokensForUser(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// No devices yet
+	tokens, err := s.GetTokensForUser(context.Background(), userId, 0, 0)
+	if err != nil || tokens == nil || len(tokens) != 0 {
+		t.Fatalf("Expected an empty list of tokens: tokens: %+v err: %+v", tokens, err)
+	}
+
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+	authToken_d2 := auth.AuthToken{Token: "seekrit-d2", DeviceId: "dId-2", Scope: auth.ScopeGetWallet, UserId: userId}
+	authToken_d1 := auth.AuthToken{Token: "seekrit-d1", DeviceId: "dId-1", DeviceName: "Pixel 7", Scope: auth.ScopeFull, UserId: userId}
+	authToken_expired := auth.AuthToken{Token: "seekrit-d3", DeviceId: "dId-3", Scope: auth.ScopeFull, UserId: userId}
+	if err := s.insertToken(context.Background(), &authToken_d2, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+	if err := s.insertToken(context.Background(), &authToken_d1, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+	if err := s.insertToken(context.Background(), &authToken_expired, time.Now().Add(-time.Second).UTC()); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	// Someone else's device, not to be included
+	otherEmail, otherPassword := auth.Email("other@example.com"), auth.Password("456")
+	if err := s.CreateAccount(context.Background(), otherEmail, otherPassword, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	otherUserId, err := s.GetUserId(context.Background(), otherEmail, otherPassword)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	authToken_other := auth.AuthToken{Token: "seekrit-other", DeviceId: "dId-1", Scope: auth.ScopeFull, UserId: otherUserId}
+	if err := s.insertToken(context.Background(), &authToken_other, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	tokens, err = s.GetTokensForUser(context.Background(), userId, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetTokensForUser: %+v", err)
+	}
+
+	// Ordered by device id, without the token strings or the expired one
+	expectedTokens := []auth.AuthToken{authToken_d1, authToken_d2}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatalf("Expected %d tokens, got %+v", len(expectedTokens), tokens)
+	}
+	for i, expectedToken := range expectedTokens {
+		expectedToken.Token = ""
+		gotToken := tokens[i]
+		if gotToken.Expiration == nil || !gotToken.Expiration.Equal(expiration) {
+			t.Errorf("Expected token %d expiration %v, got %v", i, expiration, gotToken.Expiration)
+		}
+		gotToken.Expiration = nil
+		if gotToken != expectedToken {
+			t.Errorf("Expected token %d to be %+v, got %+v", i, expectedToken, gotToken)
+		}
+	}
+}
+
+func TestStoreGetTokensForUserPages(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+	for _, deviceId := range []auth.DeviceId{"dId-3", "dId-1", "dId-5", "dId-2", "dId-4"} {
+		authToken := auth.AuthToken{Token: auth.AuthTokenString("seekrit-" + deviceId), DeviceId: deviceId, Scope: auth.ScopeFull, UserId: userId}
+		if err := s.insertToken(context.Background(), &authToken, expiration); err != nil {
+			t.Fatalf("Unexpected error in insertToken: %+v", err)
+		}
+	}
+
+	tt := []struct {
+		name   string
+		limit  int
+		offset int
+
+		expectedDeviceIds []auth.DeviceId
+	}{
+		{
+			name:              "first page",
+			limit:             2,
+			expectedDeviceIds: []auth.DeviceId{"dId-1", "dId-2"},
+		}, {
+			name:              "middle page",
+			limit:             2,
+			offset:            2,
+			expectedDeviceIds: []auth.DeviceId{"dId-3", "dId-4"},
+		}, {
+			name:              "last page, not full",
+			limit:             2,
+			offset:            4,
+			expectedDeviceIds: []auth.DeviceId{"dId-5"},
+		}, {
+			name:              "beyond the end",
+			limit:             2,
+			offset:            6,
+			expectedDeviceIds: []auth.DeviceId{},
+		}, {
+			name:              "no limit",
+			offset:            3,
+			expectedDeviceIds: []auth.DeviceId{"dId-4", "dId-5"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := s.GetTokensForUser(context.Background(), userId, tc.limit, tc.offset)
+			if err != nil || tokens == nil {
+				t.Fatalf("Unexpected error in GetTokensForUser: tokens: %+v err: %+v", tokens, err)
+			}
+			deviceIds := []auth.DeviceId{}
+			for _, token := range tokens {
+				deviceIds = append(deviceIds, token.DeviceId)
+			}
+			if !reflect.DeepEqual(deviceIds, tc.expectedDeviceIds) {
+				t.Errorf("Expected devices %v, got %v", tc.expectedDeviceIds, deviceIds)
+			}
+		})
+	}
+}
+
+func TestStoreDeleteToken(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+
+	authToken1 := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId, Expiration: &expiration}
+	authToken2 := auth.AuthToken{Token: "seekrit-2", DeviceId: "dId-2", Scope: "*", UserId: userId, Expiration: &expiration}
+
+	if err := s.insertToken(context.Background(), &authToken1, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+	if err := s.insertToken(context.Background(), &authToken2, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	if err := s.DeleteToken(context.Background(), userId, "dId-1"); err != nil {
+		t.Fatalf("Unexpected error in DeleteToken: %+v", err)
+	}
+	expectTokenNotExists(t, &s, authToken1.Token)
+	expectTokenExists(t, &s, authToken2)
+
+	// Already gone
+	if err := s.DeleteToken(context.Background(), userId, "dId-1"); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`DeleteToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+
+	// Right device id, wrong user
+	if err := s.DeleteToken(context.Background(), userId+1, "dId-2"); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`DeleteToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+	expectTokenExists(t, &s, authToken2)
+}
+
+func TestStoreDeleteAllTokens(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+
+	for i := 1; i <= 2; i++ {
+		authToken := auth.AuthToken{Token: auth.AuthTokenString(fmt.Sprintf("seekrit-%d", i)), DeviceId: auth.DeviceId(fmt.Sprintf("dId-%d", i)), Scope: "*", UserId: userId}
+		if err := s.insertToken(context.Background(), &authToken, expiration); err != nil {
+			t.Fatalf("Unexpected error in insertToken: %+v", err)
+		}
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	numDeleted, err := s.DeleteAllTokens(context.Background(), userId)
+	if err != nil || numDeleted != 2 {
+		t.Fatalf("Expected 2 tokens deleted, got %d err: %+v", numDeleted, err)
+	}
+	expectTokenNotExists(t, &s, "seekrit-1")
+	expectTokenNotExists(t, &s, "seekrit-2")
+
+	// The wallet and the account are still there
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
+	if exists, err := s.EmailExists(context.Background(), email); err != nil || !exists {
+		t.Errorf("Expected the account to still exist. err: %+v", err)
+	}
+
+	// Nothing left to delete. Not an error.
+	numDeleted, err = s.DeleteAllTokens(context.Background(), userId)
+	if err != nil || numDeleted != 0 {
+		t.Fatalf("Expected 0 tokens deleted, got %d err: %+v", numDeleted, err)
+	}
+}
+
+// Expired tokens get deleted, and nothing else does
+func TestStorePurgeExpiredTokens(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expired1 := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId}
+	expired2 := auth.AuthToken{Token: "seekrit-2", DeviceId: "dId-2", Scope: "*", UserId: userId}
+	current := auth.AuthToken{Token: "seekrit-3", DeviceId: "dId-3", Scope: "*", UserId: userId}
+
+	past, future := time.Now().Add(-time.Minute).UTC(), time.Now().Add(time.Hour).UTC()
+	for _, token := range []struct {
+		authToken  auth.AuthToken
+		expiration time.Time
+	}{{expired1, past}, {expired2, past}, {current, future}} {
+		if err := s.insertToken(context.Background(), &token.authToken, token.expiration); err != nil {
+			t.Fatalf("Unexpected error in insertToken: %+v", err)
+		}
+	}
+	current.Expiration = &future
+
+	numDeleted, err := s.PurgeExpiredTokens(context.Background())
+	if err != nil || numDeleted != 2 {
+		t.Fatalf("Expected 2 tokens purged, got %d err: %+v", numDeleted, err)
+	}
+	expectTokenNotExists(t, &s, expired1.Token)
+	expectTokenNotExists(t, &s, expired2.Token)
+	expectTokenExists(t, &s, current)
+
+	// Nothing left to purge. Not an error.
+	numDeleted, err = s.PurgeExpiredTokens(context.Background())
+	if err != nil || numDeleted != 0 {
+		t.Fatalf("Expected 0 tokens purged, got %d err: %+v", numDeleted, err)
+	}
+}
+
 // test GetToken using insertToken and updateToken as helpers (so we can set expiration timestamps)
 // normal
 // token not found
 // expired not returned
+// Move a token to a new device id, succeed
+// Move a token to a device id the user already has a token for, fail
+// Move a token from a device id the user has no token for, fail
+func TestStoreUpdateTokenDeviceId(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	expiration := time.Now().Add(time.Hour * 24 * 14).UTC()
+
+	authToken1 := auth.AuthToken{Token: "seekrit-1", DeviceId: "dId-1", Scope: "*", UserId: userId, Expiration: &expiration}
+	authToken2 := auth.AuthToken{Token: "seekrit-2", DeviceId: "dId-2", Scope: "*", UserId: userId, Expiration: &expiration}
+
+	if err := s.insertToken(context.Background(), &authToken1, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+	if err := s.insertToken(context.Background(), &authToken2, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	// Move the first token to a new device id. It keeps the same token string,
+	// scope and expiration.
+	if err := s.UpdateTokenDeviceId(context.Background(), userId, "dId-1", "dId-3"); err != nil {
+		t.Fatalf("Unexpected error in UpdateTokenDeviceId: %+v", err)
+	}
+	authToken1.DeviceId = "dId-3"
+	expectTokenExists(t, &s, authToken1)
+
+	// Try to move it onto the device id of the second token. Fail, and leave
+	// both tokens alone.
+	if err := s.UpdateTokenDeviceId(context.Background(), userId, "dId-3", "dId-2"); err != ErrDuplicateToken {
+		t.Fatalf(`UpdateTokenDeviceId err: wanted "%+v", got "%+v"`, ErrDuplicateToken, err)
+	}
+	expectTokenExists(t, &s, authToken1)
+	expectTokenExists(t, &s, authToken2)
+
+	// Try to move from the device id it was just moved away from. Fail, since
+	// there's nothing there anymore.
+	if err := s.UpdateTokenDeviceId(context.Background(), userId, "dId-1", "dId-4"); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`UpdateTokenDeviceId err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+
+	// Try to move a token for the right device id but the wrong user. Fail.
+	if err := s.UpdateTokenDeviceId(context.Background(), userId+1, "dId-3", "dId-4"); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`UpdateTokenDeviceId err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+	expectTokenExists(t, &s, authToken1)
+
+	// Try to move it to a device id that isn't valid. Fail.
+	if err := s.UpdateTokenDeviceId(context.Background(), userId, "dId-3", "dId\n4"); err != ErrInvalidDeviceId {
+		t.Fatalf(`UpdateTokenDeviceId err: wanted "%+v", got "%+v"`, ErrInvalidDeviceId, err)
+	}
+	expectTokenExists(t, &s, authToken1)
+}
+
 func TestStoreGetToken(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
@@ -286,13 +751,13 @@ func TestStoreGetToken(t *testing.T) {
 	expiration := time.Time(time.Now().UTC().Add(time.Hour * 24 * 14))
 
 	// Not found (nothing saved for this token string)
-	gotToken, err := s.GetToken(authToken.Token)
+	gotToken, err := s.GetToken(context.Background(), authToken.Token)
 	if gotToken != nil || err != ErrNoTokenForUserDevice {
 		t.Fatalf("Expected ErrNoTokenForUserDevice. token: %+v err: %+v", gotToken, err)
 	}
 
 	// Put in a token
-	if err := s.insertToken(&authToken, expiration); err != nil {
+	if err := s.insertToken(context.Background(), &authToken, expiration); err != nil {
 		t.Fatalf("Unexpected error in insertToken: %+v", err)
 	}
 
@@ -301,7 +766,7 @@ func TestStoreGetToken(t *testing.T) {
 	authTokenExpected.Expiration = &expiration
 
 	// Confirm it saved
-	gotToken, err = s.GetToken(authToken.Token)
+	gotToken, err = s.GetToken(context.Background(), authToken.Token)
 	if err != nil {
 		t.Fatalf("Unexpected error in GetToken: %+v", err)
 	}
@@ -311,12 +776,12 @@ func TestStoreGetToken(t *testing.T) {
 
 	// Update the token to be expired
 	expirationOld := time.Now().Add(time.Second * (-1)).UTC()
-	if err := s.updateToken(&authToken, expirationOld); err != nil {
+	if err := s.updateToken(context.Background(), &authToken, expirationOld); err != nil {
 		t.Fatalf("Unexpected error in updateToken: %+v", err)
 	}
 
 	// Fail to get the expired token
-	gotToken, err = s.GetToken(authToken.Token)
+	gotToken, err = s.GetToken(context.Background(), authToken.Token)
 	if gotToken != nil || err != ErrNoTokenForUserDevice {
 		t.Fatalf("Expected ErrNoTokenForUserDevice, for expired token. token: %+v err: %+v", gotToken, err)
 	}
@@ -336,7 +801,7 @@ func TestStoreTokenUTC(t *testing.T) {
 		UserId:   userId,
 	}
 
-	if err := s.SaveToken(&authToken); err != nil {
+	if err := s.SaveToken(context.Background(), &authToken); err != nil {
 		t.Fatalf("Unexpected error in SaveToken: %+v", err)
 	}
 
@@ -364,6 +829,142 @@ func TestStoreTokenUTC(t *testing.T) {
 	}
 }
 
+// Expirations should be stored in UTC and compared correctly even if the
+// process's local time zone isn't UTC, and even if the expiration we're given
+// isn't in UTC
+func TestStoreTokenLocalTimeZone(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	origLocal := time.Local
+	time.Local = time.FixedZone("UTC+10", 10*60*60)
+	defer func() { time.Local = origLocal }()
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	authToken := auth.AuthToken{
+		Token:    "seekrit-1",
+		DeviceId: "dId",
+		Scope:    "*",
+		UserId:   userId,
+	}
+
+	// An hour from now, but in local time
+	expiration := time.Now().Add(time.Hour).Local().Truncate(time.Microsecond)
+	if err := s.insertToken(context.Background(), &authToken, expiration); err != nil {
+		t.Fatalf("Unexpected error in insertToken: %+v", err)
+	}
+
+	var expirationString string
+	if err := s.db.QueryRow("SELECT expiration FROM auth_tokens").Scan(&expirationString); err != nil {
+		t.Fatalf("Unexpected error getting expiration from db: %+v", err)
+	}
+	if !strings.HasSuffix(expirationString, "Z") {
+		t.Fatalf("Expected expiration timezone to be UTC (+00:00). Got %s", expirationString)
+	}
+
+	gotToken, err := s.GetToken(context.Background(), authToken.Token)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetToken: %+v", err)
+	}
+	if gotToken.Expiration.Location() != time.UTC || !gotToken.Expiration.Equal(expiration.UTC()) {
+		t.Fatalf("Expected expiration %v in UTC, got %v", expiration.UTC(), gotToken.Expiration)
+	}
+
+	// Now an hour ago, in local time, via updateToken. Stored as given, the
+	// "+10:00" string would still sort after GetToken's UTC cutoff, so it would
+	// look like it hadn't expired.
+	if err := s.updateToken(context.Background(), &authToken, time.Now().Add(-time.Hour).Local()); err != nil {
+		t.Fatalf("Unexpected error in updateToken: %+v", err)
+	}
+	if _, err := s.GetToken(context.Background(), authToken.Token); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`GetToken err for expired token: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+}
+
+// SaveToken should turn down a token missing any of its identifying fields
+// before working out an expiration, and leave nothing behind in the DB
+func TestStoreSaveTokenEmptyFields(t *testing.T) {
+	tt := []struct {
+		name       string
+		authToken  auth.AuthToken
+		omitUserId bool
+	}{
+		{
+			name:      "missing token",
+			authToken: auth.AuthToken{Token: "", DeviceId: "dId", Scope: "*"},
+		}, {
+			name:      "missing device id",
+			authToken: auth.AuthToken{Token: "seekrit-1", DeviceId: "", Scope: "*"},
+		}, {
+			name:       "missing user id",
+			authToken:  auth.AuthToken{Token: "seekrit-1", DeviceId: "dId", Scope: "*"},
+			omitUserId: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+
+			userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+			if !tc.omitUserId {
+				tc.authToken.UserId = userId
+			}
+
+			if err := s.SaveToken(context.Background(), &tc.authToken); err != ErrUnsanitaryToken {
+				t.Fatalf(`SaveToken err: wanted "%+v", got "%+v"`, ErrUnsanitaryToken, err)
+			}
+			if tc.authToken.Expiration != nil {
+				t.Errorf("Expected SaveToken to not set expiration on error")
+			}
+
+			var count int
+			if err := s.db.QueryRow("SELECT COUNT(*) FROM auth_tokens").Scan(&count); err != nil {
+				t.Fatalf("Error counting tokens: %+v", err)
+			}
+			if count != 0 {
+				t.Errorf("Expected no tokens in the DB, got %d", count)
+			}
+		})
+	}
+}
+
+// Device ids that auth.DeviceId.Validate turns down don't get saved either
+func TestStoreSaveTokenInvalidDeviceId(t *testing.T) {
+	tt := []struct {
+		name     string
+		deviceId auth.DeviceId
+	}{
+		{"overlong", auth.DeviceId(strings.Repeat("d", 129))},
+		{"control character", "dId\x00"},
+		{"not normalized", " dId"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+
+			userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+			authToken := auth.AuthToken{Token: "seekrit-1", DeviceId: tc.deviceId, Scope: "*", UserId: userId}
+
+			if err := s.SaveToken(context.Background(), &authToken); err != ErrInvalidDeviceId {
+				t.Fatalf(`SaveToken err: wanted "%+v", got "%+v"`, ErrInvalidDeviceId, err)
+			}
+
+			var count int
+			if err := s.db.QueryRow("SELECT COUNT(*) FROM auth_tokens").Scan(&count); err != nil {
+				t.Fatalf("Error counting tokens: %+v", err)
+			}
+			if count != 0 {
+				t.Errorf("Expected no tokens in the DB, got %d", count)
+			}
+		})
+	}
+}
+
 func TestStoreTokenEmptyFields(t *testing.T) {
 	tt := []struct {
 		name       string
@@ -398,7 +999,7 @@ func TestStoreTokenEmptyFields(t *testing.T) {
 
 			var sqliteErr sqlite3.Error
 
-			err := s.insertToken(&tc.authToken, tc.expiration)
+			err := s.insertToken(context.Background(), &tc.authToken, tc.expiration)
 			if errors.As(err, &sqliteErr) {
 				if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintCheck) {
 					return // We got the error we expected
@@ -0,0 +1,393 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blob"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Wraps a store, keeping encrypted wallets in a blob store (S3 and such)
+// instead of the database. The database still has everything else about the
+// wallet (sequence, hmac, etc) and is still what decides whether an update
+// goes through. In place of the encrypted wallet it just has a reference to
+// the object:
+//
+//	blob:<size in bytes>:<object key>
+//
+// which can't be mistaken for an actual encrypted wallet since those are
+// base64 and don't have colons. Wallets saved before switching to a blob
+// store are left as they are, and returned as they are.
+//
+// Every update gets a new object, written before the database is updated. If
+// the database update then fails (wrong sequence, etc), we delete the new
+// object. If it succeeds, we delete the object it replaced. Either delete can
+// fail, or the server can go down in between, which leaves an orphaned
+// object, but never a wallet that refers to a missing object.
+type BlobWalletStore struct {
+	StoreInterface
+	Blobs blob.BlobStore
+}
+
+const blobReferencePrefix = "blob:"
+
+func blobReference(key string, size int) wallet.EncryptedWallet {
+	return wallet.EncryptedWallet(fmt.Sprintf("%s%d:%s", blobReferencePrefix, size, key))
+}
+
+// Returns ok == false if it's an actual encrypted wallet rather than a
+// reference to one
+func parseBlobReference(encryptedWallet wallet.EncryptedWallet) (key string, size int, ok bool) {
+	if !strings.HasPrefix(string(encryptedWallet), blobReferencePrefix) {
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(string(encryptedWallet), blobReferencePrefix), ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	size, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	return parts[1], size, true
+}
+
+func newBlobKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "wallets/" + hex.EncodeToString(b), nil
+}
+
+// Write the encrypted wallet to a new object, returning the reference to save
+// in the database.
+func (s *BlobWalletStore) putWallet(encryptedWallet wallet.EncryptedWallet) (key string, reference wallet.EncryptedWallet, err error) {
+	key, err = newBlobKey()
+	if err != nil {
+		return
+	}
+	if err = s.Blobs.Put(key, []byte(encryptedWallet)); err != nil {
+		return
+	}
+	return key, blobReference(key, len(encryptedWallet)), nil
+}
+
+// Failing to delete just leaves an orphaned object, which is not worth failing
+// the request over.
+func (s *BlobWalletStore) deleteBlob(key string) {
+	if err := s.Blobs.Delete(key); err != nil {
+		log.Printf("Error deleting wallet blob %s, leaving it orphaned: %+v", key, err)
+	}
+}
+
+// The object key of the user's current wallet for the app, if it's in the
+// blob store and has the given sequence. That's the wallet an update to
+// sequence + 1 would replace.
+func (s *BlobWalletStore) currentBlobKey(ctx context.Context, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (key string, ok bool) {
+	reference, currentSequence, _, _, err := s.StoreInterface.GetWallet(ctx, userId, appId)
+	if err != nil || currentSequence != sequence {
+		return
+	}
+	key, _, ok = parseBlobReference(reference)
+	return
+}
+
+func (s *BlobWalletStore) SetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (err error) {
+	// If what we see now is at sequence - 1 and the update goes through, this is
+	// what it replaced; sequences never go back down.
+	previousKey, hasPrevious := s.currentBlobKey(ctx, userId, appId, sequence-1)
+
+	key, reference, err := s.putWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+
+	err = s.StoreInterface.SetWallet(ctx, userId, appId, reference, sequence, hmac, parentHmac, encryptionVersion)
+	if err != nil {
+		s.deleteBlob(key)
+		return
+	}
+	if hasPrevious {
+		s.deleteBlob(previousKey)
+	}
+	return
+}
+
+// Same as SetWallet, except that the new object also goes if the wallet
+// didn't go through, and the latest wallet's object has to be gotten.
+func (s *BlobWalletStore) SyncWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (applied bool, latest *WalletUpdate, err error) {
+	previousKey, hasPrevious := s.currentBlobKey(ctx, userId, appId, sequence-1)
+
+	key, reference, err := s.putWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+
+	applied, latest, err = s.StoreInterface.SyncWallet(ctx, userId, appId, reference, sequence, hmac, parentHmac, encryptionVersion)
+	if err != nil || !applied {
+		s.deleteBlob(key)
+	}
+	if err != nil {
+		return
+	}
+	if applied {
+		if hasPrevious {
+			s.deleteBlob(previousKey)
+		}
+		// No need to get back what we just put
+		latest.EncryptedWallet = encryptedWallet
+		return
+	}
+	if latest != nil {
+		latest.EncryptedWallet, err = s.getBlobWallet(latest.EncryptedWallet)
+		if err != nil {
+			applied, latest = false, nil
+		}
+	}
+	return
+}
+
+// There are no wallets yet if this goes through, so nothing to replace
+func (s *BlobWalletStore) ImportWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, appWallets []AppWalletUpdate) (err error) {
+	key, reference, err := s.putWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+	appKeys, appReferences, err := s.putAppWallets(appWallets)
+	if err != nil {
+		s.deleteBlob(key)
+		return
+	}
+
+	err = s.StoreInterface.ImportWallet(ctx, userId, appId, reference, sequence, hmac, encryptionVersion, appReferences)
+	if err != nil {
+		s.deleteBlob(key)
+		for _, appKey := range appKeys {
+			s.deleteBlob(appKey)
+		}
+	}
+	return
+}
+
+func (s *BlobWalletStore) SetWalletBatch(ctx context.Context, userId auth.UserId, appId wallet.AppId, updates []WalletUpdate, parentHmac *wallet.WalletHmac) (err error) {
+	if len(updates) == 0 {
+		return s.StoreInterface.SetWalletBatch(ctx, userId, appId, updates, parentHmac)
+	}
+	previousKey, hasPrevious := s.currentBlobKey(ctx, userId, appId, updates[0].Sequence-1)
+
+	var keys []string
+	defer func() {
+		if err != nil {
+			for _, key := range keys {
+				s.deleteBlob(key)
+			}
+		}
+	}()
+
+	referenceUpdates := make([]WalletUpdate, len(updates))
+	for i, update := range updates {
+		var key string
+		key, referenceUpdates[i].EncryptedWallet, err = s.putWallet(update.EncryptedWallet)
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+		referenceUpdates[i].Sequence = update.Sequence
+		referenceUpdates[i].Hmac = update.Hmac
+		referenceUpdates[i].EncryptionVersion = update.EncryptionVersion
+	}
+
+	err = s.StoreInterface.SetWalletBatch(ctx, userId, appId, referenceUpdates, parentHmac)
+	if err != nil {
+		return
+	}
+
+	// Only the last one is current now. The rest were replaced in the same
+	// transaction they were saved in.
+	for _, key := range keys[:len(keys)-1] {
+		s.deleteBlob(key)
+	}
+	if hasPrevious {
+		s.deleteBlob(previousKey)
+	}
+	return
+}
+
+func (s *BlobWalletStore) GetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, err error) {
+	encryptedWallet, sequence, hmac, encryptionVersion, err = s.StoreInterface.GetWallet(ctx, userId, appId)
+	if err != nil {
+		return
+	}
+	encryptedWallet, err = s.getBlobWallet(encryptedWallet)
+	return
+}
+
+// The encrypted wallet a reference from the database refers to
+func (s *BlobWalletStore) getBlobWallet(reference wallet.EncryptedWallet) (encryptedWallet wallet.EncryptedWallet, err error) {
+	key, size, ok := parseBlobReference(reference)
+	if !ok {
+		// Saved before we switched to a blob store
+		return reference, nil
+	}
+
+	data, err := s.Blobs.Get(key)
+	if err != nil {
+		err = fmt.Errorf("Error getting wallet blob %s: %w", key, err)
+		return
+	}
+	if len(data) != size {
+		err = fmt.Errorf("Wallet blob %s is %d bytes, expected %d", key, len(data), size)
+		return
+	}
+	return wallet.EncryptedWallet(data), nil
+}
+
+func (s *BlobWalletStore) ChangePasswordWithWallet(
+	ctx context.Context,
+	email auth.Email,
+	oldPassword auth.Password,
+	newPassword auth.Password,
+	clientSaltSeed auth.ClientSaltSeed,
+	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
+	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
+	previousUserId, previousKeys := s.previousBlobKeys(ctx, email, sequence, appWallets)
+
+	key, reference, err := s.putWallet(encryptedWallet)
+	if err != nil {
+		return
+	}
+	appKeys, appReferences, err := s.putAppWallets(appWallets)
+	if err != nil {
+		s.deleteBlob(key)
+		return
+	}
+
+	userId, numTokensDeleted, err = s.StoreInterface.ChangePasswordWithWallet(ctx, email, oldPassword, newPassword, clientSaltSeed, reference, sequence, hmac, parentHmac, encryptionVersion, appReferences)
+	if err != nil {
+		s.deleteBlob(key)
+		for _, appKey := range appKeys {
+			s.deleteBlob(appKey)
+		}
+		return
+	}
+	if userId == previousUserId {
+		for _, previousKey := range previousKeys {
+			s.deleteBlob(previousKey)
+		}
+	}
+	return
+}
+
+func (s *BlobWalletStore) ChangePasswordNoWallet(
+	ctx context.Context,
+	email auth.Email,
+	oldPassword auth.Password,
+	newPassword auth.Password,
+	clientSaltSeed auth.ClientSaltSeed,
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
+	// No default wallet, so nothing there to replace
+	previousUserId, previousKeys := s.previousBlobKeys(ctx, email, 0, appWallets)
+
+	appKeys, appReferences, err := s.putAppWallets(appWallets)
+	if err != nil {
+		return
+	}
+
+	userId, numTokensDeleted, err = s.StoreInterface.ChangePasswordNoWallet(ctx, email, oldPassword, newPassword, clientSaltSeed, appReferences)
+	if err != nil {
+		for _, appKey := range appKeys {
+			s.deleteBlob(appKey)
+		}
+		return
+	}
+	if userId == previousUserId {
+		for _, previousKey := range previousKeys {
+			s.deleteBlob(previousKey)
+		}
+	}
+	return
+}
+
+// The objects a password change would replace if it goes through, same as
+// currentBlobKey for each wallet in it. We don't have the user id until the
+// change goes through, by which point those wallets are gone, so we look it
+// up by email beforehand. A sequence of zero means there's no default wallet
+// in the change.
+func (s *BlobWalletStore) previousBlobKeys(ctx context.Context, email auth.Email, sequence wallet.Sequence, appWallets []AppWalletUpdate) (userId auth.UserId, keys []string) {
+	status, err := s.StoreInterface.GetAccountStatus(ctx, email, wallet.DefaultAppId)
+	if err != nil {
+		return
+	}
+	if sequence > 0 {
+		if key, ok := s.currentBlobKey(ctx, status.UserId, wallet.DefaultAppId, sequence-1); ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, appWallet := range appWallets {
+		if key, ok := s.currentBlobKey(ctx, status.UserId, appWallet.AppId, appWallet.Sequence-1); ok {
+			keys = append(keys, key)
+		}
+	}
+	return status.UserId, keys
+}
+
+// The other apps' wallets that come with a password change, each written to
+// a new object. If one fails, the ones already written are deleted.
+func (s *BlobWalletStore) putAppWallets(appWallets []AppWalletUpdate) (keys []string, referenceWallets []AppWalletUpdate, err error) {
+	referenceWallets = make([]AppWalletUpdate, len(appWallets))
+	for i, appWallet := range appWallets {
+		var key string
+		referenceWallets[i] = appWallet
+		key, referenceWallets[i].EncryptedWallet, err = s.putWallet(appWallet.EncryptedWallet)
+		if err != nil {
+			for _, key := range keys {
+				s.deleteBlob(key)
+			}
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// The objects of the user's wallets go too, for every app, once the account
+// is gone. If deleting the account fails, the objects stay; the account still
+// refers to them.
+func (s *BlobWalletStore) DeleteAccount(ctx context.Context, userId auth.UserId) (err error) {
+	var keys []string
+	appIds, getErr := s.StoreInterface.GetWalletAppIds(ctx, userId)
+	if getErr != nil {
+		log.Printf("Error getting wallets of user %d, leaving their blobs orphaned: %+v", userId, getErr)
+	}
+	for _, appId := range appIds {
+		reference, _, _, _, getErr := s.StoreInterface.GetWallet(ctx, userId, appId)
+		if getErr != nil {
+			continue
+		}
+		if key, _, ok := parseBlobReference(reference); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	if err = s.StoreInterface.DeleteAccount(ctx, userId); err != nil {
+		return
+	}
+	for _, key := range keys {
+		s.deleteBlob(key)
+	}
+	return
+}
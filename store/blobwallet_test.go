@@ -0,0 +1,338 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/blob"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// A local stand-in for S3
+type TestBlobStore struct {
+	blobs  map[string][]byte
+	putErr error
+}
+
+func (b *TestBlobStore) Put(key string, data []byte) error {
+	if b.putErr != nil {
+		return b.putErr
+	}
+	b.blobs[key] = data
+	return nil
+}
+
+func (b *TestBlobStore) Get(key string) ([]byte, error) {
+	data, ok := b.blobs[key]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return data, nil
+}
+
+func (b *TestBlobStore) Delete(key string) error {
+	delete(b.blobs, key)
+	return nil
+}
+
+func blobWalletStoreTestInit(s *Store) (*BlobWalletStore, *TestBlobStore) {
+	blobs := &TestBlobStore{blobs: map[string][]byte{}}
+	return &BlobWalletStore{StoreInterface: s, Blobs: blobs}, blobs
+}
+
+func expectBlobWallet(t *testing.T, bs *BlobWalletStore, userId auth.UserId, expectedEncryptedWallet wallet.EncryptedWallet, expectedSequence wallet.Sequence) {
+	t.Helper()
+	encryptedWallet, sequence, _, _, err := bs.GetWallet(context.Background(), userId, wallet.DefaultAppId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetWallet: %+v", err)
+	}
+	if encryptedWallet != expectedEncryptedWallet || sequence != expectedSequence {
+		t.Errorf("Expected wallet %s at sequence %d, got %s at sequence %d", expectedEncryptedWallet, expectedSequence, encryptedWallet, sequence)
+	}
+}
+
+func expectBlobCount(t *testing.T, blobs *TestBlobStore, expectedCount int) {
+	t.Helper()
+	if len(blobs.blobs) != expectedCount {
+		t.Errorf("Expected %d blob(s), got %d", expectedCount, len(blobs.blobs))
+	}
+}
+
+func TestBlobWalletStoreSetGetWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1))
+	expectBlobCount(t, blobs, 1)
+
+	// The database only has the reference
+	encryptedWallet, _, _, _, err := s.GetWallet(context.Background(), userId, wallet.DefaultAppId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetWallet: %+v", err)
+	}
+	if !strings.HasPrefix(string(encryptedWallet), "blob:15:wallets/") {
+		t.Errorf("Expected a blob reference in the database, got %s", encryptedWallet)
+	}
+
+	// The next one replaces it, and the old object is cleaned up
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2))
+	expectBlobCount(t, blobs, 1)
+
+	// Wrong sequence: the wallet stays as it was, and the object written for the
+	// failed update is cleaned up
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-c"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2))
+	expectBlobCount(t, blobs, 1)
+}
+
+// If the object can't be written, the database isn't touched
+func TestBlobWalletStoreSetWalletPutError(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	blobs.putErr = fmt.Errorf("Blob store is down")
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != blobs.putErr {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, blobs.putErr, err)
+	}
+	expectWalletNotExists(t, &s, userId)
+}
+
+func TestBlobWalletStoreImportWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := bs.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-a"), wallet.EncryptionVersion(""), nil); err != nil {
+		t.Fatalf("Unexpected error in ImportWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(5))
+	expectBlobCount(t, blobs, 1)
+
+	// There's a wallet already, so the object written for this one is cleaned up
+	if err := bs.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(9), wallet.WalletHmac("my-hmac-b"), wallet.EncryptionVersion(""), nil); err != ErrDuplicateWallet {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrDuplicateWallet, err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(5))
+	expectBlobCount(t, blobs, 1)
+}
+
+// Every app's wallet gets its own object, and they're all cleaned up together
+// if the import doesn't go through
+func TestBlobWalletStoreImportWalletAppWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	appWallets := []AppWalletUpdate{{AppId: "my-app", EncryptedWallet: "my-app-wallet", Sequence: 3, Hmac: "my-hmac-app"}}
+	if err := bs.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-a"), wallet.EncryptionVersion(""), appWallets); err != nil {
+		t.Fatalf("Unexpected error in ImportWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(5))
+	if encryptedWallet, sequence, _, _, err := bs.GetWallet(context.Background(), userId, "my-app"); err != nil || encryptedWallet != "my-app-wallet" || sequence != 3 {
+		t.Errorf("Expected the app wallet at sequence 3, got %s at sequence %d, err %+v", encryptedWallet, sequence, err)
+	}
+	expectBlobCount(t, blobs, 2)
+
+	if err := bs.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(9), wallet.WalletHmac("my-hmac-b"), wallet.EncryptionVersion(""), appWallets); err != ErrDuplicateWallet {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrDuplicateWallet, err)
+	}
+	expectBlobCount(t, blobs, 2)
+}
+
+func TestBlobWalletStoreSyncWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	for _, sequence := range []wallet.Sequence{1, 2} {
+		encryptedWallet := wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d", sequence))
+		applied, latest, err := bs.SyncWallet(context.Background(), userId, wallet.DefaultAppId, encryptedWallet, sequence, wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion(""))
+		if err != nil || !applied || latest == nil || latest.EncryptedWallet != encryptedWallet {
+			t.Fatalf("Expected SyncWallet to be applied with the wallet as the latest: applied: %v latest: %+v err: %+v", applied, latest, err)
+		}
+		// The one it replaced is cleaned up
+		expectBlobCount(t, blobs, 1)
+	}
+
+	// Losing cleans up the object for the wallet that lost, and returns the
+	// actual wallet it lost to, not the reference
+	applied, latest, err := bs.SyncWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-x"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-x"), nil, wallet.EncryptionVersion(""))
+	if err != nil || applied || latest == nil || latest.EncryptedWallet != wallet.EncryptedWallet("my-enc-wallet-2") {
+		t.Fatalf("Expected SyncWallet to lose to the current wallet: applied: %v latest: %+v err: %+v", applied, latest, err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2))
+	expectBlobCount(t, blobs, 1)
+}
+
+// Wallets saved before switching to a blob store are still readable, and the
+// first update after the switch moves them over
+func TestBlobWalletStoreExistingWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1))
+
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2))
+	expectBlobCount(t, blobs, 1)
+}
+
+func TestBlobWalletStoreGetWalletMissingBlob(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	for key := range blobs.blobs {
+		delete(blobs.blobs, key)
+	}
+	if _, _, _, _, err := bs.GetWallet(context.Background(), userId, wallet.DefaultAppId); err == nil {
+		t.Errorf("Expected an error getting a wallet whose blob is missing")
+	}
+}
+
+func TestBlobWalletStoreSetWalletBatch(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := bs.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-1"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	updates := []WalletUpdate{
+		{EncryptedWallet: "my-enc-wallet-2", Sequence: 2, Hmac: "my-hmac-2"},
+		{EncryptedWallet: "my-enc-wallet-3", Sequence: 3, Hmac: "my-hmac-3"},
+	}
+	if err := bs.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, nil); err != nil {
+		t.Fatalf("Unexpected error in SetWalletBatch: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-3"), wallet.Sequence(3))
+	expectBlobCount(t, blobs, 1)
+
+	// A failed batch leaves nothing behind
+	updates = []WalletUpdate{
+		{EncryptedWallet: "my-enc-wallet-4", Sequence: 4, Hmac: "my-hmac-4"},
+		{EncryptedWallet: "my-enc-wallet-6", Sequence: 6, Hmac: "my-hmac-6"},
+	}
+	if err := bs.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, nil); err != ErrWrongSequence {
+		t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-3"), wallet.Sequence(3))
+	expectBlobCount(t, blobs, 1)
+}
+
+func TestBlobWalletStoreChangePasswordWithWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	for _, appId := range []wallet.AppId{wallet.DefaultAppId, "my-app"} {
+		if err := bs.SetWallet(context.Background(), userId, appId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-1"), nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	newSeed := auth.ClientSaltSeed("edcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcb")
+	appWallets := []AppWalletUpdate{{AppId: "my-app", EncryptedWallet: "my-app-enc-wallet-2", Sequence: 2, Hmac: "my-app-hmac-2"}}
+
+	// Wrong password: the new objects are cleaned up
+	if _, _, err := bs.ChangePasswordWithWallet(context.Background(), email, "wrong-password", "new-password", newSeed, "my-enc-wallet-2", 2, "my-hmac-2", nil, "", appWallets); err != ErrWrongCredentials {
+		t.Fatalf(`ChangePasswordWithWallet err: wanted "%+v", got "%+v"`, ErrWrongCredentials, err)
+	}
+	expectBlobCount(t, blobs, 2)
+
+	// The objects of the wallets it replaced are cleaned up
+	if _, _, err := bs.ChangePasswordWithWallet(context.Background(), email, password, "new-password", newSeed, "my-enc-wallet-2", 2, "my-hmac-2", nil, "", appWallets); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordWithWallet: %+v", err)
+	}
+	expectBlobWallet(t, bs, userId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2))
+	if encryptedWallet, _, _, _, err := bs.GetWallet(context.Background(), userId, "my-app"); err != nil || encryptedWallet != "my-app-enc-wallet-2" {
+		t.Errorf("Expected my-app wallet my-app-enc-wallet-2, got %s err %+v", encryptedWallet, err)
+	}
+	expectBlobCount(t, blobs, 2)
+}
+
+func TestBlobWalletStoreChangePasswordNoWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := bs.SetWallet(context.Background(), userId, "my-app", wallet.EncryptedWallet("my-app-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-app-hmac-1"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	newSeed := auth.ClientSaltSeed("edcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcbaedcb")
+	appWallets := []AppWalletUpdate{{AppId: "my-app", EncryptedWallet: "my-app-enc-wallet-2", Sequence: 2, Hmac: "my-app-hmac-2"}}
+
+	if _, _, err := bs.ChangePasswordNoWallet(context.Background(), email, password, "new-password", newSeed, appWallets); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordNoWallet: %+v", err)
+	}
+	if encryptedWallet, _, _, _, err := bs.GetWallet(context.Background(), userId, "my-app"); err != nil || encryptedWallet != "my-app-enc-wallet-2" {
+		t.Errorf("Expected my-app wallet my-app-enc-wallet-2, got %s err %+v", encryptedWallet, err)
+	}
+	expectBlobCount(t, blobs, 1)
+}
+
+func TestBlobWalletStoreDeleteAccount(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	bs, blobs := blobWalletStoreTestInit(&s)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Every app's object goes, not just the default app's
+	for _, appId := range []wallet.AppId{wallet.DefaultAppId, "app-a", "app-b"} {
+		if err := bs.SetWallet(context.Background(), userId, appId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+	expectBlobCount(t, blobs, 3)
+
+	if err := bs.DeleteAccount(context.Background(), userId); err != nil {
+		t.Fatalf("Unexpected error in DeleteAccount: %+v", err)
+	}
+	expectWalletNotExists(t, &s, userId)
+	expectBlobCount(t, blobs, 0)
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestStoreUpdateDeviceSync(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Nothing synced yet
+	deviceSyncs, err := s.GetDeviceSyncs(context.Background(), userId)
+	if err != nil || deviceSyncs == nil || len(deviceSyncs) != 0 {
+		t.Fatalf("Expected an empty list of device syncs: deviceSyncs: %+v err: %+v", deviceSyncs, err)
+	}
+
+	if err := s.UpdateDeviceSync(context.Background(), userId, auth.DeviceId("dId-2"), wallet.Sequence(3)); err != nil {
+		t.Fatalf("Unexpected error in UpdateDeviceSync: %+v", err)
+	}
+	if err := s.UpdateDeviceSync(context.Background(), userId, auth.DeviceId("dId-1"), wallet.Sequence(1)); err != nil {
+		t.Fatalf("Unexpected error in UpdateDeviceSync: %+v", err)
+	}
+	// Replaces the earlier one for the device
+	if err := s.UpdateDeviceSync(context.Background(), userId, auth.DeviceId("dId-1"), wallet.Sequence(4)); err != nil {
+		t.Fatalf("Unexpected error in UpdateDeviceSync: %+v", err)
+	}
+
+	// Someone else's device, not to be included
+	otherEmail, otherPassword := auth.Email("other@example.com"), auth.Password("456")
+	if err := s.CreateAccount(context.Background(), otherEmail, otherPassword, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	otherUserId, err := s.GetUserId(context.Background(), otherEmail, otherPassword)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+	if err := s.UpdateDeviceSync(context.Background(), otherUserId, auth.DeviceId("dId-1"), wallet.Sequence(7)); err != nil {
+		t.Fatalf("Unexpected error in UpdateDeviceSync: %+v", err)
+	}
+
+	deviceSyncs, err = s.GetDeviceSyncs(context.Background(), userId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetDeviceSyncs: %+v", err)
+	}
+	if len(deviceSyncs) != 2 ||
+		deviceSyncs[0].DeviceId != "dId-1" || deviceSyncs[0].Sequence != 4 ||
+		deviceSyncs[1].DeviceId != "dId-2" || deviceSyncs[1].Sequence != 3 {
+		t.Fatalf("Unexpected device syncs: %+v", deviceSyncs)
+	}
+	for _, deviceSync := range deviceSyncs {
+		if deviceSync.Updated.After(time.Now().UTC()) || deviceSync.Updated.Before(time.Now().UTC().Add(-time.Minute)) {
+			t.Errorf("Expected Updated to be about now, got %+v", deviceSync.Updated)
+		}
+	}
+}
+
+func TestStoreAddKnownDevice(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	otherEmail, otherPassword := auth.Email("other@example.com"), auth.Password("456")
+	if err := s.CreateAccount(context.Background(), otherEmail, otherPassword, auth.ClientSaltSeed("abcd1234abcd1234"), nil); err != nil {
+		t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+	}
+	otherUserId, err := s.GetUserId(context.Background(), otherEmail, otherPassword)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetUserId: %+v", err)
+	}
+
+	for _, tc := range []struct {
+		userId        auth.UserId
+		deviceId      auth.DeviceId
+		expectedIsNew bool
+	}{
+		{userId, "dId-1", true},
+		{userId, "dId-1", false},
+		{userId, "dId-2", true},
+		// Someone else's device with the same id is separate
+		{otherUserId, "dId-1", true},
+	} {
+		isNew, err := s.AddKnownDevice(context.Background(), tc.userId, tc.deviceId)
+		if err != nil || isNew != tc.expectedIsNew {
+			t.Errorf("AddKnownDevice(%d, %s): expected isNew %t, got %t err %+v", tc.userId, tc.deviceId, tc.expectedIsNew, isNew, err)
+		}
+	}
+}
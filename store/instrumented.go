@@ -0,0 +1,255 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Wraps a store and times every operation, labelled by the name of the
+// operation, the backend, and whether it returned an error. Wallet operations
+// also record the size of the encrypted wallet, so that a slow GetWallet can
+// be told apart from a big one.
+//
+// Every method of StoreInterface goes through here, so a new one needs to be
+// added here as well (the compiler will insist).
+type InstrumentedStore struct {
+	Store   StoreInterface
+	Backend string
+}
+
+func (s *InstrumentedStore) observe(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.StoreOperationDuration.With(prometheus.Labels{
+		"operation": operation,
+		"backend":   s.Backend,
+		"result":    result,
+	}).Observe(time.Since(start).Seconds())
+}
+
+func (s *InstrumentedStore) observeWalletSize(operation string, encryptedWallet wallet.EncryptedWallet) {
+	metrics.StoreWalletSize.With(prometheus.Labels{
+		"operation": operation,
+		"backend":   s.Backend,
+	}).Observe(float64(len(encryptedWallet)))
+}
+
+func (s *InstrumentedStore) SaveToken(ctx context.Context, token *auth.AuthToken) (err error) {
+	defer func(start time.Time) { s.observe("SaveToken", start, err) }(time.Now())
+	return s.Store.SaveToken(ctx, token)
+}
+
+func (s *InstrumentedStore) GetToken(ctx context.Context, token auth.AuthTokenString) (authToken *auth.AuthToken, err error) {
+	defer func(start time.Time) { s.observe("GetToken", start, err) }(time.Now())
+	return s.Store.GetToken(ctx, token)
+}
+
+func (s *InstrumentedStore) RefreshToken(ctx context.Context, token auth.AuthTokenString) (expiration time.Time, err error) {
+	defer func(start time.Time) { s.observe("RefreshToken", start, err) }(time.Now())
+	return s.Store.RefreshToken(ctx, token)
+}
+
+func (s *InstrumentedStore) DeleteToken(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) (err error) {
+	defer func(start time.Time) { s.observe("DeleteToken", start, err) }(time.Now())
+	return s.Store.DeleteToken(ctx, userId, deviceId)
+}
+
+func (s *InstrumentedStore) GetTokensForUser(ctx context.Context, userId auth.UserId, limit int, offset int) (tokens []auth.AuthToken, err error) {
+	defer func(start time.Time) { s.observe("GetTokensForUser", start, err) }(time.Now())
+	return s.Store.GetTokensForUser(ctx, userId, limit, offset)
+}
+
+func (s *InstrumentedStore) UpdateTokenDeviceId(ctx context.Context, userId auth.UserId, oldDeviceId auth.DeviceId, newDeviceId auth.DeviceId) (err error) {
+	defer func(start time.Time) { s.observe("UpdateTokenDeviceId", start, err) }(time.Now())
+	return s.Store.UpdateTokenDeviceId(ctx, userId, oldDeviceId, newDeviceId)
+}
+
+func (s *InstrumentedStore) SetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (err error) {
+	defer func(start time.Time) { s.observe("SetWallet", start, err) }(time.Now())
+	s.observeWalletSize("SetWallet", encryptedWallet)
+	return s.Store.SetWallet(ctx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+}
+
+func (s *InstrumentedStore) SetWalletBatch(ctx context.Context, userId auth.UserId, appId wallet.AppId, updates []WalletUpdate, parentHmac *wallet.WalletHmac) (err error) {
+	defer func(start time.Time) { s.observe("SetWalletBatch", start, err) }(time.Now())
+	for _, update := range updates {
+		s.observeWalletSize("SetWalletBatch", update.EncryptedWallet)
+	}
+	return s.Store.SetWalletBatch(ctx, userId, appId, updates, parentHmac)
+}
+
+func (s *InstrumentedStore) SyncWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (applied bool, latest *WalletUpdate, err error) {
+	defer func(start time.Time) { s.observe("SyncWallet", start, err) }(time.Now())
+	s.observeWalletSize("SyncWallet", encryptedWallet)
+	return s.Store.SyncWallet(ctx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+}
+
+func (s *InstrumentedStore) ImportWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, appWallets []AppWalletUpdate) (err error) {
+	defer func(start time.Time) { s.observe("ImportWallet", start, err) }(time.Now())
+	s.observeWalletSize("ImportWallet", encryptedWallet)
+	for _, appWallet := range appWallets {
+		s.observeWalletSize("ImportWallet", appWallet.EncryptedWallet)
+	}
+	return s.Store.ImportWallet(ctx, userId, appId, encryptedWallet, sequence, hmac, encryptionVersion, appWallets)
+}
+
+func (s *InstrumentedStore) GetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, err error) {
+	defer func(start time.Time) { s.observe("GetWallet", start, err) }(time.Now())
+	encryptedWallet, sequence, hmac, encryptionVersion, err = s.Store.GetWallet(ctx, userId, appId)
+	if err == nil {
+		s.observeWalletSize("GetWallet", encryptedWallet)
+	}
+	return
+}
+
+func (s *InstrumentedStore) GetWalletMetadata(ctx context.Context, userId auth.UserId, appId wallet.AppId) (sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+	defer func(start time.Time) { s.observe("GetWalletMetadata", start, err) }(time.Now())
+	return s.Store.GetWalletMetadata(ctx, userId, appId)
+}
+
+func (s *InstrumentedStore) GetWalletAppIds(ctx context.Context, userId auth.UserId) (appIds []wallet.AppId, err error) {
+	defer func(start time.Time) { s.observe("GetWalletAppIds", start, err) }(time.Now())
+	return s.Store.GetWalletAppIds(ctx, userId)
+}
+
+func (s *InstrumentedStore) CheckSequence(ctx context.Context, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (err error) {
+	defer func(start time.Time) { s.observe("CheckSequence", start, err) }(time.Now())
+	return s.Store.CheckSequence(ctx, userId, appId, sequence)
+}
+
+func (s *InstrumentedStore) GetUserId(ctx context.Context, email auth.Email, password auth.Password) (userId auth.UserId, err error) {
+	defer func(start time.Time) { s.observe("GetUserId", start, err) }(time.Now())
+	return s.Store.GetUserId(ctx, email, password)
+}
+
+func (s *InstrumentedStore) CreateAccount(ctx context.Context, email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) (err error) {
+	defer func(start time.Time) { s.observe("CreateAccount", start, err) }(time.Now())
+	return s.Store.CreateAccount(ctx, email, password, seed, verifyToken)
+}
+
+func (s *InstrumentedStore) UpdateVerifyTokenString(ctx context.Context, email auth.Email, verifyTokenString auth.VerifyTokenString) (err error) {
+	defer func(start time.Time) { s.observe("UpdateVerifyTokenString", start, err) }(time.Now())
+	return s.Store.UpdateVerifyTokenString(ctx, email, verifyTokenString)
+}
+
+func (s *InstrumentedStore) VerifyAccount(ctx context.Context, verifyTokenString auth.VerifyTokenString) (err error) {
+	defer func(start time.Time) { s.observe("VerifyAccount", start, err) }(time.Now())
+	return s.Store.VerifyAccount(ctx, verifyTokenString)
+}
+
+func (s *InstrumentedStore) ChangePasswordWithWallet(
+	ctx context.Context,
+	email auth.Email,
+	oldPassword auth.Password,
+	newPassword auth.Password,
+	clientSaltSeed auth.ClientSaltSeed,
+	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
+	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
+	defer func(start time.Time) { s.observe("ChangePasswordWithWallet", start, err) }(time.Now())
+	s.observeWalletSize("ChangePasswordWithWallet", encryptedWallet)
+	for _, appWallet := range appWallets {
+		s.observeWalletSize("ChangePasswordWithWallet", appWallet.EncryptedWallet)
+	}
+	return s.Store.ChangePasswordWithWallet(ctx, email, oldPassword, newPassword, clientSaltSeed, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion, appWallets)
+}
+
+func (s *InstrumentedStore) ChangePasswordNoWallet(ctx context.Context, email auth.Email, oldPassword auth.Password, newPassword auth.Password, clientSaltSeed auth.ClientSaltSeed, appWallets []AppWalletUpdate) (userId auth.UserId, numTokensDeleted int64, err error) {
+	defer func(start time.Time) { s.observe("ChangePasswordNoWallet", start, err) }(time.Now())
+	for _, appWallet := range appWallets {
+		s.observeWalletSize("ChangePasswordNoWallet", appWallet.EncryptedWallet)
+	}
+	return s.Store.ChangePasswordNoWallet(ctx, email, oldPassword, newPassword, clientSaltSeed, appWallets)
+}
+
+func (s *InstrumentedStore) GetClientSaltSeed(ctx context.Context, email auth.Email) (seed auth.ClientSaltSeed, err error) {
+	defer func(start time.Time) { s.observe("GetClientSaltSeed", start, err) }(time.Now())
+	return s.Store.GetClientSaltSeed(ctx, email)
+}
+
+func (s *InstrumentedStore) EmailExists(ctx context.Context, email auth.Email) (exists bool, err error) {
+	defer func(start time.Time) { s.observe("EmailExists", start, err) }(time.Now())
+	return s.Store.EmailExists(ctx, email)
+}
+
+func (s *InstrumentedStore) GetEmail(ctx context.Context, userId auth.UserId) (email auth.Email, err error) {
+	defer func(start time.Time) { s.observe("GetEmail", start, err) }(time.Now())
+	return s.Store.GetEmail(ctx, userId)
+}
+
+func (s *InstrumentedStore) GetAccountStatus(ctx context.Context, email auth.Email, appId wallet.AppId) (status AccountStatus, err error) {
+	defer func(start time.Time) { s.observe("GetAccountStatus", start, err) }(time.Now())
+	return s.Store.GetAccountStatus(ctx, email, appId)
+}
+
+func (s *InstrumentedStore) GetSigningPublicKey(ctx context.Context, email auth.Email) (publicKey auth.SigningPublicKey, err error) {
+	defer func(start time.Time) { s.observe("GetSigningPublicKey", start, err) }(time.Now())
+	return s.Store.GetSigningPublicKey(ctx, email)
+}
+
+func (s *InstrumentedStore) SetSigningPublicKey(ctx context.Context, userId auth.UserId, publicKey auth.SigningPublicKey) (err error) {
+	defer func(start time.Time) { s.observe("SetSigningPublicKey", start, err) }(time.Now())
+	return s.Store.SetSigningPublicKey(ctx, userId, publicKey)
+}
+
+func (s *InstrumentedStore) DeleteAccount(ctx context.Context, userId auth.UserId) (err error) {
+	defer func(start time.Time) { s.observe("DeleteAccount", start, err) }(time.Now())
+	return s.Store.DeleteAccount(ctx, userId)
+}
+
+func (s *InstrumentedStore) CheckAndStoreNonce(ctx context.Context, nonce string, ttl time.Duration) (fresh bool, err error) {
+	defer func(start time.Time) { s.observe("CheckAndStoreNonce", start, err) }(time.Now())
+	return s.Store.CheckAndStoreNonce(ctx, nonce, ttl)
+}
+
+func (s *InstrumentedStore) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { s.observe("Ping", start, err) }(time.Now())
+	return s.Store.Ping(ctx)
+}
+
+func (s *InstrumentedStore) UpdateDeviceSync(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId, sequence wallet.Sequence) (err error) {
+	defer func(start time.Time) { s.observe("UpdateDeviceSync", start, err) }(time.Now())
+	return s.Store.UpdateDeviceSync(ctx, userId, deviceId, sequence)
+}
+
+func (s *InstrumentedStore) GetDeviceSyncs(ctx context.Context, userId auth.UserId) (deviceSyncs []DeviceSync, err error) {
+	defer func(start time.Time) { s.observe("GetDeviceSyncs", start, err) }(time.Now())
+	return s.Store.GetDeviceSyncs(ctx, userId)
+}
+
+func (s *InstrumentedStore) PurgeExpiredTokens(ctx context.Context) (numDeleted int64, err error) {
+	defer func(start time.Time) { s.observe("PurgeExpiredTokens", start, err) }(time.Now())
+	return s.Store.PurgeExpiredTokens(ctx)
+}
+
+func (s *InstrumentedStore) AddKnownDevice(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) (isNew bool, err error) {
+	defer func(start time.Time) { s.observe("AddKnownDevice", start, err) }(time.Now())
+	return s.Store.AddKnownDevice(ctx, userId, deviceId)
+}
+
+func (s *InstrumentedStore) SetTotpSecret(ctx context.Context, userId auth.UserId, secret auth.TotpSecret) (email auth.Email, err error) {
+	defer func(start time.Time) { s.observe("SetTotpSecret", start, err) }(time.Now())
+	return s.Store.SetTotpSecret(ctx, userId, secret)
+}
+
+func (s *InstrumentedStore) EnableTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) (err error) {
+	defer func(start time.Time) { s.observe("EnableTotp", start, err) }(time.Now())
+	return s.Store.EnableTotp(ctx, userId, code)
+}
+
+func (s *InstrumentedStore) CheckTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) (err error) {
+	defer func(start time.Time) { s.observe("CheckTotp", start, err) }(time.Now())
+	return s.Store.CheckTotp(ctx, userId, code)
+}
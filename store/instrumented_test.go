@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+// Find the sample count for the histogram with exactly these labels
+func histogramSampleCount(t *testing.T, name string, labels map[string]string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %+v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			if labelsMatch(metric.Label, labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func labelsMatch(labelPairs []*dto.LabelPair, labels map[string]string) bool {
+	if len(labelPairs) != len(labels) {
+		return false
+	}
+	for _, labelPair := range labelPairs {
+		if labels[labelPair.GetName()] != labelPair.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreInstrumented(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	is := InstrumentedStore{Store: &s, Backend: "test-backend"}
+
+	const durationMetric = "wallet_sync_store_operation_duration_seconds"
+	const sizeMetric = "wallet_sync_store_wallet_size_bytes"
+
+	setWalletOk := map[string]string{"operation": "SetWallet", "backend": "test-backend", "result": "ok"}
+	getWalletOk := map[string]string{"operation": "GetWallet", "backend": "test-backend", "result": "ok"}
+	getWalletError := map[string]string{"operation": "GetWallet", "backend": "test-backend", "result": "error"}
+	getWalletSize := map[string]string{"operation": "GetWallet", "backend": "test-backend"}
+
+	// Nothing there yet, so this one is an error
+	if _, _, _, _, err := is.GetWallet(context.Background(), userId, wallet.DefaultAppId); err != ErrNoWallet {
+		t.Fatalf(`GetWallet err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
+	}
+	if err := is.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if _, _, _, _, err := is.GetWallet(context.Background(), userId, wallet.DefaultAppId); err != nil {
+		t.Fatalf("Unexpected error in GetWallet: %+v", err)
+	}
+	if _, err := is.GetToken(context.Background(), auth.AuthTokenString("nonexistent")); err != ErrNoTokenForUserDevice {
+		t.Fatalf(`GetToken err: wanted "%+v", got "%+v"`, ErrNoTokenForUserDevice, err)
+	}
+
+	tt := []struct {
+		metric        string
+		labels        map[string]string
+		expectedCount uint64
+	}{
+		{durationMetric, setWalletOk, 1},
+		{durationMetric, getWalletOk, 1},
+		{durationMetric, getWalletError, 1},
+		{durationMetric, map[string]string{"operation": "GetToken", "backend": "test-backend", "result": "error"}, 1},
+		{sizeMetric, getWalletSize, 1}, // only for the one that found a wallet
+	}
+	for _, tc := range tt {
+		if want, got := tc.expectedCount, histogramSampleCount(t, tc.metric, tc.labels); want != got {
+			t.Errorf("%s %+v: expected sample count %d, got %d", tc.metric, tc.labels, want, got)
+		}
+	}
+}
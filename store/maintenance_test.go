@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
+)
+
+func TestStoreReclaim(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Make a lot of (big) tokens, so there's something to reclaim later
+	for i := 0; i < 500; i++ {
+		authToken := auth.AuthToken{
+			Token:    auth.AuthTokenString(fmt.Sprintf("seekrit-%d-%s", i, strings.Repeat("a", 1000))),
+			DeviceId: auth.DeviceId(fmt.Sprintf("dId-%d", i)),
+			Scope:    "*",
+			UserId:   userId,
+		}
+		if err := s.insertToken(context.Background(), &authToken, time.Now().UTC().Add(time.Hour)); err != nil {
+			t.Fatalf("Unexpected error in insertToken: %+v", err)
+		}
+	}
+
+	if _, err := s.db.Exec("DELETE FROM auth_tokens"); err != nil {
+		t.Fatalf("Unexpected error deleting tokens: %+v", err)
+	}
+
+	sizeBefore, sizeAfter, err := s.Reclaim()
+	if err != nil {
+		t.Fatalf("Unexpected error in Reclaim: %+v", err)
+	}
+
+	if sizeAfter >= sizeBefore {
+		t.Fatalf("Expected the db size to drop after Reclaim. Before: %d After: %d", sizeBefore, sizeAfter)
+	}
+
+	// Make sure the numbers we got back are the real ones
+	if size, err := s.dbSize(); err != nil || size != sizeAfter {
+		t.Fatalf("Expected db size to be what Reclaim reported: %d. Got: %d err: %+v", sizeAfter, size, err)
+	}
+}
+
+// Foreign keys are on for our connections, so the only way to make orphans is
+// the way they'd happen in real life: a connection that has them off.
+func deleteAccountWithoutForeignKeys(t *testing.T, s *Store, userId auth.UserId) {
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error getting a connection: %+v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA foreign_keys=OFF"); err != nil {
+		t.Fatalf("Unexpected error turning off foreign keys: %+v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "DELETE FROM accounts WHERE user_id=?", userId); err != nil {
+		t.Fatalf("Unexpected error deleting account: %+v", err)
+	}
+	// Back on before it goes back in the pool
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA foreign_keys=ON"); err != nil {
+		t.Fatalf("Unexpected error turning on foreign keys: %+v", err)
+	}
+}
+
+func TestStoreFindOrphans(t *testing.T) {
+	for _, clean := range []bool{false, true} {
+		t.Run(fmt.Sprintf("clean %t", clean), func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+
+			// An account that will stay, with a token and a wallet
+			keptUserId, _, _, _ := makeTestUser(t, &s, nil, nil)
+			keptToken := auth.AuthToken{Token: "kept-token", DeviceId: "dId", Scope: "*", UserId: keptUserId}
+			if err := s.insertToken(context.Background(), &keptToken, time.Now().UTC().Add(time.Hour)); err != nil {
+				t.Fatalf("Unexpected error in insertToken: %+v", err)
+			}
+			if err := s.SetWallet(context.Background(), keptUserId, wallet.DefaultAppId, "my-enc-wallet", 1, "my-hmac", nil, ""); err != nil {
+				t.Fatalf("Unexpected error in SetWallet: %+v", err)
+			}
+
+			// An account that will go, with two tokens and wallets in two apps
+			if err := s.CreateAccount(context.Background(), "gone@example.com", "12345678", "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234", nil); err != nil {
+				t.Fatalf("Unexpected error in CreateAccount: %+v", err)
+			}
+			goneUserId, err := s.GetUserId(context.Background(), "gone@example.com", "12345678")
+			if err != nil {
+				t.Fatalf("Unexpected error in GetUserId: %+v", err)
+			}
+			for i := 0; i < 2; i++ {
+				token := auth.AuthToken{Token: auth.AuthTokenString(fmt.Sprintf("gone-token-%d", i)), DeviceId: auth.DeviceId(fmt.Sprintf("dId-%d", i)), Scope: "*", UserId: goneUserId}
+				if err := s.insertToken(context.Background(), &token, time.Now().UTC().Add(time.Hour)); err != nil {
+					t.Fatalf("Unexpected error in insertToken: %+v", err)
+				}
+			}
+			for _, appId := range []wallet.AppId{wallet.DefaultAppId, "other-app"} {
+				if err := s.SetWallet(context.Background(), goneUserId, appId, "my-enc-wallet", 1, "my-hmac", nil, ""); err != nil {
+					t.Fatalf("Unexpected error in SetWallet: %+v", err)
+				}
+			}
+
+			deleteAccountWithoutForeignKeys(t, &s, goneUserId)
+
+			counts, err := s.FindOrphans(clean)
+			if err != nil {
+				t.Fatalf("Unexpected error in FindOrphans: %+v", err)
+			}
+			if expected := (OrphanCounts{Tokens: 2, Wallets: 2, HighestSequences: 2}); counts != expected {
+				t.Errorf("Expected orphan counts %+v, got %+v", expected, counts)
+			}
+
+			var tokenCount, walletCount, highestSequenceCount int64
+			if err := s.db.QueryRow("SELECT COUNT(*) FROM auth_tokens").Scan(&tokenCount); err != nil {
+				t.Fatalf("Unexpected error counting tokens: %+v", err)
+			}
+			if err := s.db.QueryRow("SELECT COUNT(*) FROM wallets").Scan(&walletCount); err != nil {
+				t.Fatalf("Unexpected error counting wallets: %+v", err)
+			}
+			if err := s.db.QueryRow("SELECT COUNT(*) FROM highest_wallet_sequences").Scan(&highestSequenceCount); err != nil {
+				t.Fatalf("Unexpected error counting highest wallet sequences: %+v", err)
+			}
+
+			if clean {
+				// Only the kept account's rows are left
+				if tokenCount != 1 || walletCount != 1 || highestSequenceCount != 1 {
+					t.Errorf("Expected orphans to be deleted. Tokens: %d, wallets: %d, highest wallet sequences: %d", tokenCount, walletCount, highestSequenceCount)
+				}
+				counts, err = s.FindOrphans(false)
+				if err != nil || counts != (OrphanCounts{}) {
+					t.Errorf("Expected no orphans left, got %+v err: %+v", counts, err)
+				}
+			} else {
+				// Dry run, nothing deleted
+				if tokenCount != 3 || walletCount != 3 || highestSequenceCount != 3 {
+					t.Errorf("Expected nothing to be deleted. Tokens: %d, wallets: %d, highest wallet sequences: %d", tokenCount, walletCount, highestSequenceCount)
+				}
+			}
+
+			if _, err := s.GetToken(context.Background(), keptToken.Token); err != nil {
+				t.Errorf("Expected the kept account's token to still be there: %+v", err)
+			}
+		})
+	}
+}
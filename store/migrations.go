@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+// The schema is built up by an ordered list of migrations. Each one runs once
+// per database, in its own transaction, and schema_version records which ones
+// have run. To change the schema, add a migration to the end of the list.
+// Never change or reorder one that has already been released; databases out
+// there have already run it.
+//
+// Databases from before schema_version existed were set up by running the
+// whole schema every time with CREATE TABLE IF NOT EXISTS and adding missing
+// columns. They may have any of the early migrations' changes already, so
+// those steps (up to and including migration 6) check before they change
+// anything. Later migrations can assume everything before them has run.
+type migration struct {
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// For migrations that are plain SQL
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+var migrations = []migration{
+	// We use the `sequence` field for transaction safety. For instance, let's
+	// say two different clients are trying to update the sequence from 5 to 6.
+	// The update command will specify "WHERE sequence=5". Only one of these
+	// commands will succeed, and the other will get back an error.
+
+	// We use AUTOINCREMENT against the protestations of people on the Internet
+	// who claim that INTEGER PRIMARY KEY automatically has autoincrment, and
+	// that using it when it's not "strictly needed" uses extra resources. But
+	// without AUTOINCREMENT, it might reuse primary keys if a row is deleted and
+	// re-added. Who wants that risk? Besides, we'll switch to Postgres when it's
+	// time to scale anyway.
+
+	// We use UNIQUE on auth_tokens.token so that we can retrieve it easily and
+	// identify the user (and I suppose the uniqueness provides a little extra
+	// security in case we screw up the random generator). However the primary
+	// key should still be (user_id, device_id) so that a device's row can be
+	// updated with a new token.
+
+	// DATETIME columns are stored as text the way the sqlite driver formats a
+	// time.Time ("2006-01-02 15:04:05.999999999-07:00"), and compared as text
+	// (e.g. "expiration>?"). That only works if everything is in the same zone,
+	// so we always write them in UTC, whatever the process's local time zone is.
+	{"create tables", execMigration(`
+		CREATE TABLE IF NOT EXISTS auth_tokens(
+			token TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			expiration DATETIME NOT NULL,
+			CHECK (
+			  -- should eventually fail for foreign key constraint instead
+			  device_id <> '' AND
+
+			  token <> '' AND
+			  scope <> '' AND
+
+			  -- Don't know when it uses either format to denote UTC
+			  expiration <> "0001-01-01 00:00:00+00:00" AND
+			  expiration <> "0001-01-01 00:00:00Z"
+
+			),
+			PRIMARY KEY (user_id, device_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+		);
+		CREATE TABLE IF NOT EXISTS wallets(
+			user_id INTEGER NOT NULL,
+			encrypted_wallet TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			updated DATETIME NOT NULL,
+
+			PRIMARY KEY (user_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  encrypted_wallet <> '' AND
+			  hmac <> '' AND
+			  sequence <> 0
+			)
+		);
+		CREATE TABLE IF NOT EXISTS accounts(
+			normalized_email TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL,
+			key TEXT NOT NULL,
+			client_salt_seed TEXT NOT NULL,
+			server_salt TEXT NOT NULL,
+
+			-- UNIQUE because we will query by token when verifying
+			--
+			-- Nullable because we want to use null to represent verified users. We can't use empty string
+			-- because multiple accounts with empty string will trigger the unique constraint, unlike null.
+			verify_token TEXT UNIQUE,
+
+			verify_expiration DATETIME,
+			user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created DATETIME DEFAULT (DATETIME('now')),
+			updated DATETIME NOT NULL,
+			CHECK (
+			  email <> '' AND
+			  normalized_email <> '' AND
+			  key <> '' AND
+			  client_salt_seed <> '' AND
+			  server_salt <> ''
+			)
+		);
+	`)},
+	{"add wallets.encryption_version", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "wallets", "encryption_version", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"add accounts.signing_public_key", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "accounts", "signing_public_key", "TEXT")
+	}},
+	{"add accounts.highest_wallet_sequence", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "accounts", "highest_wallet_sequence", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		// Accounts from before highest_wallet_sequence existed start from whatever
+		// wallet they have now. Safe to run even if the column was already there,
+		// it never lowers it.
+		_, err := tx.Exec(`
+			UPDATE accounts SET highest_wallet_sequence=(SELECT sequence FROM wallets WHERE wallets.user_id=accounts.user_id)
+			WHERE highest_wallet_sequence < (SELECT sequence FROM wallets WHERE wallets.user_id=accounts.user_id)
+		`)
+		return err
+	}},
+	{"create nonces", execMigration(`
+		CREATE TABLE IF NOT EXISTS nonces(
+			nonce TEXT NOT NULL,
+			expiration DATETIME NOT NULL,
+			PRIMARY KEY (nonce)
+			CHECK (
+			  nonce <> ''
+			)
+		);
+	`)},
+	{"add auth_tokens.device_name", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "auth_tokens", "device_name", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{"add accounts.failed_login_count and accounts.locked_until", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "accounts", "failed_login_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "accounts", "locked_until", "DATETIME")
+	}},
+	{"create device_syncs", execMigration(`
+		CREATE TABLE device_syncs(
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			updated DATETIME NOT NULL,
+			PRIMARY KEY (user_id, device_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  device_id <> ''
+			)
+		);
+	`)},
+	{"hash verify tokens", hashVerifyTokens},
+
+	// Devices already logged in or synced count as known, so that turning on
+	// NEW_DEVICE_EMAIL doesn't email everyone about devices they already have.
+	// (The account check is only there to skip any orphaned rows.)
+	{"create known_devices", execMigration(`
+		CREATE TABLE known_devices(
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			first_seen DATETIME NOT NULL,
+			PRIMARY KEY (user_id, device_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  device_id <> ''
+			)
+		);
+		INSERT OR IGNORE INTO known_devices (user_id, device_id, first_seen)
+			SELECT user_id, device_id, datetime('now') FROM auth_tokens WHERE user_id IN (SELECT user_id FROM accounts);
+		INSERT OR IGNORE INTO known_devices (user_id, device_id, first_seen)
+			SELECT user_id, device_id, datetime('now') FROM device_syncs WHERE user_id IN (SELECT user_id FROM accounts);
+	`)},
+
+	// totp_secret is set as soon as the user starts enrolling, but only counts
+	// once totp_enabled. totp_last_counter is the period of the last code used
+	// (see auth.TotpSecret.Check), so it can't be used again.
+	{"add accounts totp columns", execMigration(`
+		ALTER TABLE accounts ADD COLUMN totp_secret TEXT;
+		ALTER TABLE accounts ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE accounts ADD COLUMN totp_last_counter INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE accounts ADD COLUMN totp_failed_count INTEGER NOT NULL DEFAULT 0;
+	`)},
+
+	// Every key from before this was made with cost 15 (see
+	// auth.DefaultPasswordCost). Leave the default alone even if that changes.
+	{"add accounts.password_cost", execMigration(`
+		ALTER TABLE accounts ADD COLUMN password_cost INTEGER NOT NULL DEFAULT 15;
+	`)},
+
+	// A wallet per app (see wallet.AppId) instead of per user. See
+	// addWalletsAppId.
+	{"add wallets.app_id", addWalletsAppId},
+
+	// The rollback protection floor (see checkRollbackWith) has to be per app
+	// too, or one app's wallet would hold the others back. What
+	// accounts.highest_wallet_sequence had becomes the default app's, and that
+	// column isn't used anymore.
+	{"create highest_wallet_sequences", execMigration(`
+		CREATE TABLE highest_wallet_sequences(
+			user_id INTEGER NOT NULL,
+			app_id TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			PRIMARY KEY (user_id, app_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+		);
+		INSERT INTO highest_wallet_sequences (user_id, app_id, sequence)
+			SELECT user_id, '', highest_wallet_sequence FROM accounts WHERE highest_wallet_sequence > 0;
+	`)},
+
+	// Emails of deleted accounts that can't sign up again yet (see
+	// Store.DeletedEmailReservation)
+	{"create reserved_emails", execMigration(`
+		CREATE TABLE reserved_emails(
+			normalized_email TEXT NOT NULL,
+			expiration DATETIME NOT NULL,
+			PRIMARY KEY (normalized_email)
+		);
+	`)},
+}
+
+// SQLite can't change a primary key in place, so the table is copied over.
+// Every wallet from before this is the default app's. Orphaned wallets (see
+// FindOrphans) can't come along, since the copy checks the foreign key, so
+// they're dropped. That's the one place they get deleted without
+// -clean-orphans, so say how many. Any wallet blobs they referred to (see
+// BlobWalletStore) are left in the blob store.
+func addWalletsAppId(tx *sql.Tx) error {
+	var numOrphans int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM wallets WHERE user_id NOT IN (SELECT user_id FROM accounts)").Scan(&numOrphans); err != nil {
+		return err
+	}
+	if numOrphans > 0 {
+		log.Printf("Dropping %d orphaned wallet(s) with no account while adding wallets.app_id. Any wallet blobs they referred to are left in the blob store.", numOrphans)
+	}
+
+	_, err := tx.Exec(`
+		CREATE TABLE wallets_by_app(
+			user_id INTEGER NOT NULL,
+			app_id TEXT NOT NULL DEFAULT '',
+			encrypted_wallet TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			encryption_version TEXT NOT NULL DEFAULT '',
+			updated DATETIME NOT NULL,
+
+			PRIMARY KEY (user_id, app_id)
+			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
+			CHECK (
+			  encrypted_wallet <> '' AND
+			  hmac <> '' AND
+			  sequence <> 0
+			)
+		);
+		INSERT INTO wallets_by_app (user_id, app_id, encrypted_wallet, sequence, hmac, encryption_version, updated)
+			SELECT user_id, '', encrypted_wallet, sequence, hmac, encryption_version, updated FROM wallets WHERE user_id IN (SELECT user_id FROM accounts);
+		DROP TABLE wallets;
+		ALTER TABLE wallets_by_app RENAME TO wallets;
+	`)
+	return err
+}
+
+// Verify tokens used to be stored as they are. Hash the ones still waiting to
+// be used (see hashVerifyToken) so the emails already sent keep working.
+func hashVerifyTokens(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT user_id, verify_token FROM accounts WHERE verify_token IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	verifyTokens := make(map[auth.UserId]auth.VerifyTokenString)
+	for rows.Next() {
+		var userId auth.UserId
+		var verifyToken auth.VerifyTokenString
+		if err := rows.Scan(&userId, &verifyToken); err != nil {
+			rows.Close()
+			return err
+		}
+		verifyTokens[userId] = verifyToken
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for userId, verifyToken := range verifyTokens {
+		if _, err := tx.Exec("UPDATE accounts SET verify_token=? WHERE user_id=?", hashVerifyToken(verifyToken), userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) schemaVersion() (version int, err error) {
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return
+}
+
+// Bring the database up to date, running whatever migrations it hasn't had
+// yet. Fine to run on an empty database, and does nothing if it's already up
+// to date.
+func (s *Store) Migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version(
+			version INTEGER NOT NULL,
+			applied DATETIME NOT NULL,
+			PRIMARY KEY (version)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		// Probably rolled back to an older server. Better not to touch a schema
+		// we don't know.
+		return fmt.Errorf("Database schema version %d is newer than the latest this server knows about (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if err := s.runMigration(version+1, migrations[version]); err != nil {
+			return fmt.Errorf("Error running migration %d (%s): %w", version+1, migrations[version].description, err)
+		}
+		log.Printf("Ran migration %d: %s", version+1, migrations[version].description)
+	}
+	return nil
+}
+
+func (s *Store) runMigration(version int, m migration) (err error) {
+	return s.withTx(context.Background(), func(tx *sql.Tx) (err error) {
+		if err = m.up(tx); err != nil {
+			return
+		}
+
+		// If another process ran this migration in the meantime, this fails on the
+		// primary key and the whole migration is rolled back.
+		_, err = tx.Exec("INSERT INTO schema_version (version, applied) VALUES(?, datetime('now'))", version)
+		return
+	})
+}
+
+func addColumnIfMissing(q querier, table string, column string, definition string) (err error) {
+	var count int
+	err = q.QueryRowContext(
+		context.Background(),
+		"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column,
+	).Scan(&count)
+	if err != nil || count > 0 {
+		return
+	}
+	// Table and column names can't be query parameters. These only ever come
+	// from constants in migrations.
+	_, err = q.ExecContext(context.Background(), fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStoreCheckAndStoreNonce(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// First time we see it, it's fresh
+	fresh, err := s.CheckAndStoreNonce(context.Background(), "nonce-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error in CheckAndStoreNonce: %+v", err)
+	}
+	if !fresh {
+		t.Fatalf("Expected a new nonce to be fresh")
+	}
+
+	// Second time, it's a replay
+	fresh, err = s.CheckAndStoreNonce(context.Background(), "nonce-1", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error in CheckAndStoreNonce: %+v", err)
+	}
+	if fresh {
+		t.Fatalf("Expected a replayed nonce to not be fresh")
+	}
+
+	// A different nonce is unaffected
+	fresh, err = s.CheckAndStoreNonce(context.Background(), "nonce-2", time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error in CheckAndStoreNonce: %+v", err)
+	}
+	if !fresh {
+		t.Fatalf("Expected a different nonce to be fresh")
+	}
+}
+
+func TestStoreCheckAndStoreNonceAgesOut(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// Record it with a ttl that's already over
+	fresh, err := s.CheckAndStoreNonce(context.Background(), "nonce-1", -time.Second)
+	if err != nil || !fresh {
+		t.Fatalf("Expected a new nonce to be fresh. fresh: %v err: %+v", fresh, err)
+	}
+
+	// Since it aged out, it can be used again
+	fresh, err = s.CheckAndStoreNonce(context.Background(), "nonce-1", time.Minute)
+	if err != nil || !fresh {
+		t.Fatalf("Expected an aged out nonce to be fresh again. fresh: %v err: %+v", fresh, err)
+	}
+
+	var count int
+	if err := s.db.QueryRow("SELECT count(*) FROM nonces").Scan(&count); err != nil {
+		t.Fatalf("Error counting nonces: %+v", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected the expired row to be cleaned up. Got %d rows", count)
+	}
+}
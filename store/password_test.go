@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"strings"
 	"testing"
 	"time"
@@ -43,16 +44,22 @@ func TestStoreChangePasswordSuccess(t *testing.T) {
 
 	lowerEmail := auth.Email(strings.ToLower(string(email)))
 
-	pwUserId, err := s.ChangePasswordWithWallet(lowerEmail, oldPassword, newPassword, newSeed, encryptedWallet, sequence, hmac)
+	pwUserId, numTokensDeleted, err := s.ChangePasswordWithWallet(context.Background(), lowerEmail, oldPassword, newPassword, newSeed, encryptedWallet, sequence, hmac, nil, wallet.EncryptionVersion("my-encryption-version-2"), nil)
 	if err != nil {
 		t.Errorf("ChangePasswordWithWallet (lower case email): unexpected error: %+v", err)
 	}
 	if userId != pwUserId {
 		t.Errorf("Expected ChangePasswordWithWallet to return correct user Id. Want %d got %d", userId, pwUserId)
 	}
+	if numTokensDeleted != 1 {
+		t.Errorf("Expected ChangePasswordWithWallet to report 1 deleted token(s). Got %d", numTokensDeleted)
+	}
 
 	expectAccountMatch(t, &s, email.Normalize(), email, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
 	expectWalletExists(t, &s, userId, encryptedWallet, sequence, hmac, time.Now().UTC())
+	if _, _, _, encryptionVersion, _ := s.GetWallet(context.Background(), userId, wallet.DefaultAppId); encryptionVersion != wallet.EncryptionVersion("my-encryption-version-2") {
+		t.Errorf("Expected ChangePasswordWithWallet to set the encryption version. Got %q", encryptionVersion)
+	}
 	expectTokenNotExists(t, &s, token)
 
 	newNewPassword := newPassword + auth.Password("_new")
@@ -63,19 +70,23 @@ func TestStoreChangePasswordSuccess(t *testing.T) {
 
 	upperEmail := auth.Email(strings.ToUpper(string(email)))
 
-	pwUserId, err = s.ChangePasswordWithWallet(upperEmail, newPassword, newNewPassword, newNewSeed, newEncryptedWallet, newSequence, newHmac)
+	pwUserId, numTokensDeleted, err = s.ChangePasswordWithWallet(context.Background(), upperEmail, newPassword, newNewPassword, newNewSeed, newEncryptedWallet, newSequence, newHmac, &hmac, wallet.EncryptionVersion(""), nil) // with the matching parent hmac this time
 	if err != nil {
 		t.Errorf("ChangePasswordWithWallet (upper case email): unexpected error: %+v", err)
 	}
 	if userId != pwUserId {
 		t.Errorf("Expected ChangePasswordWithWallet to return correct user Id. Want %d got %d", userId, pwUserId)
 	}
+	if numTokensDeleted != 0 {
+		t.Errorf("Expected ChangePasswordWithWallet to report 0 deleted token(s). Got %d", numTokensDeleted)
+	}
 
 	expectAccountMatch(t, &s, email.Normalize(), email, newNewPassword, newNewSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
 }
 
 func TestStoreChangePasswordErrors(t *testing.T) {
 	verifyToken := auth.VerifyTokenString("aoeu1234aoeu1234aoeu1234aoeu1234")
+	forkedParentHmac := wallet.WalletHmac("my-hmac-forked")
 	tt := []struct {
 		name              string
 		hasWallet         bool
@@ -84,6 +95,8 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 		oldPasswordSuffix auth.Password
 		verifyToken       *auth.VerifyTokenString
 		verifyExpiration  *time.Time
+		parentHmac        *wallet.WalletHmac
+		requireParentHmac bool
 		expectedError     error
 	}{
 		{
@@ -126,6 +139,22 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 			// Sequence=1 always ends up being wrong for this endpoint since we
 			// should never be creating a wallet here.
 			expectedError: ErrWrongSequence,
+		}, {
+			name:              "wrong parent hmac",
+			hasWallet:         true,               // we have the requisite wallet
+			sequence:          wallet.Sequence(2), // sequence is correct
+			emailSuffix:       auth.Email(""),     // the email is correct
+			oldPasswordSuffix: auth.Password(""),  // the password is correct
+			parentHmac:        &forkedParentHmac,  // the parent hmac is *incorrect*
+			expectedError:     ErrWrongParentHmac,
+		}, {
+			name:              "missing required parent hmac",
+			hasWallet:         true,               // we have the requisite wallet
+			sequence:          wallet.Sequence(2), // sequence is correct
+			emailSuffix:       auth.Email(""),     // the email is correct
+			oldPasswordSuffix: auth.Password(""),  // the password is correct
+			requireParentHmac: true,               // parent hmac is required, and *missing*
+			expectedError:     ErrNoParentHmac,
 		},
 	}
 
@@ -133,6 +162,7 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			s, sqliteTmpFile := StoreTestInit(t)
 			defer StoreTestCleanup(sqliteTmpFile)
+			s.RequireParentHmac = tc.requireParentHmac
 
 			userId, email, oldPassword, oldSeed := makeTestUser(t, &s, tc.verifyToken, tc.verifyExpiration)
 			expiration := time.Now().UTC().Add(time.Hour * 24 * 14)
@@ -173,7 +203,7 @@ func TestStoreChangePasswordErrors(t *testing.T) {
 			newPassword := oldPassword + auth.Password("_new")         // Make the new password different (as it should be)
 			newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
 
-			if _, err := s.ChangePasswordWithWallet(submittedEmail, submittedOldPassword, newPassword, newSeed, newEncryptedWallet, tc.sequence, newHmac); err != tc.expectedError {
+			if _, _, err := s.ChangePasswordWithWallet(context.Background(), submittedEmail, submittedOldPassword, newPassword, newSeed, newEncryptedWallet, tc.sequence, newHmac, tc.parentHmac, wallet.EncryptionVersion(""), nil); err != tc.expectedError {
 				t.Errorf("ChangePasswordWithWallet: unexpected value for err. want: %+v, got: %+v", tc.expectedError, err)
 			}
 
@@ -212,13 +242,16 @@ func TestStoreChangePasswordNoWalletSuccess(t *testing.T) {
 
 	lowerEmail := auth.Email(strings.ToLower(string(email)))
 
-	pwUserId, err := s.ChangePasswordNoWallet(lowerEmail, oldPassword, newPassword, newSeed)
+	pwUserId, numTokensDeleted, err := s.ChangePasswordNoWallet(context.Background(), lowerEmail, oldPassword, newPassword, newSeed, nil)
 	if err != nil {
 		t.Errorf("ChangePasswordNoWallet (lower case email): unexpected error: %+v", err)
 	}
 	if userId != pwUserId {
 		t.Errorf("Expected ChangePasswordNoWallet to return correct user Id. Want %d got %d", userId, pwUserId)
 	}
+	if numTokensDeleted != 1 {
+		t.Errorf("Expected ChangePasswordNoWallet to report 1 deleted token(s). Got %d", numTokensDeleted)
+	}
 
 	expectAccountMatch(t, &s, email.Normalize(), email, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
 	expectWalletNotExists(t, &s, userId)
@@ -229,7 +262,7 @@ func TestStoreChangePasswordNoWalletSuccess(t *testing.T) {
 
 	upperEmail := auth.Email(strings.ToUpper(string(email)))
 
-	pwUserId, err = s.ChangePasswordNoWallet(upperEmail, newPassword, newNewPassword, newNewSeed)
+	pwUserId, numTokensDeleted, err = s.ChangePasswordNoWallet(context.Background(), upperEmail, newPassword, newNewPassword, newNewSeed, nil)
 
 	if err != nil {
 		t.Errorf("ChangePasswordNoWallet (upper case email): unexpected error: %+v", err)
@@ -237,10 +270,39 @@ func TestStoreChangePasswordNoWalletSuccess(t *testing.T) {
 	if userId != pwUserId {
 		t.Errorf("Expected ChangePasswordNoWallet to return correct user Id. Want %d got %d", userId, pwUserId)
 	}
+	if numTokensDeleted != 0 {
+		t.Errorf("Expected ChangePasswordNoWallet to report 0 deleted token(s). Got %d", numTokensDeleted)
+	}
 
 	expectAccountMatch(t, &s, email.Normalize(), email, newNewPassword, newNewSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
 }
 
+// After a password change, only the new password gets you in
+func TestStoreChangePasswordOldPasswordRejected(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, oldPassword, _ := makeTestUser(t, &s, nil, nil)
+	newPassword := oldPassword + auth.Password("_new")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, newPassword, newSeed, nil); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordNoWallet: %+v", err)
+	}
+
+	if _, err := s.GetUserId(context.Background(), email, oldPassword); err != ErrWrongCredentials {
+		t.Errorf("GetUserId with the old password: wanted %+v, got %+v", ErrWrongCredentials, err)
+	}
+	if newUserId, err := s.GetUserId(context.Background(), email, newPassword); err != nil || newUserId != userId {
+		t.Errorf("GetUserId with the new password: wanted user %d, got %d, err %+v", userId, newUserId, err)
+	}
+
+	// Trying to change it again with the old password doesn't work either
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, oldPassword+auth.Password("_other"), newSeed, nil); err != ErrWrongCredentials {
+		t.Errorf("ChangePasswordNoWallet with the old password: wanted %+v, got %+v", ErrWrongCredentials, err)
+	}
+}
+
 func TestStoreChangePasswordNoWalletErrors(t *testing.T) {
 	verifyToken := auth.VerifyTokenString("aoeu1234aoeu1234aoeu1234aoeu1234")
 
@@ -325,7 +387,7 @@ func TestStoreChangePasswordNoWalletErrors(t *testing.T) {
 			newPassword := oldPassword + auth.Password("_new")         // Possibly make the new password different (as it should be)
 			newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
 
-			if _, err := s.ChangePasswordNoWallet(submittedEmail, submittedOldPassword, newPassword, newSeed); err != tc.expectedError {
+			if _, _, err := s.ChangePasswordNoWallet(context.Background(), submittedEmail, submittedOldPassword, newPassword, newSeed, nil); err != tc.expectedError {
 				t.Errorf("ChangePasswordNoWallet: unexpected value for err. want: %+v, got: %+v", tc.expectedError, err)
 			}
 
@@ -343,3 +405,127 @@ func TestStoreChangePasswordNoWalletErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreChangePasswordWeakPassword(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.WeakPasswordCheck = true
+
+	_, email, oldPassword, oldSeed := makeTestUser(t, &s, nil, nil)
+
+	newPassword := auth.Password(email)
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, newPassword, newSeed, nil); err != ErrWeakPassword {
+		t.Errorf(`ChangePasswordNoWallet err: wanted "%+v", got "%+v"`, ErrWeakPassword, err)
+	}
+
+	// Old password still in place
+	expectAccountMatch(t, &s, email.Normalize(), email, oldPassword, oldSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+}
+
+func TestStoreChangePasswordTooShort(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.PasswordMinLength = 12
+
+	_, email, oldPassword, oldSeed := makeTestUser(t, &s, nil, nil)
+
+	newPassword := auth.Password("12345678901")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, newPassword, newSeed, nil); err != ErrPasswordTooShort {
+		t.Errorf(`ChangePasswordNoWallet err: wanted "%+v", got "%+v"`, ErrPasswordTooShort, err)
+	}
+
+	// Old password still in place
+	expectAccountMatch(t, &s, email.Normalize(), email, oldPassword, oldSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+}
+
+func expectAppWallet(t *testing.T, s *Store, userId auth.UserId, appId wallet.AppId, expectedEncryptedWallet wallet.EncryptedWallet, expectedSequence wallet.Sequence) {
+	t.Helper()
+	encryptedWallet, sequence, _, _, err := s.GetWallet(context.Background(), userId, appId)
+	if err != nil || encryptedWallet != expectedEncryptedWallet || sequence != expectedSequence {
+		t.Errorf("Expected %s wallet %s at sequence %d, got %s at %d err %+v", appId, expectedEncryptedWallet, expectedSequence, encryptedWallet, sequence, err)
+	}
+}
+
+// Other apps' wallets are re-encrypted along with the default one, and the
+// password doesn't change without them
+func TestStoreChangePasswordAppWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, oldPassword, oldSeed := makeTestUser(t, &s, nil, nil)
+	for _, appId := range []wallet.AppId{wallet.DefaultAppId, "app-a", "app-b"} {
+		if err := s.SetWallet(context.Background(), userId, appId, "my-enc-wallet", 1, "my-hmac", nil, ""); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	newPassword := oldPassword + auth.Password("_new")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+	appA := AppWalletUpdate{AppId: "app-a", EncryptedWallet: "my-enc-wallet-a-2", Sequence: 2, Hmac: "my-hmac-a-2"}
+	appB := AppWalletUpdate{AppId: "app-b", EncryptedWallet: "my-enc-wallet-b-2", Sequence: 2, Hmac: "my-hmac-b-2"}
+
+	for _, tc := range []struct {
+		name          string
+		appWallets    []AppWalletUpdate
+		expectedError error
+	}{
+		{"none", nil, ErrUnexpectedWallet},
+		{"one left out", []AppWalletUpdate{appA}, ErrUnexpectedWallet},
+		{"wrong sequence", []AppWalletUpdate{appA, {AppId: "app-b", EncryptedWallet: "my-enc-wallet-b-3", Sequence: 3, Hmac: "my-hmac-b-3"}}, ErrWrongSequence},
+		{"app with no wallet", []AppWalletUpdate{appA, appB, {AppId: "app-c", EncryptedWallet: "my-enc-wallet-c-2", Sequence: 2, Hmac: "my-hmac-c-2"}}, ErrWrongSequence},
+		{"same app twice", []AppWalletUpdate{appA, appA, appB}, ErrWrongSequence},
+		{"default app", []AppWalletUpdate{appA, appB, {AppId: wallet.DefaultAppId, EncryptedWallet: "my-enc-wallet-2", Sequence: 2, Hmac: "my-hmac-2"}}, ErrWrongSequence},
+	} {
+		if _, _, err := s.ChangePasswordWithWallet(context.Background(), email, oldPassword, newPassword, newSeed, "my-enc-wallet-2", 2, "my-hmac-2", nil, "", tc.appWallets); err != tc.expectedError {
+			t.Errorf("%s: ChangePasswordWithWallet: want %+v, got %+v", tc.name, tc.expectedError, err)
+		}
+	}
+
+	// None of those changed anything
+	expectAccountMatch(t, &s, email.Normalize(), email, oldPassword, oldSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	for _, appId := range []wallet.AppId{wallet.DefaultAppId, "app-a", "app-b"} {
+		expectAppWallet(t, &s, userId, appId, "my-enc-wallet", 1)
+	}
+
+	if _, _, err := s.ChangePasswordWithWallet(context.Background(), email, oldPassword, newPassword, newSeed, "my-enc-wallet-2", 2, "my-hmac-2", nil, "", []AppWalletUpdate{appB, appA}); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordWithWallet: %+v", err)
+	}
+	expectAccountMatch(t, &s, email.Normalize(), email, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectAppWallet(t, &s, userId, wallet.DefaultAppId, "my-enc-wallet-2", 2)
+	expectAppWallet(t, &s, userId, "app-a", "my-enc-wallet-a-2", 2)
+	expectAppWallet(t, &s, userId, "app-b", "my-enc-wallet-b-2", 2)
+}
+
+// A user whose only wallet is another app's still changes their password
+// without a default wallet
+func TestStoreChangePasswordNoWalletAppWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, oldPassword, oldSeed := makeTestUser(t, &s, nil, nil)
+	if err := s.SetWallet(context.Background(), userId, "app-a", "my-enc-wallet", 1, "my-hmac", nil, ""); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	newPassword := oldPassword + auth.Password("_new")
+	newSeed := auth.ClientSaltSeed("edf98765edf98765edf98765edf98765edf98765edf98765edf98765edf98765")
+
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, newPassword, newSeed, nil); err != ErrUnexpectedWallet {
+		t.Errorf("ChangePasswordNoWallet without the app's wallet: want %+v, got %+v", ErrUnexpectedWallet, err)
+	}
+	expectAccountMatch(t, &s, email.Normalize(), email, oldPassword, oldSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+
+	appWallets := []AppWalletUpdate{{AppId: "app-a", EncryptedWallet: "my-enc-wallet-2", Sequence: 2, Hmac: "my-hmac-2"}}
+	if _, _, err := s.ChangePasswordNoWallet(context.Background(), email, oldPassword, newPassword, newSeed, appWallets); err != nil {
+		t.Fatalf("Unexpected error in ChangePasswordNoWallet: %+v", err)
+	}
+	expectAccountMatch(t, &s, email.Normalize(), email, newPassword, newSeed, nil, nil, time.Now().UTC(), time.Now().UTC())
+	expectAppWallet(t, &s, userId, "app-a", "my-enc-wallet-2", 2)
+	if _, _, _, _, err := s.GetWallet(context.Background(), userId, wallet.DefaultAppId); err != ErrNoWallet {
+		t.Errorf("Expected still no default wallet, got err %+v", err)
+	}
+}
@@ -3,15 +3,22 @@ package store
 // TODO - DeviceId - What about clients that lie about deviceId? Maybe require a certain format to make sure it gives a real value? Something it wouldn't come up with by accident.
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/wallet"
 )
 
@@ -19,25 +26,48 @@ var (
 	ErrDuplicateToken       = fmt.Errorf("Token already exists for this user and device")
 	ErrNoTokenForUserDevice = fmt.Errorf("Token does not exist for this user and device")
 	ErrNoTokenForUser       = fmt.Errorf("Token does not exist for this user")
+	ErrUnsanitaryToken      = fmt.Errorf("Token is missing required fields")
+	ErrInvalidDeviceId      = fmt.Errorf("Device id is not valid")
 
 	ErrDuplicateWallet = fmt.Errorf("Wallet already exists for this user")
 
 	ErrNoWallet = fmt.Errorf("Wallet does not exist for this user")
 
-	ErrUnexpectedWallet = fmt.Errorf("Wallet unexpectedly exist for this user")
-	ErrWrongSequence    = fmt.Errorf("Wallet could not be updated to this sequence")
+	ErrUnexpectedWallet  = fmt.Errorf("Wallet unexpectedly exist for this user")
+	ErrWrongSequence     = fmt.Errorf("Wallet could not be updated to this sequence")
+	ErrWrongParentHmac   = fmt.Errorf("Wallet could not be updated from this parent hmac")
+	ErrNoParentHmac      = fmt.Errorf("Wallet update needs a parent hmac")
+	ErrWalletTooLarge    = fmt.Errorf("Wallet is too large")
+	ErrInvalidHmac       = fmt.Errorf("Wallet hmac is not valid")
+	ErrSequenceExhausted = fmt.Errorf("Wallet sequence is past the highest allowed")
 
 	ErrDuplicateEmail   = fmt.Errorf("Email already exists for this user")
 	ErrDuplicateAccount = fmt.Errorf("User already has an account")
+	ErrInvalidEmail     = fmt.Errorf("Email address is not valid")
+	ErrEmailReserved    = fmt.Errorf("Email belongs to a recently deleted account")
 
 	ErrWrongCredentials = fmt.Errorf("No match for email and/or password")
 	ErrNotVerified      = fmt.Errorf("User account is not verified")
+	ErrAccountLocked    = fmt.Errorf("User account is locked after too many failed logins")
+
+	ErrTotpRequired       = fmt.Errorf("Two-factor code is required for this account")
+	ErrTotpInvalid        = fmt.Errorf("Two-factor code is not valid")
+	ErrTotpAlreadyEnabled = fmt.Errorf("Two-factor authentication is already enabled for this account")
+	ErrTotpNotEnrolled    = fmt.Errorf("Two-factor authentication has not been enrolled for this account")
+
+	ErrWeakPassword     = fmt.Errorf("Password is too easy to guess")
+	ErrPasswordTooShort = fmt.Errorf("Password is too short")
 )
 
 const (
 	AuthTokenLifespan   = time.Hour * 24 * 14
 	VerifyTokenLifespan = time.Hour * 24 * 2
 
+	LoginLockoutDuration = time.Minute * 15
+
+	// The same as the sqlite driver's own default
+	SQLiteBusyTimeout = time.Second * 5
+
 	// Eventually it could become variable when we introduce server switching. A user
 	// might be on a later sequence when they switch from another server.
 	InitialWalletSequence = 1
@@ -45,115 +75,226 @@ const (
 
 // For test stubs
 type StoreInterface interface {
-	SaveToken(*auth.AuthToken) error
-	GetToken(auth.AuthTokenString) (*auth.AuthToken, error)
-	SetWallet(auth.UserId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac) error
-	GetWallet(auth.UserId) (wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, error)
-	GetUserId(auth.Email, auth.Password) (auth.UserId, error)
-	CreateAccount(auth.Email, auth.Password, auth.ClientSaltSeed, *auth.VerifyTokenString) error
-	UpdateVerifyTokenString(auth.Email, auth.VerifyTokenString) error
-	VerifyAccount(auth.VerifyTokenString) error
-	ChangePasswordWithWallet(auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac) (auth.UserId, error)
-	ChangePasswordNoWallet(auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed) (auth.UserId, error)
-	GetClientSaltSeed(auth.Email) (auth.ClientSaltSeed, error)
+	SaveToken(context.Context, *auth.AuthToken) error
+	GetToken(context.Context, auth.AuthTokenString) (*auth.AuthToken, error)
+	RefreshToken(context.Context, auth.AuthTokenString) (time.Time, error)
+	DeleteToken(context.Context, auth.UserId, auth.DeviceId) error
+	GetTokensForUser(context.Context, auth.UserId, int, int) ([]auth.AuthToken, error)
+	UpdateTokenDeviceId(context.Context, auth.UserId, auth.DeviceId, auth.DeviceId) error
+	SetWallet(context.Context, auth.UserId, wallet.AppId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, *wallet.WalletHmac, wallet.EncryptionVersion) error
+	SetWalletBatch(context.Context, auth.UserId, wallet.AppId, []WalletUpdate, *wallet.WalletHmac) error
+	SyncWallet(context.Context, auth.UserId, wallet.AppId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, *wallet.WalletHmac, wallet.EncryptionVersion) (bool, *WalletUpdate, error)
+	ImportWallet(context.Context, auth.UserId, wallet.AppId, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, wallet.EncryptionVersion, []AppWalletUpdate) error
+	GetWallet(context.Context, auth.UserId, wallet.AppId) (wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, wallet.EncryptionVersion, error)
+	GetWalletMetadata(context.Context, auth.UserId, wallet.AppId) (wallet.Sequence, wallet.WalletHmac, error)
+	GetWalletAppIds(context.Context, auth.UserId) ([]wallet.AppId, error)
+	CheckSequence(context.Context, auth.UserId, wallet.AppId, wallet.Sequence) error
+	GetUserId(context.Context, auth.Email, auth.Password) (auth.UserId, error)
+	CreateAccount(context.Context, auth.Email, auth.Password, auth.ClientSaltSeed, *auth.VerifyTokenString) error
+	UpdateVerifyTokenString(context.Context, auth.Email, auth.VerifyTokenString) error
+	VerifyAccount(context.Context, auth.VerifyTokenString) error
+	ChangePasswordWithWallet(context.Context, auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed, wallet.EncryptedWallet, wallet.Sequence, wallet.WalletHmac, *wallet.WalletHmac, wallet.EncryptionVersion, []AppWalletUpdate) (auth.UserId, int64, error)
+	ChangePasswordNoWallet(context.Context, auth.Email, auth.Password, auth.Password, auth.ClientSaltSeed, []AppWalletUpdate) (auth.UserId, int64, error)
+	GetClientSaltSeed(context.Context, auth.Email) (auth.ClientSaltSeed, error)
+	EmailExists(context.Context, auth.Email) (bool, error)
+	GetEmail(context.Context, auth.UserId) (auth.Email, error)
+	GetAccountStatus(context.Context, auth.Email, wallet.AppId) (AccountStatus, error)
+	GetSigningPublicKey(context.Context, auth.Email) (auth.SigningPublicKey, error)
+	SetSigningPublicKey(context.Context, auth.UserId, auth.SigningPublicKey) error
+	DeleteAccount(context.Context, auth.UserId) error
+	CheckAndStoreNonce(context.Context, string, time.Duration) (bool, error)
+	Ping(context.Context) error
+	UpdateDeviceSync(context.Context, auth.UserId, auth.DeviceId, wallet.Sequence) error
+	GetDeviceSyncs(context.Context, auth.UserId) ([]DeviceSync, error)
+	PurgeExpiredTokens(context.Context) (int64, error)
+	AddKnownDevice(context.Context, auth.UserId, auth.DeviceId) (bool, error)
+	SetTotpSecret(context.Context, auth.UserId, auth.TotpSecret) (auth.Email, error)
+	EnableTotp(context.Context, auth.UserId, auth.TotpCode) error
+	CheckTotp(context.Context, auth.UserId, auth.TotpCode) error
 }
 
 type Store struct {
 	db *sql.DB
+
+	// If set, log (and count) wallet updates where the encrypted wallet is
+	// byte-identical to the previous version but the hmac changed. They're not
+	// rejected, but they shouldn't normally happen, so they may point to a bug
+	// in a client.
+	FlagSameWalletNewHmac bool
+
+	// If set, reject new passwords (on account creation and password change)
+	// that are too easy to guess given the email address or that contain any of
+	// WeakPasswordPatterns. See auth.Password.IsWeak.
+	WeakPasswordCheck    bool
+	WeakPasswordPatterns []string
+
+	// If set, reject new passwords (on account creation and password change)
+	// shorter than this with ErrPasswordTooShort. The request handlers insist
+	// on 8 characters regardless (see auth.Password.Validate), so this is only
+	// useful above that.
+	PasswordMinLength int
+
+	// If set, every wallet update (anything but the first wallet) has to give
+	// the hmac of the wallet it was built on, and it has to match the one we
+	// have. The wallet history then forms a chain where every version follows
+	// from the one before, and two devices that each made a different version
+	// at the same sequence can't overwrite each other. Updates that don't give
+	// one fail with ErrNoParentHmac.
+	RequireParentHmac bool
+
+	// How long a token is good for, from when it's issued or refreshed. Zero
+	// means AuthTokenLifespan.
+	TokenExpirationDuration time.Duration
+
+	// If set, after this many failed logins in a row (see GetUserId), the
+	// account can't log in for LoginLockoutDuration, even with the right
+	// password. Zero means no lockout. Keep in mind that anyone who knows the
+	// email address can lock the account this way.
+	LoginLockoutThreshold int
+
+	// Zero means LoginLockoutDuration
+	LoginLockoutDuration time.Duration
+
+	// If set, the email of a deleted account can't sign up again for this long
+	// (CreateAccount fails with ErrEmailReserved), so that whoever gets the
+	// address next can't pick up where the old account's devices left off
+	// right away. Zero means it can sign up again right after.
+	DeletedEmailReservation time.Duration
+
+	// The cost new passwords are hashed with (see auth.DefaultPasswordCost).
+	// Keys with a lower cost are hashed again with this one the next time they
+	// log in (see GetUserId), so raising it upgrades accounts as they're used.
+	// Lowering it doesn't downgrade anything. Zero means
+	// auth.DefaultPasswordCost.
+	PasswordCost int
+
+	// If set, reject encrypted wallets longer than this (in bytes) with
+	// ErrWalletTooLarge. The request handlers check first, so this is just to
+	// be safe. Zero means no limit.
+	MaxWalletSize int
+
+	// Reject wallets with a sequence above this with ErrSequenceExhausted,
+	// rather than let it go on until it's too big for the clients (or for
+	// wallet.Sequence). There's no going past it, so the client has to start
+	// over with a new wallet. Zero means wallet.DefaultMaxSequence.
+	MaxWalletSequence wallet.Sequence
+
+	// If set, reject wallets whose hmac can't be what the LBRY clients make
+	// (see wallet.WalletHmac.Validate) with ErrInvalidHmac, so we don't store a
+	// wallet that could never pass the check on download. Off by default in
+	// case another client does it differently.
+	HmacFormatCheck bool
+
+	// SQLite only lets one connection write at a time. This is how long a write
+	// waits for its turn before giving up with "database is locked". Zero
+	// means SQLiteBusyTimeout. Only takes effect on Init.
+	BusyTimeout time.Duration
+
+	// If set, use SQLite's write-ahead log instead of its rollback journal.
+	// Reads then don't wait on writes or the other way around, though writes
+	// still go one at a time. The database gets -wal and -shm files next to it,
+	// which go with it if it's copied while the server is running, and it can't
+	// be on a network filesystem. Once on, it stays on for the database even if
+	// this is turned off. Only takes effect on Init.
+	WALMode bool
+
+	// If set, the most connections to the database at once. With 1, requests
+	// wait their turn in the server rather than in SQLite, so there's no busy
+	// timeout to run out, but reads also wait on writes (and on each other).
+	// Zero means no limit. Only takes effect on Init.
+	MaxOpenConns int
+
+	// Where expirations, lockouts and the like get the time from. Nil means
+	// the system clock. Only for tests, which can set one that doesn't move
+	// unless they move it.
+	Clock Clock
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (s *Store) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+func (s *Store) busyTimeout() time.Duration {
+	if s.BusyTimeout == 0 {
+		return SQLiteBusyTimeout
+	}
+	return s.BusyTimeout
+}
+
+func (s *Store) maxWalletSequence() wallet.Sequence {
+	if s.MaxWalletSequence == 0 {
+		return wallet.DefaultMaxSequence
+	}
+	return s.MaxWalletSequence
+}
+
+func (s *Store) lockoutDuration() time.Duration {
+	if s.LoginLockoutDuration == 0 {
+		return LoginLockoutDuration
+	}
+	return s.LoginLockoutDuration
+}
+
+func (s *Store) passwordCost() int {
+	if s.PasswordCost == 0 {
+		return auth.DefaultPasswordCost
+	}
+	return s.PasswordCost
+}
+
+func (s *Store) tokenLifespan() time.Duration {
+	if s.TokenExpirationDuration == 0 {
+		return AuthTokenLifespan
+	}
+	return s.TokenExpirationDuration
 }
 
 func (s *Store) Init(fileName string) {
-	db, err := sql.Open("sqlite3", "file:"+fileName+"?_foreign_keys=on")
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", strconv.FormatInt(s.busyTimeout().Milliseconds(), 10))
+	// Transactions take the write lock when they start, rather than on their
+	// first write. Otherwise a transaction that reads before it writes can find
+	// that another connection got the write lock in the meantime, and SQLite
+	// fails it with "database is locked" right away instead of waiting.
+	params.Set("_txlock", "immediate")
+	if s.WALMode {
+		params.Set("_journal_mode", "WAL")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+fileName+"?"+params.Encode())
 	if err != nil {
 		log.Fatal(err)
 	}
+	if s.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(s.MaxOpenConns)
+	}
 	s.db = db
 }
 
-func (s *Store) Migrate() error {
-	// We use the `sequence` field for transaction safety. For instance, let's
-	// say two different clients are trying to update the sequence from 5 to 6.
-	// The update command will specify "WHERE sequence=5". Only one of these
-	// commands will succeed, and the other will get back an error.
-
-	// We use AUTOINCREMENT against the protestations of people on the Internet
-	// who claim that INTEGER PRIMARY KEY automatically has autoincrment, and
-	// that using it when it's not "strictly needed" uses extra resources. But
-	// without AUTOINCREMENT, it might reuse primary keys if a row is deleted and
-	// re-added. Who wants that risk? Besides, we'll switch to Postgres when it's
-	// time to scale anyway.
-
-	// We use UNIQUE on auth_tokens.token so that we can retrieve it easily and
-	// identify the user (and I suppose the uniqueness provides a little extra
-	// security in case we screw up the random generator). However the primary
-	// key should still be (user_id, device_id) so that a device's row can be
-	// updated with a new token.
-	query := `
-		CREATE TABLE IF NOT EXISTS auth_tokens(
-			token TEXT NOT NULL UNIQUE,
-			user_id INTEGER NOT NULL,
-			device_id TEXT NOT NULL,
-			scope TEXT NOT NULL,
-			expiration DATETIME NOT NULL,
-			CHECK (
-			  -- should eventually fail for foreign key constraint instead
-			  device_id <> '' AND
-
-			  token <> '' AND
-			  scope <> '' AND
-
-			  -- Don't know when it uses either format to denote UTC
-			  expiration <> "0001-01-01 00:00:00+00:00" AND
-			  expiration <> "0001-01-01 00:00:00Z"
-
-			),
-			PRIMARY KEY (user_id, device_id)
-			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
-		);
-		CREATE TABLE IF NOT EXISTS wallets(
-			user_id INTEGER NOT NULL,
-			encrypted_wallet TEXT NOT NULL,
-			sequence INTEGER NOT NULL,
-			hmac TEXT NOT NULL,
-			updated DATETIME NOT NULL,
-
-			PRIMARY KEY (user_id)
-			FOREIGN KEY (user_id) REFERENCES accounts(user_id)
-			CHECK (
-			  encrypted_wallet <> '' AND
-			  hmac <> '' AND
-			  sequence <> 0
-			)
-		);
-		CREATE TABLE IF NOT EXISTS accounts(
-			normalized_email TEXT NOT NULL UNIQUE,
-			email TEXT NOT NULL,
-			key TEXT NOT NULL,
-			client_salt_seed TEXT NOT NULL,
-			server_salt TEXT NOT NULL,
-
-			-- UNIQUE because we will query by token when verifying
-			--
-			-- Nullable because we want to use null to represent verified users. We can't use empty string
-			-- because multiple accounts with empty string will trigger the unique constraint, unlike null.
-			verify_token TEXT UNIQUE,
-
-			verify_expiration DATETIME,
-			user_id INTEGER PRIMARY KEY AUTOINCREMENT,
-			created DATETIME DEFAULT (DATETIME('now')),
-			updated DATETIME NOT NULL,
-			CHECK (
-			  email <> '' AND
-			  normalized_email <> '' AND
-			  key <> '' AND
-			  client_salt_seed <> '' AND
-			  server_salt <> ''
-			)
-		);
-	`
+// Only once nothing is using the store anymore, such as after the server has
+// shut down
+func (s *Store) Close() error {
+	return s.db.Close()
+}
 
-	_, err := s.db.Exec(query)
-	return err
+// Make sure the database is there and answering, for health checks
+func (s *Store) Ping(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
 }
 
 ////////////////
@@ -167,17 +308,40 @@ func (s *Store) Migrate() error {
 // TODO Put the timestamp in the token to avoid duplicates over time. And/or just use a library! Someone solved this already.
 // Assumption: User is verified (as it was necessary to call SaveToken to begin
 // with)
-func (s *Store) GetToken(token auth.AuthTokenString) (authToken *auth.AuthToken, err error) {
-	expirationCutoff := time.Now().UTC()
+func (s *Store) GetToken(ctx context.Context, token auth.AuthTokenString) (authToken *auth.AuthToken, err error) {
+	expirationCutoff := s.clock().Now().UTC()
 
+	return s.getToken(
+		ctx,
+		"SELECT token, user_id, device_id, device_name, scope, expiration FROM auth_tokens WHERE token=? AND expiration>?", token, expirationCutoff,
+	)
+}
+
+// Same as GetToken, but an expired token comes back too, with `expired` set,
+// so that it can be told apart from one that was never there. That only
+// lasts until it's purged (see PurgeExpiredTokens). For admin tools and the
+// like; a request must never be let through on an expired token.
+func (s *Store) GetTokenIncludingExpired(token auth.AuthTokenString) (authToken *auth.AuthToken, expired bool, err error) {
+	authToken, err = s.getToken(
+		context.Background(),
+		"SELECT token, user_id, device_id, device_name, scope, expiration FROM auth_tokens WHERE token=?", token,
+	)
+	if err != nil {
+		return
+	}
+	// Same cutoff as GetToken: expired from the moment of expiration on
+	expired = !authToken.Expiration.After(s.clock().Now().UTC())
+	return
+}
+
+func (s *Store) getToken(ctx context.Context, query string, args ...interface{}) (authToken *auth.AuthToken, err error) {
 	authToken = &(auth.AuthToken{})
 
-	err = s.db.QueryRow(
-		"SELECT token, user_id, device_id, scope, expiration FROM auth_tokens WHERE token=? AND expiration>?", token, expirationCutoff,
-	).Scan(
+	err = s.db.QueryRowContext(ctx, query, args...).Scan(
 		&authToken.Token,
 		&authToken.UserId,
 		&authToken.DeviceId,
+		&authToken.DeviceName,
 		&authToken.Scope,
 		&authToken.Expiration,
 	)
@@ -186,14 +350,22 @@ func (s *Store) GetToken(token auth.AuthTokenString) (authToken *auth.AuthToken,
 	}
 	if err != nil {
 		authToken = nil
+		return
+	}
+	// The driver already parses these as UTC, unless someone adds _loc to the
+	// connection string
+	if authToken.Expiration != nil {
+		expiration := authToken.Expiration.UTC()
+		authToken.Expiration = &expiration
 	}
 	return
 }
 
-func (s *Store) insertToken(authToken *auth.AuthToken, expiration time.Time) (err error) {
-	_, err = s.db.Exec(
-		"INSERT INTO auth_tokens (token, user_id, device_id, scope, expiration) VALUES(?,?,?,?,?)",
-		authToken.Token, authToken.UserId, authToken.DeviceId, authToken.Scope, expiration,
+func (s *Store) insertToken(ctx context.Context, authToken *auth.AuthToken, expiration time.Time) (err error) {
+	_, err = s.db.ExecContext(
+		ctx,
+		"INSERT INTO auth_tokens (token, user_id, device_id, device_name, scope, expiration) VALUES(?,?,?,?,?,?)",
+		authToken.Token, authToken.UserId, authToken.DeviceId, authToken.DeviceName, authToken.Scope, expiration.UTC(),
 	)
 
 	var sqliteErr sqlite3.Error
@@ -208,10 +380,11 @@ func (s *Store) insertToken(authToken *auth.AuthToken, expiration time.Time) (er
 	return
 }
 
-func (s *Store) updateToken(authToken *auth.AuthToken, experation time.Time) (err error) {
-	res, err := s.db.Exec(
-		"UPDATE auth_tokens SET token=?, expiration=?, scope=? WHERE user_id=? AND device_id=?",
-		authToken.Token, experation, authToken.Scope, authToken.UserId, authToken.DeviceId,
+func (s *Store) updateToken(ctx context.Context, authToken *auth.AuthToken, experation time.Time) (err error) {
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE auth_tokens SET token=?, expiration=?, scope=?, device_name=? WHERE user_id=? AND device_id=?",
+		authToken.Token, experation.UTC(), authToken.Scope, authToken.DeviceName, authToken.UserId, authToken.DeviceId,
 	)
 	if err != nil {
 		return
@@ -227,31 +400,49 @@ func (s *Store) updateToken(authToken *auth.AuthToken, experation time.Time) (er
 	return
 }
 
+// The token, device, and user are what identify a token row. The CHECK
+// constraints would catch most of this anyway, but we want to fail before
+// SaveToken works out an expiration, not after.
+func sanitizeToken(token *auth.AuthToken) error {
+	if token.Token == "" || token.DeviceId == "" || token.UserId == 0 {
+		return ErrUnsanitaryToken
+	}
+	// See auth.DeviceId.Validate. The request handlers check first.
+	if !token.DeviceId.Validate() {
+		return ErrInvalidDeviceId
+	}
+	return nil
+}
+
 // Assumption: User is verified (as they have been identified with GetUserId
 // which requires users be verified)
-func (s *Store) SaveToken(token *auth.AuthToken) (err error) {
+func (s *Store) SaveToken(ctx context.Context, token *auth.AuthToken) (err error) {
+	if err = sanitizeToken(token); err != nil {
+		return
+	}
+
 	// TODO: For psql, do upsert here instead of separate insertToken and updateToken functions
 	//       Actually it may even be available for SQLite?
 	//       But not for wallet, it probably makes sense to keep that separate because of the sequence variable
 
-	// TODO - Should we auto-delete expired tokens?
+	// Expired tokens are left in place here (see PurgeExpiredTokens)
 
-	expiration := time.Now().UTC().Add(AuthTokenLifespan)
+	expiration := s.clock().Now().UTC().Add(s.tokenLifespan())
 
 	// This is most likely not the first time calling this function for this
 	// device, so there's probably already a token in there.
-	err = s.updateToken(token, expiration)
+	err = s.updateToken(ctx, token, expiration)
 
 	if err == ErrNoTokenForUserDevice {
 		// If we don't have a token already saved, insert a new one:
-		err = s.insertToken(token, expiration)
+		err = s.insertToken(ctx, token, expiration)
 
 		if err == ErrDuplicateToken {
 			// By unlikely coincidence, a token was created between trying `updateToken`
 			// and trying `insertToken`. At this point we can safely `updateToken`.
 			// TODO - reconsider this - if one client has two concurrent requests
 			// that create this situation, maybe the second one should just fail?
-			err = s.updateToken(token, expiration)
+			err = s.updateToken(ctx, token, expiration)
 		}
 	}
 	if err == nil {
@@ -260,19 +451,181 @@ func (s *Store) SaveToken(token *auth.AuthToken) (err error) {
 	return
 }
 
+// Push the expiration of a token that hasn't expired yet out to a full token
+// lifespan from now, same as SaveToken would give a new one. The
+// token string stays the same. Fails with ErrNoTokenForUserDevice if the token
+// doesn't exist or has already expired.
+func (s *Store) RefreshToken(ctx context.Context, token auth.AuthTokenString) (expiration time.Time, err error) {
+	now := s.clock().Now().UTC()
+	expiration = now.Add(s.tokenLifespan())
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE auth_tokens SET expiration=? WHERE token=? AND expiration>?",
+		expiration, token, now,
+	)
+	if err != nil {
+		return
+	}
+
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrNoTokenForUserDevice
+	}
+	return
+}
+
+// The user's unexpired tokens, one per logged in device, ordered by device id.
+// The token strings are left out; this is for showing the user their devices,
+// not for authenticating as them. An empty list (not an error) if there are
+// none.
+//
+// At most `limit` of them (zero means all of them), skipping the first
+// `offset`. Device ids don't change when a token is refreshed the way
+// expirations do, so the order holds still from one page to the next.
+func (s *Store) GetTokensForUser(ctx context.Context, userId auth.UserId, limit int, offset int) (tokens []auth.AuthToken, err error) {
+	expirationCutoff := s.clock().Now().UTC()
+
+	if limit == 0 {
+		limit = -1 // no limit, to SQLite
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT user_id, device_id, device_name, scope, expiration FROM auth_tokens WHERE user_id=? AND expiration>? ORDER BY device_id LIMIT ? OFFSET ?",
+		userId, expirationCutoff, limit, offset,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	tokens = []auth.AuthToken{}
+	for rows.Next() {
+		var token auth.AuthToken
+		var expiration time.Time
+		if err = rows.Scan(&token.UserId, &token.DeviceId, &token.DeviceName, &token.Scope, &expiration); err != nil {
+			tokens = nil
+			return
+		}
+		expiration = expiration.UTC()
+		token.Expiration = &expiration
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		tokens = nil
+	}
+	return
+}
+
+// Log out the one device. The user's tokens for other devices are left alone.
+// Fails with ErrNoTokenForUserDevice if there's no token for the device.
+func (s *Store) DeleteToken(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) (err error) {
+	res, err := s.db.ExecContext(
+		ctx,
+		"DELETE FROM auth_tokens WHERE user_id=? AND device_id=?",
+		userId, deviceId,
+	)
+	if err != nil {
+		return
+	}
+
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrNoTokenForUserDevice
+	}
+	return
+}
+
+// Log out every device for the user. Only the tokens are touched, not the
+// account or the wallet. Returns how many tokens were deleted, which may be
+// zero.
+func (s *Store) DeleteAllTokens(ctx context.Context, userId auth.UserId) (numDeleted int64, err error) {
+	return deleteAllTokensWith(ctx, s.db, userId)
+}
+
+func deleteAllTokensWith(ctx context.Context, q querier, userId auth.UserId) (numDeleted int64, err error) {
+	res, err := q.ExecContext(ctx, "DELETE FROM auth_tokens WHERE user_id=?", userId)
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// Delete every user's expired tokens. They're already ignored everywhere
+// else, so this just keeps the table from growing forever. Returns how many
+// were deleted.
+func (s *Store) PurgeExpiredTokens(ctx context.Context) (numDeleted int64, err error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM auth_tokens WHERE expiration<=?", s.clock().Now().UTC())
+	if err != nil {
+		return
+	}
+	return res.RowsAffected()
+}
+
+// Move the user's token from one device id to another, keeping the session
+// (token string, scope, expiration) intact. Fails with ErrDuplicateToken if
+// the user already has a token for the new device id.
+func (s *Store) UpdateTokenDeviceId(ctx context.Context, userId auth.UserId, oldDeviceId auth.DeviceId, newDeviceId auth.DeviceId) (err error) {
+	if !newDeviceId.Validate() {
+		err = ErrInvalidDeviceId
+		return
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE auth_tokens SET device_id=? WHERE user_id=? AND device_id=?",
+		newDeviceId, userId, oldDeviceId,
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintPrimaryKey) {
+				err = ErrDuplicateToken
+			}
+		}
+		return
+	}
+
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrNoTokenForUserDevice
+	}
+	return
+}
+
 ////////////
 // Wallet //
 ////////////
 
+// Every wallet function takes the app (see wallet.AppId) whose wallet it's
+// for. Each app's wallet is separate, with its own sequence, and has nothing
+// to do with any other app's.
+//
 // Assumption: Auth token has been checked (thus account is verified)
-func (s *Store) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
-	err = s.db.QueryRow(
-		"SELECT encrypted_wallet, sequence, hmac FROM wallets WHERE user_id=?",
-		userId,
+func (s *Store) GetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, err error) {
+	return getWalletWith(ctx, s.db, userId, appId)
+}
+
+func getWalletWith(ctx context.Context, q querier, userId auth.UserId, appId wallet.AppId) (encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, err error) {
+	err = q.QueryRowContext(
+		ctx,
+		"SELECT encrypted_wallet, sequence, hmac, encryption_version FROM wallets WHERE user_id=? AND app_id=?",
+		userId, appId,
 	).Scan(
 		&encryptedWallet,
 		&sequence,
 		&hmac,
+		&encryptionVersion,
 	)
 	if err == sql.ErrNoRows {
 		err = ErrNoWallet
@@ -280,18 +633,158 @@ func (s *Store) GetWallet(userId auth.UserId) (encryptedWallet wallet.EncryptedW
 	return
 }
 
+// Just the sequence and hmac of the current wallet, without the (possibly big)
+// encrypted wallet itself. Enough to tell whether a client is up to date.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) GetWalletMetadata(ctx context.Context, userId auth.UserId, appId wallet.AppId) (sequence wallet.Sequence, hmac wallet.WalletHmac, err error) {
+	err = s.db.QueryRowContext(
+		ctx,
+		"SELECT sequence, hmac FROM wallets WHERE user_id=? AND app_id=?",
+		userId, appId,
+	).Scan(
+		&sequence,
+		&hmac,
+	)
+	if err == sql.ErrNoRows {
+		err = ErrNoWallet
+	}
+	return
+}
+
+// Every app the user has a wallet for, the default app included
+func (s *Store) GetWalletAppIds(ctx context.Context, userId auth.UserId) (appIds []wallet.AppId, err error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT app_id FROM wallets WHERE user_id=? ORDER BY app_id",
+		userId,
+	)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	appIds = []wallet.AppId{}
+	for rows.Next() {
+		var appId wallet.AppId
+		if err = rows.Scan(&appId); err != nil {
+			appIds = nil
+			return
+		}
+		appIds = append(appIds, appId)
+	}
+	if err = rows.Err(); err != nil {
+		appIds = nil
+	}
+	return
+}
+
+// See MaxWalletSize
+func (s *Store) walletTooLarge(encryptedWallet wallet.EncryptedWallet) bool {
+	return s.MaxWalletSize > 0 && len(encryptedWallet) > s.MaxWalletSize
+}
+
+// See MaxWalletSequence
+func (s *Store) sequenceExhausted(sequence wallet.Sequence) bool {
+	return sequence > s.maxWalletSequence()
+}
+
+// See HmacFormatCheck
+func (s *Store) invalidHmac(hmac wallet.WalletHmac) bool {
+	return s.HmacFormatCheck && !hmac.Validate()
+}
+
+// See RequireParentHmac
+func (s *Store) missingParentHmac(sequence wallet.Sequence, parentHmac *wallet.WalletHmac) bool {
+	return s.RequireParentHmac && sequence != InitialWalletSequence && parentHmac == nil
+}
+
+// Satisfied by both *sql.DB and *sql.Tx, so that the same wallet queries can
+// be run on their own or as part of a bigger transaction. Callers that don't
+// take a context themselves yet pass context.Background().
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Run fn in a transaction. It's committed if fn returns nil, and rolled back
+// if fn returns an error (which is returned as is) or panics (which carries
+// on panicking once it's rolled back). fn shouldn't use s.db itself, since
+// with MaxOpenConns set that can wait forever on the connection fn is holding.
+func (s *Store) withTx(ctx context.Context, fn func(*sql.Tx) error) (err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = fn(tx)
+	return
+}
+
 func (s *Store) insertFirstWallet(
+	ctx context.Context,
+	userId auth.UserId,
+	appId wallet.AppId,
+	encryptedWallet wallet.EncryptedWallet,
+	hmac wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+) (err error) {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return insertFirstWalletWith(ctx, tx, userId, appId, encryptedWallet, hmac, encryptionVersion)
+	})
+}
+
+func insertFirstWalletWith(
+	ctx context.Context,
+	q querier,
+	userId auth.UserId,
+	appId wallet.AppId,
+	encryptedWallet wallet.EncryptedWallet,
+	hmac wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+) (err error) {
+	return insertWalletWith(ctx, q, userId, appId, encryptedWallet, InitialWalletSequence, hmac, encryptionVersion)
+}
+
+// The first wallet is normally at InitialWalletSequence, but an imported one
+// can start anywhere.
+func insertWalletWith(
+	ctx context.Context,
+	q querier,
 	userId auth.UserId,
+	appId wallet.AppId,
 	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
 ) (err error) {
-	// This will only be used to attempt to insert the first wallet (sequence=InitialWalletSequence).
+	if err = checkRollbackWith(ctx, q, userId, appId, sequence); err != nil {
+		return
+	}
+
+	// This will only be used to attempt to insert the first wallet.
 	//   The database will enforce that this will not be set if this user already
-	//   has a wallet.
-	_, err = s.db.Exec(
-		"INSERT INTO wallets (user_id, encrypted_wallet, sequence, hmac, updated) VALUES(?,?,?,?, datetime('now'))",
-		userId, encryptedWallet, InitialWalletSequence, hmac,
+	//   has a wallet for this app.
+	_, err = q.ExecContext(
+		ctx,
+		"INSERT INTO wallets (user_id, app_id, encrypted_wallet, sequence, hmac, encryption_version, updated) VALUES(?,?,?,?,?,?, datetime('now'))",
+		userId, appId, encryptedWallet, sequence, hmac, encryptionVersion,
 	)
+	if err == nil {
+		err = raiseHighestSequenceWith(ctx, q, userId, appId, sequence)
+	}
 
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
@@ -308,19 +801,74 @@ func (s *Store) insertFirstWallet(
 }
 
 func (s *Store) updateWalletToSequence(
+	ctx context.Context,
+	userId auth.UserId,
+	appId wallet.AppId,
+	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
+	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+) (err error) {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return updateWalletToSequenceWith(ctx, tx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+	})
+}
+
+func updateWalletToSequenceWith(
+	ctx context.Context,
+	q querier,
 	userId auth.UserId,
+	appId wallet.AppId,
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
 ) (err error) {
+	if err = checkRollbackWith(ctx, q, userId, appId, sequence); err != nil {
+		return
+	}
+
+	// Gaps are never allowed: a wallet is always replaced by the very next
+	// sequence. The update below couldn't match a jump anyway, but say so
+	// outright rather than count on how it's written. Anything at or below the
+	// wallet we have is left to the update, which fails as usual.
+	var currentSequence wallet.Sequence
+	err = q.QueryRowContext(
+		ctx,
+		"SELECT sequence FROM wallets WHERE user_id=? AND app_id=?", userId, appId,
+	).Scan(&currentSequence)
+	if err == nil && sequence > currentSequence+1 {
+		err = ErrWrongSequence
+		return
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+
 	// This will be used for wallets with sequence > InitialWalletSequence.
 	// Use the database to enforce that we only update if we are incrementing the sequence.
 	// This way, if two clients attempt to update at the same time, it will return
 	// an error for the second one.
-	res, err := s.db.Exec(
-		"UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, updated=datetime('now') WHERE user_id=? AND sequence=?",
-		encryptedWallet, sequence, hmac, userId, sequence-1,
-	)
+	//
+	// If parentHmac is given, the wallet at `sequence - 1` also has to have that
+	// hmac. That is, the new wallet has to be built on the version we have, not
+	// on some other fork that happens to have the same sequence.
+	var res sql.Result
+	if parentHmac == nil {
+		res, err = q.ExecContext(
+			ctx,
+			"UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, encryption_version=?, updated=datetime('now') WHERE user_id=? AND app_id=? AND sequence=?",
+			encryptedWallet, sequence, hmac, encryptionVersion, userId, appId, sequence-1,
+		)
+	} else {
+		res, err = q.ExecContext(
+			ctx,
+			"UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, encryption_version=?, updated=datetime('now') WHERE user_id=? AND app_id=? AND sequence=? AND hmac=?",
+			encryptedWallet, sequence, hmac, encryptionVersion, userId, appId, sequence-1, *parentHmac,
+		)
+	}
 	if err != nil {
 		return
 	}
@@ -329,66 +877,727 @@ func (s *Store) updateWalletToSequence(
 	if err != nil {
 		return
 	}
+	if numRows == 0 && parentHmac != nil {
+		// Figure out whether it was the sequence or the parent hmac that didn't
+		// match. This is only for picking which error to return; the update
+		// already failed either way.
+		var dummy string
+		err = q.QueryRowContext(
+			ctx,
+			"SELECT 1 FROM wallets WHERE user_id=? AND app_id=? AND sequence=?",
+			userId, appId, sequence-1,
+		).Scan(&dummy)
+		if err == nil {
+			err = ErrWrongParentHmac
+			return
+		}
+		if err != sql.ErrNoRows {
+			return
+		}
+	}
 	if numRows == 0 {
 		// NOTE While ErrNoWallet makes sense in the context of trying to update,
 		// SetWallet, which also handles insert, translates this to ErrWrongSequence
 		err = ErrNoWallet
+		return
 	}
+	err = raiseHighestSequenceWith(ctx, q, userId, appId, sequence)
 	return
 }
 
+// Rollback protection. We remember the highest wallet sequence each account
+// has ever had for each app, separately from the wallet itself, and refuse
+// anything below it. The normal sequence check already covers this as long as we have the
+// latest wallet, but this holds even if the wallet we have is ever not the
+// latest (lost, pruned, restored from backup, etc).
+//
+// Someone trying to write an old wallet is either a client that's way out of
+// date or someone replaying a wallet they captured. Either way we want to
+// know about it.
+func checkRollbackWith(ctx context.Context, q querier, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (err error) {
+	var highestSequence wallet.Sequence
+	err = q.QueryRowContext(
+		ctx,
+		"SELECT sequence FROM highest_wallet_sequences WHERE user_id=? AND app_id=?", userId, appId,
+	).Scan(&highestSequence)
+	if err == sql.ErrNoRows {
+		// Never had a wallet for this app, nothing to compare to
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	if sequence < highestSequence {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "wallet-rollback-attempt"}).Inc()
+		log.Printf("Security: refused wallet write for user id %d app id %q at sequence %d, below the highest sequence it has had (%d). Possible rollback attempt.", userId, appId, sequence, highestSequence)
+		// To the caller it's just a stale sequence
+		err = ErrWrongSequence
+	}
+	return
+}
+
+func raiseHighestSequenceWith(ctx context.Context, q querier, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (err error) {
+	_, err = q.ExecContext(
+		ctx,
+		`INSERT INTO highest_wallet_sequences (user_id, app_id, sequence) VALUES(?,?,?)
+		ON CONFLICT(user_id, app_id) DO UPDATE SET sequence=excluded.sequence WHERE sequence<excluded.sequence`,
+		userId, appId, sequence,
+	)
+	return
+}
+
+// Check whether the wallet we're about to replace (at `sequence - 1`) has the
+// same encrypted wallet as the new one, but a different hmac. If so, log it.
+// We only flag it; this is not part of the sequence check, so it's fine that
+// it's not in the same transaction as the update.
+func (s *Store) flagSameWalletNewHmac(
+	ctx context.Context,
+	userId auth.UserId,
+	appId wallet.AppId,
+	encryptedWallet wallet.EncryptedWallet,
+	sequence wallet.Sequence,
+	hmac wallet.WalletHmac,
+) {
+	var sameWalletNewHmac bool
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT encrypted_wallet=? AND hmac<>? FROM wallets WHERE user_id=? AND app_id=? AND sequence=?",
+		encryptedWallet, hmac, userId, appId, sequence-1,
+	).Scan(&sameWalletNewHmac)
+	if err == sql.ErrNoRows {
+		// Nothing to compare to. The update will fail on the sequence anyway.
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking for same wallet with new hmac: %+v", err)
+		return
+	}
+	if sameWalletNewHmac {
+		metrics.ErrorsCount.With(prometheus.Labels{"error_type": "same-wallet-new-hmac"}).Inc()
+		log.Printf("Wallet for user id %d updated to sequence %d with an identical encrypted wallet but a different hmac", userId, sequence)
+	}
+}
+
+// parentHmac is optional. If given, it's the hmac of the wallet (at
+// `sequence - 1`) that the client built this one on. If it doesn't match ours,
+// the update fails with ErrWrongParentHmac. It's ignored for the first wallet
+// since there's no parent.
+//
+// encryptionVersion is stored as-is, replacing whatever the previous wallet
+// had. See wallet.EncryptionVersion.
+//
+// Picking insert vs update based on the sequence the client gave (rather than
+// on what's in the database) doesn't leave room for a race: either way it's
+// one statement that the database only lets through if the client was right.
+// Of any number of concurrent calls for the same sequence, exactly one wins
+// and the rest get ErrWrongSequence. There are never gaps: an update has to be
+// exactly one past the wallet we have, and skipping ahead (say, from 2 to 5)
+// gets ErrWrongSequence too. The rollback check and the bump to the
+// highest sequence (see checkRollbackWith) go in the same transaction as that
+// statement, so the wallet and its floor never disagree.
+//
 // Assumption: Sequence has been validated (>=InitialWalletSequence)
 // Assumption: Auth token has been checked (thus account is verified)
-func (s *Store) SetWallet(userId auth.UserId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac) (err error) {
+func (s *Store) SetWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (err error) {
+	if s.walletTooLarge(encryptedWallet) {
+		err = ErrWalletTooLarge
+		return
+	}
+	if s.invalidHmac(hmac) {
+		err = ErrInvalidHmac
+		return
+	}
+	if s.sequenceExhausted(sequence) {
+		err = ErrSequenceExhausted
+		return
+	}
+	if s.missingParentHmac(sequence, parentHmac) {
+		err = ErrNoParentHmac
+		return
+	}
+
 	if sequence == InitialWalletSequence {
 		// If sequence == InitialWalletSequence, the client assumed that this is our first
 		// wallet. Try to insert. If we get a conflict, the client
 		// assumed incorrectly and we proceed below to return the latest
 		// wallet from the db.
-		err = s.insertFirstWallet(userId, encryptedWallet, hmac)
+		err = s.insertFirstWallet(ctx, userId, appId, encryptedWallet, hmac, encryptionVersion)
 		if err == ErrDuplicateWallet {
 			// A wallet already exists. That means the input sequence should not be InitialWalletSequence.
 			// To the caller, this means the sequence was wrong.
 			err = ErrWrongSequence
 		}
-	} else {
-		// If sequence > InitialWalletSequence, the client assumed that it is replacing wallet
-		// with sequence - 1. Explicitly try to update the wallet with
-		// sequence - 1. If we updated no rows, the client assumed incorrectly
-		// and we proceed below to return the latest wallet from the db.
-		err = s.updateWalletToSequence(userId, encryptedWallet, sequence, hmac)
-		if err == ErrNoWallet {
-			// No wallet found to replace at the `sequence - 1`. To the caller, this
-			// means the sequence they put in was wrong.
-			err = ErrWrongSequence
+	} else {
+		// If sequence > InitialWalletSequence, the client assumed that it is replacing wallet
+		// with sequence - 1. Explicitly try to update the wallet with
+		// sequence - 1. If we updated no rows, the client assumed incorrectly
+		// and we proceed below to return the latest wallet from the db.
+		if s.FlagSameWalletNewHmac {
+			s.flagSameWalletNewHmac(ctx, userId, appId, encryptedWallet, sequence, hmac)
+		}
+		err = s.updateWalletToSequence(ctx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+		if err == ErrNoWallet {
+			// No wallet found to replace at the `sequence - 1`. To the caller, this
+			// means the sequence they put in was wrong.
+			err = ErrWrongSequence
+		}
+	}
+	return
+}
+
+// Whether SetWallet would take a wallet at this sequence right now, going by
+// the sequence alone (not parentHmac), without writing anything. Returns
+// ErrWrongSequence (or ErrSequenceExhausted) if it wouldn't. This is only as of now; another update can
+// land before the real one, which then fails as usual.
+//
+// Unlike SetWallet, a sequence below the highest this account has had isn't
+// logged as a possible rollback attempt, since nothing is being written.
+//
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) CheckSequence(ctx context.Context, userId auth.UserId, appId wallet.AppId, sequence wallet.Sequence) (err error) {
+	if s.sequenceExhausted(sequence) {
+		return ErrSequenceExhausted
+	}
+
+	var highestSequence wallet.Sequence
+	var currentSequence sql.NullInt64
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(highest_wallet_sequences.sequence, 0), wallets.sequence FROM accounts
+		LEFT JOIN highest_wallet_sequences ON highest_wallet_sequences.user_id=accounts.user_id AND highest_wallet_sequences.app_id=?
+		LEFT JOIN wallets ON wallets.user_id=accounts.user_id AND wallets.app_id=?
+		WHERE accounts.user_id=?`,
+		appId, appId, userId,
+	).Scan(&highestSequence, &currentSequence)
+	if err != nil {
+		return
+	}
+
+	if sequence < highestSequence {
+		return ErrWrongSequence
+	}
+	if sequence == InitialWalletSequence {
+		// Only as the first wallet
+		if currentSequence.Valid {
+			return ErrWrongSequence
+		}
+		return nil
+	}
+	// Only as the next one after the wallet we have
+	if !currentSequence.Valid || wallet.Sequence(currentSequence.Int64) != sequence-1 {
+		return ErrWrongSequence
+	}
+	return nil
+}
+
+// For moving a user over from another server. Like the first wallet from
+// SetWallet, but at whatever sequence it had there, so that the copies the
+// user's clients already have keep counting from the same place. Only if
+// there's no wallet yet; otherwise ErrDuplicateWallet. The rollback check
+// still applies, so an account can't be imported back to before a sequence it
+// has already had here.
+//
+// appWallets are the other apps' wallets from the same export, each at its
+// own sequence (ParentHmac doesn't apply). They go in the same transaction, so
+// either the whole account comes over or none of it does.
+//
+// Assumption: Sequences have been validated (>=InitialWalletSequence)
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) ImportWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion, appWallets []AppWalletUpdate) (err error) {
+	if s.walletTooLarge(encryptedWallet) {
+		err = ErrWalletTooLarge
+		return
+	}
+	if s.invalidHmac(hmac) {
+		err = ErrInvalidHmac
+		return
+	}
+	if s.sequenceExhausted(sequence) {
+		err = ErrSequenceExhausted
+		return
+	}
+	for _, appWallet := range appWallets {
+		if s.walletTooLarge(appWallet.EncryptedWallet) {
+			err = ErrWalletTooLarge
+			return
+		}
+		if s.invalidHmac(appWallet.Hmac) {
+			err = ErrInvalidHmac
+			return
+		}
+		if s.sequenceExhausted(appWallet.Sequence) {
+			err = ErrSequenceExhausted
+			return
+		}
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) (err error) {
+		if err = insertWalletWith(ctx, tx, userId, appId, encryptedWallet, sequence, hmac, encryptionVersion); err != nil {
+			return
+		}
+		// An app id that's already in there (the one above included) is a
+		// duplicate wallet like any other
+		for _, appWallet := range appWallets {
+			if err = insertWalletWith(ctx, tx, userId, appWallet.AppId, appWallet.EncryptedWallet, appWallet.Sequence, appWallet.Hmac, appWallet.EncryptionVersion); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+type WalletUpdate struct {
+	EncryptedWallet   wallet.EncryptedWallet
+	Sequence          wallet.Sequence
+	Hmac              wallet.WalletHmac
+	EncryptionVersion wallet.EncryptionVersion
+}
+
+// A wallet for an app other than the default one, re-encrypted with the new
+// password during a password change. It's an update like any other, so the
+// sequence goes up by one (see SetWallet). Also used for the other apps'
+// wallets in ImportWallet, which keep whatever sequence they come with.
+type AppWalletUpdate struct {
+	AppId             wallet.AppId
+	EncryptedWallet   wallet.EncryptedWallet
+	Sequence          wallet.Sequence
+	Hmac              wallet.WalletHmac
+	ParentHmac        *wallet.WalletHmac
+	EncryptionVersion wallet.EncryptionVersion
+}
+
+// Apply a chain of wallet updates, in order, all or nothing. Each update has
+// to follow from the one before it the same way it would for SetWallet, with
+// the first following from the wallet we currently have (or being the first
+// wallet). If any of them fails, none of them are applied, and we return the
+// error SetWallet would have returned for it.
+//
+// parentHmac is optional and applies to the first update only; the rest are
+// built on the update before them in the chain.
+//
+// Assumption: Sequences have been validated (>=InitialWalletSequence)
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) SetWalletBatch(ctx context.Context, userId auth.UserId, appId wallet.AppId, updates []WalletUpdate, parentHmac *wallet.WalletHmac) (err error) {
+	for _, update := range updates {
+		if s.walletTooLarge(update.EncryptedWallet) {
+			err = ErrWalletTooLarge
+			return
+		}
+		if s.invalidHmac(update.Hmac) {
+			err = ErrInvalidHmac
+			return
+		}
+		if s.sequenceExhausted(update.Sequence) {
+			err = ErrSequenceExhausted
+			return
+		}
+	}
+	if len(updates) > 0 && s.missingParentHmac(updates[0].Sequence, parentHmac) {
+		err = ErrNoParentHmac
+		return
+	}
+
+	return s.withTx(ctx, func(tx *sql.Tx) (err error) {
+		for i, update := range updates {
+			if i > 0 && update.Sequence != updates[i-1].Sequence+1 {
+				err = ErrWrongSequence
+				return
+			}
+
+			if update.Sequence == InitialWalletSequence {
+				err = insertFirstWalletWith(ctx, tx, userId, appId, update.EncryptedWallet, update.Hmac, update.EncryptionVersion)
+				if err == ErrDuplicateWallet {
+					err = ErrWrongSequence
+				}
+			} else {
+				var updateParentHmac *wallet.WalletHmac
+				if i == 0 {
+					updateParentHmac = parentHmac
+				}
+				err = updateWalletToSequenceWith(ctx, tx, userId, appId, update.EncryptedWallet, update.Sequence, update.Hmac, updateParentHmac, update.EncryptionVersion)
+				if err == ErrNoWallet {
+					err = ErrWrongSequence
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// SetWallet and GetWallet in one transaction. Tries to save the wallet the
+// same way SetWallet does, and returns whether it went through (`applied`)
+// along with the wallet we have once it's done: the client's if it went
+// through, otherwise whatever beat it. Nothing can land in between, so unlike
+// getting the wallet after a failed SetWallet, `latest` is the very wallet the
+// client lost to. It's nil if there's no wallet at all.
+//
+// Losing (wrong sequence or parent hmac) isn't an error here; `err` is for
+// everything else, same as with SetWallet.
+//
+// Assumption: Sequence has been validated (>=InitialWalletSequence)
+// Assumption: Auth token has been checked (thus account is verified)
+func (s *Store) SyncWallet(ctx context.Context, userId auth.UserId, appId wallet.AppId, encryptedWallet wallet.EncryptedWallet, sequence wallet.Sequence, hmac wallet.WalletHmac, parentHmac *wallet.WalletHmac, encryptionVersion wallet.EncryptionVersion) (applied bool, latest *WalletUpdate, err error) {
+	if s.walletTooLarge(encryptedWallet) {
+		err = ErrWalletTooLarge
+		return
+	}
+	if s.invalidHmac(hmac) {
+		err = ErrInvalidHmac
+		return
+	}
+	if s.sequenceExhausted(sequence) {
+		err = ErrSequenceExhausted
+		return
+	}
+	if s.missingParentHmac(sequence, parentHmac) {
+		err = ErrNoParentHmac
+		return
+	}
+	// Before the transaction, since it doesn't go through it
+	if s.FlagSameWalletNewHmac && sequence != InitialWalletSequence {
+		s.flagSameWalletNewHmac(ctx, userId, appId, encryptedWallet, sequence, hmac)
+	}
+
+	err = s.withTx(ctx, func(tx *sql.Tx) (err error) {
+		if sequence == InitialWalletSequence {
+			err = insertFirstWalletWith(ctx, tx, userId, appId, encryptedWallet, hmac, encryptionVersion)
+		} else {
+			err = updateWalletToSequenceWith(ctx, tx, userId, appId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+		}
+		switch err {
+		case nil:
+			applied = true
+		case ErrDuplicateWallet, ErrNoWallet, ErrWrongSequence, ErrWrongParentHmac:
+			err = nil
+		default:
+			return
+		}
+
+		latest = &WalletUpdate{}
+		latest.EncryptedWallet, latest.Sequence, latest.Hmac, latest.EncryptionVersion, err = getWalletWith(ctx, tx, userId, appId)
+		if err == ErrNoWallet {
+			latest, err = nil, nil
+		}
+		return
+	})
+	if err != nil {
+		applied, latest = false, nil
+	}
+	return
+}
+
+func (s *Store) GetUserId(ctx context.Context, email auth.Email, password auth.Password) (userId auth.UserId, err error) {
+	var key auth.KDFKey
+	var salt auth.ServerSalt
+	var verified bool
+	var failedLoginCount int
+	var lockedUntil sql.NullTime
+	var cost int
+
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT user_id, key, server_salt, verify_token is null, failed_login_count, locked_until, password_cost from accounts WHERE normalized_email=?`,
+		email.Normalize(),
+	).Scan(&userId, &key, &salt, &verified, &failedLoginCount, &lockedUntil, &cost)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+	if s.LoginLockoutThreshold > 0 && lockedUntil.Valid && s.clock().Now().Before(lockedUntil.Time) {
+		// Don't even check the password. Otherwise it'd still be worth guessing.
+		err = ErrAccountLocked
+		userId = auth.UserId(0)
+		return
+	}
+	match, err := password.CheckWithCost(key, salt, cost)
+	if err == nil && !match {
+		if s.LoginLockoutThreshold > 0 {
+			err = s.recordFailedLogin(ctx, userId)
+		}
+		if err == nil {
+			err = ErrWrongCredentials
+		}
+		userId = auth.UserId(0)
+	}
+	if err == nil && s.LoginLockoutThreshold > 0 && (failedLoginCount > 0 || lockedUntil.Valid) {
+		err = s.resetFailedLogins(ctx, userId)
+	}
+	if err == nil && !verified {
+		err = ErrNotVerified
+		userId = auth.UserId(0)
+	}
+	if err == nil && cost < s.passwordCost() {
+		// This is the only time we have the password to do it with. The login
+		// is good either way, so don't fail it over this; it'll be tried again
+		// next time.
+		if rehashErr := s.rehashPassword(ctx, userId, password, key); rehashErr != nil {
+			log.Printf("Error upgrading the password cost for user %d: %+v", userId, rehashErr)
+		}
+	}
+	return
+}
+
+// Hash the password again with the configured cost. Only if the key is still
+// the one we just checked the password against, in case the password changed
+// in the meantime.
+func (s *Store) rehashPassword(ctx context.Context, userId auth.UserId, password auth.Password, oldKey auth.KDFKey) error {
+	newKey, newSalt, err := password.CreateWithCost(s.passwordCost())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		"UPDATE accounts SET key=?, server_salt=?, password_cost=? WHERE user_id=? AND key=?",
+		newKey, newSalt, s.passwordCost(), userId, oldKey,
+	)
+	return err
+}
+
+// Count a failed login. Once it reaches the threshold, lock the account and
+// start counting again from zero, so that after the lockout the account gets
+// the same number of tries.
+func (s *Store) recordFailedLogin(ctx context.Context, userId auth.UserId) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE accounts SET
+			failed_login_count=CASE WHEN failed_login_count + 1 >= ? THEN 0 ELSE failed_login_count + 1 END,
+			locked_until=CASE WHEN failed_login_count + 1 >= ? THEN ? ELSE locked_until END
+		WHERE user_id=?`,
+		s.LoginLockoutThreshold, s.LoginLockoutThreshold, s.clock().Now().UTC().Add(s.lockoutDuration()), userId,
+	)
+	return err
+}
+
+func (s *Store) resetFailedLogins(ctx context.Context, userId auth.UserId) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		"UPDATE accounts SET failed_login_count=0, locked_until=NULL WHERE user_id=?",
+		userId,
+	)
+	return err
+}
+
+//////////
+// TOTP //
+//////////
+
+// Two-factor authentication goes:
+//
+// 1. SetTotpSecret with a new secret, which the user puts in their app
+// 2. EnableTotp with a code from the app, to show they got it right
+// 3. CheckTotp on every login from then on
+//
+// Until step 2, the account logs in with just the password as before.
+
+// Start (or restart) enrolling. Fails with ErrTotpAlreadyEnabled once it's
+// been enabled, so that a stolen token can't be used to swap in a new secret.
+// Returns the account's email, for the authenticator app to show.
+func (s *Store) SetTotpSecret(ctx context.Context, userId auth.UserId, secret auth.TotpSecret) (email auth.Email, err error) {
+	err = s.db.QueryRowContext(
+		ctx,
+		"UPDATE accounts SET totp_secret=?, updated=datetime('now') WHERE user_id=? AND NOT totp_enabled RETURNING email",
+		secret, userId,
+	).Scan(&email)
+	if err == sql.ErrNoRows {
+		err = ErrTotpAlreadyEnabled
+	}
+	return
+}
+
+// Finish enrolling, if the code is good for the secret from SetTotpSecret.
+// Same as a login, the code can't be used again.
+func (s *Store) EnableTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) (err error) {
+	var secret sql.NullString
+	var enabled bool
+	err = s.db.QueryRowContext(
+		ctx,
+		"SELECT totp_secret, totp_enabled FROM accounts WHERE user_id=?",
+		userId,
+	).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return
+	}
+	if enabled {
+		return ErrTotpAlreadyEnabled
+	}
+	if !secret.Valid {
+		return ErrTotpNotEnrolled
+	}
+
+	counter, ok, err := auth.TotpSecret(secret.String).Check(code, s.clock().Now())
+	if err != nil {
+		return
+	}
+	if !ok {
+		return ErrTotpInvalid
+	}
+
+	// In case the secret changed in the meantime
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE accounts SET totp_enabled=true, totp_last_counter=?, updated=datetime('now') WHERE user_id=? AND totp_secret=? AND NOT totp_enabled",
+		counter, userId, secret.String,
+	)
+	if err != nil {
+		return
+	}
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrTotpInvalid
+	}
+	return
+}
+
+// For logging in, after the password has been checked with GetUserId. Fine
+// (nil) if the account doesn't have two-factor enabled. Otherwise needs a
+// good code, which can't have been used before.
+//
+// Wrong codes count towards LOGIN_LOCKOUT_THRESHOLD, separately from wrong
+// passwords. (Whoever gets here has the password, so a correct password
+// resetting the count would make the lockout no use for guessing codes.)
+func (s *Store) CheckTotp(ctx context.Context, userId auth.UserId, code auth.TotpCode) (err error) {
+	var secret sql.NullString
+	var enabled bool
+	err = s.db.QueryRowContext(
+		ctx,
+		"SELECT totp_secret, totp_enabled FROM accounts WHERE user_id=?",
+		userId,
+	).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil || !enabled {
+		return
+	}
+	if code == "" {
+		return ErrTotpRequired
+	}
+
+	counter, ok, err := auth.TotpSecret(secret.String).Check(code, s.clock().Now())
+	if err != nil {
+		return
+	}
+
+	var numRows int64
+	if ok {
+		// Only if it's for a later period than the last code used, so that a
+		// code can't be used twice
+		var res sql.Result
+		res, err = s.db.ExecContext(
+			ctx,
+			"UPDATE accounts SET totp_last_counter=?, totp_failed_count=0 WHERE user_id=? AND totp_last_counter<?",
+			counter, userId, counter,
+		)
+		if err != nil {
+			return
+		}
+		if numRows, err = res.RowsAffected(); err != nil {
+			return
+		}
+	}
+	if numRows == 0 {
+		if s.LoginLockoutThreshold > 0 {
+			if err = s.recordFailedTotp(ctx, userId); err != nil {
+				return
+			}
 		}
+		err = ErrTotpInvalid
 	}
 	return
 }
 
-func (s *Store) GetUserId(email auth.Email, password auth.Password) (userId auth.UserId, err error) {
-	var key auth.KDFKey
-	var salt auth.ServerSalt
-	var verified bool
+// Same as recordFailedLogin, with its own count
+func (s *Store) recordFailedTotp(ctx context.Context, userId auth.UserId) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE accounts SET
+			totp_failed_count=CASE WHEN totp_failed_count + 1 >= ? THEN 0 ELSE totp_failed_count + 1 END,
+			locked_until=CASE WHEN totp_failed_count + 1 >= ? THEN ? ELSE locked_until END
+		WHERE user_id=?`,
+		s.LoginLockoutThreshold, s.LoginLockoutThreshold, s.clock().Now().UTC().Add(s.lockoutDuration()), userId,
+	)
+	return err
+}
 
-	err = s.db.QueryRow(
-		`SELECT user_id, key, server_salt, verify_token is null from accounts WHERE normalized_email=?`,
-		email.Normalize(),
-	).Scan(&userId, &key, &salt, &verified)
-	if err == sql.ErrNoRows {
-		err = ErrWrongCredentials
+/////////////////
+// Device Sync //
+/////////////////
+
+// The wallet sequence a device last had, as of the last time it saved or got
+// the wallet.
+type DeviceSync struct {
+	DeviceId auth.DeviceId
+	Sequence wallet.Sequence
+	Updated  time.Time
+}
+
+// Record that the device saved or got the wallet at this sequence. This is
+// only for showing the user (see GetDeviceSyncs), so it's not part of the
+// wallet update itself, and nothing stops it from going backwards if a slow
+// request lands after a newer one.
+func (s *Store) UpdateDeviceSync(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId, sequence wallet.Sequence) (err error) {
+	_, err = s.db.ExecContext(
+		ctx,
+		`INSERT INTO device_syncs (user_id, device_id, sequence, updated) VALUES(?,?,?,?)
+		ON CONFLICT(user_id, device_id) DO UPDATE SET sequence=excluded.sequence, updated=excluded.updated`,
+		userId, deviceId, sequence, s.clock().Now().UTC(),
+	)
+	return
+}
+
+// Record that the user logged in from the device. isNew is true if it's the
+// first time we've seen it, even if it has since logged out. Devices from
+// before this was tracked count as seen if they were logged in or had synced
+// at the time (see the "create known_devices" migration).
+func (s *Store) AddKnownDevice(ctx context.Context, userId auth.UserId, deviceId auth.DeviceId) (isNew bool, err error) {
+	res, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO known_devices (user_id, device_id, first_seen) VALUES(?,?,?) ON CONFLICT(user_id, device_id) DO NOTHING",
+		userId, deviceId, s.clock().Now().UTC(),
+	)
+	if err != nil {
+		return
 	}
+	numRows, err := res.RowsAffected()
+	return numRows == 1, err
+}
+
+// Every device that has synced for the user, ordered by device id, including
+// ones that have since logged out. An empty list (not an error) if there are
+// none.
+func (s *Store) GetDeviceSyncs(ctx context.Context, userId auth.UserId) (deviceSyncs []DeviceSync, err error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT device_id, sequence, updated FROM device_syncs WHERE user_id=? ORDER BY device_id",
+		userId,
+	)
 	if err != nil {
 		return
 	}
-	match, err := password.Check(key, salt)
-	if err == nil && !match {
-		err = ErrWrongCredentials
-		userId = auth.UserId(0)
+	defer rows.Close()
+
+	deviceSyncs = []DeviceSync{}
+	for rows.Next() {
+		var deviceSync DeviceSync
+		if err = rows.Scan(&deviceSync.DeviceId, &deviceSync.Sequence, &deviceSync.Updated); err != nil {
+			deviceSyncs = nil
+			return
+		}
+		deviceSync.Updated = deviceSync.Updated.UTC()
+		deviceSyncs = append(deviceSyncs, deviceSync)
 	}
-	if err == nil && !verified {
-		err = ErrNotVerified
-		userId = auth.UserId(0)
+	if err = rows.Err(); err != nil {
+		deviceSyncs = nil
 	}
 	return
 }
@@ -397,22 +1606,70 @@ func (s *Store) GetUserId(email auth.Email, password auth.Password) (userId auth
 // Account //
 /////////////
 
-func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) (err error) {
-	key, salt, err := password.Create()
+func (s *Store) passwordIsWeak(email auth.Email, password auth.Password) bool {
+	return s.WeakPasswordCheck && password.IsWeak(email, s.WeakPasswordPatterns)
+}
+
+// The password policy for new passwords
+func (s *Store) checkNewPassword(email auth.Email, password auth.Password) error {
+	if len(password) < s.PasswordMinLength {
+		return ErrPasswordTooShort
+	}
+	if s.passwordIsWeak(email, password) {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+// Verify tokens are stored hashed, so that someone who gets a look at the
+// database (or a backup of it) can't use them to verify accounts. They're
+// long and random, unlike passwords, so a plain sha256 is enough.
+func hashVerifyToken(verifyTokenString auth.VerifyTokenString) string {
+	hash := sha256.Sum256([]byte(verifyTokenString))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *Store) CreateAccount(ctx context.Context, email auth.Email, password auth.Password, seed auth.ClientSaltSeed, verifyToken *auth.VerifyTokenString) (err error) {
+	// The request handler should have caught this already, but don't count on
+	// every caller to
+	if !email.Validate() {
+		return ErrInvalidEmail
+	}
+
+	if err = s.checkNewPassword(email, password); err != nil {
+		return
+	}
+
+	key, salt, err := password.CreateWithCost(s.passwordCost())
 	if err != nil {
 		return
 	}
 
+	var verifyTokenHash *string
 	var verifyExpiration *time.Time
 	if verifyToken != nil {
+		verifyTokenHash = new(string)
+		*verifyTokenHash = hashVerifyToken(*verifyToken)
 		verifyExpiration = new(time.Time)
-		*verifyExpiration = time.Now().UTC().Add(VerifyTokenLifespan)
+		*verifyExpiration = s.clock().Now().UTC().Add(VerifyTokenLifespan)
+	}
+
+	// Age out reservations (see DeleteAccount) that are over, so they don't
+	// pile up
+	now := s.clock().Now().UTC()
+	if _, err = s.db.ExecContext(ctx, "DELETE FROM reserved_emails WHERE expiration<=?", now); err != nil {
+		return
 	}
 
-	// userId auto-increments
-	_, err = s.db.Exec(
-		"INSERT INTO accounts (normalized_email, email, key, server_salt, client_salt_seed, verify_token, verify_expiration, updated) VALUES(?,?,?,?,?,?,?, datetime('now'))",
-		email.Normalize(), email, key, salt, seed, verifyToken, verifyExpiration,
+	// userId auto-increments. The reservation check is part of the insert, so
+	// that an account deleted in the meantime can't slip in between.
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO accounts (normalized_email, email, key, server_salt, password_cost, client_salt_seed, verify_token, verify_expiration, updated)
+			SELECT ?,?,?,?,?,?,?,?, datetime('now')
+			WHERE NOT EXISTS (SELECT 1 FROM reserved_emails WHERE normalized_email=? AND expiration>?)`,
+		email.Normalize(), email, key, salt, s.passwordCost(), seed, verifyTokenHash, verifyExpiration,
+		email.Normalize(), now,
 	)
 	var sqliteErr sqlite3.Error
 	if errors.As(err, &sqliteErr) {
@@ -420,7 +1677,17 @@ func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed aut
 			err = ErrDuplicateAccount
 		}
 	}
+	if err != nil {
+		return
+	}
 
+	numRows, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if numRows == 0 {
+		err = ErrEmailReserved
+	}
 	return
 }
 
@@ -430,12 +1697,13 @@ func (s *Store) CreateAccount(email auth.Email, password auth.Password, seed aut
 // This function should only work if the account is not already verified.
 // Otherwise we risk de-verifying accounts which would be confusing and
 // annoying if it were to ever get triggered.
-func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth.VerifyTokenString) (err error) {
-	expiration := time.Now().UTC().Add(VerifyTokenLifespan)
+func (s *Store) UpdateVerifyTokenString(ctx context.Context, email auth.Email, verifyTokenString auth.VerifyTokenString) (err error) {
+	expiration := s.clock().Now().UTC().Add(VerifyTokenLifespan)
 
-	res, err := s.db.Exec(
+	res, err := s.db.ExecContext(
+		ctx,
 		`UPDATE accounts SET verify_token=?, verify_expiration=?, updated=datetime('now') WHERE normalized_email=? and verify_token is not null`,
-		verifyTokenString, expiration, email.Normalize(),
+		hashVerifyToken(verifyTokenString), expiration, email.Normalize(),
 	)
 	if err != nil {
 		return
@@ -449,7 +1717,8 @@ func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth
 		// Since we got a miss (presumably not very common), let's do another check
 		// to see which error to return: invalid email or invalid token
 		var dummy int
-		err = s.db.QueryRow(
+		err = s.db.QueryRowContext(
+			ctx,
 			`SELECT 1 from accounts WHERE normalized_email=?`,
 			email.Normalize(),
 		).Scan(&dummy)
@@ -463,12 +1732,13 @@ func (s *Store) UpdateVerifyTokenString(email auth.Email, verifyTokenString auth
 	return
 }
 
-func (s *Store) VerifyAccount(verifyTokenString auth.VerifyTokenString) (err error) {
-	expirationCutoff := time.Now().UTC()
+func (s *Store) VerifyAccount(ctx context.Context, verifyTokenString auth.VerifyTokenString) (err error) {
+	expirationCutoff := s.clock().Now().UTC()
 
-	res, err := s.db.Exec(
+	res, err := s.db.ExecContext(
+		ctx,
 		"UPDATE accounts SET verify_token=null, verify_expiration=null, updated=datetime('now') WHERE verify_token=? AND verify_expiration>?",
-		verifyTokenString, expirationCutoff,
+		hashVerifyToken(verifyTokenString), expirationCutoff,
 	)
 	if err != nil {
 		return
@@ -489,11 +1759,16 @@ func (s *Store) VerifyAccount(verifyTokenString auth.VerifyTokenString) (err err
 // update the wallet at the same time to avoid ever having a situation where
 // these two don't match.
 //
+// The same goes for every other app's wallet, which come in appWallets, one
+// for each app that has a wallet. If any of them is missing, the change fails
+// with ErrUnexpectedWallet rather than leave that wallet under the old key.
+//
 // Also delete all auth tokens to force clients to update their root password
 // to get a new token. This prevents other clients from posting a wallet
 // encrypted with the old key.
 //
-// Return userId as a pure convenience for the calling request handler.
+// Return userId, and how many auth tokens were deleted, as a pure convenience
+// for the calling request handler.
 //
 // TODO - A wallet encrypted with the old key could still save successfully in
 //   a race condition:
@@ -509,6 +1784,7 @@ func (s *Store) VerifyAccount(verifyTokenString auth.VerifyTokenString) (err err
 //   Sequence? And the tokens have that number attached to it. We can check it
 //   as an extra validation of the token.
 func (s *Store) ChangePasswordWithWallet(
+	ctx context.Context,
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
@@ -516,8 +1792,12 @@ func (s *Store) ChangePasswordWithWallet(
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
-) (userId auth.UserId, err error) {
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
 	return s.changePassword(
+		ctx,
 		email,
 		oldPassword,
 		newPassword,
@@ -525,24 +1805,32 @@ func (s *Store) ChangePasswordWithWallet(
 		encryptedWallet,
 		sequence,
 		hmac,
+		parentHmac,
+		encryptionVersion,
+		appWallets,
 	)
 }
 
-// Change password, but with no wallet currently saved. Since there's no
-// wallet saved, there's no wallet to update. The encryption key is moot.
+// Change password, but with no wallet currently saved for the default app.
+// Since there's no wallet saved, there's no wallet to update. Other apps'
+// wallets still need updating, same as with ChangePasswordWithWallet.
 //
 // Also delete all auth tokens to force clients to update their root password
 // to get a new token. This prevents other clients from posting a wallet
 // encrypted with the old key.
 //
-// Return userId as a pure convenience for the calling request handler.
+// Return userId, and how many auth tokens were deleted, as a pure convenience
+// for the calling request handler.
 func (s *Store) ChangePasswordNoWallet(
+	ctx context.Context,
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
 	clientSaltSeed auth.ClientSaltSeed,
-) (userId auth.UserId, err error) {
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
 	return s.changePassword(
+		ctx,
 		email,
 		oldPassword,
 		newPassword,
@@ -550,11 +1838,15 @@ func (s *Store) ChangePasswordNoWallet(
 		wallet.EncryptedWallet(""),
 		wallet.Sequence(0),
 		wallet.WalletHmac(""),
+		nil,
+		wallet.EncryptionVersion(""),
+		appWallets,
 	)
 }
 
 // Common code for for WithWallet and WithNoWallet password change functions
 func (s *Store) changePassword(
+	ctx context.Context,
 	email auth.Email,
 	oldPassword auth.Password,
 	newPassword auth.Password,
@@ -562,40 +1854,76 @@ func (s *Store) changePassword(
 	encryptedWallet wallet.EncryptedWallet,
 	sequence wallet.Sequence,
 	hmac wallet.WalletHmac,
-) (userId auth.UserId, err error) {
-
-	tx, err := s.db.Begin()
-	if err != nil {
+	parentHmac *wallet.WalletHmac,
+	encryptionVersion wallet.EncryptionVersion,
+	appWallets []AppWalletUpdate,
+) (userId auth.UserId, numTokensDeleted int64, err error) {
+	if err = s.checkNewPassword(email, newPassword); err != nil {
 		return
 	}
-
-	// Lots of error conditions. Just defer this. However, we need to make sure to
-	// make sure the variable `err` is set to the error before we return, instead
-	// of doing `return <error>`.
-	endTxn := func() {
-		if err != nil {
-			tx.Rollback()
-		} else {
-			tx.Commit()
+	if s.walletTooLarge(encryptedWallet) {
+		err = ErrWalletTooLarge
+		return
+	}
+	if encryptedWallet != "" && s.invalidHmac(hmac) {
+		err = ErrInvalidHmac
+		return
+	}
+	if encryptedWallet != "" && s.sequenceExhausted(sequence) {
+		err = ErrSequenceExhausted
+		return
+	}
+	if encryptedWallet != "" && s.missingParentHmac(sequence, parentHmac) {
+		err = ErrNoParentHmac
+		return
+	}
+	seenAppIds := make(map[wallet.AppId]bool)
+	for _, appWallet := range appWallets {
+		// One for each app. The default app's wallet is the one in
+		// encryptedWallet.
+		if appWallet.AppId == wallet.DefaultAppId || seenAppIds[appWallet.AppId] {
+			err = ErrWrongSequence
+			return
+		}
+		seenAppIds[appWallet.AppId] = true
+		if s.walletTooLarge(appWallet.EncryptedWallet) {
+			err = ErrWalletTooLarge
+			return
+		}
+		if s.invalidHmac(appWallet.Hmac) {
+			err = ErrInvalidHmac
+			return
+		}
+		if s.sequenceExhausted(appWallet.Sequence) {
+			err = ErrSequenceExhausted
+			return
+		}
+		if s.missingParentHmac(appWallet.Sequence, appWallet.ParentHmac) {
+			err = ErrNoParentHmac
+			return
 		}
 	}
-	defer endTxn()
 
+	// Check the old password and work out the new key before starting the
+	// transaction. The KDF is slow on purpose, and there's no need to hold up
+	// every other write to the database while it runs.
 	var oldKey auth.KDFKey
 	var oldSalt auth.ServerSalt
+	var oldCost int
 	var verified bool
 
-	err = tx.QueryRow(
-		`SELECT user_id, key, server_salt, verify_token is null from accounts WHERE normalized_email=?`,
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT user_id, key, server_salt, password_cost, verify_token is null from accounts WHERE normalized_email=?`,
 		email.Normalize(),
-	).Scan(&userId, &oldKey, &oldSalt, &verified)
+	).Scan(&userId, &oldKey, &oldSalt, &oldCost, &verified)
 	if err == sql.ErrNoRows {
 		err = ErrWrongCredentials
 	}
 	if err != nil {
 		return
 	}
-	match, err := oldPassword.Check(oldKey, oldSalt)
+	match, err := oldPassword.CheckWithCost(oldKey, oldSalt, oldCost)
 	if err == nil && !match {
 		err = ErrWrongCredentials
 	}
@@ -606,79 +1934,377 @@ func (s *Store) changePassword(
 		return
 	}
 
-	newKey, newSalt, err := newPassword.Create()
+	newKey, newSalt, err := newPassword.CreateWithCost(s.passwordCost())
 	if err != nil {
 		return
 	}
 
-	res, err := tx.Exec(
-		"UPDATE accounts SET key=?, server_salt=?, client_salt_seed=?, updated=datetime('now') WHERE user_id=?",
-		newKey, newSalt, clientSaltSeed, userId,
+	err = s.withTx(ctx, func(tx *sql.Tx) (err error) {
+		// Only if the key is still the one we checked the old password against. If
+		// the password changed in the meantime, the old password is wrong now.
+		res, err := tx.ExecContext(
+			ctx,
+			"UPDATE accounts SET key=?, server_salt=?, password_cost=?, client_salt_seed=?, updated=datetime('now') WHERE user_id=? AND key=?",
+			newKey, newSalt, s.passwordCost(), clientSaltSeed, userId, oldKey,
+		)
+		if err != nil {
+			return
+		}
+		numRows, err := res.RowsAffected()
+		if err != nil {
+			return
+		}
+		if numRows == 0 {
+			err = ErrWrongCredentials
+			return
+		}
+
+		if encryptedWallet != "" {
+			// With a wallet expected: update it.
+			err = updateWalletToSequenceWith(ctx, tx, userId, wallet.DefaultAppId, encryptedWallet, sequence, hmac, parentHmac, encryptionVersion)
+			if err == ErrNoWallet {
+				err = ErrWrongSequence
+			}
+			if err != nil {
+				return
+			}
+		} else {
+			// With no wallet expected: assert we have no wallet.
+
+			var dummy string
+			err = tx.QueryRowContext(ctx, "SELECT 1 FROM wallets WHERE user_id=? AND app_id=?", userId, wallet.DefaultAppId).Scan(&dummy)
+			if err != sql.ErrNoRows {
+				if err == nil {
+					// We expected no rows
+					err = ErrUnexpectedWallet
+					return
+				}
+				// Some other error
+				return
+			}
+		}
+
+		// Every other app's wallet has to come along, or it would be left
+		// encrypted with the old password.
+		for _, appWallet := range appWallets {
+			err = updateWalletToSequenceWith(ctx, tx, userId, appWallet.AppId, appWallet.EncryptedWallet, appWallet.Sequence, appWallet.Hmac, appWallet.ParentHmac, appWallet.EncryptionVersion)
+			if err == ErrNoWallet {
+				err = ErrWrongSequence
+			}
+			if err != nil {
+				return
+			}
+		}
+		// Each of those is for a different app, so if there are more wallets
+		// than that, some app was left out.
+		var numAppWallets int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM wallets WHERE user_id=? AND app_id!=?", userId, wallet.DefaultAppId).Scan(&numAppWallets)
+		if err != nil {
+			return
+		}
+		if numAppWallets > len(appWallets) {
+			err = ErrUnexpectedWallet
+			return
+		}
+
+		// The count might be zero (no login token while changing password seems
+		// plausible). The main reason for this is that we want to prevent any
+		// client from saving a subsequent wallet without changing its password
+		// first. Doing it in the same transaction means there's no window where
+		// the new password is in place but the old tokens still work.
+		numTokensDeleted, err = deleteAllTokensWith(ctx, tx, userId)
+		return
+	})
+	return
+}
+
+// It's a public endpoint, we don't really care if the user is verified
+func (s *Store) GetClientSaltSeed(ctx context.Context, email auth.Email) (seed auth.ClientSaltSeed, err error) {
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT client_salt_seed from accounts WHERE normalized_email=?`,
+		email.Normalize(),
+	).Scan(&seed)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	return
+}
+
+// Whether there's an account for the email, verified or not, or the email is
+// still reserved after its account was deleted (see DeleteAccount). Either
+// way the email can't be used to sign up again.
+func (s *Store) EmailExists(ctx context.Context, email auth.Email) (exists bool, err error) {
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS(SELECT 1 from accounts WHERE normalized_email=?)
+			OR EXISTS(SELECT 1 from reserved_emails WHERE normalized_email=? AND expiration>?)`,
+		email.Normalize(), email.Normalize(), s.clock().Now().UTC(),
+	).Scan(&exists)
+	return
+}
+
+// The email as the user signed up with it, rather than normalized
+func (s *Store) GetEmail(ctx context.Context, userId auth.UserId) (email auth.Email, err error) {
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT email from accounts WHERE user_id=?`,
+		userId,
+	).Scan(&email)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	return
+}
+
+// What support needs to know about an account, without anything secret
+type AccountStatus struct {
+	UserId    auth.UserId
+	Verified  bool
+	Locked    bool // see LoginLockoutThreshold
+	HasWallet bool
+	Sequence  wallet.Sequence // zero if there's no wallet
+}
+
+// For the admin API. The wallet is the one for appId. Fails with
+// ErrWrongCredentials if there's no such account.
+func (s *Store) GetAccountStatus(ctx context.Context, email auth.Email, appId wallet.AppId) (status AccountStatus, err error) {
+	var lockedUntil sql.NullTime
+	var sequence sql.NullInt64
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT accounts.user_id, verify_token is null, locked_until, wallets.sequence FROM accounts
+		LEFT JOIN wallets ON wallets.user_id=accounts.user_id AND wallets.app_id=?
+		WHERE normalized_email=?`,
+		appId, email.Normalize(),
+	).Scan(&status.UserId, &status.Verified, &lockedUntil, &sequence)
+	if err == sql.ErrNoRows {
+		err = ErrWrongCredentials
+	}
+	if err != nil {
+		return AccountStatus{}, err
+	}
+	// Same as GetUserId. A lockout left over from when it was turned on doesn't
+	// count.
+	status.Locked = s.LoginLockoutThreshold > 0 && lockedUntil.Valid && s.clock().Now().Before(lockedUntil.Time)
+	status.HasWallet = sequence.Valid
+	status.Sequence = wallet.Sequence(sequence.Int64)
+	return
+}
+
+// Accounts with a signing key registered need signed requests for sensitive
+// operations. Returns an empty key if there is none, including if there's no
+// such account; the caller will find that out soon enough when checking the
+// password, and we don't want to give it away any sooner.
+func (s *Store) GetSigningPublicKey(ctx context.Context, email auth.Email) (publicKey auth.SigningPublicKey, err error) {
+	var nullablePublicKey sql.NullString
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT signing_public_key from accounts WHERE normalized_email=?`,
+		email.Normalize(),
+	).Scan(&nullablePublicKey)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	publicKey = auth.SigningPublicKey(nullablePublicKey.String)
+	return
+}
+
+func (s *Store) SetSigningPublicKey(ctx context.Context, userId auth.UserId, publicKey auth.SigningPublicKey) (err error) {
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE accounts SET signing_public_key=?, updated=datetime('now') WHERE user_id=?",
+		publicKey, userId,
 	)
 	if err != nil {
 		return
 	}
+
 	numRows, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
 	if numRows == 0 {
-		// Very unexpected error!
-		err = fmt.Errorf("Password failed to update")
-		return
+		err = ErrWrongCredentials
 	}
+	return
+}
 
-	if encryptedWallet != "" {
-		// With a wallet expected: update it.
-
-		res, err = tx.Exec(
-			`UPDATE wallets SET encrypted_wallet=?, sequence=?, hmac=?, updated=datetime('now')
-			 WHERE user_id=? AND sequence=?`,
-			encryptedWallet, sequence, hmac, userId, sequence-1,
-		)
-		if err != nil {
+// Delete the account along with its wallet and all of its tokens, all or
+// nothing. Fails with ErrWrongCredentials if there's no such account. If
+// DeletedEmailReservation is set, the email is held back from signing up again
+// until it's over.
+//
+// Assumption: The caller has re-checked the password (GetUserId)
+func (s *Store) DeleteAccount(ctx context.Context, userId auth.UserId) (err error) {
+	return s.withTx(ctx, func(tx *sql.Tx) (err error) {
+		// The account goes last, since everything else refers to it
+		if _, err = deleteAllTokensWith(ctx, tx, userId); err != nil {
 			return
 		}
-		numRows, err = res.RowsAffected()
-		if err != nil {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM device_syncs WHERE user_id=?", userId); err != nil {
 			return
 		}
-		if numRows == 0 {
-			err = ErrWrongSequence
+		if _, err = tx.ExecContext(ctx, "DELETE FROM known_devices WHERE user_id=?", userId); err != nil {
+			return
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM wallets WHERE user_id=?", userId); err != nil {
+			return
+		}
+		if _, err = tx.ExecContext(ctx, "DELETE FROM highest_wallet_sequences WHERE user_id=?", userId); err != nil {
 			return
 		}
-	} else {
-		// With no wallet expected: assert we have no wallet.
 
-		var dummy string
-		err = tx.QueryRow("SELECT 1 FROM wallets WHERE user_id=?", userId).Scan(&dummy)
-		if err != sql.ErrNoRows {
-			if err == nil {
-				// We expected no rows
-				err = ErrUnexpectedWallet
+		// Before the account goes, since that's where the email comes from. If
+		// there's no such account, this doesn't do anything either.
+		if s.DeletedEmailReservation > 0 {
+			_, err = tx.ExecContext(
+				ctx,
+				`INSERT INTO reserved_emails (normalized_email, expiration)
+					SELECT normalized_email, ? FROM accounts WHERE user_id=?
+					ON CONFLICT(normalized_email) DO UPDATE SET expiration=excluded.expiration`,
+				s.clock().Now().UTC().Add(s.DeletedEmailReservation), userId,
+			)
+			if err != nil {
 				return
 			}
-			// Some other error
+		}
+
+		res, err := tx.ExecContext(ctx, "DELETE FROM accounts WHERE user_id=?", userId)
+		if err != nil {
+			return
+		}
+		numRows, err := res.RowsAffected()
+		if err != nil {
 			return
 		}
+		if numRows == 0 {
+			err = ErrWrongCredentials
+		}
+		return
+	})
+}
+
+///////////
+// Nonce //
+///////////
+
+// Record a nonce so that it can't be used again until `ttl` has passed.
+// Returns `fresh` as false if the nonce was already recorded and has not aged
+// out yet, which means the request carrying it should be treated as a replay.
+//
+// The primary key on `nonce` makes the insert the atomic part: if two
+// requests race with the same nonce, only one of them gets to insert it.
+func (s *Store) CheckAndStoreNonce(ctx context.Context, nonce string, ttl time.Duration) (fresh bool, err error) {
+	now := s.clock().Now().UTC()
+
+	// Age out anything that has expired, including (possibly) an old use of
+	// this same nonce, which is allowed to be reused at this point.
+	_, err = s.db.ExecContext(ctx, "DELETE FROM nonces WHERE expiration<=?", now)
+	if err != nil {
+		return
 	}
 
-	// Don't care how many I delete here. Might even be zero (no login token
-	// while changing password seems plausible). The main reason for this is
-	// that we want to prevent any client from saving a subsequent wallet
-	// without changing its password first.
-	_, err = tx.Exec("DELETE FROM auth_tokens WHERE user_id=?", userId)
-	return
+	_, err = s.db.ExecContext(
+		ctx,
+		"INSERT INTO nonces (nonce, expiration) VALUES(?,?)",
+		nonce, now.Add(ttl),
+	)
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintPrimaryKey) {
+			// Seen it already. Not an error as such, just not fresh.
+			return false, nil
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	return true, nil
 }
 
-// It's a public endpoint, we don't really care if the user is verified
-func (s *Store) GetClientSaltSeed(email auth.Email) (seed auth.ClientSaltSeed, err error) {
+/////////////////
+// Maintenance //
+/////////////////
+
+// Size of the database file in bytes, according to SQLite's own accounting.
+// Pages freed by deletions stay in the file (on the freelist) and still count
+// here until the database is vacuumed.
+func (s *Store) dbSize() (size int64, err error) {
 	err = s.db.QueryRow(
-		`SELECT client_salt_seed from accounts WHERE normalized_email=?`,
-		email.Normalize(),
-	).Scan(&seed)
-	if err == sql.ErrNoRows {
-		err = ErrWrongCredentials
+		"SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+	).Scan(&size)
+	return
+}
+
+// Give space freed by deleted rows back to the OS. Returns the database size
+// before and after.
+//
+// NOTE - VACUUM rebuilds the whole database and holds an exclusive lock while
+// it does, so every other request will be blocked (or fail with "database is
+// locked") until it's done. It's best run while the server is stopped, or at
+// least at a quiet time.
+func (s *Store) Reclaim() (sizeBefore int64, sizeAfter int64, err error) {
+	sizeBefore, err = s.dbSize()
+	if err != nil {
+		return
+	}
+
+	_, err = s.db.Exec("VACUUM")
+	if err != nil {
+		return
 	}
+
+	sizeAfter, err = s.dbSize()
+	return
+}
+
+// Rows that belong to an account that doesn't exist
+type OrphanCounts struct {
+	Tokens  int64
+	Wallets int64
+
+	// Rollback protection floors (see checkRollbackWith)
+	HighestSequences int64
+}
+
+// Find tokens, wallets and highest wallet sequences whose account is gone. Foreign keys should keep
+// this from happening, but they're only enforced on connections that turn
+// them on, so someone editing the database by hand (or an older build) could
+// still leave some behind.
+//
+// Only reports them unless `clean` is set, in which case they're also
+// deleted. The counts are the same either way: what was found (and deleted).
+func (s *Store) FindOrphans(clean bool) (counts OrphanCounts, err error) {
+	err = s.withTx(context.Background(), func(tx *sql.Tx) (err error) {
+		const orphanedTokens = "FROM auth_tokens WHERE user_id NOT IN (SELECT user_id FROM accounts)"
+		const orphanedWallets = "FROM wallets WHERE user_id NOT IN (SELECT user_id FROM accounts)"
+		const orphanedHighestSequences = "FROM highest_wallet_sequences WHERE user_id NOT IN (SELECT user_id FROM accounts)"
+
+		if err = tx.QueryRow("SELECT COUNT(*) " + orphanedTokens).Scan(&counts.Tokens); err != nil {
+			return
+		}
+		if err = tx.QueryRow("SELECT COUNT(*) " + orphanedWallets).Scan(&counts.Wallets); err != nil {
+			return
+		}
+		if err = tx.QueryRow("SELECT COUNT(*) " + orphanedHighestSequences).Scan(&counts.HighestSequences); err != nil {
+			return
+		}
+
+		if !clean {
+			return
+		}
+
+		if _, err = tx.Exec("DELETE " + orphanedTokens); err != nil {
+			return
+		}
+		if _, err = tx.Exec("DELETE " + orphanedWallets); err != nil {
+			return
+		}
+		_, err = tx.Exec("DELETE " + orphanedHighestSequences)
+		return
+	})
 	return
 }
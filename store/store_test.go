@@ -1,12 +1,19 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/wallet"
 )
 
 func StoreTestInit(t *testing.T) (s Store, tmpFile *os.File) {
@@ -28,6 +35,25 @@ func StoreTestInit(t *testing.T) (s Store, tmpFile *os.File) {
 	return
 }
 
+// A clock that only moves when the test moves it, so that expirations can be
+// checked exactly. Starts at a whole second, since that's all the precision
+// some of the columns keep.
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now().UTC().Truncate(time.Second)}
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
 func StoreTestCleanup(tmpFile *os.File) {
 	if tmpFile != nil {
 		os.Remove(tmpFile.Name())
@@ -50,9 +76,15 @@ func makeTestUser(
 
 	seed = auth.ClientSaltSeed("abcd1234abcd1234")
 
+	var verifyTokenHash *string
+	if verifyToken != nil {
+		verifyTokenHash = new(string)
+		*verifyTokenHash = hashVerifyToken(*verifyToken)
+	}
+
 	rows, err := s.db.Query(
 		"INSERT INTO accounts (normalized_email, email, key, server_salt, client_salt_seed, verify_token, verify_expiration, updated) values(?,?,?,?,?,?,?, datetime('now')) returning user_id",
-		normEmail, email, key, salt, seed, verifyToken, verifyExpiration,
+		normEmail, email, key, salt, seed, verifyTokenHash, verifyExpiration,
 	)
 	if err != nil {
 		t.Fatalf("Error setting up account: %+v", err)
@@ -68,3 +100,367 @@ func makeTestUser(
 	t.Fatalf("Error setting up account - no rows found")
 	return
 }
+
+// A database created before encryption_version existed should get the column
+// when we migrate, and migrating again should be harmless.
+func TestStoreMigrateAddsMissingColumn(t *testing.T) {
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "sqlite-test-")
+	if err != nil {
+		t.Fatalf("DB setup failure: %+v", err)
+	}
+	defer StoreTestCleanup(tmpFile)
+
+	s := Store{}
+	s.Init(tmpFile.Name())
+
+	_, err = s.db.Exec(`
+		CREATE TABLE wallets(
+			user_id INTEGER NOT NULL,
+			encrypted_wallet TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			updated DATETIME NOT NULL,
+			PRIMARY KEY (user_id)
+		);
+		INSERT INTO wallets (user_id, encrypted_wallet, sequence, hmac, updated) VALUES(1, "my-enc-wallet", 1, "my-hmac", datetime('now'));
+	`)
+	if err != nil {
+		t.Fatalf("Error creating old wallets table: %+v", err)
+	}
+	// The wallet needs an account, or it's an orphan and doesn't survive the
+	// migration to wallets by app
+	_, err = s.db.Exec(`
+		CREATE TABLE accounts(
+			normalized_email TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL,
+			key TEXT NOT NULL,
+			client_salt_seed TEXT NOT NULL,
+			server_salt TEXT NOT NULL,
+			verify_token TEXT UNIQUE,
+			verify_expiration DATETIME,
+			user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created DATETIME DEFAULT (DATETIME('now')),
+			updated DATETIME NOT NULL
+		);
+		INSERT INTO accounts (normalized_email, email, key, client_salt_seed, server_salt, updated) VALUES("abc@example.com", "abc@example.com", "my-key", "abcd1234abcd1234", "my-salt", datetime('now'));
+	`)
+	if err != nil {
+		t.Fatalf("Error creating old accounts table: %+v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Migrate(); err != nil {
+			t.Fatalf("Migrate (run %d) failed: %+v", i+1, err)
+		}
+	}
+
+	_, _, _, encryptionVersion, err := s.GetWallet(context.Background(), auth.UserId(1), wallet.DefaultAppId)
+	if err != nil {
+		t.Fatalf("Unexpected error in GetWallet: %+v", err)
+	}
+	if encryptionVersion != "" {
+		t.Fatalf("Expected existing wallet to have empty encryption version, got %q", encryptionVersion)
+	}
+}
+
+func TestStoreMigrateEmpty(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// StoreTestInit already migrated it once. Again should do nothing.
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Second Migrate failed: %+v", err)
+	}
+
+	var version, numVersions int
+	if err := s.db.QueryRow("SELECT MAX(version), COUNT(*) FROM schema_version").Scan(&version, &numVersions); err != nil {
+		t.Fatalf("Error getting schema version: %+v", err)
+	}
+	if version != len(migrations) || numVersions != len(migrations) {
+		t.Fatalf("Expected each of the %d migrations to run once, got version %d with %d rows", len(migrations), version, numVersions)
+	}
+}
+
+// A database from before schema_version, with the tables as they were first
+// created and some data in them, should be brought up to date without losing
+// anything
+func TestStoreMigrateOldSchema(t *testing.T) {
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "sqlite-test-")
+	if err != nil {
+		t.Fatalf("DB setup failure: %+v", err)
+	}
+	defer StoreTestCleanup(tmpFile)
+
+	s := Store{}
+	s.Init(tmpFile.Name())
+
+	_, err = s.db.Exec(`
+		CREATE TABLE auth_tokens(
+			token TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			device_id TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			expiration DATETIME NOT NULL,
+			PRIMARY KEY (user_id, device_id)
+		);
+		CREATE TABLE wallets(
+			user_id INTEGER NOT NULL,
+			encrypted_wallet TEXT NOT NULL,
+			sequence INTEGER NOT NULL,
+			hmac TEXT NOT NULL,
+			updated DATETIME NOT NULL,
+			PRIMARY KEY (user_id)
+		);
+		CREATE TABLE accounts(
+			normalized_email TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL,
+			key TEXT NOT NULL,
+			client_salt_seed TEXT NOT NULL,
+			server_salt TEXT NOT NULL,
+			verify_token TEXT UNIQUE,
+			verify_expiration DATETIME,
+			user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created DATETIME DEFAULT (DATETIME('now')),
+			updated DATETIME NOT NULL
+		);
+		INSERT INTO accounts (normalized_email, email, key, client_salt_seed, server_salt, updated) VALUES("abc@example.com", "abc@example.com", "my-key", "abcd1234abcd1234", "my-salt", datetime('now'));
+		INSERT INTO accounts (normalized_email, email, key, client_salt_seed, server_salt, verify_token, verify_expiration, updated) VALUES("def@example.com", "def@example.com", "my-key", "abcd1234abcd1234", "my-salt", "abcd1234abcd1234abcd1234abcd1234", "2999-01-01 00:00:00+00:00", datetime('now'));
+		INSERT INTO wallets (user_id, encrypted_wallet, sequence, hmac, updated) VALUES(1, "my-enc-wallet", 3, "my-hmac", datetime('now'));
+		INSERT INTO wallets (user_id, encrypted_wallet, sequence, hmac, updated) VALUES(99, "my-orphaned-enc-wallet", 1, "my-hmac", datetime('now'));
+		INSERT INTO auth_tokens (token, user_id, device_id, scope, expiration) VALUES("seekrit", 1, "dId", "*", "2999-01-01 00:00:00+00:00");
+	`)
+	if err != nil {
+		t.Fatalf("Error creating old schema: %+v", err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	err = s.Migrate()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		t.Fatalf("Migrate failed: %+v", err)
+	}
+	if version, err := s.schemaVersion(); err != nil || version != len(migrations) {
+		t.Fatalf("Expected schema version %d, got %d err %+v", len(migrations), version, err)
+	}
+
+	// The orphaned wallet couldn't come along, and we said so
+	if !strings.Contains(logs.String(), "Dropping 1 orphaned wallet(s)") {
+		t.Errorf("Expected the dropped orphaned wallet to be logged. Logs: %s", logs.String())
+	}
+	if _, _, _, _, err := s.GetWallet(context.Background(), auth.UserId(99), wallet.DefaultAppId); err != ErrNoWallet {
+		t.Errorf("Expected the orphaned wallet to be gone, got err %+v", err)
+	}
+
+	authToken, err := s.GetToken(context.Background(), "seekrit")
+	if err != nil || authToken.DeviceId != "dId" || authToken.DeviceName != "" {
+		t.Errorf("Expected the old token, with no device name: token %+v err %+v", authToken, err)
+	}
+
+	encryptedWallet, sequence, _, encryptionVersion, err := s.GetWallet(context.Background(), auth.UserId(1), wallet.DefaultAppId)
+	if err != nil || encryptedWallet != "my-enc-wallet" || sequence != 3 || encryptionVersion != "" {
+		t.Errorf("Expected the old wallet, with no encryption version: wallet %s sequence %d encryption version %q err %+v", encryptedWallet, sequence, encryptionVersion, err)
+	}
+
+	var highestSequence int
+	if err := s.db.QueryRow("SELECT sequence FROM highest_wallet_sequences WHERE user_id=1 AND app_id=''").Scan(&highestSequence); err != nil || highestSequence != 3 {
+		t.Errorf("Expected highest wallet sequence to start at the current wallet: got %d err %+v", highestSequence, err)
+	}
+
+	if fresh, err := s.CheckAndStoreNonce(context.Background(), "my-nonce", time.Minute); err != nil || !fresh {
+		t.Errorf("Expected the nonces table to be created: fresh %v err %+v", fresh, err)
+	}
+
+	// Already logged in, so not a new device
+	if isNew, err := s.AddKnownDevice(context.Background(), auth.UserId(1), "dId"); err != nil || isNew {
+		t.Errorf("Expected the logged in device to be known already: isNew %t err %+v", isNew, err)
+	}
+
+	// Stored hashed now, but the token from the email that was already sent
+	// still works
+	var verifyTokenHash string
+	if err := s.db.QueryRow("SELECT verify_token FROM accounts WHERE normalized_email='def@example.com'").Scan(&verifyTokenHash); err != nil || verifyTokenHash != hashVerifyToken("abcd1234abcd1234abcd1234abcd1234") {
+		t.Errorf("Expected the old verify token to be hashed: got %s err %+v", verifyTokenHash, err)
+	}
+	if err := s.VerifyAccount(context.Background(), "abcd1234abcd1234abcd1234abcd1234"); err != nil {
+		t.Errorf("Expected the old verify token to still work: %+v", err)
+	}
+}
+
+// Don't touch a database from a newer version of the server
+func TestStoreMigrateNewerSchema(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if _, err := s.db.Exec("INSERT INTO schema_version (version, applied) VALUES(?, datetime('now'))", len(migrations)+1); err != nil {
+		t.Fatalf("Error setting schema version: %+v", err)
+	}
+	if err := s.Migrate(); err == nil {
+		t.Fatalf("Expected Migrate to refuse a newer schema version")
+	}
+}
+
+// Once the request is gone, store calls that take its context give up rather
+// than running their queries
+func TestStoreCanceledContext(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, _, _, err := s.GetWallet(ctx, userId, wallet.DefaultAppId); err != context.Canceled {
+		t.Errorf(`GetWallet err: wanted "%+v", got "%+v"`, context.Canceled, err)
+	}
+	if _, err := s.GetUserId(ctx, email, password); err != context.Canceled {
+		t.Errorf(`GetUserId err: wanted "%+v", got "%+v"`, context.Canceled, err)
+	}
+	if err := s.SetWallet(ctx, userId, wallet.DefaultAppId, "my-enc-wallet", InitialWalletSequence, "my-hmac", nil, ""); err != context.Canceled {
+		t.Errorf(`SetWallet err: wanted "%+v", got "%+v"`, context.Canceled, err)
+	}
+	expectWalletNotExists(t, &s, userId)
+}
+
+func TestStoreClose(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error in Close: %+v", err)
+	}
+
+	if _, err := s.GetToken(context.Background(), "seekrit"); err == nil || err == ErrNoTokenForUserDevice {
+		t.Errorf("Expected an error using the store after it's closed, got %+v", err)
+	}
+}
+
+func TestStorePing(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	if err := s.Ping(context.Background()); err != nil {
+		t.Fatalf("Unexpected error in Ping: %+v", err)
+	}
+
+	s.Close()
+	if err := s.Ping(context.Background()); err == nil {
+		t.Errorf("Expected an error in Ping after the store is closed")
+	}
+}
+
+func TestStoreInitSQLiteSettings(t *testing.T) {
+	tt := []struct {
+		name string
+
+		busyTimeout time.Duration
+		walMode     bool
+
+		expectedBusyTimeout int
+		expectedJournalMode string
+	}{
+		{
+			name:                "defaults",
+			expectedBusyTimeout: 5000,
+			expectedJournalMode: "delete",
+		},
+		{
+			name:                "set",
+			busyTimeout:         time.Second * 30,
+			walMode:             true,
+			expectedBusyTimeout: 30000,
+			expectedJournalMode: "wal",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpFile, err := ioutil.TempFile(os.TempDir(), "sqlite-test-")
+			if err != nil {
+				t.Fatalf("DB setup failure: %+v", err)
+			}
+			defer StoreTestCleanup(tmpFile)
+			defer os.Remove(tmpFile.Name() + "-wal")
+			defer os.Remove(tmpFile.Name() + "-shm")
+
+			s := Store{BusyTimeout: tc.busyTimeout, WALMode: tc.walMode, MaxOpenConns: 1}
+			s.Init(tmpFile.Name())
+			defer s.Close()
+
+			var busyTimeout int
+			var journalMode string
+			if err := s.db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+				t.Fatalf("Unexpected error getting busy_timeout: %+v", err)
+			}
+			if err := s.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+				t.Fatalf("Unexpected error getting journal_mode: %+v", err)
+			}
+			if busyTimeout != tc.expectedBusyTimeout {
+				t.Errorf("Expected busy_timeout %d, got %d", tc.expectedBusyTimeout, busyTimeout)
+			}
+			if journalMode != tc.expectedJournalMode {
+				t.Errorf("Expected journal_mode %s, got %s", tc.expectedJournalMode, journalMode)
+			}
+			if got := s.db.Stats().MaxOpenConnections; got != 1 {
+				t.Errorf("Expected MaxOpenConnections 1, got %d", got)
+			}
+		})
+	}
+}
+
+func TestStoreWithTx(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	insertNonce := func(nonce string) func(*sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO nonces (nonce, expiration) VALUES(?, datetime('now', '+1 hour'))", nonce)
+			return err
+		}
+	}
+	expectNonce := func(nonce string, expected bool) {
+		t.Helper()
+		var exists bool
+		if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM nonces WHERE nonce=?)", nonce).Scan(&exists); err != nil || exists != expected {
+			t.Errorf("Expected nonce %s to exist: %t, got %t err %+v", nonce, expected, exists, err)
+		}
+	}
+
+	if err := s.withTx(context.Background(), insertNonce("committed")); err != nil {
+		t.Fatalf("Unexpected error in withTx: %+v", err)
+	}
+	expectNonce("committed", true)
+
+	// fn's error comes back as is, and its writes are undone
+	fnErr := fmt.Errorf("Some random error!")
+	err := s.withTx(context.Background(), func(tx *sql.Tx) error {
+		if err := insertNonce("failed")(tx); err != nil {
+			return err
+		}
+		return fnErr
+	})
+	if err != fnErr {
+		t.Errorf(`withTx err: wanted "%+v", got "%+v"`, fnErr, err)
+	}
+	expectNonce("failed", false)
+
+	// Same if it panics, and the panic carries on
+	func() {
+		defer func() {
+			if p := recover(); p != "Some random panic!" {
+				t.Errorf("Expected the panic to carry on, got %+v", p)
+			}
+		}()
+		s.withTx(context.Background(), func(tx *sql.Tx) error {
+			insertNonce("panicked")(tx)
+			panic("Some random panic!")
+		})
+	}()
+	expectNonce("panicked", false)
+
+	// Nothing left holding the write lock
+	if err := s.withTx(context.Background(), insertNonce("after")); err != nil {
+		t.Fatalf("Unexpected error in withTx after the rollbacks: %+v", err)
+	}
+	expectNonce("after", true)
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"lbryio/wallet-sync-server/auth"
+)
+
+func totpTestCode(t *testing.T, secret auth.TotpSecret, at time.Time) auth.TotpCode {
+	code, err := secret.Code(at)
+	if err != nil {
+		t.Fatalf("Error getting TOTP code: %+v", err)
+	}
+	return code
+}
+
+// A wrong code that's still a valid format
+func totpWrongCode(code auth.TotpCode) auth.TotpCode {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestStoreTotpEnroll(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, email, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.EnableTotp(context.Background(), userId, "123456"); err != ErrTotpNotEnrolled {
+		t.Fatalf("Expected ErrTotpNotEnrolled before enrolling, got %+v", err)
+	}
+
+	// Enrolling again before confirming replaces the secret
+	oldSecret, _ := (&auth.Auth{}).NewTotpSecret()
+	if _, err := s.SetTotpSecret(context.Background(), userId, oldSecret); err != nil {
+		t.Fatalf("Unexpected error in SetTotpSecret: %+v", err)
+	}
+	secret, _ := (&auth.Auth{}).NewTotpSecret()
+	gotEmail, err := s.SetTotpSecret(context.Background(), userId, secret)
+	if err != nil || gotEmail != email {
+		t.Fatalf("Expected SetTotpSecret to return the email %s, got %s err %+v", email, gotEmail, err)
+	}
+
+	// Not on yet
+	if err := s.CheckTotp(context.Background(), userId, ""); err != nil {
+		t.Fatalf("Expected no two-factor check before confirming, got %+v", err)
+	}
+
+	code := totpTestCode(t, secret, time.Now())
+	if err := s.EnableTotp(context.Background(), userId, totpWrongCode(code)); err != ErrTotpInvalid {
+		t.Fatalf("Expected ErrTotpInvalid for a wrong code, got %+v", err)
+	}
+	if err := s.EnableTotp(context.Background(), userId, code); err != nil {
+		t.Fatalf("Unexpected error in EnableTotp: %+v", err)
+	}
+
+	if err := s.EnableTotp(context.Background(), userId, code); err != ErrTotpAlreadyEnabled {
+		t.Fatalf("Expected ErrTotpAlreadyEnabled confirming again, got %+v", err)
+	}
+	if _, err := s.SetTotpSecret(context.Background(), userId, oldSecret); err != ErrTotpAlreadyEnabled {
+		t.Fatalf("Expected ErrTotpAlreadyEnabled enrolling once enabled, got %+v", err)
+	}
+}
+
+func TestStoreCheckTotp(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Nothing needed without two-factor
+	if err := s.CheckTotp(context.Background(), userId, ""); err != nil {
+		t.Fatalf("Expected no two-factor check for an account without it, got %+v", err)
+	}
+
+	secret, _ := (&auth.Auth{}).NewTotpSecret()
+	if _, err := s.SetTotpSecret(context.Background(), userId, secret); err != nil {
+		t.Fatalf("Unexpected error in SetTotpSecret: %+v", err)
+	}
+	confirmCode := totpTestCode(t, secret, time.Now())
+	if err := s.EnableTotp(context.Background(), userId, confirmCode); err != nil {
+		t.Fatalf("Unexpected error in EnableTotp: %+v", err)
+	}
+
+	if err := s.CheckTotp(context.Background(), userId, ""); err != ErrTotpRequired {
+		t.Errorf("Expected ErrTotpRequired without a code, got %+v", err)
+	}
+	if err := s.CheckTotp(context.Background(), userId, totpWrongCode(confirmCode)); err != ErrTotpInvalid {
+		t.Errorf("Expected ErrTotpInvalid for a wrong code, got %+v", err)
+	}
+
+	// The code used to confirm can't be used again
+	if err := s.CheckTotp(context.Background(), userId, confirmCode); err != ErrTotpInvalid {
+		t.Errorf("Expected ErrTotpInvalid for the code already used, got %+v", err)
+	}
+
+	// The next one works, once
+	nextCode := totpTestCode(t, secret, time.Now().Add(30*time.Second))
+	if err := s.CheckTotp(context.Background(), userId, nextCode); err != nil {
+		t.Errorf("Expected the next code to pass, got %+v", err)
+	}
+	if err := s.CheckTotp(context.Background(), userId, nextCode); err != ErrTotpInvalid {
+		t.Errorf("Expected ErrTotpInvalid using a code twice, got %+v", err)
+	}
+}
+
+// Wrong codes lock the account, even though the password was right each time
+func TestStoreCheckTotpLockout(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.LoginLockoutThreshold = 3
+
+	userId, email, password, _ := makeTestUser(t, &s, nil, nil)
+
+	secret, _ := (&auth.Auth{}).NewTotpSecret()
+	if _, err := s.SetTotpSecret(context.Background(), userId, secret); err != nil {
+		t.Fatalf("Unexpected error in SetTotpSecret: %+v", err)
+	}
+	code := totpTestCode(t, secret, time.Now())
+	if err := s.EnableTotp(context.Background(), userId, code); err != nil {
+		t.Fatalf("Unexpected error in EnableTotp: %+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetUserId(context.Background(), email, password); err != nil {
+			t.Fatalf("Unexpected error in GetUserId (attempt %d): %+v", i+1, err)
+		}
+		if err := s.CheckTotp(context.Background(), userId, totpWrongCode(code)); err != ErrTotpInvalid {
+			t.Fatalf("Expected ErrTotpInvalid (attempt %d), got %+v", i+1, err)
+		}
+	}
+
+	if _, err := s.GetUserId(context.Background(), email, password); err != ErrAccountLocked {
+		t.Fatalf("Expected the account to be locked, got %+v", err)
+	}
+}
@@ -1,13 +1,21 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"lbryio/wallet-sync-server/auth"
+	"lbryio/wallet-sync-server/metrics"
 	"lbryio/wallet-sync-server/wallet"
 )
 
@@ -105,7 +113,7 @@ func TestStoreInsertWallet(t *testing.T) {
 	expectWalletNotExists(t, &s, userId)
 
 	// Put in a first wallet
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.WalletHmac("my-hmac")); err != nil {
+	if err := s.insertFirstWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.WalletHmac("my-hmac"), wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in insertFirstWallet: %+v", err)
 	}
 
@@ -113,7 +121,7 @@ func TestStoreInsertWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
 
 	// Put in a first wallet for a second time, have an error for trying
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.WalletHmac("my-hmac-2")); err != ErrDuplicateWallet {
+	if err := s.insertFirstWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.WalletHmac("my-hmac-2"), wallet.EncryptionVersion("")); err != ErrDuplicateWallet {
 		t.Fatalf(`insertFirstWallet err: wanted "%+v", got "%+v"`, ErrDuplicateToken, err)
 	}
 
@@ -134,7 +142,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// Try to update a wallet, fail for nothing to update
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != ErrNoWallet {
+	if err := s.updateWalletToSequence(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != ErrNoWallet {
 		t.Fatalf(`updateWalletToSequence err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
 	}
 
@@ -142,20 +150,20 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletNotExists(t, &s, userId)
 
 	// Put in a first wallet
-	if err := s.insertFirstWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.insertFirstWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.WalletHmac("my-hmac-a"), wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in insertFirstWallet: %+v", err)
 	}
 
-	// Try to update the wallet, fail for having the wrong sequence
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrNoWallet {
-		t.Fatalf(`updateWalletToSequence err: wanted "%+v", got "%+v"`, ErrNoWallet, err)
+	// Try to update the wallet, fail for skipping a sequence
+	if err := s.updateWalletToSequence(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`updateWalletToSequence err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 
 	// Get the same wallet we initially *inserted*, since it didn't update
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Update the wallet successfully, with the right sequence
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+	if err := s.updateWalletToSequence(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in updateWalletToSequence: %+v", err)
 	}
 
@@ -163,7 +171,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
 
 	// Update the wallet again successfully
-	if err := s.updateWalletToSequence(userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
+	if err := s.updateWalletToSequence(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"), nil, wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in updateWalletToSequence: %+v", err)
 	}
 
@@ -171,6 +179,239 @@ func TestStoreUpdateWallet(t *testing.T) {
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"), time.Now().UTC())
 }
 
+// Two updates racing from the same base sequence. The sequence check and the
+// update happen in one conditional UPDATE, so exactly one of them should win,
+// and the other should fail as if it had the wrong sequence.
+func TestStoreUpdateWalletConcurrent(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.insertFirstWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.WalletHmac("my-hmac-a"), wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in insertFirstWallet: %+v", err)
+	}
+
+	newEncryptedWallets := []wallet.EncryptedWallet{"my-enc-wallet-b", "my-enc-wallet-c"}
+	newHmacs := []wallet.WalletHmac{"my-hmac-b", "my-hmac-c"}
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.updateWalletToSequence(context.Background(), userId, wallet.DefaultAppId, newEncryptedWallets[i], wallet.Sequence(2), newHmacs[i], nil, wallet.EncryptionVersion(""))
+		}(i)
+	}
+	wg.Wait()
+
+	var winner int
+	switch {
+	case errs[0] == nil && errs[1] == ErrNoWallet:
+		winner = 0
+	case errs[0] == ErrNoWallet && errs[1] == nil:
+		winner = 1
+	default:
+		t.Fatalf("Expected exactly one update to succeed and the other to get ErrNoWallet. Got: %+v", errs)
+	}
+
+	// The winner's wallet is what's stored
+	expectWalletExists(t, &s, userId, newEncryptedWallets[winner], wallet.Sequence(2), newHmacs[winner], time.Now().UTC())
+}
+
+// Lots of devices saving at once, through SetWallet, for both the first
+// wallet (insert) and later ones (update). Every device tries to save
+// whatever sequence comes after what it last saw. At each sequence exactly one
+// of them should win, all of the others should get ErrWrongSequence, and the
+// wallet should end up at the sequence of the last win.
+func TestStoreSetWalletConcurrent(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	const numDevices = 10
+	const numRounds = 5
+
+	for round := 0; round < numRounds; round++ {
+		sequence := wallet.Sequence(InitialWalletSequence + round)
+
+		errs := make([]error, numDevices)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = s.SetWallet(
+					context.Background(),
+					userId,
+					wallet.DefaultAppId,
+					wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d-%d", round, i)),
+					sequence,
+					wallet.WalletHmac(fmt.Sprintf("my-hmac-%d-%d", round, i)),
+					nil,
+					wallet.EncryptionVersion(""),
+				)
+			}(i)
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			if err == nil {
+				if winner != -1 {
+					t.Fatalf("Round %d: expected only one SetWallet to succeed, got devices %d and %d", round, winner, i)
+				}
+				winner = i
+			} else if err != ErrWrongSequence {
+				t.Fatalf(`Round %d: SetWallet err: wanted "%+v", got "%+v"`, round, ErrWrongSequence, err)
+			}
+		}
+		if winner == -1 {
+			t.Fatalf("Round %d: expected one SetWallet to succeed", round)
+		}
+
+		expectWalletExists(
+			t,
+			&s,
+			userId,
+			wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d-%d", round, winner)),
+			sequence,
+			wallet.WalletHmac(fmt.Sprintf("my-hmac-%d-%d", round, winner)),
+			time.Now().UTC(),
+		)
+	}
+}
+
+func TestStoreSyncWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expectSync := func(
+		encryptedWallet wallet.EncryptedWallet,
+		sequence wallet.Sequence,
+		hmac wallet.WalletHmac,
+		parentHmac *wallet.WalletHmac,
+		expectedApplied bool,
+		expectedLatest *WalletUpdate,
+	) {
+		t.Helper()
+		applied, latest, err := s.SyncWallet(context.Background(), userId, wallet.DefaultAppId, encryptedWallet, sequence, hmac, parentHmac, wallet.EncryptionVersion(""))
+		if err != nil {
+			t.Fatalf("Unexpected error in SyncWallet: %+v", err)
+		}
+		if applied != expectedApplied {
+			t.Errorf("Expected applied to be %v for sequence %d", expectedApplied, sequence)
+		}
+		if (latest == nil) != (expectedLatest == nil) || latest != nil && *latest != *expectedLatest {
+			t.Errorf("Expected latest %+v, got %+v", expectedLatest, latest)
+		}
+	}
+
+	walletA := WalletUpdate{EncryptedWallet: "my-enc-wallet-a", Sequence: 1, Hmac: "my-hmac-a"}
+	walletB := WalletUpdate{EncryptedWallet: "my-enc-wallet-b", Sequence: 2, Hmac: "my-hmac-b"}
+
+	// Not the first wallet, with no wallet yet: loses, and there's nothing to
+	// return
+	expectSync("my-enc-wallet-x", 2, "my-hmac-x", nil, false, nil)
+	expectWalletNotExists(t, &s, userId)
+
+	// The first wallet, and the next one: the client's own is the latest
+	expectSync(walletA.EncryptedWallet, walletA.Sequence, walletA.Hmac, nil, true, &walletA)
+	expectSync(walletB.EncryptedWallet, walletB.Sequence, walletB.Hmac, nil, true, &walletB)
+
+	// A sequence that was already taken, or that's too far ahead: loses to the
+	// wallet we have
+	expectSync("my-enc-wallet-x", 1, "my-hmac-x", nil, false, &walletB)
+	expectSync("my-enc-wallet-x", 2, "my-hmac-x", nil, false, &walletB)
+	expectSync("my-enc-wallet-x", 4, "my-hmac-x", nil, false, &walletB)
+
+	// The right sequence built on the wrong version: also loses
+	wrongParentHmac := wallet.WalletHmac("my-hmac-a")
+	expectSync("my-enc-wallet-x", 3, "my-hmac-x", &wrongParentHmac, false, &walletB)
+
+	expectWalletExists(t, &s, userId, walletB.EncryptedWallet, walletB.Sequence, walletB.Hmac, time.Now().UTC())
+
+	// Other problems are still errors
+	s.MaxWalletSize = 5
+	if _, _, err := s.SyncWallet(context.Background(), userId, wallet.DefaultAppId, "my-enc-wallet-c", 3, "my-hmac-c", nil, wallet.EncryptionVersion("")); err != ErrWalletTooLarge {
+		t.Fatalf(`SyncWallet err: wanted "%+v", got "%+v"`, ErrWalletTooLarge, err)
+	}
+}
+
+// Every device that loses gets back the very wallet it lost to
+func TestStoreSyncWalletConcurrent(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	const numDevices = 10
+	const numRounds = 5
+
+	type syncResult struct {
+		applied bool
+		latest  *WalletUpdate
+		err     error
+	}
+
+	for round := 0; round < numRounds; round++ {
+		sequence := wallet.Sequence(InitialWalletSequence + round)
+
+		results := make([]syncResult, numDevices)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var result syncResult
+				result.applied, result.latest, result.err = s.SyncWallet(
+					context.Background(),
+					userId,
+					wallet.DefaultAppId,
+					wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d-%d", round, i)),
+					sequence,
+					wallet.WalletHmac(fmt.Sprintf("my-hmac-%d-%d", round, i)),
+					nil,
+					wallet.EncryptionVersion(""),
+				)
+				results[i] = result
+			}(i)
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, result := range results {
+			if result.err != nil {
+				t.Fatalf("Round %d: unexpected error in SyncWallet: %+v", round, result.err)
+			}
+			if result.applied {
+				if winner != -1 {
+					t.Fatalf("Round %d: expected only one SyncWallet to be applied, got devices %d and %d", round, winner, i)
+				}
+				winner = i
+			}
+		}
+		if winner == -1 {
+			t.Fatalf("Round %d: expected one SyncWallet to be applied", round)
+		}
+
+		expectedLatest := WalletUpdate{
+			EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d-%d", round, winner)),
+			Sequence:        sequence,
+			Hmac:            wallet.WalletHmac(fmt.Sprintf("my-hmac-%d-%d", round, winner)),
+		}
+		for i, result := range results {
+			if result.latest == nil || *result.latest != expectedLatest {
+				t.Errorf("Round %d: expected device %d to get the winning wallet %+v, got %+v", round, i, expectedLatest, result.latest)
+			}
+		}
+	}
+}
+
 // NOTE - the "behind the scenes" comments give a view of what we're expecting
 // to happen, and why we're testing what we are. Sometimes it should insert,
 // sometimes it should update. It depends on whether it's the first wallet
@@ -179,9 +420,7 @@ func TestStoreUpdateWallet(t *testing.T) {
 // the scenes will change a little, so the comments should be updated. Though,
 // we'd probably best test the same cases.
 //
-// TODO when we have lastSynced again: test fail via update for having
-// non-matching device sequence history. Though, maybe this goes into wallet
-// util
+// Checking the parent hmac is tested separately below.
 func TestStoreSetWallet(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
 	defer StoreTestCleanup(sqliteTmpFile)
@@ -190,44 +429,626 @@ func TestStoreSetWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// Sequence 2 - fails - out of sequence (behind the scenes, tries to update but there's nothing there yet)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-a")); err != ErrWrongSequence {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	expectWalletNotExists(t, &s, userId)
 
 	// Sequence 1 - succeeds - out of sequence (behind the scenes, does an insert)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 1 - fails - out of sequence (behind the scenes, tries to insert but there's something there already)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	// Expect the *first* wallet to still be there
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 3 - fails - out of sequence (behind the scenes: tries via update, which is appropriate here)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b")); err != ErrWrongSequence {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
 		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
 	}
 	// Expect the *first* wallet to still be there
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
 
 	// Sequence 2 - succeeds - (behind the scenes, does an update. Tests successful update-after-insert)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b")); err != nil {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
 
 	// Sequence 3 - succeeds - (behind the scenes, does an update. Tests successful update-after-update. Maybe gratuitous?)
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c")); err != nil {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"), nil, wallet.EncryptionVersion("")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-c"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c"), time.Now().UTC())
 }
 
+// Skipping ahead is refused, with or without a parent hmac, and whatever the
+// wallet we have is left alone
+func TestStoreSetWalletNoGaps(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	for sequence := wallet.Sequence(1); sequence <= 2; sequence++ {
+		hmac := wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence))
+		if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), sequence, hmac, nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	parentHmac := wallet.WalletHmac("my-hmac-2")
+	for _, parent := range []*wallet.WalletHmac{nil, &parentHmac} {
+		if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-4"), wallet.Sequence(4), wallet.WalletHmac("my-hmac-4"), parent, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+			t.Fatalf(`SetWallet err with parent hmac %v: wanted "%+v", got "%+v"`, parent, ErrWrongSequence, err)
+		}
+		expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-2"), time.Now().UTC())
+	}
+
+	// The skipped-to sequence doesn't count towards the rollback floor either
+	var highestSequence wallet.Sequence
+	if err := s.db.QueryRow("SELECT sequence FROM highest_wallet_sequences WHERE user_id=? AND app_id=?", userId, wallet.DefaultAppId).Scan(&highestSequence); err != nil || highestSequence != 2 {
+		t.Fatalf("Expected highest sequence 2, got %d err %+v", highestSequence, err)
+	}
+}
+
+// If the wallet we have ever ends up behind the highest sequence the account
+// has had, writes below that highest sequence are refused (and flagged), even
+// where the normal sequence check would let them through.
+func TestStoreSetWalletRollbackProtection(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	for sequence := wallet.Sequence(1); sequence <= 3; sequence++ {
+		hmac := wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence))
+		if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), sequence, hmac, nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	rollbackCounter := metrics.ErrorsCount.With(prometheus.Labels{"error_type": "wallet-rollback-attempt"})
+	countBefore := testutil.ToFloat64(rollbackCounter)
+
+	// A normal stale write, at the highest sequence. Fails on the sequence check
+	// as usual, and isn't flagged.
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-x"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-x"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if want, got := countBefore, testutil.ToFloat64(rollbackCounter); want != got {
+		t.Fatalf("Expected rollback count %f, got %f", want, got)
+	}
+
+	// Somehow the wallet we have goes back to sequence 1
+	if _, err := s.db.Exec("UPDATE wallets SET sequence=1 WHERE user_id=?", userId); err != nil {
+		t.Fatalf("Error setting up rolled back wallet: %+v", err)
+	}
+
+	// Sequence 2 would follow the wallet we have now, but the account has been
+	// at sequence 3 before. Refused, and flagged.
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-old"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-old"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if want, got := countBefore+1, testutil.ToFloat64(rollbackCounter); want != got {
+		t.Fatalf("Expected rollback count %f, got %f", want, got)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-3"), time.Now().UTC())
+
+	// Same with no wallet at all, starting over from the first one
+	if _, err := s.db.Exec("DELETE FROM wallets WHERE user_id=?", userId); err != nil {
+		t.Fatalf("Error deleting wallet: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-old"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-old"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if want, got := countBefore+2, testutil.ToFloat64(rollbackCounter); want != got {
+		t.Fatalf("Expected rollback count %f, got %f", want, got)
+	}
+	expectWalletNotExists(t, &s, userId)
+
+	var highestSequence wallet.Sequence
+	if err := s.db.QueryRow("SELECT sequence FROM highest_wallet_sequences WHERE user_id=? AND app_id=?", userId, wallet.DefaultAppId).Scan(&highestSequence); err != nil {
+		t.Fatalf("Error getting highest sequence: %+v", err)
+	}
+	if highestSequence != 3 {
+		t.Fatalf("Expected highest sequence 3, got %d", highestSequence)
+	}
+}
+
+// If raising the rollback floor fails, the wallet write is undone along with
+// it, for the first wallet and for updates
+func TestStoreSetWalletAtomic(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	_, err := s.db.Exec(`
+		CREATE TRIGGER fail_highest_insert BEFORE INSERT ON highest_wallet_sequences
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END;
+		CREATE TRIGGER fail_highest_update BEFORE UPDATE ON highest_wallet_sequences
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END;
+	`)
+	if err != nil {
+		t.Fatalf("Error creating triggers: %+v", err)
+	}
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion("")); err == nil {
+		t.Fatalf("Expected SetWallet to fail")
+	}
+	expectWalletNotExists(t, &s, userId)
+
+	if _, err := s.db.Exec("DROP TRIGGER fail_highest_insert"); err != nil {
+		t.Fatalf("Error dropping trigger: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-2"), nil, wallet.EncryptionVersion("")); err == nil {
+		t.Fatalf("Expected SetWallet to fail")
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
+}
+
+// Each app has its own wallet, with its own sequence and rollback floor
+func TestStoreSetWalletApps(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+	appA, appB := wallet.DefaultAppId, wallet.AppId("com.example.other-app")
+
+	for sequence := wallet.Sequence(1); sequence <= 3; sequence++ {
+		hmac := wallet.WalletHmac(fmt.Sprintf("my-hmac-a-%d", sequence))
+		if err := s.SetWallet(context.Background(), userId, appA, wallet.EncryptedWallet("my-enc-wallet-a"), sequence, hmac, nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	// The other app starts at the first wallet, not after app A's
+	if err := s.CheckSequence(context.Background(), userId, appB, wallet.Sequence(1)); err != nil {
+		t.Fatalf("Unexpected error in CheckSequence: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, appB, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(4), wallet.WalletHmac("my-hmac-b-4"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	if err := s.SetWallet(context.Background(), userId, appB, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b-1"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// Neither one touched the other
+	encryptedWallet, sequence, hmac, _, err := s.GetWallet(context.Background(), userId, appA)
+	if encryptedWallet != wallet.EncryptedWallet("my-enc-wallet-a") || sequence != wallet.Sequence(3) || hmac != wallet.WalletHmac("my-hmac-a-3") || err != nil {
+		t.Fatalf("Unexpected values for wallet A: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
+	}
+	encryptedWallet, sequence, hmac, _, err = s.GetWallet(context.Background(), userId, appB)
+	if encryptedWallet != wallet.EncryptedWallet("my-enc-wallet-b") || sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-b-1") || err != nil {
+		t.Fatalf("Unexpected values for wallet B: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
+	}
+	if err := s.CheckSequence(context.Background(), userId, appA, wallet.Sequence(4)); err != nil {
+		t.Fatalf("Unexpected error in CheckSequence: %+v", err)
+	}
+	if err := s.CheckSequence(context.Background(), userId, appB, wallet.Sequence(2)); err != nil {
+		t.Fatalf("Unexpected error in CheckSequence: %+v", err)
+	}
+
+	// Losing app B's wallet still leaves it with its own rollback floor
+	if err := s.SetWallet(context.Background(), userId, appB, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b-2"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM wallets WHERE user_id=? AND app_id=?", userId, appB); err != nil {
+		t.Fatalf("Error deleting wallet: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, appB, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-b-1"), nil, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-a-3"), time.Now().UTC())
+
+	// Deleting the account takes all of them
+	if err := s.DeleteAccount(context.Background(), userId); err != nil {
+		t.Fatalf("Unexpected error in DeleteAccount: %+v", err)
+	}
+	expectWalletNotExists(t, &s, userId)
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM highest_wallet_sequences WHERE user_id=?", userId).Scan(&count); err != nil || count != 0 {
+		t.Fatalf("Expected no highest sequences left: count: %d err: %+v", count, err)
+	}
+}
+
+// An imported wallet starts at the sequence it had on the old server, and
+// updates carry on from there
+func TestStoreImportWallet(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-5"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-5"), wallet.EncryptionVersion(""), nil); err != nil {
+		t.Fatalf("Unexpected error in ImportWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-5"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-5"), time.Now().UTC())
+
+	// Only if there's no wallet yet
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-9"), wallet.Sequence(9), wallet.WalletHmac("my-hmac-9"), wallet.EncryptionVersion(""), nil); err != ErrDuplicateWallet {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrDuplicateWallet, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-5"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-5"), time.Now().UTC())
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-6"), wallet.Sequence(6), wallet.WalletHmac("my-hmac-6"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-6"), wallet.Sequence(6), wallet.WalletHmac("my-hmac-6"), time.Now().UTC())
+
+	// Rollback protection counts imported sequences like any other. Without a
+	// wallet, an import still can't go back below them.
+	if _, err := s.db.Exec("DELETE FROM wallets WHERE user_id=?", userId); err != nil {
+		t.Fatalf("Error deleting wallet: %+v", err)
+	}
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-old"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-old"), wallet.EncryptionVersion(""), nil); err != ErrWrongSequence {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectWalletNotExists(t, &s, userId)
+}
+
+// The other apps' wallets come over along with the default app's, each at its
+// own sequence, and all in one go
+func TestStoreImportWalletAppWallets(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	appA := AppWalletUpdate{AppId: "app-a", EncryptedWallet: "my-app-a-wallet", Sequence: 3, Hmac: "my-hmac-a", EncryptionVersion: "my-version-a"}
+	appB := AppWalletUpdate{AppId: "app-b", EncryptedWallet: "my-app-b-wallet", Sequence: 7, Hmac: "my-hmac-b"}
+
+	// The second app-a is a duplicate, so nothing is imported, not even the
+	// wallets before it
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-5"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-5"), wallet.EncryptionVersion(""), []AppWalletUpdate{appA, appB, appA}); err != ErrDuplicateWallet {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrDuplicateWallet, err)
+	}
+	expectWalletNotExists(t, &s, userId)
+
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-5"), wallet.Sequence(5), wallet.WalletHmac("my-hmac-5"), wallet.EncryptionVersion(""), []AppWalletUpdate{appA, appB}); err != nil {
+		t.Fatalf("Unexpected error in ImportWallet: %+v", err)
+	}
+
+	for _, expected := range []AppWalletUpdate{
+		{AppId: wallet.DefaultAppId, EncryptedWallet: "my-enc-wallet-5", Sequence: 5, Hmac: "my-hmac-5"},
+		appA,
+		appB,
+	} {
+		encryptedWallet, sequence, hmac, encryptionVersion, err := s.GetWallet(context.Background(), userId, expected.AppId)
+		if err != nil {
+			t.Fatalf("Unexpected error in GetWallet for app %q: %+v", expected.AppId, err)
+		}
+		if encryptedWallet != expected.EncryptedWallet || sequence != expected.Sequence || hmac != expected.Hmac || encryptionVersion != expected.EncryptionVersion {
+			t.Errorf("Unexpected wallet for app %q: wanted %+v, got %s %d %s %s", expected.AppId, expected, encryptedWallet, sequence, hmac, encryptionVersion)
+		}
+	}
+
+	// Updates carry on from the imported sequence, app by app
+	if err := s.SetWallet(context.Background(), userId, "app-b", wallet.EncryptedWallet("my-app-b-wallet-8"), wallet.Sequence(8), wallet.WalletHmac("my-hmac-b-8"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+}
+
+// The client says which wallet (by its hmac) it built the new one on. The
+// update should only go through if that's the wallet we have at `sequence - 1`,
+// even when the sequence lines up.
+func TestStoreSetWalletParentHmac(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Parent hmac is ignored for the first wallet; there's no parent.
+	firstParentHmac := wallet.WalletHmac("my-hmac-nonexistent")
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), &firstParentHmac, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+
+	// Right sequence, but built on a forked base - fails
+	forkedParentHmac := wallet.WalletHmac("my-hmac-forked")
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), &forkedParentHmac, wallet.EncryptionVersion("")); err != ErrWrongParentHmac {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongParentHmac, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+
+	// Wrong sequence - still fails on the sequence, whatever the parent hmac
+	matchingParentHmac := wallet.WalletHmac("my-hmac-a")
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-b"), &matchingParentHmac, wallet.EncryptionVersion("")); err != ErrWrongSequence {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongSequence, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+
+	// Right sequence, built on our version - succeeds
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), &matchingParentHmac, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
+}
+
+// With RequireParentHmac, every update has to name the current wallet's hmac
+// as its parent. This is what keeps two devices that both made a version 2
+// from one version 1 from overwriting each other.
+func TestStoreSetWalletRequireParentHmac(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.RequireParentHmac = true
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// The first wallet has no parent, so it doesn't need one
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// No parent hmac - fails
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != ErrNoParentHmac {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrNoParentHmac, err)
+	}
+	if err := s.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, []WalletUpdate{{EncryptedWallet: "my-enc-wallet-b", Sequence: 2, Hmac: "my-hmac-b"}}, nil); err != ErrNoParentHmac {
+		t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, ErrNoParentHmac, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+
+	// Device 1 builds on the head - succeeds
+	headHmac := wallet.WalletHmac("my-hmac-a")
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), &headHmac, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
+
+	// Device 2 independently built its own version 2 from "a", and then a
+	// version 3 on top of that. The sequence lines up with the head, but the
+	// parent doesn't - fails.
+	staleParentHmac := wallet.WalletHmac("my-hmac-b-device-2")
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-c-device-2"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-c-device-2"), &staleParentHmac, wallet.EncryptionVersion("")); err != ErrWrongParentHmac {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWrongParentHmac, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-b"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
+}
+
+func TestStoreSetWalletMaxWalletSize(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.MaxWalletSize = 10
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Right at the limit - succeeds
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("0123456789"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// One byte over - fails, whether on its own or in a batch
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("0123456789a"), wallet.Sequence(2), wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != ErrWalletTooLarge {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrWalletTooLarge, err)
+	}
+	updates := []WalletUpdate{
+		{EncryptedWallet: "0123456789", Sequence: 2, Hmac: "my-hmac-b"},
+		{EncryptedWallet: "0123456789a", Sequence: 3, Hmac: "my-hmac-c"},
+	}
+	if err := s.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, nil); err != ErrWalletTooLarge {
+		t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, ErrWalletTooLarge, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("0123456789"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+}
+
+func TestStoreSetWalletMaxWalletSequence(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+	s.MaxWalletSequence = 3
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// Up to the limit - succeeds
+	for sequence := wallet.Sequence(1); sequence <= 2; sequence++ {
+		hmac := wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence))
+		if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), sequence, hmac, nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+	updates := []WalletUpdate{
+		{EncryptedWallet: "my-enc-wallet", Sequence: 3, Hmac: "my-hmac-3"},
+		{EncryptedWallet: "my-enc-wallet", Sequence: 4, Hmac: "my-hmac-4"},
+	}
+	if err := s.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, nil); err != ErrSequenceExhausted {
+		t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-3"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// One past it - fails, rather than as a wrong sequence, whether checking,
+	// setting or syncing
+	if err := s.CheckSequence(context.Background(), userId, wallet.DefaultAppId, wallet.Sequence(4)); err != ErrSequenceExhausted {
+		t.Fatalf(`CheckSequence err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(4), wallet.WalletHmac("my-hmac-4"), nil, wallet.EncryptionVersion("")); err != ErrSequenceExhausted {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	if _, _, err := s.SyncWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(4), wallet.WalletHmac("my-hmac-4"), nil, wallet.EncryptionVersion("")); err != ErrSequenceExhausted {
+		t.Fatalf(`SyncWallet err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.Sequence(3), wallet.WalletHmac("my-hmac-3"), time.Now().UTC())
+}
+
+// With no limit set, a wallet can get right up to the default one, but not
+// past it
+func TestStoreSetWalletDefaultMaxWalletSequence(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.DefaultMaxSequence+1, wallet.WalletHmac("my-hmac"), wallet.EncryptionVersion(""), nil); err != ErrSequenceExhausted {
+		t.Fatalf(`ImportWallet err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	if err := s.ImportWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.DefaultMaxSequence-1, wallet.WalletHmac("my-hmac-a"), wallet.EncryptionVersion(""), nil); err != nil {
+		t.Fatalf("Unexpected error in ImportWallet: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.DefaultMaxSequence, wallet.WalletHmac("my-hmac-b"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), wallet.DefaultMaxSequence+1, wallet.WalletHmac("my-hmac-c"), nil, wallet.EncryptionVersion("")); err != ErrSequenceExhausted {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrSequenceExhausted, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet"), wallet.DefaultMaxSequence, wallet.WalletHmac("my-hmac-b"), time.Now().UTC())
+}
+
+func TestStoreSetWalletHmacFormatCheck(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	validHmac := wallet.WalletHmac(strings.Repeat("ab", wallet.HmacHexLength/2))
+
+	// Anything goes when it's off
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	s.HmacFormatCheck = true
+
+	// Wrong length - fails, whether on its own or in a batch
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2), validHmac[1:], nil, wallet.EncryptionVersion("")); err != ErrInvalidHmac {
+		t.Fatalf(`SetWallet err: wanted "%+v", got "%+v"`, ErrInvalidHmac, err)
+	}
+	updates := []WalletUpdate{
+		{EncryptedWallet: "my-enc-wallet-2", Sequence: 2, Hmac: validHmac},
+		{EncryptedWallet: "my-enc-wallet-3", Sequence: 3, Hmac: validHmac + "ab"},
+	}
+	if err := s.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, nil); err != ErrInvalidHmac {
+		t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, ErrInvalidHmac, err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac"), time.Now().UTC())
+
+	// Right length - succeeds
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2), validHmac, nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-2"), wallet.Sequence(2), validHmac, time.Now().UTC())
+}
+
+func TestStoreSetWalletBatch(t *testing.T) {
+	forkedParentHmac := wallet.WalletHmac("my-hmac-forked")
+	matchingParentHmac := wallet.WalletHmac("my-hmac-1")
+
+	tt := []struct {
+		name string
+
+		// Whether the user already has a wallet at sequence 1 before the batch
+		existingWallet bool
+
+		sequences  []wallet.Sequence
+		parentHmac *wallet.WalletHmac
+
+		expectedErr      error
+		expectedSequence wallet.Sequence // 0 means no wallet
+	}{
+		{
+			name:             "first wallet and then some",
+			sequences:        []wallet.Sequence{1, 2, 3},
+			expectedSequence: 3,
+		}, {
+			name:             "chain from existing wallet",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{2, 3, 4},
+			expectedSequence: 4,
+		}, {
+			name:             "chain from existing wallet with matching parent hmac",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{2, 3},
+			parentHmac:       &matchingParentHmac,
+			expectedSequence: 3,
+		}, {
+			name:             "gap in chain",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{2, 4},
+			expectedErr:      ErrWrongSequence,
+			expectedSequence: 1,
+		}, {
+			name:             "chain from stale sequence",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{3, 4},
+			expectedErr:      ErrWrongSequence,
+			expectedSequence: 1,
+		}, {
+			name:             "first wallet when one already exists",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{1, 2},
+			expectedErr:      ErrWrongSequence,
+			expectedSequence: 1,
+		}, {
+			name:             "gap in chain from no wallet",
+			sequences:        []wallet.Sequence{1, 3},
+			expectedErr:      ErrWrongSequence,
+			expectedSequence: 0,
+		}, {
+			name:             "forked parent hmac",
+			existingWallet:   true,
+			sequences:        []wallet.Sequence{2, 3},
+			parentHmac:       &forkedParentHmac,
+			expectedErr:      ErrWrongParentHmac,
+			expectedSequence: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+
+			userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+			if tc.existingWallet {
+				if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-1"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-1"), nil, wallet.EncryptionVersion("")); err != nil {
+					t.Fatalf("Unexpected error in SetWallet: %+v", err)
+				}
+			}
+
+			var updates []WalletUpdate
+			for _, sequence := range tc.sequences {
+				updates = append(updates, WalletUpdate{
+					EncryptedWallet: wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d", sequence)),
+					Sequence:        sequence,
+					Hmac:            wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", sequence)),
+				})
+			}
+
+			if err := s.SetWalletBatch(context.Background(), userId, wallet.DefaultAppId, updates, tc.parentHmac); err != tc.expectedErr {
+				t.Fatalf(`SetWalletBatch err: wanted "%+v", got "%+v"`, tc.expectedErr, err)
+			}
+
+			// All or nothing: either the whole chain went in, or we still have what
+			// we started with.
+			if tc.expectedSequence == 0 {
+				expectWalletNotExists(t, &s, userId)
+			} else {
+				expectWalletExists(
+					t,
+					&s,
+					userId,
+					wallet.EncryptedWallet(fmt.Sprintf("my-enc-wallet-%d", tc.expectedSequence)),
+					tc.expectedSequence,
+					wallet.WalletHmac(fmt.Sprintf("my-hmac-%d", tc.expectedSequence)),
+					time.Now().UTC(),
+				)
+			}
+		})
+	}
+}
+
 // Pretty simple, only two cases: wallet is there or it's not.
 func TestStoreGetWallet(t *testing.T) {
 	s, sqliteTmpFile := StoreTestInit(t)
@@ -237,19 +1058,127 @@ func TestStoreGetWallet(t *testing.T) {
 	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
 
 	// GetWallet fails when there's no wallet
-	encryptedWallet, sequence, hmac, err := s.GetWallet(userId)
-	if len(encryptedWallet) != 0 || sequence != 0 || len(hmac) != 0 || err != ErrNoWallet {
-		t.Fatalf("Expected ErrNoWallet, and no wallet values. Instead got: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
+	encryptedWallet, sequence, hmac, encryptionVersion, err := s.GetWallet(context.Background(), userId, wallet.DefaultAppId)
+	if len(encryptedWallet) != 0 || sequence != 0 || len(hmac) != 0 || len(encryptionVersion) != 0 || err != ErrNoWallet {
+		t.Fatalf("Expected ErrNoWallet, and no wallet values. Instead got: encrypted wallet: %+v sequence: %+v hmac: %+v encryption version: %+v err: %+v", encryptedWallet, sequence, hmac, encryptionVersion, err)
 	}
 
-	if err := s.SetWallet(userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a")); err != nil {
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("my-encryption-version-a")); err != nil {
 		t.Fatalf("Unexpected error in SetWallet: %+v", err)
 	}
 
 	// GetWallet succeeds when there's a wallet
-	encryptedWallet, sequence, hmac, err = s.GetWallet(userId)
-	if encryptedWallet != wallet.EncryptedWallet("my-enc-wallet-a") || sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-a") || err != nil {
-		t.Fatalf("Unexpected values for wallet: encrypted wallet: %+v sequence: %+v hmac: %+v err: %+v", encryptedWallet, sequence, hmac, err)
+	encryptedWallet, sequence, hmac, encryptionVersion, err = s.GetWallet(context.Background(), userId, wallet.DefaultAppId)
+	if encryptedWallet != wallet.EncryptedWallet("my-enc-wallet-a") || sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-a") || encryptionVersion != wallet.EncryptionVersion("my-encryption-version-a") || err != nil {
+		t.Fatalf("Unexpected values for wallet: encrypted wallet: %+v sequence: %+v hmac: %+v encryption version: %+v err: %+v", encryptedWallet, sequence, hmac, encryptionVersion, err)
+	}
+}
+
+func TestStoreGetWalletMetadata(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	// Get a valid userId
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	// GetWalletMetadata fails when there's no wallet
+	sequence, hmac, err := s.GetWalletMetadata(context.Background(), userId, wallet.DefaultAppId)
+	if sequence != 0 || len(hmac) != 0 || err != ErrNoWallet {
+		t.Fatalf("Expected ErrNoWallet, and no wallet values. Instead got: sequence: %+v hmac: %+v err: %+v", sequence, hmac, err)
+	}
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// GetWalletMetadata succeeds when there's a wallet
+	sequence, hmac, err = s.GetWalletMetadata(context.Background(), userId, wallet.DefaultAppId)
+	if sequence != wallet.Sequence(1) || hmac != wallet.WalletHmac("my-hmac-a") || err != nil {
+		t.Fatalf("Unexpected values for wallet metadata: sequence: %+v hmac: %+v err: %+v", sequence, hmac, err)
+	}
+}
+
+func TestStoreGetWalletAppIds(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	if appIds, err := s.GetWalletAppIds(context.Background(), userId); err != nil || len(appIds) != 0 {
+		t.Fatalf("Expected no app ids. Instead got: app ids: %+v err: %+v", appIds, err)
+	}
+
+	for _, appId := range []wallet.AppId{"app-b", wallet.DefaultAppId, "app-a"} {
+		if err := s.SetWallet(context.Background(), userId, appId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+	}
+
+	appIds, err := s.GetWalletAppIds(context.Background(), userId)
+	if want := []wallet.AppId{wallet.DefaultAppId, "app-a", "app-b"}; err != nil || !reflect.DeepEqual(appIds, want) {
+		t.Fatalf("Expected app ids %+v. Instead got: app ids: %+v err: %+v", want, appIds, err)
+	}
+}
+
+// CheckSequence agrees with what SetWallet would do, and doesn't change
+// anything
+func TestStoreCheckSequence(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	expectCheckSequence := func(sequence wallet.Sequence, expectedErr error) {
+		t.Helper()
+		if err := s.CheckSequence(context.Background(), userId, wallet.DefaultAppId, sequence); err != expectedErr {
+			t.Errorf("CheckSequence for sequence %d: expected %+v, got %+v", sequence, expectedErr, err)
+		}
+	}
+
+	// No wallet yet: only the first one
+	expectCheckSequence(wallet.Sequence(1), nil)
+	expectCheckSequence(wallet.Sequence(2), ErrWrongSequence)
+	expectWalletNotExists(t, &s, userId)
+
+	if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+		t.Fatalf("Unexpected error in SetWallet: %+v", err)
+	}
+
+	// Only the next one after the wallet we have
+	expectCheckSequence(wallet.Sequence(1), ErrWrongSequence)
+	expectCheckSequence(wallet.Sequence(2), nil)
+	expectCheckSequence(wallet.Sequence(3), ErrWrongSequence)
+	expectWalletExists(t, &s, userId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), time.Now().UTC())
+
+	// Nothing below the highest sequence the account has had, even if the
+	// wallet we have is older than that
+	if _, err := s.db.Exec("UPDATE highest_wallet_sequences SET sequence=5 WHERE user_id=? AND app_id=?", userId, wallet.DefaultAppId); err != nil {
+		t.Fatalf("Error setting highest wallet sequence: %+v", err)
+	}
+	expectCheckSequence(wallet.Sequence(2), ErrWrongSequence)
+}
+
+// The encryption version is opaque to us. Whatever the latest wallet was set
+// with is what we get back, including nothing at all.
+func TestStoreSetWalletEncryptionVersion(t *testing.T) {
+	s, sqliteTmpFile := StoreTestInit(t)
+	defer StoreTestCleanup(sqliteTmpFile)
+
+	userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+	encryptionVersions := []wallet.EncryptionVersion{"1", "2", ""}
+	for i, setEncryptionVersion := range encryptionVersions {
+		sequence := wallet.Sequence(i + 1)
+		if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet"), sequence, wallet.WalletHmac("my-hmac"), nil, setEncryptionVersion); err != nil {
+			t.Fatalf("Unexpected error in SetWallet: %+v", err)
+		}
+		_, _, _, encryptionVersion, err := s.GetWallet(context.Background(), userId, wallet.DefaultAppId)
+		if err != nil {
+			t.Fatalf("Unexpected error in GetWallet: %+v", err)
+		}
+		if encryptionVersion != setEncryptionVersion {
+			t.Fatalf("Expected encryption version %q at sequence %d, got %q", setEncryptionVersion, sequence, encryptionVersion)
+		}
 	}
 }
 
@@ -281,7 +1210,7 @@ func TestStoreWalletEmptyFields(t *testing.T) {
 
 			var sqliteErr sqlite3.Error
 
-			err := s.insertFirstWallet(userId, tc.encryptedWallet, tc.hmac)
+			err := s.insertFirstWallet(context.Background(), userId, wallet.DefaultAppId, tc.encryptedWallet, tc.hmac, wallet.EncryptionVersion(""))
 			if errors.As(err, &sqliteErr) {
 				if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintCheck) {
 					return // We got the error we expected
@@ -291,3 +1220,61 @@ func TestStoreWalletEmptyFields(t *testing.T) {
 		})
 	}
 }
+
+// Make sure we flag an identical encrypted wallet submitted with a new hmac,
+// but only when it's turned on, and that the update goes through either way.
+func TestStoreSetWalletFlagSameWalletNewHmac(t *testing.T) {
+	tt := []struct {
+		name                  string
+		flagSameWalletNewHmac bool
+		newEncryptedWallet    wallet.EncryptedWallet
+		newHmac               wallet.WalletHmac
+		expectFlag            bool
+	}{
+		{
+			name:                  "same wallet new hmac",
+			flagSameWalletNewHmac: true,
+			newEncryptedWallet:    wallet.EncryptedWallet("my-enc-wallet-a"),
+			newHmac:               wallet.WalletHmac("my-hmac-b"),
+			expectFlag:            true,
+		}, {
+			name:                  "new wallet new hmac",
+			flagSameWalletNewHmac: true,
+			newEncryptedWallet:    wallet.EncryptedWallet("my-enc-wallet-b"),
+			newHmac:               wallet.WalletHmac("my-hmac-b"),
+			expectFlag:            false,
+		}, {
+			name:                  "same wallet new hmac, flag turned off",
+			flagSameWalletNewHmac: false,
+			newEncryptedWallet:    wallet.EncryptedWallet("my-enc-wallet-a"),
+			newHmac:               wallet.WalletHmac("my-hmac-b"),
+			expectFlag:            false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s, sqliteTmpFile := StoreTestInit(t)
+			defer StoreTestCleanup(sqliteTmpFile)
+			s.FlagSameWalletNewHmac = tc.flagSameWalletNewHmac
+
+			userId, _, _, _ := makeTestUser(t, &s, nil, nil)
+
+			if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, wallet.EncryptedWallet("my-enc-wallet-a"), wallet.Sequence(1), wallet.WalletHmac("my-hmac-a"), nil, wallet.EncryptionVersion("")); err != nil {
+				t.Fatalf("Unexpected error in SetWallet: %+v", err)
+			}
+
+			flagCounter := metrics.ErrorsCount.With(prometheus.Labels{"error_type": "same-wallet-new-hmac"})
+			countBefore := testutil.ToFloat64(flagCounter)
+
+			if err := s.SetWallet(context.Background(), userId, wallet.DefaultAppId, tc.newEncryptedWallet, wallet.Sequence(2), tc.newHmac, nil, wallet.EncryptionVersion("")); err != nil {
+				t.Fatalf("Unexpected error in SetWallet: %+v", err)
+			}
+			expectWalletExists(t, &s, userId, tc.newEncryptedWallet, wallet.Sequence(2), tc.newHmac, time.Now().UTC())
+
+			if flagged := testutil.ToFloat64(flagCounter) > countBefore; flagged != tc.expectFlag {
+				t.Errorf("Expected flagged to be %v, got %v", tc.expectFlag, flagged)
+			}
+		})
+	}
+}
@@ -140,10 +140,10 @@ class WalletSync():
     return response.json()['clientSaltSeed']
 
   def get_wallet(self, token):
-    params = {
-      'token': token,
+    headers = {
+      'Authorization': 'Bearer ' + token,
     }
-    response = requests.get(self.WALLET_URL, params=params)
+    response = requests.get(self.WALLET_URL, headers=headers)
 
     if response.status_code == 404:
       print ('Wallet not found')
@@ -164,13 +164,15 @@ class WalletSync():
 
   def update_wallet(self, wallet_state, hmac, token):
     body = json.dumps({
-      "token": token,
       "encryptedWallet": wallet_state.encrypted_wallet,
       "sequence": wallet_state.sequence,
       "hmac": hmac,
     })
+    headers = {
+      'Authorization': 'Bearer ' + token,
+    }
 
-    response = requests.post(self.WALLET_URL, body)
+    response = requests.post(self.WALLET_URL, body, headers=headers)
 
     if response.status_code == 200:
       print ('Successfully updated wallet state on server')
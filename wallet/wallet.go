@@ -1,5 +1,60 @@
 package wallet
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+)
+
 type EncryptedWallet string
 type WalletHmac string
 type Sequence uint32
+
+// The highest a wallet's sequence can go unless the server is set to stop
+// sooner. Clients may well keep the sequence in a signed 32 bit int, so it's
+// no higher than that.
+const DefaultMaxSequence = Sequence(math.MaxInt32)
+
+// Which version of the client's encryption scheme the encrypted wallet was
+// written with. Opaque to the server; we just store it and hand it back so
+// that clients can tell when a wallet was written by a newer, incompatible
+// client. Empty if the client didn't say.
+type EncryptionVersion string
+
+// The LBRY clients sign the wallet with HMAC-SHA256, hex encoded
+const HmacHexLength = sha256.Size * 2
+
+// The server never checks the hmac against the wallet (it doesn't have the
+// key), but it can at least tell when it couldn't possibly be right.
+func (h WalletHmac) Validate() bool {
+	_, err := hex.DecodeString(string(h))
+	return len(h) == HmacHexLength && err == nil
+}
+
+// Which app a wallet belongs to, for users with more than one LBRY app that
+// each keep their own wallet. Each app's wallet has its own sequence, so they
+// don't conflict with each other. Opaque to the server, other than
+// Validate.
+type AppId string
+
+// The wallet every user had before there were app ids, and what clients that
+// don't give one still get
+const DefaultAppId = AppId("")
+
+const maxAppIdLength = 64
+
+// Letters, digits, '.', '_' and '-', so that it's something like "odysee" or
+// "io.lbry.browser" rather than anything that needs escaping. Empty is the
+// default app.
+func (a AppId) Validate() bool {
+	if len(a) > maxAppIdLength {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		c := a[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
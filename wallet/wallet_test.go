@@ -0,0 +1,53 @@
+package wallet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWalletHmacValidate(t *testing.T) {
+	tt := []struct {
+		name  string
+		hmac  WalletHmac
+		valid bool
+	}{
+		{"valid", WalletHmac(strings.Repeat("0123456789abcdef", 4)), true},
+		{"valid upper case", WalletHmac(strings.Repeat("0123456789ABCDEF", 4)), true},
+		{"empty", WalletHmac(""), false},
+		{"too short", WalletHmac(strings.Repeat("0123456789abcdef", 4)[1:]), false},
+		{"too long", WalletHmac(strings.Repeat("0123456789abcdef", 4) + "00"), false},
+		{"not hex", WalletHmac(strings.Repeat("0123456789abcdeg", 4)), false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.hmac.Validate() != tc.valid {
+				t.Errorf("Expected Validate() to be %v for %s", tc.valid, tc.hmac)
+			}
+		})
+	}
+}
+
+func TestAppIdValidate(t *testing.T) {
+	tt := []struct {
+		name  string
+		appId AppId
+		valid bool
+	}{
+		{"default", DefaultAppId, true},
+		{"simple", AppId("odysee"), true},
+		{"reverse domain", AppId("io.lbry.browser"), true},
+		{"with dashes and underscores", AppId("lbry-desktop_2"), true},
+		{"longest", AppId(strings.Repeat("a", 64)), true},
+		{"too long", AppId(strings.Repeat("a", 65)), false},
+		{"space", AppId("lbry desktop"), false},
+		{"slash", AppId("lbry/desktop"), false},
+		{"not ascii", AppId("lbrÿ"), false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.appId.Validate() != tc.valid {
+				t.Errorf("Expected Validate() to be %v for %s", tc.valid, tc.appId)
+			}
+		})
+	}
+}